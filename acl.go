@@ -0,0 +1,842 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aclUser is a user connections and HTTP requests authenticate as. Its rules
+// decide which commands it can run and which keys and channels they can
+// touch.
+type aclUser struct {
+	name    string
+	enabled bool
+
+	// nopass users accept any password. passwords holds the hex encoded
+	// SHA-256 of the others, so that ACL GETUSER and the ACL file never
+	// reveal them.
+	nopass    bool
+	passwords []string
+
+	// commands holds the +command, -command, +@category and -@category
+	// rules in the order they were given, the last matching one winning.
+	// An empty list allows nothing.
+	commands []string
+
+	// keys and channels hold the glob patterns of the keys and pub/sub
+	// channels the user can access.
+	keys     []string
+	channels []string
+
+	// removed is set once the user is deleted. The connections
+	// authenticated as it are closed before their next command.
+	removed bool
+}
+
+// aclMu guards aclUsers, aclFile and the fields of every user.
+var aclMu = sync.RWMutex{}
+
+// aclUsers maps names to users. The default user always exists: new
+// connections are authenticated as it right away as long as it is enabled
+// and has nopass.
+var aclUsers = map[string]*aclUser{
+	"default": {name: "default", enabled: true, nopass: true, commands: []string{"+@all"}, keys: []string{"*"}, channels: []string{"*"}},
+}
+
+// aclFile is where ACL SAVE writes the users and ACL LOAD reads them from.
+var aclFile string
+
+var errACLSyntax = errors.New("Syntax error")
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func defaultUser() *aclUser {
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+
+	return aclUsers["default"]
+}
+
+// initialUser returns the user a new connection is authenticated as, or nil
+// when it must authenticate first.
+func initialUser() *aclUser {
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+
+	if u := aclUsers["default"]; u.enabled && u.nopass {
+		return u
+	}
+	return nil
+}
+
+// setDefaultPassword makes password the only password of the default user,
+// or gives it nopass when password is empty, as requirepass does in Redis.
+func setDefaultPassword(password string) {
+	aclMu.Lock()
+	defer aclMu.Unlock()
+
+	u := aclUsers["default"]
+	u.passwords = nil
+	u.nopass = password == ""
+	if password != "" {
+		u.passwords = []string{hashPassword(password)}
+	}
+}
+
+// authenticateUser returns the user called name if password is one of its
+// passwords, or nil. The hashes are compared in constant time.
+func authenticateUser(name, password string) *aclUser {
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+
+	u := aclUsers[name]
+	if u == nil || !u.enabled {
+		return nil
+	}
+	if u.nopass || u.hasPassword(hashPassword(password)) {
+		return u
+	}
+	return nil
+}
+
+// userByToken returns the user an HTTP bearer token authenticates: the
+// first enabled user, default before the others, that has it as a password.
+func userByToken(token string) *aclUser {
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+
+	hash := hashPassword(token)
+	for _, name := range sortedUserNames() {
+		if u := aclUsers[name]; u.enabled && !u.nopass && u.hasPassword(hash) {
+			return u
+		}
+	}
+	return nil
+}
+
+func (u *aclUser) hasPassword(hash string) bool {
+	found := false
+	for _, stored := range u.passwords {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+func (u *aclUser) hasNopass() bool {
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+
+	return u.nopass
+}
+
+func (u *aclUser) isRemoved() bool {
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+
+	return u.removed
+}
+
+// sortedUserNames returns the names of the users, default first. aclMu must
+// be held.
+func sortedUserNames() []string {
+	names := []string{}
+	for name := range aclUsers {
+		if name != "default" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return append([]string{"default"}, names...)
+}
+
+// aclCategories returns the names of the ACL categories, without the @.
+func aclCategories() []string {
+	categories := []string{}
+	for _, spec := range commandTable {
+		for _, category := range spec.categories() {
+			if !containsString(categories, category[1:]) {
+				categories = append(categories, category[1:])
+			}
+		}
+	}
+	sort.Strings(categories)
+
+	return categories
+}
+
+// applyRule changes u according to a single ACL rule, such as on, >password,
+// ~pattern, &pattern, +@category or -command.
+func (u *aclUser) applyRule(rule string) error {
+	if rule == "" {
+		return errACLSyntax
+	}
+
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass, u.passwords = true, nil
+		return nil
+	case "resetpass":
+		u.nopass, u.passwords = false, nil
+		return nil
+	case "allkeys":
+		u.keys = []string{"*"}
+		return nil
+	case "resetkeys":
+		u.keys = nil
+		return nil
+	case "allchannels":
+		u.channels = []string{"*"}
+		return nil
+	case "resetchannels":
+		u.channels = nil
+		return nil
+	case "allcommands":
+		u.commands = []string{"+@all"}
+		return nil
+	case "nocommands":
+		u.commands = nil
+		return nil
+	case "reset":
+		*u = aclUser{name: u.name}
+		return nil
+	}
+
+	switch value := rule[1:]; rule[0] {
+	case '>':
+		u.nopass = false
+		u.addPassword(hashPassword(value))
+	case '<':
+		u.removePassword(hashPassword(value))
+	case '#':
+		if _, err := hex.DecodeString(value); err != nil || len(value) != 2*sha256.Size {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.nopass = false
+		u.addPassword(strings.ToLower(value))
+	case '!':
+		u.removePassword(strings.ToLower(value))
+	case '~':
+		if !containsString(u.keys, value) {
+			u.keys = append(u.keys, value)
+		}
+	case '&':
+		if !containsString(u.channels, value) {
+			u.channels = append(u.channels, value)
+		}
+	case '+', '-':
+		name := strings.ToLower(value)
+		if !validCommandRule(name) {
+			return errors.New("Unknown command or category name in ACL")
+		}
+		switch {
+		case name == "@all" && rule[0] == '+':
+			u.commands = []string{"+@all"}
+		case name == "@all":
+			u.commands = nil
+		default:
+			u.commands = append(u.commands, rule[:1]+name)
+		}
+	default:
+		return errACLSyntax
+	}
+
+	return nil
+}
+
+func (u *aclUser) addPassword(hash string) {
+	if !containsString(u.passwords, hash) {
+		u.passwords = append(u.passwords, hash)
+	}
+}
+
+func (u *aclUser) removePassword(hash string) {
+	passwords := []string{}
+	for _, stored := range u.passwords {
+		if stored != hash {
+			passwords = append(passwords, stored)
+		}
+	}
+	u.passwords = passwords
+}
+
+// validCommandRule reports whether name, lower case, is a category such as
+// @read, a command, or a command and one of its subcommands such as
+// config|get.
+func validCommandRule(name string) bool {
+	if category, ok := strings.CutPrefix(name, "@"); ok {
+		return category == "all" || containsString(aclCategories(), category)
+	}
+
+	command, _, _ := strings.Cut(name, "|")
+	return lookupCommand(strings.ToUpper(command)) != nil
+}
+
+// canRun reports whether u can run the command described by spec with args.
+func (u *aclUser) canRun(spec *commandSpec, args []Value) bool {
+	allowed := false
+	for _, rule := range u.commands {
+		if commandRuleMatches(rule[1:], spec, args) {
+			allowed = rule[0] == '+'
+		}
+	}
+	return allowed
+}
+
+func commandRuleMatches(name string, spec *commandSpec, args []Value) bool {
+	if name == "@all" {
+		return true
+	}
+	if name[0] == '@' {
+		return containsString(spec.categories(), name)
+	}
+
+	command, subcommand, found := strings.Cut(name, "|")
+	if command != spec.name {
+		return false
+	}
+	return !found || len(args) > 0 && strings.EqualFold(args[0].bulk, subcommand)
+}
+
+// commandChannels returns the pub/sub channels a command addresses, and
+// whether they are patterns.
+func commandChannels(spec *commandSpec, args []Value) ([]string, bool) {
+	channels := []string{}
+	switch spec.name {
+	case "publish":
+		if len(args) > 0 {
+			channels = append(channels, args[0].bulk)
+		}
+	case "subscribe", "psubscribe":
+		for _, arg := range args {
+			channels = append(channels, arg.bulk)
+		}
+	}
+
+	return channels, spec.name == "psubscribe"
+}
+
+// permit checks that u can run a command. It returns the reason it cannot,
+// command, key or channel, along with the offending name, or two empty
+// strings.
+func (u *aclUser) permit(spec *commandSpec, args []Value) (string, string) {
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+
+	if !u.canRun(spec, args) {
+		return "command", spec.name
+	}
+
+	for _, key := range spec.keys(args) {
+		if !matchesAny(u.keys, key) {
+			return "key", key
+		}
+	}
+
+	channels, patterns := commandChannels(spec, args)
+	for _, channel := range channels {
+		// a pattern subscription is only allowed if it is one of the
+		// user's patterns, as it could match channels that are not
+		if patterns && !containsString(u.channels, "*") && !containsString(u.channels, channel) {
+			return "channel", channel
+		}
+		if !patterns && !matchesAny(u.channels, channel) {
+			return "channel", channel
+		}
+	}
+
+	return "", ""
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if globMatch(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// denyACL logs a command refused to u and returns the error to reply with.
+// context is where the command came from: toplevel, multi or http.
+func denyACL(u *aclUser, reason, object, context, client string) Value {
+	addACLLog(reason, context, object, u.name, client)
+
+	switch reason {
+	case "key":
+		return Value{typ: "error", str: "NOPERM No permissions to access a key"}
+	case "channel":
+		return Value{typ: "error", str: "NOPERM No permissions to access a channel"}
+	}
+	return Value{typ: "error", str: "NOPERM User " + u.name + " has no permissions to run the '" + object + "' command"}
+}
+
+// aclDenied checks that the user of c can run a command, returning the
+// error to reply with if it cannot.
+func (c *client) aclDenied(spec *commandSpec, args []Value) (Value, bool) {
+	reason, object := c.user.permit(spec, args)
+	if reason == "" {
+		return Value{}, false
+	}
+
+	context := "toplevel"
+	if c.multi {
+		context = "multi"
+	}
+	return denyACL(c.user, reason, object, context, c.info()), true
+}
+
+// info describes c in the ACL log.
+func (c *client) info() string {
+	return "id=" + strconv.FormatInt(c.id, 10) + " addr=" + c.conn.RemoteAddr().String() + " name=" + c.name
+}
+
+// describe returns the rules that recreate u, as listed by ACL LIST and
+// saved to the ACL file. aclMu must be held.
+func (u *aclUser) describe() string {
+	rules := []string{"user", u.name}
+
+	if u.enabled {
+		rules = append(rules, "on")
+	} else {
+		rules = append(rules, "off")
+	}
+	if u.nopass {
+		rules = append(rules, "nopass")
+	}
+	for _, hash := range u.passwords {
+		rules = append(rules, "#"+hash)
+	}
+	for _, pattern := range u.keys {
+		rules = append(rules, "~"+pattern)
+	}
+	for _, pattern := range u.channels {
+		rules = append(rules, "&"+pattern)
+	}
+	rules = append(rules, u.commandRules())
+
+	return strings.Join(rules, " ")
+}
+
+func (u *aclUser) commandRules() string {
+	if len(u.commands) == 0 {
+		return "-@all"
+	}
+	return strings.Join(u.commands, " ")
+}
+
+// aclLogEntry records commands and authentications that were refused.
+// Identical refusals in a row are counted in a single entry.
+type aclLogEntry struct {
+	id      int64
+	count   int
+	reason  string
+	context string
+	object  string
+	user    string
+	client  string
+	created time.Time
+	updated time.Time
+}
+
+// aclLogMaxLen is how many entries ACL LOG keeps.
+const aclLogMaxLen = 128
+
+var (
+	aclLogMu     = sync.Mutex{}
+	aclLog       []*aclLogEntry
+	aclLogNextID int64
+)
+
+func addACLLog(reason, context, object, user, client string) {
+	aclLogMu.Lock()
+	defer aclLogMu.Unlock()
+
+	now := time.Now()
+	for _, entry := range aclLog {
+		if entry.reason == reason && entry.context == context && entry.object == object && entry.user == user && now.Sub(entry.updated) < time.Minute {
+			entry.count++
+			entry.client = client
+			entry.updated = now
+			return
+		}
+	}
+
+	aclLog = append([]*aclLogEntry{{
+		id: aclLogNextID, count: 1, reason: reason, context: context, object: object, user: user, client: client, created: now, updated: now,
+	}}, aclLog...)
+	aclLogNextID++
+
+	if len(aclLog) > aclLogMaxLen {
+		aclLog = aclLog[:aclLogMaxLen]
+	}
+}
+
+func (entry *aclLogEntry) value() Value {
+	now := time.Now()
+	return Value{typ: "map", array: []Value{
+		{typ: "bulk", bulk: "count"}, {typ: "integer", num: entry.count},
+		{typ: "bulk", bulk: "reason"}, {typ: "bulk", bulk: entry.reason},
+		{typ: "bulk", bulk: "context"}, {typ: "bulk", bulk: entry.context},
+		{typ: "bulk", bulk: "object"}, {typ: "bulk", bulk: entry.object},
+		{typ: "bulk", bulk: "username"}, {typ: "bulk", bulk: entry.user},
+		{typ: "bulk", bulk: "age-seconds"}, {typ: "double", double: now.Sub(entry.created).Seconds()},
+		{typ: "bulk", bulk: "client-info"}, {typ: "bulk", bulk: entry.client},
+		{typ: "bulk", bulk: "entry-id"}, {typ: "integer", num: int(entry.id)},
+		{typ: "bulk", bulk: "timestamp-created"}, {typ: "integer", num: int(entry.created.UnixMilli())},
+		{typ: "bulk", bulk: "timestamp-last-updated"}, {typ: "integer", num: int(entry.updated.UnixMilli())},
+	}}
+}
+
+// aclCommand implements ACL SETUSER, GETUSER, DELUSER, USERS, LIST, WHOAMI,
+// CAT, LOG, SAVE and LOAD.
+func aclCommand(c *client, args []Value) {
+	subcommand := strings.ToUpper(args[0].bulk)
+	args = args[1:]
+
+	switch {
+	case subcommand == "SETUSER" && len(args) >= 1:
+		c.write(aclSetUser(args[0].bulk, args[1:]))
+	case subcommand == "GETUSER" && len(args) == 1:
+		c.write(aclGetUser(args[0].bulk))
+	case subcommand == "DELUSER" && len(args) >= 1:
+		c.write(aclDelUser(args))
+	case subcommand == "USERS" && len(args) == 0:
+		aclMu.RLock()
+		names := sortedUserNames()
+		aclMu.RUnlock()
+		c.write(Value{typ: "array", array: bulks(names...)})
+	case subcommand == "LIST" && len(args) == 0:
+		aclMu.RLock()
+		rules := []string{}
+		for _, name := range sortedUserNames() {
+			rules = append(rules, aclUsers[name].describe())
+		}
+		aclMu.RUnlock()
+		c.write(Value{typ: "array", array: bulks(rules...)})
+	case subcommand == "WHOAMI" && len(args) == 0:
+		c.write(Value{typ: "bulk", bulk: c.user.name})
+	case subcommand == "CAT" && len(args) <= 1:
+		c.write(aclCat(args))
+	case subcommand == "LOG" && len(args) <= 1:
+		c.write(aclLogCommand(args))
+	case subcommand == "SAVE" && len(args) == 0:
+		if err := saveACLFile(); err != nil {
+			c.write(Value{typ: "error", str: "ERR " + err.Error()})
+			return
+		}
+		c.write(Value{typ: "string", str: "OK"})
+	case subcommand == "LOAD" && len(args) == 0:
+		if err := loadACLFile(); err != nil {
+			c.write(Value{typ: "error", str: "ERR " + err.Error()})
+			return
+		}
+		c.write(Value{typ: "string", str: "OK"})
+	default:
+		c.write(Value{typ: "error", str: "ERR unknown subcommand or wrong number of arguments for '" + strings.ToLower(subcommand) + "'. Try ACL HELP."})
+	}
+}
+
+// aclSetUser creates the user called name, or modifies it, applying rules in
+// order. Nothing changes if one of them is invalid.
+func aclSetUser(name string, rules []Value) Value {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return Value{typ: "error", str: "ERR Usernames can't contain spaces or null characters"}
+	}
+
+	aclMu.Lock()
+	defer aclMu.Unlock()
+
+	u := &aclUser{name: name}
+	if existing := aclUsers[name]; existing != nil {
+		*u = *existing
+		u.passwords = append([]string(nil), existing.passwords...)
+		u.commands = append([]string(nil), existing.commands...)
+		u.keys = append([]string(nil), existing.keys...)
+		u.channels = append([]string(nil), existing.channels...)
+	}
+
+	for _, rule := range rules {
+		if err := u.applyRule(rule.bulk); err != nil {
+			return Value{typ: "error", str: "ERR Error in ACL SETUSER modifier '" + rule.bulk + "': " + err.Error()}
+		}
+	}
+
+	// connections authenticated as the user see the changes right away
+	if existing := aclUsers[name]; existing != nil {
+		*existing = *u
+	} else {
+		aclUsers[name] = u
+	}
+
+	return Value{typ: "string", str: "OK"}
+}
+
+func aclGetUser(name string) Value {
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+
+	u := aclUsers[name]
+	if u == nil {
+		return Value{typ: "null"}
+	}
+
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+
+	keys := []string{}
+	for _, pattern := range u.keys {
+		keys = append(keys, "~"+pattern)
+	}
+	channels := []string{}
+	for _, pattern := range u.channels {
+		channels = append(channels, "&"+pattern)
+	}
+
+	return Value{typ: "map", array: []Value{
+		{typ: "bulk", bulk: "flags"}, {typ: "array", array: bulks(flags...)},
+		{typ: "bulk", bulk: "passwords"}, {typ: "array", array: bulks(u.passwords...)},
+		{typ: "bulk", bulk: "commands"}, {typ: "bulk", bulk: u.commandRules()},
+		{typ: "bulk", bulk: "keys"}, {typ: "bulk", bulk: strings.Join(keys, " ")},
+		{typ: "bulk", bulk: "channels"}, {typ: "bulk", bulk: strings.Join(channels, " ")},
+	}}
+}
+
+// aclDelUser deletes users, closing the connections authenticated as them.
+func aclDelUser(names []Value) Value {
+	aclMu.Lock()
+	defer aclMu.Unlock()
+
+	for _, name := range names {
+		if name.bulk == "default" {
+			return Value{typ: "error", str: "ERR The 'default' user cannot be removed"}
+		}
+	}
+
+	deleted := 0
+	for _, name := range names {
+		if u := aclUsers[name.bulk]; u != nil {
+			u.removed = true
+			delete(aclUsers, name.bulk)
+			deleted++
+		}
+	}
+
+	return Value{typ: "integer", num: deleted}
+}
+
+// aclCat lists the categories, or the commands of one of them.
+func aclCat(args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "array", array: bulks(aclCategories()...)}
+	}
+
+	category := "@" + strings.ToLower(args[0].bulk)
+	if !containsString(aclCategories(), category[1:]) {
+		return Value{typ: "error", str: "ERR Unknown category '" + args[0].bulk + "'"}
+	}
+
+	names := []string{}
+	for _, spec := range sortedCommands() {
+		if containsString(spec.categories(), category) {
+			names = append(names, spec.name)
+		}
+	}
+	return Value{typ: "array", array: bulks(names...)}
+}
+
+// aclLogCommand implements ACL LOG [count | RESET].
+func aclLogCommand(args []Value) Value {
+	count := 10
+	if len(args) == 1 {
+		if strings.EqualFold(args[0].bulk, "RESET") {
+			aclLogMu.Lock()
+			aclLog = nil
+			aclLogMu.Unlock()
+			return Value{typ: "string", str: "OK"}
+		}
+
+		n, err := strconv.Atoi(args[0].bulk)
+		if err != nil || n < 0 {
+			return Value{typ: "error", str: "ERR value is out of range, must be positive"}
+		}
+		count = n
+	}
+
+	aclLogMu.Lock()
+	defer aclLogMu.Unlock()
+
+	entries := []Value{}
+	for _, entry := range aclLog[:min(count, len(aclLog))] {
+		entries = append(entries, entry.value())
+	}
+	return Value{typ: "array", array: entries}
+}
+
+// setACLFile sets the file ACL SAVE and ACL LOAD use.
+func setACLFile(path string) {
+	aclMu.Lock()
+	defer aclMu.Unlock()
+
+	aclFile = path
+}
+
+func aclFilePath() string {
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+
+	return aclFile
+}
+
+var errNoACLFile = errors.New("This instance is not configured to use an ACL file. Start it with -aclfile to store users in a file.")
+
+// saveACLFile writes every user to the ACL file, one "user name rules..."
+// line each, replacing it atomically.
+func saveACLFile() error {
+	aclMu.RLock()
+	path := aclFile
+	var b strings.Builder
+	for _, name := range sortedUserNames() {
+		b.WriteString(aclUsers[name].describe() + "\n")
+	}
+	aclMu.RUnlock()
+
+	if path == "" {
+		return errNoACLFile
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadACLFile replaces the users with those of the ACL file. Nothing
+// changes if the file has an error. Users missing from it are deleted,
+// except default, which keeps its rules.
+func loadACLFile() error {
+	users, err := readACLFile()
+	if err != nil {
+		return err
+	}
+
+	replaceACLUsers(users)
+	return nil
+}
+
+// loadStartupACLFile is loadACLFile when the server starts. A file that
+// defines the default user is refused if requirepass is set too, as Redis
+// does, since one would silently replace the password set by the other.
+func loadStartupACLFile() error {
+	users, err := readACLFile()
+	if err != nil {
+		return err
+	}
+	if users["default"] != nil && requirepass() != "" {
+		return fmt.Errorf("%s defines the default user while requirepass is set: set the password of default in the ACL file only", aclFilePath())
+	}
+
+	replaceACLUsers(users)
+	return nil
+}
+
+// readACLFile parses the users of the ACL file.
+func readACLFile() (map[string]*aclUser, error) {
+	path := aclFilePath()
+	if path == "" {
+		return nil, errNoACLFile
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string]*aclUser{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || fields[0] != "user" {
+			return nil, fmt.Errorf("%s:%d: should start with user <username>", path, line)
+		}
+
+		u := &aclUser{name: fields[1]}
+		for _, rule := range fields[2:] {
+			if err := u.applyRule(rule); err != nil {
+				return nil, fmt.Errorf("%s:%d: error in modifier '%s': %v", path, line, rule, err)
+			}
+		}
+		users[u.name] = u
+	}
+
+	return users, scanner.Err()
+}
+
+// replaceACLUsers replaces the users with users, as loadACLFile describes.
+func replaceACLUsers(users map[string]*aclUser) {
+	aclMu.Lock()
+	defer aclMu.Unlock()
+
+	for name, u := range aclUsers {
+		if users[name] == nil && name != "default" {
+			u.removed = true
+			delete(aclUsers, name)
+		}
+	}
+	for name, u := range users {
+		if existing := aclUsers[name]; existing != nil {
+			*existing = *u
+		} else {
+			aclUsers[name] = u
+		}
+	}
+}
+
+// userContextKey holds the user of an HTTP request in its context.
+type userContextKey struct{}
+
+// requestUser returns the user an HTTP request was authenticated as by
+// authorize. Requests that did not go through it run as the default user.
+func requestUser(r *http.Request) *aclUser {
+	if u, ok := r.Context().Value(userContextKey{}).(*aclUser); ok {
+		return u
+	}
+	return defaultUser()
+}
+
+func withUser(r *http.Request, u *aclUser) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey{}, u))
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetACL leaves only the default user, without a password, and empties the
+// ACL log, both now and at the end of the test.
+func resetACL(t *testing.T) {
+	t.Helper()
+
+	reset := func() {
+		aclMu.Lock()
+		aclUsers = map[string]*aclUser{
+			"default": {name: "default", enabled: true, nopass: true, commands: []string{"+@all"}, keys: []string{"*"}, channels: []string{"*"}},
+		}
+		aclFile = ""
+		aclMu.Unlock()
+
+		aclLogMu.Lock()
+		aclLog = nil
+		aclLogMu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestACLRules(t *testing.T) {
+	u := &aclUser{name: "u"}
+	for _, rule := range strings.Fields("on >pw +@read -hget +config|get ~cache:* &notify:*") {
+		if err := u.applyRule(rule); err != nil {
+			t.Fatalf("rule %s: %v", rule, err)
+		}
+	}
+
+	tests := []struct {
+		command string
+		args    []string
+		reason  string
+	}{
+		{"GET", []string{"cache:1"}, ""},
+		{"GET", []string{"other"}, "key"},
+		{"HGET", []string{"cache:1", "f"}, "command"},
+		{"SET", []string{"cache:1", "v"}, "command"},
+		{"CONFIG", []string{"GET", "save"}, ""},
+		{"CONFIG", []string{"SET", "save", ""}, "command"},
+		{"PUBLISH", []string{"notify:1", "hi"}, "command"},
+	}
+	for _, tt := range tests {
+		if reason, _ := u.permit(lookupCommand(tt.command), bulks(tt.args...)); reason != tt.reason {
+			t.Errorf("%s %v refused for %q, want %q", tt.command, tt.args, reason, tt.reason)
+		}
+	}
+
+	u.applyRule("+@pubsub")
+	if reason, _ := u.permit(lookupCommand("PUBLISH"), bulks("other", "hi")); reason != "channel" {
+		t.Errorf("PUBLISH other refused for %q, want channel", reason)
+	}
+	if reason, _ := u.permit(lookupCommand("PSUBSCRIBE"), bulks("notify:1*")); reason != "channel" {
+		t.Errorf("PSUBSCRIBE notify:1* refused for %q, want channel", reason)
+	}
+	if reason, _ := u.permit(lookupCommand("PSUBSCRIBE"), bulks("notify:*")); reason != "" {
+		t.Errorf("PSUBSCRIBE notify:* refused for %q", reason)
+	}
+
+	if got := u.describe(); got != "user u on #"+hashPassword("pw")+" ~cache:* &notify:* +@read -hget +config|get +@pubsub" {
+		t.Errorf("describe = %q", got)
+	}
+
+	for _, rule := range []string{"+nosuch", "+@nosuch", "#abc", "bogus", ""} {
+		if err := u.applyRule(rule); err == nil {
+			t.Errorf("rule %q was accepted", rule)
+		}
+	}
+}
+
+func TestACLEnforcement(t *testing.T) {
+	resetKeyspace()
+	resetACL(t)
+	port := startTestServer(t)
+
+	admin := dialTestServer(t, port)
+	if got := admin.do(t, "ACL", "SETUSER", "alice", "on", ">pw", "~cache:*", "&notify:*", "+@read", "+set", "+publish", "+multi", "+exec"); got != "+OK" {
+		t.Fatalf("ACL SETUSER = %q", got)
+	}
+	if got := admin.do(t, "ACL", "SETUSER", "alice", "+nosuch"); !strings.HasPrefix(got, "-ERR Error in ACL SETUSER modifier '+nosuch'") {
+		t.Fatalf("ACL SETUSER with an unknown command = %q", got)
+	}
+
+	alice := dialTestServer(t, port)
+	if got := alice.do(t, "AUTH", "alice", "wrong"); !strings.HasPrefix(got, "-WRONGPASS") {
+		t.Fatalf("AUTH alice wrong = %q", got)
+	}
+	if got := alice.do(t, "AUTH", "alice", "pw"); got != "+OK" {
+		t.Fatalf("AUTH alice = %q", got)
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SET", "cache:a", "1"}, "+OK"},
+		{[]string{"GET", "cache:a"}, "$1"},
+		{[]string{"GET", "secret"}, "-NOPERM No permissions to access a key"},
+		{[]string{"DEL", "cache:a"}, "-NOPERM User alice has no permissions to run the 'del' command"},
+		{[]string{"PUBLISH", "notify:x", "hi"}, ":0"},
+		{[]string{"PUBLISH", "other", "hi"}, "-NOPERM No permissions to access a channel"},
+		{[]string{"ACL", "WHOAMI"}, "-NOPERM User alice has no permissions to run the 'acl' command"},
+	}
+	for _, tt := range tests {
+		if got := alice.do(t, tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+		if tt.want[0] == '$' {
+			alice.resp.reader.ReadString('\n')
+		}
+	}
+
+	// a refused command aborts the transaction
+	alice.do(t, "MULTI")
+	alice.do(t, "SET", "cache:b", "1")
+	if got := alice.do(t, "SET", "secret", "1"); got != "-NOPERM No permissions to access a key" {
+		t.Fatalf("SET secret in MULTI = %q", got)
+	}
+	if got := alice.do(t, "EXEC"); !strings.HasPrefix(got, "-EXECABORT") {
+		t.Fatalf("EXEC = %q", got)
+	}
+
+	send(t, admin, "ACL", "LOG")
+	log, err := admin.resp.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := []string{}
+	for _, entry := range log.array {
+		reasons = append(reasons, entry.array[3].bulk+":"+entry.array[5].bulk+":"+entry.array[7].bulk)
+	}
+	want := "key:multi:secret command:toplevel:acl channel:toplevel:other command:toplevel:del key:toplevel:secret auth:toplevel:AUTH"
+	if strings.Join(reasons, " ") != want {
+		t.Errorf("ACL LOG = %v, want %s", reasons, want)
+	}
+
+	send(t, admin, "ACL", "GETUSER", "alice")
+	user, err := admin.resp.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.array[3].array[0].bulk != hashPassword("pw") || user.array[5].bulk != "+@read +set +publish +multi +exec" || user.array[7].bulk != "~cache:*" {
+		t.Errorf("ACL GETUSER alice = %+v", user)
+	}
+	if got := admin.do(t, "ACL", "WHOAMI"); got != "$7" {
+		t.Errorf("ACL WHOAMI = %q", got)
+	}
+	admin.resp.reader.ReadString('\n')
+
+	// deleting a user disconnects its clients
+	if got := admin.do(t, "ACL", "DELUSER", "alice", "nobody"); got != ":1" {
+		t.Fatalf("ACL DELUSER = %q", got)
+	}
+	if got := admin.do(t, "ACL", "DELUSER", "default"); !strings.HasPrefix(got, "-ERR The 'default' user cannot be removed") {
+		t.Fatalf("ACL DELUSER default = %q", got)
+	}
+	send(t, alice, "GET", "cache:a")
+	alice.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := alice.resp.reader.ReadString('\n'); err != io.EOF {
+		t.Fatalf("the client of a deleted user got %v, want EOF", err)
+	}
+}
+
+func TestACLCat(t *testing.T) {
+	categories := aclCategories()
+	for _, category := range []string{"read", "write", "keyspace", "pubsub", "admin", "dangerous", "fast", "slow"} {
+		if !containsString(categories, category) {
+			t.Errorf("ACL CAT is missing %s", category)
+		}
+	}
+
+	commands := aclCat(bulks("hash"))
+	names := []string{}
+	for _, command := range commands.array {
+		names = append(names, command.bulk)
+	}
+	if !containsString(names, "hset") || containsString(names, "get") {
+		t.Errorf("ACL CAT hash = %v", names)
+	}
+	if got := aclCat(bulks("nosuch")); got.typ != "error" {
+		t.Errorf("ACL CAT nosuch = %+v", got)
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	resetACL(t)
+	path := filepath.Join(t.TempDir(), "users.acl")
+
+	if err := saveACLFile(); err != errNoACLFile {
+		t.Fatalf("ACL SAVE without a file: %v", err)
+	}
+	setACLFile(path)
+
+	aclSetUser("alice", bulks("on", ">secret", "~cache:*", "+@read"))
+	aclSetUser("bob", bulks("on", "nopass", "+@all", "allkeys"))
+	if err := saveACLFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Fatalf("the ACL file holds a password in clear:\n%s", data)
+	}
+
+	aclSetUser("alice", bulks("reset"))
+	aclSetUser("carol", bulks("on"))
+	bob := authenticateUser("bob", "")
+	if err := loadACLFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	if authenticateUser("alice", "secret") == nil {
+		t.Error("alice cannot authenticate after ACL LOAD")
+	}
+	if authenticateUser("carol", "") != nil || aclGetUser("carol").typ != "null" {
+		t.Error("carol, missing from the file, survived ACL LOAD")
+	}
+	if bob.isRemoved() || authenticateUser("bob", "") != bob {
+		t.Error("bob was replaced by ACL LOAD")
+	}
+
+	os.WriteFile(path, []byte("user alice on +nosuch\n"), 0600)
+	if err := loadACLFile(); err == nil || !strings.Contains(err.Error(), ":1:") {
+		t.Fatalf("loading an invalid file: %v", err)
+	}
+	if authenticateUser("alice", "secret") == nil {
+		t.Error("a failed ACL LOAD changed the users")
+	}
+}
+
+func TestStartupACLFileWithRequirepass(t *testing.T) {
+	resetACL(t)
+	path := filepath.Join(t.TempDir(), "users.acl")
+	setACLFile(path)
+	os.WriteFile(path, []byte("user default on nopass +@all ~*\nuser alice on nopass +@all ~*\n"), 0600)
+
+	requirePassword(t, "secret")
+	if err := loadStartupACLFile(); err == nil || !strings.Contains(err.Error(), "requirepass") {
+		t.Fatalf("ACL file defining default with requirepass set: %v", err)
+	}
+	if authenticateUser("alice", "") != nil || authenticateUser("default", "") != nil {
+		t.Error("the users were loaded from a refused ACL file")
+	}
+
+	// without default, the file leaves requirepass alone
+	os.WriteFile(path, []byte("user alice on nopass +@all ~*\n"), 0600)
+	if err := loadStartupACLFile(); err != nil {
+		t.Fatal(err)
+	}
+	if authenticateUser("default", "secret") == nil || authenticateUser("alice", "") == nil {
+		t.Error("requirepass or the ACL file users were lost")
+	}
+}
+
+func TestAPIACL(t *testing.T) {
+	resetACL(t)
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	handler := api.Handler()
+
+	requirePassword(t, "secret")
+	aclSetUser("sessions", bulks("on", ">tok", "~session:*", "+@all"))
+
+	do := func(method, path, token string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader("v"))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	tests := []struct {
+		method, path, token string
+		want                int
+	}{
+		{http.MethodPut, "/kv/session:1", "tok", http.StatusOK},
+		{http.MethodGet, "/kv/session:1", "tok", http.StatusOK},
+		{http.MethodGet, "/kv/other", "tok", http.StatusForbidden},
+		{http.MethodGet, "/kv/other", "wrong", http.StatusUnauthorized},
+		{http.MethodPut, "/kv/other", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := do(tt.method, tt.path, tt.token); got != tt.want {
+			t.Errorf("%s %s with %s: status %d, want %d", tt.method, tt.path, tt.token, got, tt.want)
+		}
+	}
+}
@@ -2,8 +2,13 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,15 +17,70 @@ type Aof struct {
 	file *os.File
 	rd   *bufio.Reader
 	mu   sync.Mutex
+	path string
+
+	// size is the current length of the file and baseSize its length right
+	// after startup or the last rewrite; their ratio drives automatic
+	// rewrites.
+	size     int64
+	baseSize int64
+
+	// rewritePercentage and rewriteMinSize configure automatic rewrites:
+	// one starts when the file has grown by rewritePercentage percent over
+	// baseSize and is at least rewriteMinSize bytes. 0 disables them.
+	rewritePercentage int
+	rewriteMinSize    int64
+
+	// rewriting is set while a rewrite runs, and rewriteBuf collects the
+	// writes accepted in the meantime once the keyspace has been captured.
+	rewriting           bool
+	rewriteBuf          []byte
+	lastRewriteErr      error
+	lastRewriteTime     time.Time
+	lastRewriteDuration time.Duration
+
+	// fsyncPolicy is one of fsyncAlways, fsyncEverysec or fsyncNo.
+	// writeOffset counts every byte ever appended and syncedOffset how many
+	// of them are known to be on disk; they keep growing across rewrites.
+	// syncing is set while a goroutine is inside file.Sync, and the others
+	// wait on syncDone to piggyback on its result (group commit).
+	fsyncPolicy  string
+	writeOffset  int64
+	syncedOffset int64
+	syncing      bool
+	syncDone     *sync.Cond
+	lastFsyncErr error
+	lastWriteErr error
+	fsyncLatency histogram
+
+	// closed is set by Close, which stops the background fsyncs and
+	// automatic rewrites.
+	closed bool
 }
 
+const (
+	fsyncAlways   = "always"
+	fsyncEverysec = "everysec"
+	fsyncNo       = "no"
+)
+
+// activeAof is the AOF the server appends to. It is nil when persistence
+// is not set up, for example in tests.
+var activeAof *Aof
+
+// appendFilename is the path of the AOF, set by the appendfilename
+// parameter.
+var appendFilename = "database.aof"
+
 // NewAof creates a new Aof object with the given path.
 //
 // It opens the file at the specified path with the O_CREATE and O_RDWR flags,
 // and sets the file permissions to 0644. If the file cannot be opened, it returns
 // nil and the error. Otherwise, it initializes a new Aof object with the opened
-// file, a new bufio.Reader, and an empty mutex. It then spawns a goroutine that
-// periodically locks the mutex, calls file.Sync(), and unlocks the mutex.
+// file, a new bufio.Reader, and an empty mutex, using the everysec fsync
+// policy. It then spawns a goroutine that once a second flushes the file to
+// disk when the policy is everysec and starts an automatic rewrite when the
+// file has grown enough.
 //
 // Parameters:
 // - path: the path of the file to open.
@@ -34,17 +94,39 @@ func NewAof(path string) (*Aof, error) {
 		return nil, err
 	}
 
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
 	aof := &Aof{
-		file: f,
-		rd:   bufio.NewReader(f),
+		file:              f,
+		rd:                bufio.NewReader(f),
+		path:              path,
+		size:              info.Size(),
+		baseSize:          info.Size(),
+		rewritePercentage: defaultRewritePercentage,
+		rewriteMinSize:    defaultRewriteMinSize,
+		fsyncPolicy:       fsyncEverysec,
 	}
+	aof.syncDone = sync.NewCond(&aof.mu)
+
 	go func() {
 		for {
 			aof.mu.Lock()
+			policy, offset, closed := aof.fsyncPolicy, aof.writeOffset, aof.closed
+			aof.mu.Unlock()
 
-			aof.file.Sync()
+			if closed {
+				return
+			}
 
-			aof.mu.Unlock()
+			if policy == fsyncEverysec {
+				aof.syncUpTo(offset)
+			}
+
+			aof.maybeRewrite()
 
 			time.Sleep(time.Second)
 		}
@@ -53,35 +135,201 @@ func NewAof(path string) (*Aof, error) {
 	return aof, nil
 }
 
+// Close flushes the file to disk and closes it. Closing it again does
+// nothing.
 func (aof *Aof) Close() error {
+	aof.mu.Lock()
+	closed, offset := aof.closed, aof.writeOffset
+	aof.mu.Unlock()
+
+	if closed {
+		return nil
+	}
+	syncErr := aof.syncUpTo(offset)
+
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	return aof.file.Close()
+	if aof.closed {
+		return nil
+	}
+	aof.closed = true
+
+	if err := aof.file.Close(); err != nil {
+		return err
+	}
+	return syncErr
 }
 
-func (aof *Aof) Write(value Value) error {
+// Write appends values to the file with a single write. With the always
+// policy it only returns once they are on disk, so callers must reply to the
+// client afterwards.
+func (aof *Aof) Write(values ...Value) error {
+	if err := aof.append(values...); err != nil {
+		return err
+	}
+	return aof.awaitFsync()
+}
+
+// append writes values to the file without waiting for them to be on disk.
+// Writers append while holding callMu, so the log follows the order in which
+// writes are applied, and wait with awaitFsync once they released it.
+func (aof *Aof) append(values ...Value) error {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	_, err := aof.file.Write(value.Marshal())
+	var bytes []byte
+	for _, value := range values {
+		bytes = append(bytes, value.Marshal()...)
+	}
+
+	n, err := aof.file.Write(bytes)
+	aof.size += int64(n)
+	aof.writeOffset += int64(n)
+	aof.lastWriteErr = err
 	if err != nil {
 		return err
 	}
 
+	if aof.rewriteBuf != nil {
+		aof.rewriteBuf = append(aof.rewriteBuf, bytes...)
+	}
+
+	return nil
+}
+
+// awaitFsync returns once everything appended so far is on disk when the
+// policy is always, sharing the fsync with the other writers waiting.
+func (aof *Aof) awaitFsync() error {
+	aof.mu.Lock()
+	policy, offset := aof.fsyncPolicy, aof.writeOffset
+	aof.mu.Unlock()
+
+	if policy == fsyncAlways {
+		return aof.syncUpTo(offset)
+	}
+
+	return nil
+}
+
+// syncUpTo makes sure the first offset bytes ever written are on disk. The
+// mutex is not held during the fsync itself, so writers are never stalled by
+// it, and a single fsync covers every write that was appended before it
+// started: concurrent callers wait for it instead of issuing their own.
+func (aof *Aof) syncUpTo(offset int64) error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	for aof.syncedOffset < offset {
+		if aof.syncing {
+			aof.syncDone.Wait()
+			continue
+		}
+
+		aof.syncing = true
+		file, target := aof.file, aof.writeOffset
+		aof.mu.Unlock()
+
+		start := time.Now()
+		err := file.Sync()
+		aof.fsyncLatency.observe(time.Since(start))
+
+		aof.mu.Lock()
+		aof.syncing = false
+		aof.lastFsyncErr = err
+		if err == nil && target > aof.syncedOffset {
+			aof.syncedOffset = target
+		}
+		aof.syncDone.Broadcast()
+
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (aof *Aof) Read(fn func(value Value)) error {
+// Size returns the current length of the file.
+func (aof *Aof) Size() int64 {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	return aof.size
+}
+
+// info is the AOF part of the persistence section of INFO.
+func (aof *Aof) info() string {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "aof_enabled:1\r\n")
+	fmt.Fprintf(&b, "aof_rewrite_in_progress:%d\r\n", boolToInt(aof.rewriting))
+	fmt.Fprintf(&b, "aof_last_rewrite_time_sec:%d\r\n", durationSec(aof.lastRewriteTime, aof.lastRewriteDuration))
+	fmt.Fprintf(&b, "aof_last_bgrewrite_status:%s\r\n", infoStatus(aof.lastRewriteErr))
+	fmt.Fprintf(&b, "aof_last_write_status:%s\r\n", infoStatus(aof.lastWriteErr))
+	fmt.Fprintf(&b, "aof_current_size:%d\r\n", aof.size)
+	fmt.Fprintf(&b, "aof_base_size:%d\r\n", aof.baseSize)
+	fmt.Fprintf(&b, "aof_fsync_policy:%s\r\n", aof.fsyncPolicy)
+	fmt.Fprintf(&b, "aof_pending_fsync_bytes:%d\r\n", aof.writeOffset-aof.syncedOffset)
+	fmt.Fprintf(&b, "aof_last_fsync_status:%s\r\n", infoStatus(aof.lastFsyncErr))
+
+	return b.String()
+}
+
+// SetFsyncPolicy switches between the always, everysec and no policies.
+func (aof *Aof) SetFsyncPolicy(policy string) error {
+	switch policy {
+	case fsyncAlways, fsyncEverysec, fsyncNo:
+	default:
+		return fmt.Errorf("invalid appendfsync policy %q", policy)
+	}
+
+	aof.mu.Lock()
+	aof.fsyncPolicy = policy
+	offset := aof.writeOffset
+	aof.mu.Unlock()
+
+	if policy == fsyncAlways {
+		// writes accepted under the previous policy must not stay unsynced
+		return aof.syncUpTo(offset)
+	}
+
+	return nil
+}
+
+// FsyncPolicy returns the current fsync policy.
+func (aof *Aof) FsyncPolicy() string {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	return aof.fsyncPolicy
+}
+
+func (aof *Aof) Read(fn func(value Value, end int64) error) error {
+	return aof.ReadFrom(0, fn)
+}
+
+// ReadFrom calls fn for every command stored after the first offset bytes,
+// with the offset right after the command, and stops at the first error fn
+// returns. A file ending in the middle of a command yields
+// io.ErrUnexpectedEOF once the commands before it were read.
+func (aof *Aof) ReadFrom(offset int64, fn func(value Value, end int64) error) error {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	aof.file.Seek(0, io.SeekStart)
+	aof.file.Seek(offset, io.SeekStart)
 
-	reader := NewResp(aof.file)
+	counter := &countingReader{r: aof.file}
+	reader := NewResp(counter)
+	end := offset
 
 	for {
 		value, err := reader.Read()
+		if err == io.EOF && offset+counter.n > end {
+			err = io.ErrUnexpectedEOF
+		}
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -90,8 +338,226 @@ func (aof *Aof) Read(fn func(value Value)) error {
 			return err
 		}
 
-		fn(value)
+		end = offset + counter.n - int64(reader.reader.Buffered())
+		if err := fn(value, end); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// truncate cuts the file at size, dropping an incomplete command left at
+// its end by a crash, so that the commands appended next are read back.
+func (aof *Aof) truncate(size int64) error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if err := aof.file.Truncate(size); err != nil {
+		return err
 	}
+	if _, err := aof.file.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	aof.size = size
+	aof.baseSize = min(aof.baseSize, size)
 
 	return nil
 }
+
+// aofWindowSize is how many bytes before a position are checksummed to
+// recognise it later.
+const aofWindowSize = 4096
+
+// position returns the current length of the file together with a checksum
+// of the bytes just before it. A snapshot records both, so that at startup
+// the file can be checked to still be the one the snapshot was taken against
+// before only its tail is replayed.
+func (aof *Aof) position() (int64, uint32, error) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	sum, err := aof.windowChecksum(aof.size)
+	return aof.size, sum, err
+}
+
+// matchesPosition reports whether the file still starts with the data it
+// held when position returned offset and sum.
+func (aof *Aof) matchesPosition(offset int64, sum uint32) bool {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if offset > aof.size {
+		return false
+	}
+
+	got, err := aof.windowChecksum(offset)
+	return err == nil && got == sum
+}
+
+func (aof *Aof) windowChecksum(offset int64) (uint32, error) {
+	start := max(0, offset-aofWindowSize)
+	window := make([]byte, offset-start)
+	if _, err := aof.file.ReadAt(window, start); err != nil {
+		return 0, err
+	}
+
+	return crc32.ChecksumIEEE(window), nil
+}
+
+// loadAof replays every command stored in aof against the keyspace.
+func loadAof(aof *Aof) error {
+	return loadAofFrom(aof, 0)
+}
+
+// loadAofFrom replays the AOF from offset. The commands of a transaction
+// are only applied once its EXEC is read, so a transaction cut short by a
+// crash is dropped as a whole. The file is then truncated after the last
+// complete command or transaction. Any other invalid content is an error,
+// returned with what was replayed before it left applied.
+func loadAofFrom(aof *Aof, offset int64) error {
+	loading.Store(true)
+	defer loading.Store(false)
+
+	var transaction []Value
+	complete := offset
+
+	err := aof.ReadFrom(offset, func(value Value, end int64) error {
+		command, err := aofCommand(value)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case command == "MULTI":
+			transaction = []Value{}
+			return nil
+		case command == "EXEC":
+			for _, queued := range transaction {
+				if err := replayAofCommand(queued); err != nil {
+					return err
+				}
+			}
+			transaction = nil
+			complete = end
+			return nil
+		case transaction != nil:
+			transaction = append(transaction, value)
+			return nil
+		}
+
+		complete = end
+		return replayAofCommand(value)
+	})
+
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		log.Printf("Truncating an incomplete command at the end of the AOF, at offset %d", complete)
+	case err != nil:
+		return fmt.Errorf("invalid AOF after offset %d: %w", complete, err)
+	case transaction != nil:
+		log.Printf("Discarding an incomplete transaction of %d commands at the end of the AOF", len(transaction))
+	default:
+		return nil
+	}
+
+	return aof.truncate(complete)
+}
+
+// aofCommand returns the name of the command stored in value, in upper case,
+// or an error if value is not a command.
+func aofCommand(value Value) (string, error) {
+	if value.typ != "array" || len(value.array) == 0 || value.array[0].typ != "bulk" {
+		return "", errors.New("not a command")
+	}
+	return strings.ToUpper(value.array[0].bulk), nil
+}
+
+func replayAofCommand(value Value) error {
+	command, err := aofCommand(value)
+	if err != nil {
+		return err
+	}
+	args := value.array[1:]
+
+	handler, ok := Handlers[command]
+	if !ok {
+		return fmt.Errorf("unknown command %q", command)
+	}
+
+	handler(args)
+	return nil
+}
+
+// propagate records a write command that has just been executed: it is
+// appended to aof, when there is one, counted towards the save rules and
+// sent to the replicas, after the DEL of the keys it found expired.
+func propagate(aof *Aof, command string, args []Value, result Value) {
+	commitExpired(aof)
+
+	entry, ok := aofEntry(command, args, result)
+	if !ok {
+		return
+	}
+
+	touchKeys(command, args)
+	commit(aof, entry)
+}
+
+// commit appends the records of executed write commands to aof, counts them
+// and sends them to the replicas. Several records are wrapped in MULTI and
+// EXEC so that they are replayed and replicated as a single unit.
+//
+// It must be called with callMu held. It does not wait for the records to be
+// on disk: callers do that with Aof.awaitFsync once they released callMu.
+func commit(aof *Aof, entries ...Value) {
+	if len(entries) == 0 {
+		return
+	}
+
+	dirty.Add(int64(len(entries)))
+
+	if len(entries) > 1 {
+		entries = append(append([]Value{{typ: "array", array: bulks("MULTI")}}, entries...), Value{typ: "array", array: bulks("EXEC")})
+	}
+
+	if aof != nil {
+		aof.append(entries...)
+	}
+
+	for _, entry := range entries {
+		repl.feed(entry)
+	}
+}
+
+// aofEntry returns the record to append for a write command that has just
+// been executed, or false when nothing should be logged.
+func aofEntry(command string, args []Value, result Value) (Value, bool) {
+	if result.typ == "error" {
+		return Value{}, false
+	}
+
+	switch command {
+	case "SET":
+		return setEntry(args, result)
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT":
+		return expireEntry(args, result)
+	}
+
+	return Value{
+		typ:   "array",
+		array: append([]Value{{typ: "bulk", bulk: command}}, args...),
+	}, true
+}
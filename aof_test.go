@@ -0,0 +1,173 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSetFsyncPolicy(t *testing.T) {
+	aof := newTestAof(t)
+
+	if got := aof.FsyncPolicy(); got != fsyncEverysec {
+		t.Errorf("default policy = %q, want everysec", got)
+	}
+
+	for _, policy := range []string{fsyncAlways, fsyncNo, fsyncEverysec} {
+		if err := aof.SetFsyncPolicy(policy); err != nil {
+			t.Errorf("SetFsyncPolicy(%q): %v", policy, err)
+		}
+		if got := aof.FsyncPolicy(); got != policy {
+			t.Errorf("policy = %q, want %q", got, policy)
+		}
+	}
+
+	if err := aof.SetFsyncPolicy("sometimes"); err == nil {
+		t.Error("SetFsyncPolicy(sometimes) succeeded, want error")
+	}
+}
+
+func TestFsyncAlwaysSyncsBeforeReturning(t *testing.T) {
+	aof := newTestAof(t)
+	aof.SetFsyncPolicy(fsyncAlways)
+
+	if err := aof.Write(Value{typ: "array", array: bulks("SET", "k", "v")}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if aof.syncedOffset != aof.writeOffset {
+		t.Errorf("syncedOffset = %d after Write, want %d", aof.syncedOffset, aof.writeOffset)
+	}
+}
+
+func TestFsyncAlwaysGroupCommit(t *testing.T) {
+	aof := newTestAof(t)
+	aof.SetFsyncPolicy(fsyncAlways)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			aof.Write(Value{typ: "array", array: bulks("INCR", "counter")})
+		}()
+	}
+	wg.Wait()
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if aof.syncedOffset != aof.writeOffset {
+		t.Errorf("syncedOffset = %d after concurrent writes, want %d", aof.syncedOffset, aof.writeOffset)
+	}
+	if aof.syncing {
+		t.Error("an fsync is still marked in progress")
+	}
+}
+
+func TestFsyncNoLeavesSyncToTheOS(t *testing.T) {
+	aof := newTestAof(t)
+	aof.SetFsyncPolicy(fsyncNo)
+
+	aof.Write(Value{typ: "array", array: bulks("SET", "k", "v")})
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if aof.syncedOffset != 0 {
+		t.Errorf("syncedOffset = %d with appendfsync no, want 0", aof.syncedOffset)
+	}
+}
+
+func TestSwitchingToAlwaysSyncsPendingWrites(t *testing.T) {
+	aof := newTestAof(t)
+	aof.SetFsyncPolicy(fsyncNo)
+
+	aof.Write(Value{typ: "array", array: bulks("SET", "k", "v")})
+	aof.SetFsyncPolicy(fsyncAlways)
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if aof.syncedOffset != aof.writeOffset {
+		t.Errorf("syncedOffset = %d after switching to always, want %d", aof.syncedOffset, aof.writeOffset)
+	}
+}
+
+func TestConcurrentWritesAreLoggedInOrder(t *testing.T) {
+	resetKeyspace()
+	aof := newTestAof(t)
+	spec := lookupCommand("SET")
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := "k" + strconv.Itoa(i%200)
+				call(aof, origin{}, spec, bulks(key, strconv.Itoa(g)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := snapshotKeyspace()
+	resetKeyspace()
+	if err := loadAof(aof); err != nil {
+		t.Fatalf("loadAof: %v", err)
+	}
+
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+	for key, value := range want.strings {
+		if SETs[key] != value {
+			t.Errorf("%s = %q after reloading the AOF, want %q", key, SETs[key], value)
+		}
+	}
+}
+
+func TestLoadAofRejectsInvalidCommands(t *testing.T) {
+	for _, entry := range []Value{
+		{typ: "array", array: bulks("NOSUCH", "k")},
+		{typ: "string", str: "OK"},
+		{typ: "array", array: []Value{}},
+	} {
+		resetKeyspace()
+		aof := newTestAof(t)
+		aof.Write(Value{typ: "array", array: bulks("SET", "before", "v")}, entry, Value{typ: "array", array: bulks("SET", "after", "v")})
+
+		if err := loadAof(aof); err == nil {
+			t.Errorf("loading an AOF holding %+v succeeded", entry)
+		}
+		if got := get(bulks("after")); got.typ != "null" {
+			t.Errorf("a command after %+v was replayed", entry)
+		}
+	}
+}
+
+func TestLoadAofTruncatesIncompleteTail(t *testing.T) {
+	for _, tail := range []string{"*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1", "*3\r\n$", "*1\r\n$5\r\nMULTI\r\n"} {
+		resetKeyspace()
+		aof := newTestAof(t)
+		aof.Write(Value{typ: "array", array: bulks("SET", "a", "1")})
+		size := aof.Size()
+		aof.file.WriteString(tail)
+
+		if err := loadAof(aof); err != nil {
+			t.Fatalf("loading an AOF ending with %q: %v", tail, err)
+		}
+		if aof.Size() != size {
+			t.Errorf("AOF ending with %q is %d bytes after loading, want %d", tail, aof.Size(), size)
+		}
+
+		// what is appended next is read back
+		aof.Write(Value{typ: "array", array: bulks("SET", "c", "3")})
+		resetKeyspace()
+		if err := loadAof(aof); err != nil {
+			t.Fatalf("loading the AOF again: %v", err)
+		}
+		if a, c := get(bulks("a")), get(bulks("c")); a.bulk != "1" || c.bulk != "3" {
+			t.Errorf("a = %+v and c = %+v after truncating %q", a, c, tail)
+		}
+	}
+}
@@ -2,11 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 )
 
+// httpPort is the port the HTTP API listens on.
+var httpPort = 8080
+
 type API struct {
 	aof *Aof
 }
@@ -15,34 +20,26 @@ func NewAPI(aof *Aof) *API {
 	return &API{aof: aof}
 }
 
-var writeCommands = map[string]bool{
-	"SET": true, "HSET": true, "HDEL": true, "DEL": true, "INCR": true, "DECR": true,
-	"INCRBY": true, "DECRBY": true, "APPEND": true, "LPOP": true,
-	"RPOP": true, "LPUSH": true, "RPUSH": true,
-}
-
-func (api *API) writeAof(command string, args []Value) {
-	if !writeCommands[command] {
+func (api *API) exec(w http.ResponseWriter, r *http.Request, command string, args []Value) {
+	spec := lookupCommand(command)
+	if spec == nil || spec.handler == nil {
+		http.Error(w, "unknown command", http.StatusBadRequest)
 		return
 	}
-	value := Value{
-		typ:   "array",
-		array: append([]Value{{typ: "bulk", bulk: command}}, args...),
+	if !spec.checkArity(len(args) + 1) {
+		spec.stats.rejected.Add(1)
+		http.Error(w, spec.arityError().str, http.StatusBadRequest)
+		return
 	}
-	api.aof.Write(value)
-}
 
-func (api *API) exec(w http.ResponseWriter, command string, args []Value) {
-	api.writeAof(command, args)
-
-	handler, ok := Handlers[command]
-	if !ok {
-		http.Error(w, "unknown command", http.StatusBadRequest)
+	user := requestUser(r)
+	if reason, object := user.permit(spec, args); reason != "" {
+		spec.stats.rejected.Add(1)
+		http.Error(w, denyACL(user, reason, object, "http", "addr="+r.RemoteAddr).str, http.StatusForbidden)
 		return
 	}
 
-	result := handler(args)
-	writeValue(w, result)
+	writeValue(w, call(api.aof, origin{addr: r.RemoteAddr}, spec, args))
 }
 
 func writeValue(w http.ResponseWriter, v Value) {
@@ -55,7 +52,11 @@ func writeValue(w http.ResponseWriter, v Value) {
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(v.bulk))
-	case "null":
+	case "integer":
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(strconv.Itoa(v.num)))
+	case "null", "nullarray":
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("null"))
@@ -63,7 +64,7 @@ func writeValue(w http.ResponseWriter, v Value) {
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(v.str))
-	case "array":
+	case "array", "map", "set":
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		result := make([]string, len(v.array))
@@ -101,27 +102,27 @@ func (api *API) handleSet(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		return
 	}
-	api.exec(w, "SET", []Value{{typ: "bulk", bulk: key}, {typ: "bulk", bulk: value}})
+	api.exec(w, r, "SET", []Value{{typ: "bulk", bulk: key}, {typ: "bulk", bulk: value}})
 }
 
 func (api *API) handleGet(w http.ResponseWriter, r *http.Request) {
 	key := r.PathValue("key")
-	api.exec(w, "GET", []Value{{typ: "bulk", bulk: key}})
+	api.exec(w, r, "GET", []Value{{typ: "bulk", bulk: key}})
 }
 
 func (api *API) handleDel(w http.ResponseWriter, r *http.Request) {
 	key := r.PathValue("key")
-	api.exec(w, "DEL", []Value{{typ: "bulk", bulk: key}})
+	api.exec(w, r, "DEL", []Value{{typ: "bulk", bulk: key}})
 }
 
 func (api *API) handleIncr(w http.ResponseWriter, r *http.Request) {
 	key := r.PathValue("key")
-	api.exec(w, "INCR", []Value{{typ: "bulk", bulk: key}})
+	api.exec(w, r, "INCR", []Value{{typ: "bulk", bulk: key}})
 }
 
 func (api *API) handleDecr(w http.ResponseWriter, r *http.Request) {
 	key := r.PathValue("key")
-	api.exec(w, "DECR", []Value{{typ: "bulk", bulk: key}})
+	api.exec(w, r, "DECR", []Value{{typ: "bulk", bulk: key}})
 }
 
 func (api *API) handleIncrBy(w http.ResponseWriter, r *http.Request) {
@@ -130,7 +131,7 @@ func (api *API) handleIncrBy(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		return
 	}
-	api.exec(w, "INCRBY", []Value{{typ: "bulk", bulk: key}, {typ: "bulk", bulk: amount}})
+	api.exec(w, r, "INCRBY", []Value{{typ: "bulk", bulk: key}, {typ: "bulk", bulk: amount}})
 }
 
 func (api *API) handleDecrBy(w http.ResponseWriter, r *http.Request) {
@@ -139,7 +140,7 @@ func (api *API) handleDecrBy(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		return
 	}
-	api.exec(w, "DECRBY", []Value{{typ: "bulk", bulk: key}, {typ: "bulk", bulk: amount}})
+	api.exec(w, r, "DECRBY", []Value{{typ: "bulk", bulk: key}, {typ: "bulk", bulk: amount}})
 }
 
 func (api *API) handleAppend(w http.ResponseWriter, r *http.Request) {
@@ -148,7 +149,7 @@ func (api *API) handleAppend(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		return
 	}
-	api.exec(w, "APPEND", []Value{{typ: "bulk", bulk: key}, {typ: "bulk", bulk: value}})
+	api.exec(w, r, "APPEND", []Value{{typ: "bulk", bulk: key}, {typ: "bulk", bulk: value}})
 }
 
 func (api *API) handleListPush(w http.ResponseWriter, r *http.Request) {
@@ -180,7 +181,7 @@ func (api *API) handleListPush(w http.ResponseWriter, r *http.Request) {
 		command = "RPUSH"
 	}
 
-	api.exec(w, command, args)
+	api.exec(w, r, command, args)
 }
 
 func (api *API) handleListRange(w http.ResponseWriter, r *http.Request) {
@@ -195,7 +196,7 @@ func (api *API) handleListRange(w http.ResponseWriter, r *http.Request) {
 		endStr = "-1"
 	}
 
-	api.exec(w, "LRANGE", []Value{
+	api.exec(w, r, "LRANGE", []Value{
 		{typ: "bulk", bulk: key},
 		{typ: "bulk", bulk: startStr},
 		{typ: "bulk", bulk: endStr},
@@ -214,7 +215,7 @@ func (api *API) handleListPop(w http.ResponseWriter, r *http.Request) {
 		command = "RPOP"
 	}
 
-	api.exec(w, command, []Value{{typ: "bulk", bulk: key}})
+	api.exec(w, r, command, []Value{{typ: "bulk", bulk: key}})
 }
 
 func (api *API) handleHashSet(w http.ResponseWriter, r *http.Request) {
@@ -224,30 +225,61 @@ func (api *API) handleHashSet(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		return
 	}
-	api.exec(w, "HSET", []Value{{typ: "bulk", bulk: key}, {typ: "bulk", bulk: field}, {typ: "bulk", bulk: value}})
+	api.exec(w, r, "HSET", []Value{{typ: "bulk", bulk: key}, {typ: "bulk", bulk: field}, {typ: "bulk", bulk: value}})
 }
 
 func (api *API) handleHashGet(w http.ResponseWriter, r *http.Request) {
 	key := r.PathValue("key")
 	field := r.PathValue("field")
-	api.exec(w, "HGET", []Value{{typ: "bulk", bulk: key}, {typ: "bulk", bulk: field}})
+	api.exec(w, r, "HGET", []Value{{typ: "bulk", bulk: key}, {typ: "bulk", bulk: field}})
 }
 
 func (api *API) handleHashGetAll(w http.ResponseWriter, r *http.Request) {
 	key := r.PathValue("key")
-	api.exec(w, "HGETALL", []Value{{typ: "bulk", bulk: key}})
+	api.exec(w, r, "HGETALL", []Value{{typ: "bulk", bulk: key}})
 }
 
 func (api *API) handleHashDel(w http.ResponseWriter, r *http.Request) {
 	key := r.PathValue("key")
 	field := r.PathValue("field")
-	api.exec(w, "HDEL", []Value{{typ: "bulk", bulk: key}, {typ: "bulk", bulk: field}})
+	api.exec(w, r, "HDEL", []Value{{typ: "bulk", bulk: key}, {typ: "bulk", bulk: field}})
 }
 
 func (api *API) Start() {
+	server := &http.Server{Addr: ":" + strconv.Itoa(httpPort), Handler: api.Handler()}
+	trackHTTPServer(server)
+
+	fmt.Println("HTTP API listening on " + server.Addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		fmt.Println("HTTP API:", err)
+	}
+}
+
+// StartTLS serves the HTTP API over TLS on port, with the certificate and
+// client verification of the TLS settings.
+func (api *API) StartTLS(port int) {
+	l, err := listenTLS(port)
+	if err != nil {
+		fmt.Println("HTTPS API:", err)
+		return
+	}
+
+	server := &http.Server{Handler: api.Handler()}
+	trackHTTPServer(server)
+
+	fmt.Printf("HTTPS API listening on :%d\n", port)
+	if err := server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		fmt.Println("HTTPS API:", err)
+	}
+}
+
+// Handler routes the requests of the HTTP API, which require the password
+// when one is set.
+func (api *API) Handler() http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("GET /ping", api.handlePing)
+	mux.HandleFunc("GET /metrics", api.handleMetrics)
 
 	mux.HandleFunc("PUT /kv/{key}", api.handleSet)
 	mux.HandleFunc("GET /kv/{key}", api.handleGet)
@@ -267,6 +299,5 @@ func (api *API) Start() {
 	mux.HandleFunc("GET /hash/{key}", api.handleHashGetAll)
 	mux.HandleFunc("DELETE /hash/{key}/{field}", api.handleHashDel)
 
-	fmt.Println("HTTP API listening on :8080")
-	http.ListenAndServe(":8080", mux)
+	return authorize(mux)
 }
@@ -131,6 +131,9 @@ func TestHandleIncr(t *testing.T) {
 	if w.Code != http.StatusOK {
 		t.Errorf("INCR status = %d, want %d", w.Code, http.StatusOK)
 	}
+	if w.Body.String() != "11" {
+		t.Errorf("INCR body = %q, want 11", w.Body.String())
+	}
 
 	got := get([]Value{{typ: "bulk", bulk: "counter"}})
 	if got.bulk != "11" {
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// authMu guards requirePass and masterAuth.
+var authMu = sync.RWMutex{}
+
+// requirePass is the password of the default user. When it is empty every
+// connection is authenticated from the start.
+var requirePass string
+
+// masterAuth is the password a follower sends to its leader.
+var masterAuth string
+
+var (
+	noAuth    = Value{typ: "error", str: "NOAUTH Authentication required."}
+	wrongPass = Value{typ: "error", str: "WRONGPASS invalid username-password pair or user is disabled."}
+)
+
+func requirepass() string {
+	authMu.RLock()
+	defer authMu.RUnlock()
+
+	return requirePass
+}
+
+// setRequirepass changes the password of the default user. Connections
+// that are already authenticated stay so.
+func setRequirepass(password string) {
+	authMu.Lock()
+	requirePass = password
+	authMu.Unlock()
+
+	setDefaultPassword(password)
+}
+
+func masterauth() string {
+	authMu.RLock()
+	defer authMu.RUnlock()
+
+	return masterAuth
+}
+
+func setMasterauth(password string) {
+	authMu.Lock()
+	defer authMu.Unlock()
+
+	masterAuth = password
+}
+
+// authenticate checks the credentials sent by c, logging failed attempts.
+func (c *client) authenticate(user, password string) bool {
+	u := authenticateUser(user, password)
+	if u == nil {
+		log.Printf("Failed authentication of user %q from %s", user, c.conn.RemoteAddr())
+		addACLLog("auth", "toplevel", "AUTH", user, c.info())
+		return false
+	}
+
+	c.user = u
+	return true
+}
+
+// auth implements AUTH [username] password.
+func auth(c *client, args []Value) {
+	user, password := "default", ""
+
+	switch len(args) {
+	case 1:
+		if defaultUser().hasNopass() {
+			c.write(Value{typ: "error", str: "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"})
+			return
+		}
+		password = args[0].bulk
+	case 2:
+		user, password = args[0].bulk, args[1].bulk
+	default:
+		c.write(Value{typ: "error", str: "ERR syntax error"})
+		return
+	}
+
+	if !c.authenticate(user, password) {
+		c.write(wrongPass)
+		return
+	}
+
+	c.write(Value{typ: "string", str: "OK"})
+}
+
+// authorize wraps the HTTP API so that requests run as an ACL user. They
+// authenticate with basic authentication, or with a bearer token that is
+// the password of a user. Requests without credentials run as the default
+// user, if it does not require a password.
+func authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u *aclUser
+		name, password, basic := r.BasicAuth()
+		token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		switch {
+		case basic:
+			u = authenticateUser(name, password)
+		case bearer:
+			name, u = "", userByToken(token)
+		default:
+			u = initialUser()
+		}
+
+		if u == nil {
+			switch {
+			case basic:
+				log.Printf("Failed authentication of user %q from %s", name, r.RemoteAddr)
+			case bearer:
+				log.Printf("Failed authentication with a bearer token from %s", r.RemoteAddr)
+			}
+			if basic || bearer {
+				addACLLog("auth", "http", "AUTH", name, "addr="+r.RemoteAddr)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="tinykv"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, withUser(r, u))
+	})
+}
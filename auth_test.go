@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// requirePassword sets the password for the duration of the test.
+func requirePassword(t *testing.T, password string) {
+	t.Helper()
+
+	setRequirepass(password)
+	t.Cleanup(func() { setRequirepass("") })
+}
+
+func TestAuth(t *testing.T) {
+	resetKeyspace()
+	port := startTestServer(t)
+
+	c := dialTestServer(t, port)
+	if got := c.do(t, "AUTH", "secret"); !strings.HasPrefix(got, "-ERR AUTH <password> called without any password configured") {
+		t.Fatalf("AUTH without requirepass = %q", got)
+	}
+
+	requirePassword(t, "secret")
+
+	// connections that were open before the password was set stay
+	// authenticated
+	if got := c.do(t, "GET", "k"); got != "$-1" {
+		t.Fatalf("GET on an old connection = %q", got)
+	}
+
+	c = dialTestServer(t, port)
+	if got := c.do(t, "SET", "k", "v"); got != "-NOAUTH Authentication required." {
+		t.Fatalf("SET before AUTH = %q", got)
+	}
+	if got := c.do(t, "NOSUCH"); got != "-NOAUTH Authentication required." {
+		t.Fatalf("unknown command before AUTH = %q", got)
+	}
+	if got := c.do(t, "AUTH", "wrong"); !strings.HasPrefix(got, "-WRONGPASS") {
+		t.Fatalf("AUTH wrong = %q", got)
+	}
+	if got := c.do(t, "AUTH", "someone", "secret"); !strings.HasPrefix(got, "-WRONGPASS") {
+		t.Fatalf("AUTH with another user = %q", got)
+	}
+	if got := c.do(t, "AUTH", "secret"); got != "+OK" {
+		t.Fatalf("AUTH secret = %q", got)
+	}
+	if got := c.do(t, "SET", "k", "v"); got != "+OK" {
+		t.Fatalf("SET after AUTH = %q", got)
+	}
+	if got := c.do(t, "NOSUCH"); !strings.HasPrefix(got, "-ERR unknown command") {
+		t.Fatalf("unknown command after AUTH = %q", got)
+	}
+
+	c = dialTestServer(t, port)
+	if got := c.do(t, "AUTH", "default", "secret"); got != "+OK" {
+		t.Fatalf("AUTH default secret = %q", got)
+	}
+
+	c = dialTestServer(t, port)
+	if got := c.do(t, "QUIT"); got != "+OK" {
+		t.Fatalf("QUIT before AUTH = %q", got)
+	}
+}
+
+func TestUnauthenticatedRequestLimits(t *testing.T) {
+	resetKeyspace()
+	port := startTestServer(t)
+	requirePassword(t, "secret")
+
+	c := dialTestServer(t, port)
+	if got := c.do(t, "SET", "k", strings.Repeat("v", unauthBulkLength+1)); got != "-ERR Protocol error: unauthenticated bulk length" {
+		t.Errorf("large bulk before AUTH = %q", got)
+	}
+
+	c = dialTestServer(t, port)
+	if got := c.do(t, "AUTH", "secret"); got != "+OK" {
+		t.Fatalf("AUTH secret = %q", got)
+	}
+	if got := c.do(t, "SET", "k", strings.Repeat("v", unauthBulkLength+1)); got != "+OK" {
+		t.Errorf("large bulk after AUTH = %q", got)
+	}
+}
+
+func TestHelloAuth(t *testing.T) {
+	resetKeyspace()
+	port := startTestServer(t)
+	requirePassword(t, "secret")
+
+	c := dialTestServer(t, port)
+	if got := c.do(t, "HELLO", "3"); !strings.HasPrefix(got, "-NOAUTH HELLO must be called with the client already authenticated") {
+		t.Fatalf("HELLO 3 before AUTH = %q", got)
+	}
+	if got := c.do(t, "HELLO", "3", "AUTH", "default", "wrong"); !strings.HasPrefix(got, "-WRONGPASS") {
+		t.Fatalf("HELLO with a wrong password = %q", got)
+	}
+
+	send(t, c, "HELLO", "3", "AUTH", "default", "secret")
+	if reply, err := c.resp.Read(); err != nil || reply.typ != "map" {
+		t.Fatalf("HELLO 3 AUTH = %+v, %v", reply, err)
+	}
+	if got := c.do(t, "GET", "missing"); got != "_" {
+		t.Fatalf("GET after HELLO AUTH = %q", got)
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	handler := api.Handler()
+
+	get := func(setup func(r *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		setup(req)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	none := func(r *http.Request) {}
+
+	if w := get(none); w.Code != http.StatusOK {
+		t.Fatalf("without requirepass: status %d", w.Code)
+	}
+
+	requirePassword(t, "secret")
+
+	tests := []struct {
+		name  string
+		setup func(r *http.Request)
+		want  int
+	}{
+		{"no credentials", none, http.StatusUnauthorized},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{"token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, http.StatusOK},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("default", "secret") }, http.StatusOK},
+		{"basic with another user", func(r *http.Request) { r.SetBasicAuth("someone", "secret") }, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		w := get(tt.setup)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate header", tt.name)
+		}
+	}
+}
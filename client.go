@@ -0,0 +1,297 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// outputLimit bounds the output queued for a client that does not read it
+// fast enough. The client is disconnected as soon as the queue grows past
+// hard, or once it has stayed above soft for softFor.
+type outputLimit struct {
+	hard    int
+	soft    int
+	softFor time.Duration
+}
+
+var (
+	pubsubOutputLimit  = outputLimit{hard: 32 * 1024 * 1024, soft: 8 * 1024 * 1024, softFor: 60 * time.Second}
+	replicaOutputLimit = outputLimit{hard: 256 * 1024 * 1024, soft: 64 * 1024 * 1024, softFor: 60 * time.Second}
+)
+
+// client is the state of a RESP connection. Replies, pushed messages and the
+// replication stream are queued with write and sent by a goroutine of their
+// own, so whoever produces them never waits for the network. While corked,
+// output is only queued, so the replies to pipelined commands go out
+// together. Once closed is set nothing more is queued, and done is closed
+// with the connection.
+type client struct {
+	conn net.Conn
+	id   int64
+	aof  *Aof
+
+	// name is set with HELLO SETNAME.
+	name string
+
+	// user is the ACL user the client is authenticated as, nil until it
+	// authenticates when the default user requires a password.
+	user *aclUser
+
+	mu        sync.Mutex
+	done      chan struct{}
+	proto     int
+	wake      *sync.Cond
+	out       []byte
+	corked    bool
+	closed    bool
+	limit     *outputLimit
+	softSince time.Time
+
+	// replicaPort is the listening port a follower announced before PSYNC.
+	replicaPort int
+
+	// channels and patterns are guarded by pubsubMu.
+	channels map[string]struct{}
+	patterns map[string]struct{}
+
+	// multi is set between MULTI and EXEC or DISCARD, while the commands
+	// are queued. multiFailed is set when one of them was refused.
+	multi       bool
+	multiFailed bool
+	queued      []Value
+
+	// watched and watchDirty are guarded by watchMu.
+	watched    map[string]struct{}
+	watchDirty bool
+}
+
+// clientHandlers maps the name of every command that needs the state of the
+// connection it is sent on to its implementation. It is filled from
+// commandList.
+var clientHandlers = map[string]func(c *client, args []Value){}
+
+// nextClientID numbers the connections in the order they are accepted.
+var nextClientID atomic.Int64
+
+func newClient(conn net.Conn) *client {
+	c := &client{
+		conn:     conn,
+		id:       nextClientID.Add(1),
+		done:     make(chan struct{}),
+		user:     initialUser(),
+		proto:    2,
+		channels: map[string]struct{}{},
+		patterns: map[string]struct{}{},
+		watched:  map[string]struct{}{},
+	}
+	c.wake = sync.NewCond(&c.mu)
+
+	go c.writeLoop()
+
+	return c
+}
+
+// write queues v, marshalled for the protocol version of c.
+func (c *client) write(v Value) {
+	c.writeBytes(v.MarshalProto(c.protocol()))
+}
+
+// protocol returns the RESP version c speaks, 2 unless HELLO changed it.
+func (c *client) protocol() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.proto
+}
+
+// writeBytes queues data, disconnecting the client if that exceeds its
+// output limit.
+func (c *client) writeBytes(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	c.out = append(c.out, data...)
+	if !c.corked {
+		c.wake.Signal()
+	}
+
+	if c.limit == nil {
+		return
+	}
+
+	switch {
+	case len(c.out) > c.limit.hard:
+	case len(c.out) <= c.limit.soft:
+		c.softSince = time.Time{}
+		return
+	case c.softSince.IsZero():
+		c.softSince = time.Now()
+		return
+	case time.Since(c.softSince) < c.limit.softFor:
+		return
+	}
+
+	log.Printf("Closing client %s for overcoming of output buffer limits", c.conn.RemoteAddr())
+	c.closeLocked()
+}
+
+// setOutputLimit applies limit to the output queued from now on; nil removes
+// the limit.
+func (c *client) setOutputLimit(limit *outputLimit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.limit = limit
+	c.softSince = time.Time{}
+}
+
+// cork holds the output back until flush is called.
+func (c *client) cork() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.corked = true
+}
+
+// flush sends the output queued while c was corked, and anything queued
+// later right away.
+func (c *client) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.corked = false
+	c.wake.Signal()
+}
+
+// close drops the queued output and closes the connection right away.
+func (c *client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closeLocked()
+}
+
+func (c *client) closeLocked() {
+	c.closed = true
+	c.out = nil
+	c.conn.Close()
+	c.wake.Signal()
+}
+
+// finish closes the connection once the output queued so far has been sent.
+func (c *client) finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	c.wake.Signal()
+}
+
+// writeLoop sends the queued output until the client is closed and every
+// remaining byte has been sent.
+func (c *client) writeLoop() {
+	defer close(c.done)
+
+	for {
+		c.mu.Lock()
+		for (len(c.out) == 0 || c.corked) && !c.closed {
+			c.wake.Wait()
+		}
+		data := c.out
+		c.out = nil
+		c.mu.Unlock()
+
+		if len(data) == 0 {
+			c.conn.Close()
+			return
+		}
+
+		if _, err := c.conn.Write(data); err != nil {
+			c.close()
+			return
+		}
+	}
+}
+
+// serverVersion is reported by HELLO.
+const serverVersion = "0.1.0"
+
+// hello switches c to another protocol version and replies with a
+// description of the server: HELLO [protover [AUTH username password]
+// [SETNAME clientname]].
+func hello(c *client, args []Value) {
+	proto := c.protocol()
+	name, setName := "", false
+
+	if len(args) > 0 {
+		ver, err := strconv.Atoi(args[0].bulk)
+		if err != nil {
+			c.write(Value{typ: "error", str: "ERR Protocol version is not an integer or out of range"})
+			return
+		}
+		if ver != 2 && ver != 3 {
+			c.write(Value{typ: "error", str: "NOPROTO unsupported protocol version"})
+			return
+		}
+		proto = ver
+	}
+
+	for i := 1; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		switch {
+		case option == "AUTH" && i+2 < len(args):
+			if !c.authenticate(args[i+1].bulk, args[i+2].bulk) {
+				c.write(wrongPass)
+				return
+			}
+			i += 2
+		case option == "SETNAME" && i+1 < len(args):
+			name, setName = args[i+1].bulk, true
+			if strings.ContainsFunc(name, func(r rune) bool { return r <= ' ' || r > '~' }) {
+				c.write(Value{typ: "error", str: "ERR Client names cannot contain spaces, newlines or special characters."})
+				return
+			}
+			i++
+		default:
+			c.write(Value{typ: "error", str: "ERR Syntax error in HELLO option '" + args[i].bulk + "'"})
+			return
+		}
+	}
+
+	if c.user == nil {
+		c.write(Value{typ: "error", str: "NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"})
+		return
+	}
+
+	if setName {
+		c.name = name
+	}
+
+	c.mu.Lock()
+	c.proto = proto
+	c.mu.Unlock()
+
+	role := "master"
+	if repl.readOnly() {
+		role = "replica"
+	}
+
+	c.write(Value{typ: "map", array: []Value{
+		{typ: "bulk", bulk: "server"}, {typ: "bulk", bulk: "tinykv"},
+		{typ: "bulk", bulk: "version"}, {typ: "bulk", bulk: serverVersion},
+		{typ: "bulk", bulk: "proto"}, {typ: "integer", num: proto},
+		{typ: "bulk", bulk: "id"}, {typ: "integer", num: int(c.id)},
+		{typ: "bulk", bulk: "mode"}, {typ: "bulk", bulk: "standalone"},
+		{typ: "bulk", bulk: "role"}, {typ: "bulk", bulk: role},
+		{typ: "bulk", bulk: "modules"}, {typ: "array", array: []Value{}},
+	}})
+}
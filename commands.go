@@ -0,0 +1,358 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// commandFlags describe how a command behaves, mirroring the flags Redis
+// reports in COMMAND.
+type commandFlags int
+
+const (
+	// flagWrite commands modify the keyspace: they are refused on a
+	// follower, appended to the AOF and sent to the replicas.
+	flagWrite commandFlags = 1 << iota
+	flagReadonly
+	flagDenyOOM
+	flagAdmin
+	flagPubsub
+	flagBlocking
+	flagFast
+	// flagNoMulti commands cannot be queued in a transaction.
+	flagNoMulti
+	// flagNoAuth commands can be run before authenticating.
+	flagNoAuth
+)
+
+var commandFlagNames = []struct {
+	flag commandFlags
+	name string
+}{
+	{flagWrite, "write"},
+	{flagReadonly, "readonly"},
+	{flagDenyOOM, "denyoom"},
+	{flagAdmin, "admin"},
+	{flagPubsub, "pubsub"},
+	{flagBlocking, "blocking"},
+	{flagFast, "fast"},
+	{flagNoMulti, "no_multi"},
+	{flagNoAuth, "no_auth"},
+}
+
+// commandSpec describes a command. Exactly one of handler and clientHandler
+// is set, except for PSYNC and QUIT, which handleConnection serves itself.
+type commandSpec struct {
+	name string
+
+	handler       func([]Value) Value
+	clientHandler func(c *client, args []Value)
+
+	// arity counts the command name too. A negative arity -n means at least
+	// n arguments.
+	arity int
+	flags commandFlags
+
+	// firstKey, lastKey and keyStep locate the keys among the arguments,
+	// counting the command name as 0. A negative lastKey counts from the
+	// end, and firstKey is 0 for commands without keys.
+	firstKey, lastKey, keyStep int
+
+	// acl lists the ACL categories that do not follow from the flags.
+	acl     []string
+	group   string
+	summary string
+
+	stats commandStats
+}
+
+// commandTable describes every command, by upper case name. Handlers and
+// clientHandlers are filled from it.
+var commandTable = map[string]*commandSpec{}
+
+// commandList is the source of commandTable.
+var commandList = []*commandSpec{
+	// strings
+	{name: "get", handler: get, arity: 2, flags: flagReadonly | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@string"}, group: "string", summary: "Returns the string value of a key."},
+	{name: "set", handler: set, arity: -3, flags: flagWrite | flagDenyOOM, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@string"}, group: "string", summary: "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist."},
+	{name: "append", handler: appendto, arity: 3, flags: flagWrite | flagDenyOOM | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@string"}, group: "string", summary: "Appends a string to the value of a key. Creates the key if it doesn't exist."},
+	{name: "incr", handler: incr, arity: 2, flags: flagWrite | flagDenyOOM | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@string"}, group: "string", summary: "Increments the integer value of a key by one. Uses 0 as initial value if the key doesn't exist."},
+	{name: "decr", handler: decr, arity: 2, flags: flagWrite | flagDenyOOM | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@string"}, group: "string", summary: "Decrements the integer value of a key by one. Uses 0 as initial value if the key doesn't exist."},
+	{name: "incrby", handler: incrBy, arity: 3, flags: flagWrite | flagDenyOOM | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@string"}, group: "string", summary: "Increments the integer value of a key by a number. Uses 0 as initial value if the key doesn't exist."},
+	{name: "decrby", handler: decrBy, arity: 3, flags: flagWrite | flagDenyOOM | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@string"}, group: "string", summary: "Decrements a number from the integer value of a key. Uses 0 as initial value if the key doesn't exist."},
+
+	// lists
+	{name: "lpush", handler: Lpush, arity: -3, flags: flagWrite | flagDenyOOM | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@list"}, group: "list", summary: "Prepends one or more elements to a list. Creates the key if it doesn't exist."},
+	{name: "rpush", handler: Rpush, arity: -3, flags: flagWrite | flagDenyOOM | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@list"}, group: "list", summary: "Appends one or more elements to a list. Creates the key if it doesn't exist."},
+	{name: "lpop", handler: Lpop, arity: 2, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@list"}, group: "list", summary: "Returns the first element of a list after removing it. Deletes the list if the last element was popped."},
+	{name: "rpop", handler: Rpop, arity: 2, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@list"}, group: "list", summary: "Returns and removes the last element of a list. Deletes the list if the last element was popped."},
+	{name: "lrange", handler: Lrange, arity: 4, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@list"}, group: "list", summary: "Returns a range of elements from a list."},
+
+	// hashes, with the CH* aliases that used to address a separate hash
+	// table
+	{name: "hset", handler: hset, arity: -4, flags: flagWrite | flagDenyOOM | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@hash"}, group: "hash", summary: "Creates or modifies the value of one or more fields in a hash."},
+	{name: "hget", handler: hget, arity: 3, flags: flagReadonly | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@hash"}, group: "hash", summary: "Returns the value of a field in a hash."},
+	{name: "hgetall", handler: hgetall, arity: 2, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@hash"}, group: "hash", summary: "Returns all fields and values in a hash."},
+	{name: "hdel", handler: hdel, arity: -3, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@hash"}, group: "hash", summary: "Deletes one or more fields and their values from a hash. Deletes the hash if no fields remain."},
+	{name: "hscan", handler: hscan, arity: -3, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@hash"}, group: "hash", summary: "Iterates over fields and values of a hash."},
+	{name: "chset", handler: hset, arity: -4, flags: flagWrite | flagDenyOOM | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@hash"}, group: "hash", summary: "Alias of HSET."},
+	{name: "chget", handler: hget, arity: 3, flags: flagReadonly | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@hash"}, group: "hash", summary: "Alias of HGET."},
+	{name: "chgetall", handler: hgetall, arity: 2, flags: flagReadonly, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@hash"}, group: "hash", summary: "Alias of HGETALL."},
+	{name: "chdel", handler: hdel, arity: -3, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@hash"}, group: "hash", summary: "Alias of HDEL."},
+
+	// keyspace
+	{name: "del", handler: del, arity: -2, flags: flagWrite, firstKey: 1, lastKey: -1, keyStep: 1, acl: []string{"@keyspace"}, group: "generic", summary: "Deletes one or more keys."},
+	{name: "exists", handler: exists, arity: -2, flags: flagReadonly | flagFast, firstKey: 1, lastKey: -1, keyStep: 1, acl: []string{"@keyspace"}, group: "generic", summary: "Determines whether one or more keys exist."},
+	{name: "type", handler: typeCommand, arity: 2, flags: flagReadonly | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@keyspace"}, group: "generic", summary: "Determines the type of value stored at a key."},
+	{name: "expire", handler: expire, arity: -3, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@keyspace"}, group: "generic", summary: "Sets the expiration time of a key in seconds."},
+	{name: "pexpire", handler: pexpire, arity: -3, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@keyspace"}, group: "generic", summary: "Sets the expiration time of a key in milliseconds."},
+	{name: "expireat", handler: expireat, arity: -3, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@keyspace"}, group: "generic", summary: "Sets the expiration time of a key to a Unix timestamp."},
+	{name: "pexpireat", handler: pexpireat, arity: -3, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@keyspace"}, group: "generic", summary: "Sets the expiration time of a key to a Unix milliseconds timestamp."},
+	{name: "persist", handler: persist, arity: 2, flags: flagWrite | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@keyspace"}, group: "generic", summary: "Removes the expiration time of a key."},
+	{name: "ttl", handler: ttl, arity: 2, flags: flagReadonly | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@keyspace"}, group: "generic", summary: "Returns the expiration time in seconds of a key."},
+	{name: "pttl", handler: pttl, arity: 2, flags: flagReadonly | flagFast, firstKey: 1, lastKey: 1, keyStep: 1, acl: []string{"@keyspace"}, group: "generic", summary: "Returns the expiration time in milliseconds of a key."},
+	{name: "keys", handler: keys, arity: 2, flags: flagReadonly, acl: []string{"@keyspace", "@dangerous"}, group: "generic", summary: "Returns all key names that match a pattern."},
+	{name: "scan", handler: scan, arity: -2, flags: flagReadonly, acl: []string{"@keyspace"}, group: "generic", summary: "Iterates over the key names in the database."},
+
+	// pub/sub
+	{name: "publish", handler: publish, arity: 3, flags: flagPubsub | flagFast, group: "pubsub", summary: "Posts a message to a channel."},
+	{name: "pubsub", handler: pubsubCommand, arity: -2, flags: flagPubsub, group: "pubsub", summary: "Inspects the state of the Pub/Sub subsystem."},
+	{name: "subscribe", clientHandler: subscribe, arity: -2, flags: flagPubsub | flagNoMulti, group: "pubsub", summary: "Listens for messages published to channels."},
+	{name: "unsubscribe", clientHandler: unsubscribe, arity: -1, flags: flagPubsub | flagNoMulti, group: "pubsub", summary: "Stops listening to messages posted to channels."},
+	{name: "psubscribe", clientHandler: psubscribe, arity: -2, flags: flagPubsub | flagNoMulti, group: "pubsub", summary: "Listens for messages published to channels that match one or more patterns."},
+	{name: "punsubscribe", clientHandler: punsubscribe, arity: -1, flags: flagPubsub | flagNoMulti, group: "pubsub", summary: "Stops listening to messages published to channels that match one or more patterns."},
+
+	// transactions
+	{name: "multi", clientHandler: multi, arity: 1, flags: flagFast, acl: []string{"@transaction"}, group: "transactions", summary: "Starts a transaction."},
+	{name: "exec", clientHandler: exec, arity: 1, acl: []string{"@transaction"}, group: "transactions", summary: "Executes all commands in a transaction."},
+	{name: "discard", clientHandler: discard, arity: 1, flags: flagFast, acl: []string{"@transaction"}, group: "transactions", summary: "Discards a transaction."},
+	{name: "watch", clientHandler: watch, arity: -2, flags: flagFast, firstKey: 1, lastKey: -1, keyStep: 1, acl: []string{"@transaction"}, group: "transactions", summary: "Monitors changes to keys to determine the execution of a transaction."},
+	{name: "unwatch", clientHandler: unwatch, arity: 1, flags: flagFast, acl: []string{"@transaction"}, group: "transactions", summary: "Forgets about watched keys of a transaction."},
+
+	// connection
+	{name: "ping", handler: ping, arity: -1, flags: flagFast, acl: []string{"@connection"}, group: "connection", summary: "Returns the server's liveliness response."},
+	{name: "auth", clientHandler: auth, arity: -2, flags: flagFast | flagNoMulti | flagNoAuth, acl: []string{"@connection"}, group: "connection", summary: "Authenticates the connection."},
+	{name: "quit", arity: -1, flags: flagFast | flagNoAuth, acl: []string{"@connection"}, group: "connection", summary: "Closes the connection."},
+	{name: "hello", clientHandler: hello, arity: -1, flags: flagFast | flagNoMulti | flagNoAuth, acl: []string{"@connection"}, group: "connection", summary: "Handshakes with the server."},
+
+	// server and replication
+	{name: "info", handler: info, arity: -1, acl: []string{"@dangerous"}, group: "server", summary: "Returns information and statistics about the server."},
+	{name: "config", handler: configCommand, arity: -2, flags: flagAdmin | flagNoMulti, acl: []string{"@dangerous"}, group: "server", summary: "Gets or sets configuration parameters."},
+	{name: "bgrewriteaof", handler: bgrewriteaof, arity: 1, flags: flagAdmin | flagNoMulti, acl: []string{"@dangerous"}, group: "server", summary: "Asynchronously rewrites the append-only file to disk."},
+	{name: "save", handler: save, arity: 1, flags: flagAdmin | flagNoMulti, acl: []string{"@dangerous"}, group: "server", summary: "Synchronously saves the database to disk."},
+	{name: "bgsave", handler: bgsave, arity: 1, flags: flagAdmin | flagNoMulti, acl: []string{"@dangerous"}, group: "server", summary: "Asynchronously saves the database to disk."},
+	{name: "lastsave", handler: lastsave, arity: 1, flags: flagFast, acl: []string{"@admin", "@dangerous"}, group: "server", summary: "Returns the Unix timestamp of the last successful save to disk."},
+	{name: "role", handler: role, arity: 1, flags: flagFast, acl: []string{"@admin", "@dangerous"}, group: "server", summary: "Returns the replication role."},
+	{name: "replicaof", handler: replicaof, arity: 3, flags: flagAdmin | flagNoMulti, acl: []string{"@dangerous"}, group: "server", summary: "Configures a server as replica of another, or promotes it to a master."},
+	{name: "psync", arity: -3, flags: flagAdmin | flagNoMulti, acl: []string{"@dangerous"}, group: "server", summary: "An internal command used in replication."},
+	{name: "replconf", clientHandler: replconfCommand, arity: -1, flags: flagAdmin | flagNoMulti, acl: []string{"@dangerous"}, group: "server", summary: "An internal command for configuring the replication stream."},
+	{name: "acl", clientHandler: aclCommand, arity: -2, flags: flagAdmin | flagNoMulti, acl: []string{"@dangerous"}, group: "server", summary: "Manages the users and their permissions."},
+	{name: "monitor", clientHandler: monitor, arity: 1, flags: flagAdmin | flagNoMulti, acl: []string{"@dangerous"}, group: "server", summary: "Listens for all requests received by the server in real-time."},
+	{name: "shutdown", clientHandler: shutdownCommand, arity: -1, flags: flagAdmin | flagNoMulti, acl: []string{"@dangerous"}, group: "server", summary: "Synchronously saves the database to disk and shuts down the server."},
+	{name: "slowlog", handler: slowlogCommand, arity: -2, flags: flagAdmin, acl: []string{"@dangerous"}, group: "server", summary: "Gets, counts or resets the entries of the slow log."},
+	{name: "command", handler: commandCommand, arity: -1, acl: []string{"@connection"}, group: "server", summary: "Returns detailed information about all commands."},
+}
+
+func init() {
+	for _, spec := range commandList {
+		name := strings.ToUpper(spec.name)
+		commandTable[name] = spec
+		if spec.handler != nil {
+			Handlers[name] = spec.handler
+		}
+		if spec.clientHandler != nil {
+			clientHandlers[name] = spec.clientHandler
+		}
+	}
+}
+
+// lookupCommand returns the description of command, an upper case name, or
+// nil when it does not exist.
+func lookupCommand(command string) *commandSpec {
+	return commandTable[command]
+}
+
+// isWriteCommand reports whether command, an upper case name, modifies the
+// keyspace.
+func isWriteCommand(command string) bool {
+	spec := lookupCommand(command)
+	return spec != nil && spec.flags&flagWrite != 0
+}
+
+// checkArity reports whether a call with n words, the name included, has an
+// acceptable number of arguments.
+func (spec *commandSpec) checkArity(n int) bool {
+	if spec.arity < 0 {
+		return n >= -spec.arity
+	}
+	return n == spec.arity
+}
+
+func (spec *commandSpec) arityError() Value {
+	return Value{typ: "error", str: "ERR wrong number of arguments for '" + spec.name + "' command"}
+}
+
+// unknownCommand is the reply to a command that does not exist.
+func unknownCommand(value Value) Value {
+	var b strings.Builder
+	for _, arg := range value.array[1:] {
+		b.WriteString("'" + arg.bulk + "' ")
+	}
+
+	return Value{typ: "error", str: "ERR unknown command '" + value.array[0].bulk + "', with args beginning with: " + b.String()}
+}
+
+// keys returns the keys among args, the arguments after the command name.
+func (spec *commandSpec) keys(args []Value) []string {
+	if spec.firstKey == 0 {
+		return nil
+	}
+
+	last := spec.lastKey
+	if last < 0 {
+		last += len(args) + 1
+	}
+
+	keys := []string{}
+	for i := spec.firstKey; i <= last && i <= len(args); i += spec.keyStep {
+		keys = append(keys, args[i-1].bulk)
+	}
+
+	return keys
+}
+
+// categories returns the ACL categories of the command, those implied by its
+// flags followed by the declared ones.
+func (spec *commandSpec) categories() []string {
+	categories := []string{}
+	if spec.flags&flagWrite != 0 {
+		categories = append(categories, "@write")
+	}
+	if spec.flags&flagReadonly != 0 {
+		categories = append(categories, "@read")
+	}
+	if spec.flags&flagAdmin != 0 {
+		categories = append(categories, "@admin", "@dangerous")
+	}
+	if spec.flags&flagPubsub != 0 {
+		categories = append(categories, "@pubsub")
+	}
+	if spec.flags&flagBlocking != 0 {
+		categories = append(categories, "@blocking")
+	}
+	if spec.flags&flagFast != 0 {
+		categories = append(categories, "@fast")
+	} else {
+		categories = append(categories, "@slow")
+	}
+
+	for _, category := range spec.acl {
+		if !containsString(categories, category) {
+			categories = append(categories, category)
+		}
+	}
+
+	return categories
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// info is the description of the command in a COMMAND reply.
+func (spec *commandSpec) info() Value {
+	flags := []Value{}
+	for _, f := range commandFlagNames {
+		if spec.flags&f.flag != 0 {
+			flags = append(flags, Value{typ: "string", str: f.name})
+		}
+	}
+
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: spec.name},
+		{typ: "integer", num: spec.arity},
+		{typ: "set", array: flags},
+		{typ: "integer", num: spec.firstKey},
+		{typ: "integer", num: spec.lastKey},
+		{typ: "integer", num: spec.keyStep},
+		{typ: "set", array: bulks(spec.categories()...)},
+		{typ: "array", array: []Value{}},
+		{typ: "array", array: []Value{}},
+		{typ: "array", array: []Value{}},
+	}}
+}
+
+// docs is the description of the command in a COMMAND DOCS reply.
+func (spec *commandSpec) docs() Value {
+	return Value{typ: "map", array: []Value{
+		{typ: "bulk", bulk: "summary"}, {typ: "bulk", bulk: spec.summary},
+		{typ: "bulk", bulk: "group"}, {typ: "bulk", bulk: spec.group},
+		{typ: "bulk", bulk: "arity"}, {typ: "integer", num: spec.arity},
+	}}
+}
+
+// sortedCommands returns every command, sorted by name.
+func sortedCommands() []*commandSpec {
+	specs := []*commandSpec{}
+	for _, spec := range commandTable {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].name < specs[j].name })
+
+	return specs
+}
+
+// commandCommand implements COMMAND, COMMAND COUNT, COMMAND INFO and
+// COMMAND DOCS.
+func commandCommand(args []Value) Value {
+	if len(args) == 0 {
+		infos := []Value{}
+		for _, spec := range sortedCommands() {
+			infos = append(infos, spec.info())
+		}
+		return Value{typ: "array", array: infos}
+	}
+
+	subcommand := strings.ToUpper(args[0].bulk)
+	args = args[1:]
+
+	switch {
+	case subcommand == "COUNT" && len(args) == 0:
+		return Value{typ: "integer", num: len(commandTable)}
+	case subcommand == "INFO":
+		if len(args) == 0 {
+			return commandCommand(nil)
+		}
+		infos := []Value{}
+		for _, arg := range args {
+			if spec := lookupCommand(strings.ToUpper(arg.bulk)); spec != nil {
+				infos = append(infos, spec.info())
+			} else {
+				infos = append(infos, Value{typ: "nullarray"})
+			}
+		}
+		return Value{typ: "array", array: infos}
+	case subcommand == "DOCS":
+		specs := []*commandSpec{}
+		if len(args) == 0 {
+			specs = sortedCommands()
+		}
+		for _, arg := range args {
+			if spec := lookupCommand(strings.ToUpper(arg.bulk)); spec != nil {
+				specs = append(specs, spec)
+			}
+		}
+		docs := []Value{}
+		for _, spec := range specs {
+			docs = append(docs, Value{typ: "bulk", bulk: spec.name}, spec.docs())
+		}
+		return Value{typ: "map", array: docs}
+	}
+
+	return Value{typ: "error", str: "ERR unknown subcommand '" + strings.ToLower(subcommand) + "'. Try COMMAND HELP."}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommandTable(t *testing.T) {
+	for name, spec := range commandTable {
+		if name != strings.ToUpper(spec.name) {
+			t.Errorf("%s is registered as %s", spec.name, name)
+		}
+		if spec.arity == 0 {
+			t.Errorf("%s has no arity", name)
+		}
+		if spec.flags&flagWrite != 0 && spec.flags&flagReadonly != 0 {
+			t.Errorf("%s is both write and readonly", name)
+		}
+		if spec.handler != nil && spec.clientHandler != nil {
+			t.Errorf("%s has two handlers", name)
+		}
+	}
+
+	// the aliases used to be missing from the write command list, so they
+	// were neither persisted nor replicated
+	for _, command := range []string{"SET", "DEL", "CHSET", "CHDEL", "PEXPIREAT"} {
+		if !isWriteCommand(command) {
+			t.Errorf("%s is not a write command", command)
+		}
+	}
+	for _, command := range []string{"GET", "CHGET", "PING", "INFO", "NOSUCHCOMMAND"} {
+		if isWriteCommand(command) {
+			t.Errorf("%s is a write command", command)
+		}
+	}
+}
+
+func TestCommandKeys(t *testing.T) {
+	tests := []struct {
+		command string
+		args    []string
+		want    []string
+	}{
+		{"GET", []string{"k"}, []string{"k"}},
+		{"SET", []string{"k", "v", "EX", "10"}, []string{"k"}},
+		{"DEL", []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{"PING", []string{}, nil},
+	}
+
+	for _, tt := range tests {
+		got := lookupCommand(tt.command).keys(bulks(tt.args...))
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("keys of %s %v = %v, want %v", tt.command, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestCommandArity(t *testing.T) {
+	resetKeyspace()
+	port := startTestServer(t)
+	c := dialTestServer(t, port)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"GET", "a", "b"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"SET", "k"}, "-ERR wrong number of arguments for 'set' command"},
+		{[]string{"DEL"}, "-ERR wrong number of arguments for 'del' command"},
+		{[]string{"nosuch", "a", "b"}, "-ERR unknown command 'nosuch', with args beginning with: 'a' 'b' "},
+		{[]string{"SET", "k", "v"}, "+OK"},
+	}
+
+	for _, tt := range tests {
+		if got := c.do(t, tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestCommandCommand(t *testing.T) {
+	got := commandCommand(bulks("COUNT"))
+	if got.typ != "integer" || got.num != len(commandTable) {
+		t.Errorf("COMMAND COUNT = %+v, want %d", got, len(commandTable))
+	}
+
+	got = commandCommand(nil)
+	if len(got.array) != len(commandTable) {
+		t.Errorf("COMMAND returned %d commands, want %d", len(got.array), len(commandTable))
+	}
+
+	got = commandCommand(bulks("INFO", "set", "nosuch"))
+	if len(got.array) != 2 || got.array[1].typ != "nullarray" {
+		t.Fatalf("COMMAND INFO set nosuch = %+v", got)
+	}
+	set := got.array[0].array
+	if set[0].bulk != "set" || set[1].num != -3 || set[3].num != 1 || set[4].num != 1 || set[5].num != 1 {
+		t.Errorf("COMMAND INFO set = %+v", set)
+	}
+	if flags := set[2].array; len(flags) == 0 || flags[0].str != "write" {
+		t.Errorf("SET flags = %+v, want write first", flags)
+	}
+	categories := []string{}
+	for _, category := range set[6].array {
+		categories = append(categories, category.bulk)
+	}
+	if !containsString(categories, "@write") || !containsString(categories, "@string") {
+		t.Errorf("SET categories = %v", categories)
+	}
+
+	got = commandCommand(bulks("DOCS", "get"))
+	if got.typ != "map" || len(got.array) != 2 || got.array[0].bulk != "get" {
+		t.Fatalf("COMMAND DOCS get = %+v", got)
+	}
+	if docs := got.array[1].array; docs[0].bulk != "summary" || !strings.HasPrefix(docs[1].bulk, "Returns") {
+		t.Errorf("GET docs = %+v", docs)
+	}
+}
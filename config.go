@@ -0,0 +1,670 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configParam describes a parameter of the config file, the command line and
+// CONFIG GET and SET, with the help text of its flag. Parameters with
+// startupOnly set cannot be changed once the server runs. Those of the TLS
+// settings have tls instead of set: it changes a copy of the settings, which
+// are loaded once every parameter set together is applied, so that a
+// certificate and its key can be replaced at once.
+type configParam struct {
+	help        string
+	get         func() string
+	set         func(value string) error
+	tls         func(settings *tlsSettings, value string) error
+	startupOnly bool
+
+	// boolean parameters can be given as a flag without a value
+	boolean bool
+
+	// lines splits the value of a parameter that a config file can repeat
+	// into one value per line. Each line adds to the value set by those
+	// before it, unless it is empty, which clears the value.
+	lines func(value string) []string
+}
+
+var configParams = map[string]configParam{
+	"aclfile": {
+		help: "file the ACL users are loaded from and saved to",
+		get:  aclFilePath,
+		set: func(value string) error {
+			setACLFile(value)
+			return nil
+		},
+		startupOnly: true,
+	},
+	"appendfilename": {
+		help:        "path of the append only file",
+		get:         func() string { return appendFilename },
+		set:         setPath(&appendFilename),
+		startupOnly: true,
+	},
+	"appendfsync": {
+		help: "AOF fsync policy: always, everysec or no",
+		get: func() string {
+			if activeAof == nil {
+				return fsyncEverysec
+			}
+			return activeAof.FsyncPolicy()
+		},
+		set: func(value string) error {
+			if activeAof == nil {
+				return errAofDisabled
+			}
+			return activeAof.SetFsyncPolicy(strings.ToLower(value))
+		},
+	},
+	"dbfilename": {
+		help:        "path of the snapshot file",
+		get:         func() string { return dbFilename },
+		set:         setPath(&dbFilename),
+		startupOnly: true,
+	},
+	"http-port": {
+		help:        "port of the HTTP API",
+		get:         func() string { return strconv.Itoa(httpPort) },
+		set:         setPort(&httpPort),
+		startupOnly: true,
+	},
+	"masterauth": {
+		help: "password sent to the leader when replicating",
+		get:  masterauth,
+		set: func(value string) error {
+			setMasterauth(value)
+			return nil
+		},
+	},
+	"port": {
+		help:        "port of the RESP server",
+		get:         func() string { return strconv.Itoa(serverPort) },
+		set:         setPort(&serverPort),
+		startupOnly: true,
+	},
+	"requirepass": {
+		help: "password clients must send with AUTH, \"\" disables authentication",
+		get:  requirepass,
+		set: func(value string) error {
+			setRequirepass(value)
+			return nil
+		},
+	},
+	"maxmemory": {
+		help: "memory limit of the keyspace, such as 100mb, 0 for none",
+		get:  func() string { return strconv.FormatInt(currentMaxmemory().maxmemory, 10) },
+		set: func(value string) error {
+			bytes, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			setMaxmemory(bytes)
+			return nil
+		},
+	},
+	"maxmemory-policy": {
+		help: "what to do once maxmemory is reached: noeviction, allkeys-lru, allkeys-lfu, allkeys-random, volatile-lru, volatile-lfu, volatile-random or volatile-ttl",
+		get:  func() string { return currentMaxmemory().policy },
+		set:  setMaxmemoryPolicy,
+	},
+	"maxmemory-samples": {
+		help: "number of keys sampled to pick the one to evict",
+		get:  func() string { return strconv.Itoa(currentMaxmemory().samples) },
+		set: func(value string) error {
+			samples, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			return setMaxmemorySamples(samples)
+		},
+	},
+	"slowlog-log-slower-than": {
+		help: "microseconds a command must run for to be logged in the slow log, -1 disables it",
+		get: func() string {
+			usec, _ := slowlog.settings()
+			return strconv.FormatInt(usec, 10)
+		},
+		set: func(value string) error {
+			usec, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return err
+			}
+			slowlog.setSlowerThan(usec)
+			return nil
+		},
+	},
+	"slowlog-max-len": {
+		help: "number of entries kept in the slow log",
+		get: func() string {
+			_, maxLen := slowlog.settings()
+			return strconv.Itoa(maxLen)
+		},
+		set: func(value string) error {
+			maxLen, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			return slowlog.setMaxLen(maxLen)
+		},
+	},
+	"repl-backlog-size": {
+		help: "bytes of writes kept for followers that reconnect",
+		get: func() string {
+			return strconv.Itoa(repl.backlogSize())
+		},
+		set: func(value string) error {
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 16*1024 {
+				return errors.New("backlog size must be at least 16384 bytes")
+			}
+			repl.setBacklogSize(size)
+			return nil
+		},
+	},
+	"save": {
+		help: `snapshot rules as "seconds changes" pairs, "" disables them`,
+		get: func() string {
+			if activeSnapshotter == nil {
+				return ""
+			}
+			return activeSnapshotter.SaveRules()
+		},
+		set: func(value string) error {
+			if activeSnapshotter == nil {
+				return errSnapshotsDisabled
+			}
+			return activeSnapshotter.SetSaveRules(value)
+		},
+		// one rule per line, as Redis writes them
+		lines: func(value string) []string {
+			fields := strings.Fields(value)
+			lines := []string{}
+			for i := 0; i+1 < len(fields); i += 2 {
+				lines = append(lines, fields[i]+" "+fields[i+1])
+			}
+			return lines
+		},
+	},
+	"tls-auth-clients": {
+		help: "verify TLS client certificates: yes, no or optional",
+		get:  func() string { return currentTLSSettings().authClients },
+		tls: func(settings *tlsSettings, value string) error {
+			settings.authClients = strings.ToLower(value)
+			return nil
+		},
+	},
+	"tls-ca-cert-file": {
+		help: "CA certificates that verify clients and leaders",
+		get:  func() string { return currentTLSSettings().caCertFile },
+		tls: func(settings *tlsSettings, value string) error {
+			settings.caCertFile = value
+			return nil
+		},
+	},
+	"tls-cert-file": {
+		help: "certificate presented by the TLS listeners and replication links",
+		get:  func() string { return currentTLSSettings().certFile },
+		tls: func(settings *tlsSettings, value string) error {
+			settings.certFile = value
+			return nil
+		},
+	},
+	"tls-http-port": {
+		help:        "port of the HTTPS API listener, 0 disables it",
+		get:         func() string { return strconv.Itoa(tlsHTTPPort) },
+		set:         setPort(&tlsHTTPPort),
+		startupOnly: true,
+	},
+	"tls-key-file": {
+		help: "private key of tls-cert-file",
+		get:  func() string { return currentTLSSettings().keyFile },
+		tls: func(settings *tlsSettings, value string) error {
+			settings.keyFile = value
+			return nil
+		},
+	},
+	"tls-port": {
+		help:        "port of the TLS RESP listener, 0 disables it",
+		get:         func() string { return strconv.Itoa(tlsPort) },
+		set:         setPort(&tlsPort),
+		startupOnly: true,
+	},
+	"tls-replication": {
+		help: "connect to the leader over TLS",
+		get:  func() string { return yesNo(currentTLSSettings().replication) },
+		tls: func(settings *tlsSettings, value string) error {
+			enabled, err := parseYesNo(value)
+			settings.replication = enabled
+			return err
+		},
+		boolean: true,
+	},
+}
+
+// yesNo formats a boolean parameter.
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, errors.New("argument must be 'yes' or 'no'")
+}
+
+// setPath returns the setter of a parameter holding the path of a file.
+func setPath(path *string) func(value string) error {
+	return func(value string) error {
+		if value == "" {
+			return errors.New("path must not be empty")
+		}
+		*path = value
+		return nil
+	}
+}
+
+// setPort returns the setter of a parameter holding a TCP port.
+func setPort(port *int) func(value string) error {
+	return func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 65535 {
+			return errors.New("port must be between 0 and 65535")
+		}
+		*port = n
+		return nil
+	}
+}
+
+// configDefaults are the values of the parameters before the config file
+// and the command line are applied. CONFIG REWRITE only adds the parameters
+// that differ from them to the file.
+var configDefaults = map[string]string{}
+
+func init() {
+	for name, param := range configParams {
+		configDefaults[name] = param.get()
+	}
+	// the save rules are only readable once main creates the snapshotter
+	configDefaults["save"] = defaultSaveRules
+}
+
+// configFile is the path of the config file the server was started with, ""
+// if there is none.
+var configFile string
+
+var errImmutableConfig = errors.New("can't set immutable config")
+
+// configError reports a parameter that could not be set. err is nil if the
+// parameter does not exist.
+type configError struct {
+	name  string
+	value string
+	err   error
+}
+
+func (e *configError) Error() string {
+	if e.err == nil {
+		return "unknown parameter '" + e.name + "'"
+	}
+	return "invalid argument '" + e.value + "' for '" + e.name + "': " + e.err.Error()
+}
+
+func (e *configError) Unwrap() error {
+	return e.err
+}
+
+// applyConfig sets the parameters of pairs, alternating lowercase names and
+// values. Parameters that can only be set at startup are refused unless
+// startup is true, and nothing is set if one is refused or does not exist.
+// The TLS settings are loaded last, once with every TLS parameter of pairs.
+// If a value is invalid, the parameters set before it get their previous
+// value back, so that either every parameter is set or none is.
+func applyConfig(pairs []string, startup bool) error {
+	for i := 0; i < len(pairs); i += 2 {
+		param, ok := configParams[pairs[i]]
+		if !ok {
+			return &configError{name: pairs[i], value: pairs[i+1]}
+		}
+		if param.startupOnly && !startup {
+			return &configError{name: pairs[i], value: pairs[i+1], err: errImmutableConfig}
+		}
+	}
+
+	settings := currentTLSSettings()
+	var tlsErr *configError
+	var previous []string
+	for i := 0; i < len(pairs); i += 2 {
+		name, value := pairs[i], pairs[i+1]
+		param := configParams[name]
+
+		var err error
+		if param.tls != nil {
+			err = param.tls(&settings, value)
+			tlsErr = &configError{name: name, value: value}
+		} else {
+			old := param.get()
+			if err = param.set(value); err == nil {
+				previous = append(previous, name, old)
+			}
+		}
+		if err != nil {
+			rollbackConfig(previous)
+			return &configError{name: name, value: value, err: err}
+		}
+	}
+
+	if tlsErr != nil {
+		if tlsErr.err = setTLSSettings(settings); tlsErr.err != nil {
+			rollbackConfig(previous)
+			return tlsErr
+		}
+	}
+	return nil
+}
+
+// rollbackConfig sets back the parameters of previous, pairs of names and
+// the values they had before applyConfig changed them, latest first.
+func rollbackConfig(previous []string) {
+	for i := len(previous) - 2; i >= 0; i -= 2 {
+		if err := configParams[previous[i]].set(previous[i+1]); err != nil {
+			log.Printf("Error restoring %s to %q: %v", previous[i], previous[i+1], err)
+		}
+	}
+}
+
+// splitConfig separates the parameters of pairs that can only be set at
+// startup from the others.
+func splitConfig(pairs []string) (startup, others []string) {
+	for i := 0; i < len(pairs); i += 2 {
+		if configParams[pairs[i]].startupOnly {
+			startup = append(startup, pairs[i], pairs[i+1])
+		} else {
+			others = append(others, pairs[i], pairs[i+1])
+		}
+	}
+	return startup, others
+}
+
+// configFlag is the command-line flag of a parameter, which appends its name
+// and value to pairs so that they are applied after the config file.
+type configFlag struct {
+	name  string
+	pairs *[]string
+}
+
+func (f configFlag) String() string {
+	return configDefaults[f.name]
+}
+
+func (f configFlag) Set(value string) error {
+	if b, err := strconv.ParseBool(value); err == nil && f.IsBoolFlag() {
+		value = yesNo(b)
+	}
+	*f.pairs = append(*f.pairs, f.name, value)
+	return nil
+}
+
+func (f configFlag) IsBoolFlag() bool {
+	return configParams[f.name].boolean
+}
+
+// configFlags defines a flag on fs for every parameter, whose values are
+// appended to pairs in the order they are given.
+func configFlags(fs *flag.FlagSet, pairs *[]string) {
+	for _, name := range sortedConfigParams() {
+		fs.Var(configFlag{name: name, pairs: pairs}, name, configParams[name].help)
+	}
+}
+
+func sortedConfigParams() []string {
+	names := make([]string, 0, len(configParams))
+	for name := range configParams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseConfigLine returns the lowercase name of the parameter a line of a
+// config file sets and its value, the rest of the line, unquoted if it is a
+// double-quoted string. The name is "" for blank lines and comments.
+func parseConfigLine(line string) (name, value string, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", nil
+	}
+
+	name, value = line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name, value = line[:i], strings.TrimSpace(line[i:])
+	}
+	if strings.HasPrefix(value, `"`) {
+		if value, err = strconv.Unquote(value); err != nil {
+			return "", "", errors.New("unbalanced quotes")
+		}
+	}
+
+	return strings.ToLower(name), value, nil
+}
+
+// formatConfigLine returns the line of a config file setting name to value,
+// quoted when it would not read back the same otherwise.
+func formatConfigLine(name, value string) string {
+	if value == "" || value != strings.TrimSpace(value) || strings.HasPrefix(value, `"`) || strings.ContainsAny(value, "\r\n") {
+		value = strconv.Quote(value)
+	}
+	return name + " " + value
+}
+
+// formatConfigLines returns the lines of a config file setting name to
+// value, one per part of the value for a parameter that can be repeated.
+func formatConfigLines(name, value string) []string {
+	param := configParams[name]
+	if param.lines == nil || value == "" {
+		return []string{formatConfigLine(name, value)}
+	}
+
+	lines := []string{}
+	for _, part := range param.lines(value) {
+		lines = append(lines, formatConfigLine(name, part))
+	}
+	return lines
+}
+
+// readConfigFile returns the parameters set by the config file at path, as
+// alternating names and values. The lines of a parameter that can be
+// repeated, such as save, are joined into one value.
+func readConfigFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pairs := []string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		name, value, err := parseConfigLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if name == "" {
+			continue
+		}
+		param, ok := configParams[name]
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown parameter '%s'", path, line, name)
+		}
+		if param.lines != nil && value != "" {
+			if i := lastConfigPair(pairs, name); i >= 0 && pairs[i+1] != "" {
+				pairs[i+1] += " " + value
+				continue
+			}
+		}
+		pairs = append(pairs, name, value)
+	}
+
+	return pairs, scanner.Err()
+}
+
+// lastConfigPair returns the index of the last pair of pairs setting name, or
+// -1 if there is none.
+func lastConfigPair(pairs []string, name string) int {
+	for i := len(pairs) - 2; i >= 0; i -= 2 {
+		if pairs[i] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// configRewriteMarker precedes the parameters CONFIG REWRITE adds to the
+// config file.
+const configRewriteMarker = "# Generated by CONFIG REWRITE"
+
+// rewriteConfigFile writes the current value of the parameters to the config
+// file at path, replacing it atomically. The lines setting a parameter are
+// updated in place and those repeating one are dropped, while comments and
+// blank lines are kept. A parameter that can be repeated gets one line per
+// part of its value where it first appears. Parameters that differ from their default and are
+// not in the file yet are added at the end.
+func rewriteConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	lines := []string{}
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	written := map[string]bool{}
+	rewritten := []string{}
+	for _, line := range lines {
+		name, _, err := parseConfigLine(line)
+		if _, ok := configParams[name]; err != nil || !ok {
+			rewritten = append(rewritten, line)
+			continue
+		}
+		if !written[name] {
+			rewritten = append(rewritten, formatConfigLines(name, configParams[name].get())...)
+			written[name] = true
+		}
+	}
+
+	for _, name := range sortedConfigParams() {
+		value := configParams[name].get()
+		if written[name] || value == configDefaults[name] {
+			continue
+		}
+		if !slices.Contains(rewritten, configRewriteMarker) {
+			if len(rewritten) > 0 {
+				rewritten = append(rewritten, "")
+			}
+			rewritten = append(rewritten, configRewriteMarker)
+		}
+		rewritten = append(rewritten, formatConfigLines(name, value)...)
+	}
+
+	// the file holds requirepass and masterauth, so only the owner may read
+	// it, and a leftover temporary file would keep its own permissions
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := os.WriteFile(tmp, []byte(strings.Join(rewritten, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func configCommand(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'config' command"}
+	}
+
+	subcommand := strings.ToUpper(args[0].bulk)
+	args = args[1:]
+
+	switch {
+	case subcommand == "GET" && len(args) >= 1:
+		return configGet(args)
+	case subcommand == "SET" && len(args) >= 2 && len(args)%2 == 0:
+		return configSet(args)
+	case subcommand == "REWRITE" && len(args) == 0:
+		return configRewrite()
+	case subcommand == "RESETSTAT" && len(args) == 0:
+		resetStats()
+		return Value{typ: "string", str: "OK"}
+	}
+
+	return Value{typ: "error", str: "ERR Unknown subcommand or wrong number of arguments for '" + strings.ToLower(subcommand) + "'"}
+}
+
+// configGet replies with the name and value of every parameter matching
+// one of the patterns.
+func configGet(patterns []Value) Value {
+	result := []Value{}
+	for _, name := range sortedConfigParams() {
+		for _, pattern := range patterns {
+			if globMatch(strings.ToLower(pattern.bulk), name) {
+				result = append(result,
+					Value{typ: "bulk", bulk: name},
+					Value{typ: "bulk", bulk: configParams[name].get()},
+				)
+				break
+			}
+		}
+	}
+
+	return Value{typ: "array", array: result}
+}
+
+func configSet(args []Value) Value {
+	pairs := make([]string, 0, len(args))
+	for i := 0; i < len(args); i += 2 {
+		pairs = append(pairs, strings.ToLower(args[i].bulk), args[i+1].bulk)
+	}
+
+	err := applyConfig(pairs, false)
+	if err == nil {
+		return Value{typ: "string", str: "OK"}
+	}
+
+	var configErr *configError
+	errors.As(err, &configErr)
+	switch {
+	case configErr.err == nil:
+		return Value{typ: "error", str: "ERR Unknown option or number of arguments for CONFIG SET - '" + configErr.name + "'"}
+	case errors.Is(configErr.err, errImmutableConfig):
+		return Value{typ: "error", str: "ERR CONFIG SET failed (possibly related to argument '" + configErr.name + "') - " + configErr.err.Error()}
+	default:
+		return Value{typ: "error", str: "ERR Invalid argument '" + configErr.value + "' for CONFIG SET '" + configErr.name + "' - " + configErr.err.Error()}
+	}
+}
+
+func configRewrite() Value {
+	if configFile == "" {
+		return Value{typ: "error", str: "ERR The server is running without a config file"}
+	}
+	if err := rewriteConfigFile(configFile); err != nil {
+		return Value{typ: "error", str: "ERR Rewriting config file: " + err.Error()}
+	}
+	return Value{typ: "string", str: "OK"}
+}
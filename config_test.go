@@ -0,0 +1,256 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigAppendfsync(t *testing.T) {
+	activeAof = newTestAof(t)
+	defer func() { activeAof = nil }()
+
+	got := configCommand(bulks("GET", "appendfsync"))
+	if len(got.array) != 2 || got.array[1].bulk != fsyncEverysec {
+		t.Fatalf("CONFIG GET appendfsync = %+v, want everysec", got)
+	}
+
+	if got := configCommand(bulks("SET", "appendfsync", "always")); got.str != "OK" {
+		t.Fatalf("CONFIG SET appendfsync always = %+v, want OK", got)
+	}
+	if got := activeAof.FsyncPolicy(); got != fsyncAlways {
+		t.Errorf("policy after CONFIG SET = %q, want always", got)
+	}
+
+	got = configCommand(bulks("GET", "appendfs*"))
+	if len(got.array) != 2 || got.array[1].bulk != fsyncAlways {
+		t.Errorf("CONFIG GET appendfs* = %+v, want always", got)
+	}
+
+	if got := configCommand(bulks("SET", "appendfsync", "sometimes")); got.typ != "error" {
+		t.Errorf("CONFIG SET appendfsync sometimes = %+v, want error", got)
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	tests := [][]string{
+		{},
+		{"GET"},
+		{"SET", "appendfsync"},
+		{"SET", "nosuchparam", "1"},
+		{"SET", "port", "7000"},
+		{"REWRITE", "now"},
+		{"RESETSTAT", "all"},
+		{"BOGUS"},
+	}
+
+	for _, args := range tests {
+		if got := configCommand(bulks(args...)); got.typ != "error" {
+			t.Errorf("CONFIG %v = %+v, want error", args, got)
+		}
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tinykv.conf")
+	writeFile(t, path, []byte("# comment\n\nPort 7000\n  save \"\"\nrequirepass \"two words\"\nmaxmemory 100mb\n"))
+
+	pairs, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"port", "7000", "save", "", "requirepass", "two words", "maxmemory", "100mb"}
+	if strings.Join(pairs, "|") != strings.Join(want, "|") {
+		t.Errorf("parameters = %q, want %q", pairs, want)
+	}
+
+	startup, others := splitConfig(pairs)
+	if strings.Join(startup, "|") != "port|7000" || len(others) != 6 {
+		t.Errorf("startup parameters = %q, others = %q", startup, others)
+	}
+
+	writeFile(t, path, []byte("port 7000\nnosuchparam 1\n"))
+	if _, err := readConfigFile(path); err == nil || !strings.Contains(err.Error(), ":2: unknown parameter 'nosuchparam'") {
+		t.Errorf("unknown parameter error = %v", err)
+	}
+	writeFile(t, path, []byte("requirepass \"open\n"))
+	if _, err := readConfigFile(path); err == nil {
+		t.Error("unbalanced quotes were accepted")
+	}
+}
+
+// Each save line of a config file adds a rule, as in a Redis config file,
+// and CONFIG REWRITE writes them back one per line.
+func TestConfigFileSaveLines(t *testing.T) {
+	activeSnapshotter = newTestSnapshotter(t, nil)
+	defer func() { activeSnapshotter = nil }()
+	defer func(path string) { configFile = path }(configFile)
+
+	configFile = filepath.Join(t.TempDir(), "tinykv.conf")
+	writeFile(t, configFile, []byte("save 900 1\nsave 300 10\n"))
+
+	pairs, err := readConfigFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(pairs, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := activeSnapshotter.SaveRules(); got != "900 1 300 10" {
+		t.Errorf("save rules = %q, want both lines", got)
+	}
+
+	configCommand(bulks("SET", "save", "3600 1 300 100 60 10000"))
+	if got := configCommand(bulks("REWRITE")); got.str != "OK" {
+		t.Fatalf("CONFIG REWRITE = %+v", got)
+	}
+	data, _ := os.ReadFile(configFile)
+	if want := "save 3600 1\nsave 300 100\nsave 60 10000\n"; string(data) != want {
+		t.Errorf("rewritten config =\n%s\nwant\n%s", data, want)
+	}
+
+	// an empty save clears the rules of the lines before it
+	writeFile(t, configFile, []byte("save 900 1\nsave \"\"\nsave 60 5\nsave 30 50\n"))
+	pairs, _ = readConfigFile(configFile)
+	if err := applyConfig(pairs, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := activeSnapshotter.SaveRules(); got != "60 5 30 50" {
+		t.Errorf("save rules = %q, want 60 5 30 50", got)
+	}
+
+	configCommand(bulks("SET", "save", ""))
+	configCommand(bulks("REWRITE"))
+	if data, _ := os.ReadFile(configFile); string(data) != "save \"\"\n" {
+		t.Errorf("config rewritten without save rules =\n%s", data)
+	}
+}
+
+func TestConfigStartup(t *testing.T) {
+	defer func(port int) { httpPort = port }(httpPort)
+
+	if err := applyConfig([]string{"http-port", "9000"}, true); err != nil || httpPort != 9000 {
+		t.Fatalf("http-port at startup = %d, %v", httpPort, err)
+	}
+	if err := applyConfig([]string{"http-port", "70000"}, true); err == nil {
+		t.Error("http-port 70000 was accepted")
+	}
+
+	got := configCommand(bulks("SET", "http-port", "9001"))
+	if !strings.Contains(got.str, "can't set immutable config") || httpPort != 9000 {
+		t.Errorf("CONFIG SET http-port = %+v", got)
+	}
+}
+
+func TestConfigRewrite(t *testing.T) {
+	resetSlowlog(t, 10000, 128)
+	activeSnapshotter = newTestSnapshotter(t, nil)
+	defer func() { activeSnapshotter = nil }()
+	defer func(path string) { configFile = path }(configFile)
+
+	configFile = ""
+	if got := configCommand(bulks("REWRITE")); got.typ != "error" {
+		t.Errorf("CONFIG REWRITE without a config file = %+v", got)
+	}
+
+	configFile = filepath.Join(t.TempDir(), "tinykv.conf")
+	writeFile(t, configFile, []byte("# slow log\nslowlog-max-len 64\n\n# again\nslowlog-max-len 32\nunknown line\n"))
+
+	if got := configCommand(bulks("SET", "slowlog-max-len", "10", "slowlog-log-slower-than", "5")); got.str != "OK" {
+		t.Fatalf("CONFIG SET = %+v", got)
+	}
+	if got := configCommand(bulks("REWRITE")); got.str != "OK" {
+		t.Fatalf("CONFIG REWRITE = %+v", got)
+	}
+
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# slow log\nslowlog-max-len 10\n\n# again\nunknown line\n\n" + configRewriteMarker + "\nslowlog-log-slower-than 5\n"
+	if string(data) != want {
+		t.Errorf("rewritten config =\n%s\nwant\n%s", data, want)
+	}
+	if info, err := os.Stat(configFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("rewritten config mode = %v, %v, want 0600 as it may hold passwords", info.Mode().Perm(), err)
+	}
+
+	// a second rewrite updates the generated lines in place
+	configCommand(bulks("SET", "slowlog-log-slower-than", "7"))
+	configCommand(bulks("REWRITE"))
+	data, _ = os.ReadFile(configFile)
+	if want := strings.Replace(want, "than 5", "than 7", 1); string(data) != want {
+		t.Errorf("config rewritten twice =\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestConfigSetIsAtomic(t *testing.T) {
+	resetSlowlog(t, 10000, 128)
+	t.Cleanup(func() { setMaxmemory(0) })
+
+	got := configCommand(bulks("SET", "maxmemory", "1mb", "slowlog-log-slower-than", "5", "slowlog-max-len", "bad"))
+	if got.typ != "error" {
+		t.Fatalf("CONFIG SET with an invalid value = %+v, want error", got)
+	}
+	if max := currentMaxmemory().maxmemory; max != 0 {
+		t.Errorf("maxmemory = %d after a failed CONFIG SET, want 0", max)
+	}
+	if usec, maxLen := slowlog.settings(); usec != 10000 || maxLen != 128 {
+		t.Errorf("slow log settings = %d, %d after a failed CONFIG SET, want 10000, 128", usec, maxLen)
+	}
+}
+
+func TestFormatConfigLine(t *testing.T) {
+	for _, value := range []string{"", "3600 1 300 100", " padded", `"quoted"`, "two\nlines", "yes"} {
+		name, got, err := parseConfigLine(formatConfigLine("save", value))
+		if err != nil || name != "save" || got != value {
+			t.Errorf("%q read back as %s %q, %v", value, name, got, err)
+		}
+	}
+}
+
+func TestConfigSetTLS(t *testing.T) {
+	ca, settings := setupTLS(t, tlsAuthClientsNo)
+
+	dir := t.TempDir()
+	cert, key := ca.issue(t, 7)
+	certFile, keyFile := filepath.Join(dir, "new.crt"), filepath.Join(dir, "new.key")
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+
+	// the new certificate does not match the current key
+	if got := configCommand(bulks("SET", "tls-cert-file", certFile)); got.typ != "error" {
+		t.Errorf("CONFIG SET tls-cert-file alone = %+v, want error", got)
+	}
+	if got := currentTLSSettings().certFile; got != settings.certFile {
+		t.Fatalf("certificate after a failed CONFIG SET = %s", got)
+	}
+
+	if got := configCommand(bulks("SET", "tls-cert-file", certFile, "tls-key-file", keyFile)); got.str != "OK" {
+		t.Fatalf("CONFIG SET tls-cert-file tls-key-file = %+v", got)
+	}
+	if got := currentTLSSettings(); got.certFile != certFile || got.keyFile != keyFile {
+		t.Errorf("settings after CONFIG SET = %+v", got)
+	}
+}
+
+func TestConfigResetstat(t *testing.T) {
+	resetKeyspace()
+	port := startTestServer(t)
+	c := dialTestServer(t, port)
+
+	c.do(t, "GET", "missing")
+	c.do(t, "INCR")
+	if got := c.do(t, "CONFIG", "RESETSTAT"); got != "+OK" {
+		t.Fatalf("CONFIG RESETSTAT = %q", got)
+	}
+
+	stats := &lookupCommand("GET").stats
+	if keyspaceMisses.Load() != 0 || stats.latency.snapshot().count != 0 || lookupCommand("INCR").stats.rejected.Load() != 0 {
+		t.Errorf("statistics after CONFIG RESETSTAT: misses=%d get calls=%d", keyspaceMisses.Load(), stats.latency.snapshot().count)
+	}
+	if got := info(bulks("commandstats")).bulk; strings.Contains(got, "cmdstat_get:") {
+		t.Errorf("INFO commandstats after CONFIG RESETSTAT = %q", got)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// expires maps a key to its absolute deadline in unix milliseconds. A key
+// without an entry lives forever. volatileIndex indexes the same keys, for
+// the volatile eviction policies to sample them. Both are guarded by dbMu
+// like the rest of the keyspace.
+var (
+	expires       = map[string]int64{}
+	volatileIndex = newScanTable()
+)
+
+// Deleting an expired key is a write, logged as a DEL so that the AOF and
+// the replicas see it at the same point as the keyspace did. Writers delete
+// the expired keys they touch and record them in expiredDels, which
+// propagate logs before the write itself. Readers do not hold callMu, so
+// they only record the expired keys they met in staleKeys, for call to
+// delete them afterwards. Both are guarded by dbMu.
+var (
+	expiredDels []string
+	staleKeys   = map[string]struct{}{}
+)
+
+// loading is set while the AOF is replayed. Keys are not expired meanwhile,
+// as the commands of the log must apply to the keyspace they ran against:
+// a key deleted because it expired since is followed by its DEL in the log.
+var loading atomic.Bool
+
+const (
+	activeExpireInterval = 100 * time.Millisecond
+	activeExpireSamples  = 20
+	activeExpireBudget   = 25 * time.Millisecond
+)
+
+func nowMs() int64 {
+	return time.Now().UnixMilli()
+}
+
+func setExpire(key string, when int64) {
+	if _, ok := expires[key]; !ok {
+		volatileIndex.add(key)
+	}
+	expires[key] = when
+}
+
+func removeExpire(key string) bool {
+	_, ok := expires[key]
+	if ok {
+		delete(expires, key)
+		volatileIndex.remove(key)
+	}
+	return ok
+}
+
+// rebuildVolatileIndex indexes the keys of expires from scratch.
+func rebuildVolatileIndex() {
+	volatileIndex = newScanTable()
+	for key := range expires {
+		volatileIndex.add(key)
+	}
+}
+
+func getExpire(key string) (int64, bool) {
+	when, ok := expires[key]
+	return when, ok
+}
+
+// isExpired reports whether the deadline of key has passed.
+func isExpired(key string) bool {
+	when, ok := expires[key]
+	return ok && when <= nowMs()
+}
+
+// canExpire reports whether expired keys may be deleted. Like in Redis, a
+// follower never deletes them itself, whether lazily or in the active cycle:
+// it waits for the DEL sent by its leader, so that both agree on when a key
+// is gone. Meanwhile its readers treat them as missing.
+func canExpire() bool {
+	return !loading.Load() && !repl.following.Load()
+}
+
+// expireIfNeeded lazily deletes key when its deadline has passed. Every
+// write handler calls it first on the keys it touches so expired values are
+// never observed, even if the active cycle has not reclaimed them yet. It
+// also records the access for eviction.
+func expireIfNeeded(key string) bool {
+	if !isExpired(key) || !canExpire() {
+		recordAccess(key)
+		return false
+	}
+
+	removeKey(key)
+	touchKey(key)
+	expiredKeys.Add(1)
+	expiredDels = append(expiredDels, key)
+	return true
+}
+
+// takeExpiredDels returns the DEL records of the keys deleted because they
+// expired since the last call. It must be called with callMu held.
+func takeExpiredDels() []Value {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	for key := range staleKeys {
+		expireIfNeeded(key)
+	}
+	clear(staleKeys)
+
+	entries := make([]Value, 0, len(expiredDels))
+	for _, key := range expiredDels {
+		entries = append(entries, Value{typ: "array", array: bulks("DEL", key)})
+	}
+	expiredDels = nil
+
+	return entries
+}
+
+// commitExpired deletes the expired keys met by the commands run since the
+// last call and logs their DEL, each as a write of its own. It must be
+// called with callMu held.
+func commitExpired(aof *Aof) {
+	for _, entry := range takeExpiredDels() {
+		commit(aof, entry)
+	}
+}
+
+// expireStaleKeys deletes the expired keys met by a read command, which
+// does not hold callMu, once it has run.
+func expireStaleKeys(aof *Aof) {
+	dbMu.RLock()
+	stale := len(staleKeys)
+	dbMu.RUnlock()
+	if stale == 0 {
+		return
+	}
+
+	callMu.Lock()
+	defer callMu.Unlock()
+
+	commitExpired(aof)
+}
+
+// activeExpireCycle samples keys with a deadline and deletes the expired
+// ones, logging a DEL for each to aof. Like Redis it keeps sampling while
+// more than a quarter of a sample was expired, but never for longer than
+// activeExpireBudget. It returns the number of keys reclaimed.
+func activeExpireCycle(aof *Aof) int {
+	start := time.Now()
+	reclaimed := 0
+
+	for time.Since(start) < activeExpireBudget && canExpire() {
+		now := nowMs()
+		expired := 0
+		sampled := 0
+
+		execMu.RLock()
+		callMu.Lock()
+		dbMu.Lock()
+		for key, when := range expires {
+			if sampled == activeExpireSamples {
+				break
+			}
+			sampled++
+			if when <= now && expireIfNeeded(key) {
+				expired++
+			}
+		}
+		dbMu.Unlock()
+		commitExpired(aof)
+		callMu.Unlock()
+		execMu.RUnlock()
+
+		reclaimed += expired
+
+		if sampled == 0 || expired*4 <= sampled {
+			break
+		}
+	}
+
+	return reclaimed
+}
+
+// startActiveExpire runs activeExpireCycle in the background forever.
+func startActiveExpire(aof *Aof) {
+	ticker := time.NewTicker(activeExpireInterval)
+	go func() {
+		for range ticker.C {
+			activeExpireCycle(aof)
+		}
+	}()
+}
+
+func expire(args []Value) Value {
+	return expireGeneric(args, "expire", time.Second, false)
+}
+
+func pexpire(args []Value) Value {
+	return expireGeneric(args, "pexpire", time.Millisecond, false)
+}
+
+func expireat(args []Value) Value {
+	return expireGeneric(args, "expireat", time.Second, true)
+}
+
+func pexpireat(args []Value) Value {
+	return expireGeneric(args, "pexpireat", time.Millisecond, true)
+}
+
+// expireGeneric implements the EXPIRE family. unit scales the numeric
+// argument to milliseconds and absolute selects between a relative timeout
+// and a unix timestamp.
+func expireGeneric(args []Value, name string, unit time.Duration, absolute bool) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	key := args[0].bulk
+
+	n, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: "ERR: value is not an integer"}
+	}
+
+	nx, xx, gt, lt := false, false, false, false
+	for _, arg := range args[2:] {
+		switch strings.ToUpper(arg.bulk) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			return Value{typ: "error", str: "ERR Unsupported option " + arg.bulk}
+		}
+	}
+	if nx && (xx || gt || lt) {
+		return Value{typ: "error", str: "ERR NX and XX, GT or LT options at the same time are not compatible"}
+	}
+	if gt && lt {
+		return Value{typ: "error", str: "ERR GT and LT options at the same time are not compatible"}
+	}
+
+	// the deadline must fit in milliseconds, or it would wrap around
+	invalid := Value{typ: "error", str: "ERR invalid expire time in '" + name + "' command"}
+	scale := int64(unit / time.Millisecond)
+	if n > math.MaxInt64/scale || n < math.MinInt64/scale {
+		return invalid
+	}
+	when := n * scale
+	if !absolute {
+		now := nowMs()
+		if when > math.MaxInt64-now {
+			return invalid
+		}
+		when += now
+	}
+
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	expireIfNeeded(key)
+	if !keyExists(key) {
+		return Value{typ: "integer", num: 0}
+	}
+
+	current, volatile := getExpire(key)
+	switch {
+	case nx && volatile:
+		return Value{typ: "integer", num: 0}
+	case xx && !volatile:
+		return Value{typ: "integer", num: 0}
+	case gt && (!volatile || when <= current):
+		return Value{typ: "integer", num: 0}
+	case lt && volatile && when >= current:
+		return Value{typ: "integer", num: 0}
+	}
+
+	if when <= nowMs() {
+		removeKey(key)
+		return Value{typ: "integer", num: 1}
+	}
+
+	setExpire(key, when)
+
+	return Value{typ: "integer", num: 1}
+}
+
+func ttl(args []Value) Value {
+	return ttlGeneric(args, "ttl", time.Second)
+}
+
+func pttl(args []Value) Value {
+	return ttlGeneric(args, "pttl", time.Millisecond)
+}
+
+func ttlGeneric(args []Value, name string, unit time.Duration) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for '" + name + "' command"}
+	}
+
+	key := args[0].bulk
+
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	if !lookupRead(key) {
+		return Value{typ: "integer", num: -2}
+	}
+
+	when, ok := getExpire(key)
+	if !ok {
+		return Value{typ: "integer", num: -1}
+	}
+
+	remaining := when - nowMs()
+	if remaining < 0 {
+		remaining = 0
+	}
+	div := int64(unit / time.Millisecond)
+
+	return Value{typ: "integer", num: int((remaining + div/2) / div)}
+}
+
+func persist(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'persist' command"}
+	}
+
+	key := args[0].bulk
+
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	expireIfNeeded(key)
+	if !keyExists(key) {
+		return Value{typ: "integer", num: 0}
+	}
+
+	if !removeExpire(key) {
+		return Value{typ: "integer", num: 0}
+	}
+
+	return Value{typ: "integer", num: 1}
+}
+
+// expireEntry returns the AOF record for an EXPIRE-family command that has
+// already run. Relative timeouts are stored as the absolute deadline the
+// handler applied, so replaying the log never prolongs or resurrects a key.
+func expireEntry(args []Value, result Value) (Value, bool) {
+	if result.typ != "integer" || result.num == 0 {
+		return Value{}, false
+	}
+
+	key := args[0].bulk
+
+	// callMu is still held, so no other write changed the deadline since
+	dbMu.RLock()
+	when, ok := getExpire(key)
+	dbMu.RUnlock()
+	if !ok {
+		// the deadline was already in the past and the key got deleted
+		return Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: "DEL"},
+			{typ: "bulk", bulk: key},
+		}}, true
+	}
+
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: "PEXPIREAT"},
+		{typ: "bulk", bulk: key},
+		{typ: "bulk", bulk: strconv.FormatInt(when, 10)},
+	}}, true
+}
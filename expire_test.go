@@ -0,0 +1,345 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetExpires() {
+	dbMu.Lock()
+	for k := range expires {
+		delete(expires, k)
+	}
+	volatileIndex = newScanTable()
+	expiredDels = nil
+	clear(staleKeys)
+	dbMu.Unlock()
+}
+
+func TestExpireAndTTL(t *testing.T) {
+	resetStrings()
+	resetExpires()
+
+	set([]Value{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "v"}})
+
+	got := expire([]Value{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "100"}})
+	if got.typ != "integer" || got.num != 1 {
+		t.Fatalf("EXPIRE k 100 = %+v, want 1", got)
+	}
+
+	got = ttl([]Value{{typ: "bulk", bulk: "k"}})
+	if got.num != 100 {
+		t.Errorf("TTL k = %d, want 100", got.num)
+	}
+
+	got = pttl([]Value{{typ: "bulk", bulk: "k"}})
+	if got.num <= 99000 || got.num > 100000 {
+		t.Errorf("PTTL k = %d, want about 100000", got.num)
+	}
+}
+
+func TestTTLMissingAndPersistent(t *testing.T) {
+	resetStrings()
+	resetExpires()
+
+	got := ttl([]Value{{typ: "bulk", bulk: "nokey"}})
+	if got.num != -2 {
+		t.Errorf("TTL nokey = %d, want -2", got.num)
+	}
+
+	set([]Value{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "v"}})
+	got = ttl([]Value{{typ: "bulk", bulk: "k"}})
+	if got.num != -1 {
+		t.Errorf("TTL k = %d, want -1", got.num)
+	}
+}
+
+func TestExpireMissingKey(t *testing.T) {
+	resetStrings()
+	resetExpires()
+
+	got := expire([]Value{{typ: "bulk", bulk: "nokey"}, {typ: "bulk", bulk: "10"}})
+	if got.typ != "integer" || got.num != 0 {
+		t.Errorf("EXPIRE nokey = %+v, want 0", got)
+	}
+}
+
+func TestExpiredKeyIsNotVisible(t *testing.T) {
+	resetStrings()
+	resetHash()
+	resetExpires()
+	for k := range SETsL {
+		delete(SETsL, k)
+	}
+
+	past := nowMs() - 1000
+
+	set([]Value{{typ: "bulk", bulk: "s"}, {typ: "bulk", bulk: "v"}})
+	Rpush([]Value{{typ: "bulk", bulk: "l"}, {typ: "bulk", bulk: "a"}})
+	hset([]Value{{typ: "bulk", bulk: "h"}, {typ: "bulk", bulk: "f"}, {typ: "bulk", bulk: "v"}})
+
+	// bypass the handler so the keys stay in place until they are accessed
+	for _, key := range []string{"s", "l", "h"} {
+		setExpire(key, past)
+	}
+
+	if got := get([]Value{{typ: "bulk", bulk: "s"}}); got.typ != "null" {
+		t.Errorf("GET expired = %+v, want null", got)
+	}
+	if got := Lrange([]Value{{typ: "bulk", bulk: "l"}, {typ: "bulk", bulk: "0"}, {typ: "bulk", bulk: "-1"}}); got.typ != "null" {
+		t.Errorf("LRANGE expired = %+v, want null", got)
+	}
+	if got := hget([]Value{{typ: "bulk", bulk: "h"}, {typ: "bulk", bulk: "f"}}); got.typ != "null" {
+		t.Errorf("HGET expired = %+v, want null", got)
+	}
+}
+
+func TestPexpireatInPastDeletes(t *testing.T) {
+	resetStrings()
+	resetExpires()
+
+	set([]Value{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "v"}})
+
+	got := pexpireat([]Value{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "1"}})
+	if got.num != 1 {
+		t.Fatalf("PEXPIREAT k 1 = %+v, want 1", got)
+	}
+
+	if got := get([]Value{{typ: "bulk", bulk: "k"}}); got.typ != "null" {
+		t.Errorf("GET after PEXPIREAT in the past = %+v, want null", got)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	resetStrings()
+	resetExpires()
+
+	set([]Value{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "v"}})
+	expire([]Value{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "100"}})
+
+	got := persist([]Value{{typ: "bulk", bulk: "k"}})
+	if got.num != 1 {
+		t.Errorf("PERSIST k = %+v, want 1", got)
+	}
+
+	got = persist([]Value{{typ: "bulk", bulk: "k"}})
+	if got.num != 0 {
+		t.Errorf("second PERSIST k = %+v, want 0", got)
+	}
+
+	if got := ttl([]Value{{typ: "bulk", bulk: "k"}}); got.num != -1 {
+		t.Errorf("TTL after PERSIST = %d, want -1", got.num)
+	}
+}
+
+func TestSetClearsTTL(t *testing.T) {
+	resetStrings()
+	resetExpires()
+
+	set([]Value{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "v"}})
+	expire([]Value{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "100"}})
+	set([]Value{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "v2"}})
+
+	if got := ttl([]Value{{typ: "bulk", bulk: "k"}}); got.num != -1 {
+		t.Errorf("TTL after SET = %d, want -1", got.num)
+	}
+}
+
+func TestExpireOptions(t *testing.T) {
+	resetStrings()
+	resetExpires()
+
+	set([]Value{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "v"}})
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"XX without ttl", []string{"100", "XX"}, 0},
+		{"GT without ttl", []string{"100", "GT"}, 0},
+		{"NX without ttl", []string{"100", "NX"}, 1},
+		{"NX with ttl", []string{"200", "NX"}, 0},
+		{"GT with smaller ttl", []string{"50", "GT"}, 0},
+		{"GT with larger ttl", []string{"200", "GT"}, 1},
+		{"LT with larger ttl", []string{"300", "LT"}, 0},
+		{"LT with smaller ttl", []string{"150", "LT"}, 1},
+		{"XX with ttl", []string{"120", "XX"}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []Value{{typ: "bulk", bulk: "k"}}
+			for _, a := range tt.args {
+				args = append(args, Value{typ: "bulk", bulk: a})
+			}
+			got := expire(args)
+			if got.typ != "integer" || got.num != tt.want {
+				t.Errorf("EXPIRE k %v = %+v, want %d", tt.args, got, tt.want)
+			}
+		})
+	}
+
+	if got := ttl([]Value{{typ: "bulk", bulk: "k"}}); got.num != 120 {
+		t.Errorf("TTL k = %d, want 120", got.num)
+	}
+}
+
+func TestExpireInvalidArgs(t *testing.T) {
+	tests := [][]Value{
+		{},
+		{{typ: "bulk", bulk: "k"}},
+		{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "abc"}},
+		{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "10"}, {typ: "bulk", bulk: "NX"}, {typ: "bulk", bulk: "XX"}},
+		{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "10"}, {typ: "bulk", bulk: "GT"}, {typ: "bulk", bulk: "LT"}},
+		{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "10"}, {typ: "bulk", bulk: "BOGUS"}},
+	}
+
+	for _, args := range tests {
+		if got := expire(args); got.typ != "error" {
+			t.Errorf("EXPIRE %v = %+v, want error", args, got)
+		}
+	}
+}
+
+func TestExpireOverflow(t *testing.T) {
+	resetStrings()
+	resetExpires()
+	set(bulks("k", "v"))
+
+	tests := []struct {
+		handler func([]Value) Value
+		name    string
+		n       string
+	}{
+		{expire, "expire", "9223372036854776"},
+		{expire, "expire", "-9223372036854776"},
+		{expireat, "expireat", "9223372036854776"},
+		{pexpire, "pexpire", "9223372036854775807"},
+	}
+
+	for _, tt := range tests {
+		want := "ERR invalid expire time in '" + tt.name + "' command"
+		if got := tt.handler(bulks("k", tt.n)); got.str != want {
+			t.Errorf("%s k %s = %+v, want %q", tt.name, tt.n, got, want)
+		}
+	}
+
+	if got := get(bulks("k")); got.bulk != "v" {
+		t.Errorf("GET k = %+v after invalid expire times, want v", got)
+	}
+}
+
+func TestActiveExpireCycle(t *testing.T) {
+	resetStrings()
+	resetExpires()
+
+	for i := 0; i < 50; i++ {
+		key := "k" + strconv.Itoa(i)
+		set([]Value{{typ: "bulk", bulk: key}, {typ: "bulk", bulk: "v"}})
+		setExpire(key, nowMs()-1)
+	}
+	set([]Value{{typ: "bulk", bulk: "live"}, {typ: "bulk", bulk: "v"}})
+	expire([]Value{{typ: "bulk", bulk: "live"}, {typ: "bulk", bulk: "100"}})
+
+	if n := activeExpireCycle(nil); n != 50 {
+		t.Errorf("activeExpireCycle reclaimed %d keys, want 50", n)
+	}
+
+	dbMu.RLock()
+	remaining := len(SETs)
+	dbMu.RUnlock()
+	if remaining != 1 {
+		t.Errorf("after active expiry %d keys remain, want 1", remaining)
+	}
+}
+
+func TestExpireAofEntry(t *testing.T) {
+	resetStrings()
+	resetExpires()
+
+	set([]Value{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "v"}})
+	args := []Value{{typ: "bulk", bulk: "k"}, {typ: "bulk", bulk: "100"}}
+	result := expire(args)
+
+	entry, ok := aofEntry("EXPIRE", args, result)
+	if !ok {
+		t.Fatal("EXPIRE produced no AOF entry")
+	}
+	if entry.array[0].bulk != "PEXPIREAT" {
+		t.Fatalf("AOF command = %v, want PEXPIREAT", entry.array[0].bulk)
+	}
+
+	when, _ := getExpire("k")
+	if entry.array[2].bulk != strconv.FormatInt(when, 10) {
+		t.Errorf("AOF deadline = %v, want %d", entry.array[2].bulk, when)
+	}
+
+	result = expire([]Value{{typ: "bulk", bulk: "nokey"}, {typ: "bulk", bulk: "100"}})
+	if _, ok := aofEntry("EXPIRE", []Value{{typ: "bulk", bulk: "nokey"}}, result); ok {
+		t.Error("EXPIRE on a missing key produced an AOF entry")
+	}
+}
+
+func TestExpiredKeysAreNotExpiredWhileLoading(t *testing.T) {
+	resetKeyspace()
+	aof := newTestAof(t)
+	when := strconv.FormatInt(nowMs()+100, 10)
+	aof.Write(
+		Value{typ: "array", array: bulks("SET", "k", "v", "PXAT", when)},
+		Value{typ: "array", array: bulks("APPEND", "k", "x")},
+	)
+	time.Sleep(200 * time.Millisecond)
+
+	if err := loadAof(aof); err != nil {
+		t.Fatalf("loadAof: %v", err)
+	}
+
+	dbMu.RLock()
+	value, deadline := SETs["k"], expires["k"]
+	dbMu.RUnlock()
+	if value != "vx" || strconv.FormatInt(deadline, 10) != when {
+		t.Errorf("k = %q expiring at %d after loading, want \"vx\" expiring at %s", value, deadline, when)
+	}
+	if got := get(bulks("k")); got.typ != "null" {
+		t.Errorf("GET k = %+v after loading, want null", got)
+	}
+}
+
+func TestExpiredKeysAreLoggedAsDel(t *testing.T) {
+	resetKeyspace()
+	aof := newTestAof(t)
+	call(aof, origin{}, lookupCommand("SET"), bulks("lazy", "v", "PX", "1"))
+	call(aof, origin{}, lookupCommand("SET"), bulks("written", "v", "PX", "1"))
+	call(aof, origin{}, lookupCommand("SET"), bulks("active", "v", "PX", "1"))
+	time.Sleep(5 * time.Millisecond)
+
+	if got := call(aof, origin{}, lookupCommand("GET"), bulks("lazy")); got.typ != "null" {
+		t.Errorf("GET lazy = %+v, want null", got)
+	}
+	call(aof, origin{}, lookupCommand("APPEND"), bulks("written", "x"))
+	activeExpireCycle(aof)
+
+	var logged []string
+	aof.ReadFrom(0, func(value Value, _ int64) error {
+		if strings.EqualFold(value.array[0].bulk, "DEL") {
+			logged = append(logged, value.array[1].bulk)
+		}
+		return nil
+	})
+	if strings.Join(logged, " ") != "lazy written active" {
+		t.Errorf("DEL logged for %v, want lazy, written and active", logged)
+	}
+
+	resetKeyspace()
+	if err := loadAof(aof); err != nil {
+		t.Fatalf("loadAof: %v", err)
+	}
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+	if len(SETs) != 1 || SETs["written"] != "x" || len(expires) != 0 {
+		t.Errorf("keyspace after loading = %v with deadlines %v, want only written = \"x\"", SETs, expires)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+// globMatch reports whether str matches the Redis style glob pattern. It
+// supports '*', '?', character classes such as [abc], [^abc] and [a-z], and
+// backslash escapes.
+//
+// It runs in O(len(pattern) * len(str)): on a mismatch only the last '*'
+// seen takes one more byte, as a match found through an earlier star could
+// also be found through the last one.
+func globMatch(pattern, str string) bool {
+	p, s := 0, 0
+	star, starS := -1, 0
+
+	for s < len(str) {
+		if p < len(pattern) && pattern[p] == '*' {
+			star, starS = p, s
+			p++
+			continue
+		}
+		if p < len(pattern) {
+			if next, ok := globMatchOne(pattern, p, str[s]); ok {
+				p, s = next, s+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starS++
+		p, s = star+1, starS
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// globMatchOne matches c against the element of pattern starting at p,
+// which must not be '*', and returns the position of the next element.
+func globMatchOne(pattern string, p int, c byte) (int, bool) {
+	switch pattern[p] {
+	case '?':
+		return p + 1, true
+	case '[':
+		p++
+		not := p < len(pattern) && pattern[p] == '^'
+		if not {
+			p++
+		}
+
+		match := false
+		for p < len(pattern) && pattern[p] != ']' {
+			switch {
+			case pattern[p] == '\\' && p+1 < len(pattern):
+				p++
+				if pattern[p] == c {
+					match = true
+				}
+			case p+2 < len(pattern) && pattern[p+1] == '-':
+				lo, hi := pattern[p], pattern[p+2]
+				if lo > hi {
+					lo, hi = hi, lo
+				}
+				if c >= lo && c <= hi {
+					match = true
+				}
+				p += 2
+			default:
+				if pattern[p] == c {
+					match = true
+				}
+			}
+			p++
+		}
+		if p < len(pattern) {
+			p++
+		}
+
+		return p, match != not
+	case '\\':
+		if p+1 < len(pattern) {
+			p++
+		}
+		return p + 1, pattern[p] == c
+	default:
+		return p + 1, pattern[p] == c
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		str     string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "hllo", true},
+		{"h*llo", "heeeello", true},
+		{"h*llo", "hellox", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h[c-a]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`h[\]]llo`, "h]llo", true},
+		{"cache:*", "cache:user:1", true},
+		{"cache:*", "session:1", false},
+		{"*:1", "cache:user:1", true},
+		{"a**b", "ab", true},
+		{"", "", true},
+		{"", "a", false},
+		{"abc", "ab", false},
+		{"*a*b", "xaxxab", true},
+		{"*a*b", "xaxxa", false},
+		{"a*b*c", "abbbc", true},
+		{"a*?", "a", false},
+		{"*[0-9]", "key:7", true},
+		{"h[abc", "ha", true},
+	}
+
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.str); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.str, got, tt.want)
+		}
+	}
+}
+
+func TestGlobMatchPathologicalPattern(t *testing.T) {
+	pattern := strings.Repeat("a*", 14) + "b"
+	str := strings.Repeat("a", 90)
+
+	start := time.Now()
+	if globMatch(pattern, str) {
+		t.Fatalf("globMatch(%q, %q) = true", pattern, str)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("matching a pathological pattern took %v", elapsed)
+	}
+}
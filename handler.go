@@ -1,36 +1,80 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"math"
 	"strconv"
+	"strings"
 	"sync"
 )
 
-var Handlers = map[string]func([]Value) Value{
-	"PING":     ping,
-	"SET":      set,
-	"GET":      get,
-	"CHSET":    hsetHT,
-	"CHGET":    hgetHT,
-	"CHGETALL": hgetallHT,
-	"CHDEL":    hdelHT,
-	"INCR":     incr,
-	"DECR":     decr,
-	"INCRBY":   incrBy,
-	"DECRBY":   decrBy,
-	"DEL":      del,
-	"APPEND":   appendto,
-	"LPUSH":    Lpush,
-	"LRANGE":   Lrange,
-	"LPOP":     Lpop,
-	"RPOP":     Rpop,
-	"RPUSH":    Rpush,
-	"HSET":     hset,
-	"HGET":     hget,
-	"HGETALL":  hgetall,
-	"HDEL":     hdel,
+// callMu is held from the moment a write command starts executing until it
+// has been appended to the AOF and sent to the replicas. Writes are thus
+// logged in the order they are applied, and holding it yields a point where
+// every write is either fully logged or not applied yet, which is what an
+// AOF rewrite or a snapshot needs to capture the keyspace. Other commands do
+// not take it, so SAVE can take it while being served.
+var callMu = sync.Mutex{}
+
+// execMu is held for reading by every command while it executes and
+// exclusively by EXEC, so no command observes a transaction half applied.
+// It is always taken before callMu.
+var execMu = sync.RWMutex{}
+
+// call executes a single command sent by from outside of a transaction.
+// Write commands are refused on a follower. Otherwise keys are evicted first
+// if maxmemory is exceeded, commands that may grow the keyspace are refused
+// if that is not enough, and the others are passed to propagate.
+func call(aof *Aof, from origin, spec *commandSpec, args []Value) Value {
+	execMu.RLock()
+	defer execMu.RUnlock()
+
+	commandsProcessed.Add(1)
+
+	if spec.flags&flagWrite == 0 {
+		result := execute(from, spec, args)
+		expireStaleKeys(aof)
+		return result
+	}
+
+	if repl.readOnly() {
+		spec.stats.rejected.Add(1)
+		return readOnlyReplica
+	}
+
+	result := callWrite(aof, from, spec, args)
+
+	// with appendfsync always the reply waits for the write to be on disk,
+	// sharing the fsync with the writes appended in the meantime
+	if aof != nil {
+		aof.awaitFsync()
+	}
+
+	return result
+}
+
+// callWrite runs a write command and logs it while holding callMu.
+func callWrite(aof *Aof, from origin, spec *commandSpec, args []Value) Value {
+	callMu.Lock()
+	defer callMu.Unlock()
+
+	if !performEvictions(aof) && spec.flags&flagDenyOOM != 0 {
+		spec.stats.rejected.Add(1)
+		return errOOM
+	}
+
+	command := strings.ToUpper(spec.name)
+	preserveKeys(spec.keys(args))
+	result := execute(from, spec, args)
+	propagate(aof, command, args, result)
+
+	return result
 }
 
+// Handlers maps the name of every command that does not need the state of
+// its connection to its implementation. It is filled from commandList.
+var Handlers = map[string]func([]Value) Value{}
+
 func ping(args []Value) Value {
 	if len(args) == 0 {
 		return Value{typ: "string", str: "PONG"}
@@ -40,50 +84,199 @@ func ping(args []Value) Value {
 }
 
 var SETs = map[string]string{}
-var SETsMu = sync.RWMutex{}
+
+// setOptions holds the parsed modifiers of a SET command.
+type setOptions struct {
+	nx       bool
+	xx       bool
+	get      bool
+	keepTTL  bool
+	expireAt int64 // absolute unix milliseconds, 0 when no expiry was given
+}
+
+// parseSetOptions parses SET key value [NX|XX] [GET] [EX s|PX ms|EXAT ts|PXAT ms|KEEPTTL].
+// Relative expirations are turned into an absolute deadline right away.
+func parseSetOptions(args []Value) (setOptions, error) {
+	opts := setOptions{}
+	hasExpire := false
+
+	for i := 0; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+
+		switch option {
+		case "NX":
+			if opts.xx {
+				return opts, errors.New("ERR syntax error")
+			}
+			opts.nx = true
+		case "XX":
+			if opts.nx {
+				return opts, errors.New("ERR syntax error")
+			}
+			opts.xx = true
+		case "GET":
+			opts.get = true
+		case "KEEPTTL":
+			if hasExpire {
+				return opts, errors.New("ERR syntax error")
+			}
+			opts.keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExpire || opts.keepTTL || i+1 == len(args) {
+				return opts, errors.New("ERR syntax error")
+			}
+			i++
+			n, err := strconv.ParseInt(args[i].bulk, 10, 64)
+			if err != nil {
+				return opts, errors.New("ERR: value is not an integer")
+			}
+			// the deadline must fit in milliseconds, or it would wrap to the
+			// past and the key would be deleted at once
+			seconds := option == "EX" || option == "EXAT"
+			if n <= 0 || seconds && n > math.MaxInt64/1000 {
+				return opts, errors.New("ERR invalid expire time in 'set' command")
+			}
+			if seconds {
+				n *= 1000
+			}
+			if option == "EX" || option == "PX" {
+				now := nowMs()
+				if n > math.MaxInt64-now {
+					return opts, errors.New("ERR invalid expire time in 'set' command")
+				}
+				n += now
+			}
+			opts.expireAt = n
+			hasExpire = true
+		default:
+			return opts, errors.New("ERR syntax error")
+		}
+	}
+
+	return opts, nil
+}
 
 func set(args []Value) Value {
-	if len(args) != 2 {
+	if len(args) < 2 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'set' command"}
 	}
 
 	key := args[0].bulk
 	value := args[1].bulk
 
-	SETsMu.Lock()
-	SETs[key] = value
-	SETsMu.Unlock()
+	opts, err := parseSetOptions(args[2:])
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	expireIfNeeded(key)
+
+	t := keyType(key)
+	if opts.get && t != typeNone && t != typeString {
+		return wrongType
+	}
+
+	old := SETs[key]
+	exists := t != typeNone
+	apply := !(opts.nx && exists) && !(opts.xx && !exists)
+	if apply {
+		// SET replaces whatever was stored at key, regardless of its type
+		deleteValue(key)
+		SETs[key] = value
+		growKey(key, stringSize(value))
+
+		switch {
+		case opts.expireAt != 0:
+			setExpire(key, opts.expireAt)
+		case !opts.keepTTL:
+			// a plain SET discards any previous time to live
+			removeExpire(key)
+		}
+	}
+
+	if opts.get {
+		if t == typeNone {
+			return Value{typ: "null"}
+		}
+		return Value{typ: "bulk", bulk: old}
+	}
+
+	if !apply {
+		return Value{typ: "null"}
+	}
 
 	return Value{typ: "string", str: "OK"}
 }
 
-func appendto(args []Value) Value {
-	if len(args) != 2 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'appendto' command"}
+// setEntry returns the AOF record for a SET that has already run. Only a SET
+// that actually wrote the key is logged, with NX, XX and GET dropped and any
+// time to live pinned to the absolute deadline now attached to the key.
+func setEntry(args []Value, result Value) (Value, bool) {
+	opts, err := parseSetOptions(args[2:])
+	if err != nil {
+		return Value{}, false
+	}
+
+	applied := result.typ == "string"
+	if opts.get {
+		switch {
+		case opts.nx:
+			applied = result.typ == "null"
+		case opts.xx:
+			applied = result.typ == "bulk"
+		default:
+			applied = true
+		}
+	}
+	if !applied {
+		return Value{}, false
 	}
 
 	key := args[0].bulk
-	value := args[1].bulk
 
-	SETsMu.Lock()
-	SETs[key] += value
-	SETsMu.Unlock()
+	// callMu is still held, so no other write changed the deadline since
+	dbMu.RLock()
+	when, volatile := getExpire(key)
+	dbMu.RUnlock()
 
-	return Value{typ: "string", str: "OK"}
+	entry := []Value{
+		{typ: "bulk", bulk: "SET"},
+		{typ: "bulk", bulk: key},
+		{typ: "bulk", bulk: args[1].bulk},
+	}
+	if volatile {
+		entry = append(entry,
+			Value{typ: "bulk", bulk: "PXAT"},
+			Value{typ: "bulk", bulk: strconv.FormatInt(when, 10)},
+		)
+	}
+
+	return Value{typ: "array", array: entry}, true
 }
 
-func del(args []Value) Value {
-	if len(args) != 1 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'del' command"}
+func appendto(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'appendto' command"}
 	}
 
 	key := args[0].bulk
+	value := args[1].bulk
+
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	expireIfNeeded(key)
+	if !checkType(key, typeString) {
+		return wrongType
+	}
 
-	SETsMu.Lock()
-	delete(SETs, key)
-	SETsMu.Unlock()
+	SETs[key] += value
+	growKey(key, stringSize(value))
 
-	return Value{typ: "string", str: "ok"}
+	return Value{typ: "integer", num: len(SETs[key])}
 }
 
 func get(args []Value) Value {
@@ -93,9 +286,17 @@ func get(args []Value) Value {
 
 	key := args[0].bulk
 
-	SETsMu.RLock()
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	if !lookupRead(key) {
+		return Value{typ: "null"}
+	}
+	if !checkType(key, typeString) {
+		return wrongType
+	}
+
 	value, ok := SETs[key]
-	SETsMu.RUnlock()
 
 	if !ok {
 		return Value{typ: "null"}
@@ -104,50 +305,22 @@ func get(args []Value) Value {
 	return Value{typ: "bulk", bulk: value}
 }
 
-var INCRsMU = sync.RWMutex{}
-
 func incr(args []Value) Value {
 	if len(args) != 1 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'incr' command"}
 	}
 
-	key := args[0].bulk
-
-	val := SETs[key]
-
-	i, err := strconv.Atoi(val)
-	if err != nil {
-		return Value{typ: "error", str: "ERR: value is not an integer"}
-	}
-	INCRsMU.Lock()
-	i++
-	SETs[key] = strconv.Itoa(i)
-	INCRsMU.Unlock()
-
-	return Value{typ: "string", str: "OK"}
-
+	return incrementBy(args[0].bulk, 1)
 }
+
 func decr(args []Value) Value {
 	if len(args) != 1 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'decr' command"}
 	}
 
-	key := args[0].bulk
-
-	val := SETs[key]
-
-	i, err := strconv.Atoi(val)
-	if err != nil {
-		return Value{typ: "error", str: "ERR: value is not an integer"}
-	}
-	INCRsMU.Lock()
-	i--
-	SETs[key] = strconv.Itoa(i)
-	INCRsMU.Unlock()
-
-	return Value{typ: "string", str: "OK"}
-
+	return incrementBy(args[0].bulk, -1)
 }
+
 func incrBy(args []Value) Value {
 	if len(args) != 2 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'incrby' command"}
@@ -162,22 +335,9 @@ func incrBy(args []Value) Value {
 		return Value{typ: "error", str: "ERR: value is not an integer"}
 	}
 
-	val := SETs[key]
-
-	// convert val to integer
-	i, err := strconv.Atoi(val)
-	if err != nil {
-		return Value{typ: "error", str: "ERR: value is not an integer"}
-	}
-
-	INCRsMU.Lock()
-	i += increment
-	SETs[key] = strconv.Itoa(i)
-	INCRsMU.Unlock()
-
-	return Value{typ: "string", str: "OK"}
-
+	return incrementBy(key, increment)
 }
+
 func decrBy(args []Value) Value {
 	if len(args) != 2 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'decrby' command"}
@@ -190,95 +350,47 @@ func decrBy(args []Value) Value {
 	if err != nil {
 		return Value{typ: "error", str: "ERR: value is not an integer"}
 	}
-
-	val := SETs[key]
-
-	// convert val to integer
-	i, err := strconv.Atoi(val)
-	if err != nil {
-		return Value{typ: "error", str: "ERR: value is not an integer"}
-	}
-	INCRsMU.Lock()
-	i -= decrement
-	SETs[key] = strconv.Itoa(i)
-	INCRsMU.Unlock()
-
-	return Value{typ: "string", str: "OK"}
-
-}
-
-var hashTable = NewHashTable(100)
-
-func hsetHT(args []Value) Value {
-	if len(args) != 3 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'hset' command"}
+	// its opposite does not fit
+	if decrement == math.MinInt {
+		return Value{typ: "error", str: "ERR decrement would overflow"}
 	}
 
-	hashKey := args[0].bulk
-	field := args[1].bulk
-	val := args[2].bulk
-
-	hashTable.Set(hashKey, field, val)
-
-	return Value{typ: "string", str: "OK"}
-
+	return incrementBy(key, -decrement)
 }
 
-func hgetHT(args []Value) Value {
+// incrementBy adds delta to the integer stored at key, which counts as 0
+// when missing, and replies with the new value.
+func incrementBy(key string, delta int) Value {
+	dbMu.Lock()
+	defer dbMu.Unlock()
 
-	if len(args) != 2 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'hget' command"}
+	expireIfNeeded(key)
+	if !checkType(key, typeString) {
+		return wrongType
 	}
 
-	hashKey := args[0].bulk
-	field := args[1].bulk
-
-	val, ok := hashTable.Get(hashKey, field)
-	log.Println(val)
+	val, ok := SETs[key]
 	if !ok {
-		return Value{typ: "null"}
+		val = "0"
 	}
 
-	return Value{typ: "bulk", bulk: val}
-}
-
-func hdelHT(args []Value) Value {
-
-	if len(args) != 2 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'hdel' command"}
-	}
-
-	hashKey := args[0].bulk
-	field := args[1].bulk
-
-	hashTable.Delete(hashKey, field)
-
-	return Value{typ: "string", str: "OK"}
-}
-
-func hgetallHT(args []Value) Value {
-
-	if len(args) != 1 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'hgetall' command"}
+	// convert val to integer
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return Value{typ: "error", str: "ERR: value is not an integer"}
 	}
 
-	hash := args[0].bulk
-
-	val, ok := hashTable.GetAll(hash)
-	log.Println(val)
-	if !ok {
-		return Value{typ: "null"}
+	if delta > 0 && i > math.MaxInt-delta || delta < 0 && i < math.MinInt-delta {
+		return Value{typ: "error", str: "ERR increment or decrement would overflow"}
 	}
 
-	res := []Value{}
-
-	for k, v := range val {
-
-		res = append(res, Value{typ: "bulk", bulk: k})
-		res = append(res, Value{typ: "bulk", bulk: v})
-
+	i += delta
+	SETs[key] = strconv.Itoa(i)
+	if ok {
+		growKey(key, stringSize(SETs[key])-stringSize(val))
+	} else {
+		growKey(key, stringSize(SETs[key]))
 	}
 
-	return Value{typ: "array", array: res}
-
+	return Value{typ: "integer", num: i}
 }
@@ -1,21 +1,17 @@
 package main
 
 import (
+	"strconv"
 	"sync"
 	"testing"
 )
 
 func resetStrings() {
-	SETsMu.Lock()
+	dbMu.Lock()
 	for k := range SETs {
 		delete(SETs, k)
 	}
-	SETsMu.Unlock()
-	INCRsMU.Lock()
-	for k := range SETs {
-		delete(SETs, k)
-	}
-	INCRsMU.Unlock()
+	dbMu.Unlock()
 }
 
 func TestPing(t *testing.T) {
@@ -137,6 +133,38 @@ func TestDecrBy(t *testing.T) {
 	}
 }
 
+func TestIncrOverflow(t *testing.T) {
+	resetStrings()
+
+	set(bulks("max", "9223372036854775807"))
+	set(bulks("min", "-9223372036854775808"))
+
+	tests := []struct {
+		name string
+		got  Value
+		want string
+	}{
+		{"INCR max", incr(bulks("max")), "ERR increment or decrement would overflow"},
+		{"INCRBY max 1", incrBy(bulks("max", "1")), "ERR increment or decrement would overflow"},
+		{"DECR min", decr(bulks("min")), "ERR increment or decrement would overflow"},
+		{"DECRBY min 1", decrBy(bulks("min", "1")), "ERR increment or decrement would overflow"},
+		{"INCRBY min -1", incrBy(bulks("min", "-1")), "ERR increment or decrement would overflow"},
+		{"DECRBY max minimum", decrBy(bulks("max", "-9223372036854775808")), "ERR decrement would overflow"},
+	}
+	for _, tt := range tests {
+		if tt.got.typ != "error" || tt.got.str != tt.want {
+			t.Errorf("%s = %+v, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+
+	if got := get(bulks("max")); got.bulk != "9223372036854775807" {
+		t.Errorf("max = %q after overflowing increments", got.bulk)
+	}
+	if got := incrBy(bulks("min", "9223372036854775807")); got.num != -1 {
+		t.Errorf("INCRBY min max = %+v, want -1", got)
+	}
+}
+
 func TestIncrNonInteger(t *testing.T) {
 	resetStrings()
 
@@ -221,3 +249,146 @@ func TestConcurrentSet(t *testing.T) {
 		t.Errorf("after concurrent SETs, GET ckey = %+v, want bulk", got)
 	}
 }
+
+func TestSetOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		before  []string
+		args    []string
+		want    Value
+		wantVal string
+	}{
+		{"NX on missing key", nil, []string{"k", "v", "NX"}, Value{typ: "string", str: "OK"}, "v"},
+		{"NX on existing key", []string{"k", "old"}, []string{"k", "v", "NX"}, Value{typ: "null"}, "old"},
+		{"XX on missing key", nil, []string{"k", "v", "XX"}, Value{typ: "null"}, ""},
+		{"XX on existing key", []string{"k", "old"}, []string{"k", "v", "XX"}, Value{typ: "string", str: "OK"}, "v"},
+		{"GET returns old value", []string{"k", "old"}, []string{"k", "v", "GET"}, Value{typ: "bulk", bulk: "old"}, "v"},
+		{"GET on missing key", nil, []string{"k", "v", "GET"}, Value{typ: "null"}, "v"},
+		{"NX GET on existing key", []string{"k", "old"}, []string{"k", "v", "NX", "GET"}, Value{typ: "bulk", bulk: "old"}, "old"},
+		{"lowercase options", nil, []string{"k", "v", "ex", "10", "nx"}, Value{typ: "string", str: "OK"}, "v"},
+		{"NX and XX", nil, []string{"k", "v", "NX", "XX"}, Value{typ: "error", str: "ERR syntax error"}, ""},
+		{"EX and PX", nil, []string{"k", "v", "EX", "1", "PX", "1"}, Value{typ: "error", str: "ERR syntax error"}, ""},
+		{"EX and KEEPTTL", nil, []string{"k", "v", "EX", "1", "KEEPTTL"}, Value{typ: "error", str: "ERR syntax error"}, ""},
+		{"EX without value", nil, []string{"k", "v", "EX"}, Value{typ: "error", str: "ERR syntax error"}, ""},
+		{"EX not an integer", nil, []string{"k", "v", "EX", "ten"}, Value{typ: "error", str: "ERR: value is not an integer"}, ""},
+		{"EX zero", nil, []string{"k", "v", "EX", "0"}, Value{typ: "error", str: "ERR invalid expire time in 'set' command"}, ""},
+		{"EX overflowing", nil, []string{"k", "v", "EX", "9223372036854776"}, Value{typ: "error", str: "ERR invalid expire time in 'set' command"}, ""},
+		{"EXAT overflowing", nil, []string{"k", "v", "EXAT", "9223372036854776"}, Value{typ: "error", str: "ERR invalid expire time in 'set' command"}, ""},
+		{"PX overflowing", nil, []string{"k", "v", "PX", "9223372036854775807"}, Value{typ: "error", str: "ERR invalid expire time in 'set' command"}, ""},
+		{"EXAT largest", nil, []string{"k", "v", "EXAT", "9223372036854775"}, Value{typ: "string", str: "OK"}, "v"},
+		{"unknown option", nil, []string{"k", "v", "FOO"}, Value{typ: "error", str: "ERR syntax error"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetStrings()
+			resetExpires()
+			if tt.before != nil {
+				set(bulks(tt.before...))
+			}
+
+			got := set(bulks(tt.args...))
+			if got.typ != tt.want.typ || got.str != tt.want.str || got.bulk != tt.want.bulk {
+				t.Errorf("SET %v = %+v, want %+v", tt.args, got, tt.want)
+			}
+
+			val := get(bulks("k"))
+			if val.bulk != tt.wantVal {
+				t.Errorf("after SET %v, GET k = %q, want %q", tt.args, val.bulk, tt.wantVal)
+			}
+		})
+	}
+}
+
+func TestSetExpireOptions(t *testing.T) {
+	resetStrings()
+	resetExpires()
+
+	set(bulks("k", "v", "EX", "100"))
+	if got := ttl(bulks("k")); got.num != 100 {
+		t.Errorf("TTL after SET EX 100 = %d, want 100", got.num)
+	}
+
+	set(bulks("k", "v", "PX", "50000"))
+	if got := ttl(bulks("k")); got.num != 50 {
+		t.Errorf("TTL after SET PX 50000 = %d, want 50", got.num)
+	}
+
+	set(bulks("k", "v2", "KEEPTTL"))
+	if got := ttl(bulks("k")); got.num != 50 {
+		t.Errorf("TTL after SET KEEPTTL = %d, want 50", got.num)
+	}
+
+	set(bulks("k", "v3"))
+	if got := ttl(bulks("k")); got.num != -1 {
+		t.Errorf("TTL after plain SET = %d, want -1", got.num)
+	}
+
+	set(bulks("k", "v", "PXAT", "1"))
+	if got := get(bulks("k")); got.typ != "null" {
+		t.Errorf("GET after SET PXAT in the past = %+v, want null", got)
+	}
+}
+
+func TestSetAofEntry(t *testing.T) {
+	resetStrings()
+	resetExpires()
+
+	args := bulks("k", "v", "EX", "100", "NX", "GET")
+	entry, ok := aofEntry("SET", args, set(args))
+	if !ok {
+		t.Fatal("successful SET produced no AOF entry")
+	}
+
+	when, _ := getExpire("k")
+	want := []string{"SET", "k", "v", "PXAT", strconv.FormatInt(when, 10)}
+	if len(entry.array) != len(want) {
+		t.Fatalf("AOF entry = %+v, want %v", entry.array, want)
+	}
+	for i, w := range want {
+		if entry.array[i].bulk != w {
+			t.Errorf("AOF entry[%d] = %q, want %q", i, entry.array[i].bulk, w)
+		}
+	}
+
+	args = bulks("k", "v", "NX")
+	if _, ok := aofEntry("SET", args, set(args)); ok {
+		t.Error("SET NX on an existing key produced an AOF entry")
+	}
+
+	args = bulks("other", "v", "XX", "GET")
+	if _, ok := aofEntry("SET", args, set(args)); ok {
+		t.Error("SET XX GET on a missing key produced an AOF entry")
+	}
+}
+
+func TestIntegerReplies(t *testing.T) {
+	resetKeyspace()
+
+	tests := []struct {
+		command string
+		args    []string
+		want    int
+	}{
+		{"INCR", []string{"counter"}, 1},
+		{"INCRBY", []string{"counter", "10"}, 11},
+		{"DECR", []string{"counter"}, 10},
+		{"DECRBY", []string{"counter", "15"}, -5},
+		{"APPEND", []string{"s", "hello"}, 5},
+		{"APPEND", []string{"s", " world"}, 11},
+		{"RPUSH", []string{"l", "a", "b"}, 2},
+		{"LPUSH", []string{"l", "c"}, 3},
+		{"HSET", []string{"h", "f", "1"}, 1},
+		{"HSET", []string{"h", "f", "2"}, 0},
+		{"HDEL", []string{"h", "missing"}, 0},
+		{"HDEL", []string{"h", "f"}, 1},
+		{"DEL", []string{"counter", "s", "missing"}, 2},
+	}
+
+	for _, tt := range tests {
+		got := Handlers[tt.command](bulks(tt.args...))
+		if got.typ != "integer" || got.num != tt.want {
+			t.Errorf("%s %v = %+v, want :%d", tt.command, tt.args, got, tt.want)
+		}
+	}
+}
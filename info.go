@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// infoSections lists the sections INFO can print, in order. Sections that
+// are not default are only printed when named or with all and everything.
+var infoSections = []struct {
+	name       string
+	title      string
+	fn         func() string
+	notDefault bool
+}{
+	{"server", "Server", serverInfo, false},
+	{"clients", "Clients", clientsInfo, false},
+	{"memory", "Memory", memoryInfo, false},
+	{"persistence", "Persistence", persistenceInfo, false},
+	{"stats", "Stats", statsInfo, false},
+	{"replication", "Replication", func() string { return repl.info() }, false},
+	{"commandstats", "Commandstats", commandstatsInfo, true},
+	{"keyspace", "Keyspace", keyspaceInfo, false},
+}
+
+// info replies with the requested sections, or the default ones when none
+// is named.
+func info(args []Value) Value {
+	all, defaults := false, len(args) == 0
+	selected := map[string]bool{}
+	for _, arg := range args {
+		section := strings.ToLower(arg.bulk)
+		switch section {
+		case "all", "everything":
+			all = true
+		case "default":
+			defaults = true
+		}
+		selected[section] = true
+	}
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !selected[section.name] && (!defaults || section.notDefault) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + section.title + "\r\n")
+		b.WriteString(section.fn())
+	}
+
+	return Value{typ: "bulk", bulk: b.String()}
+}
+
+// startTime is when the server started and runID identifies this run of it.
+var (
+	startTime = time.Now()
+	runID     = newReplicationID()
+)
+
+// Counters reported by the clients and stats sections.
+var (
+	connectedClients    atomic.Int64
+	connectionsReceived atomic.Int64
+	commandsProcessed   atomic.Int64
+	keyspaceHits        atomic.Int64
+	keyspaceMisses      atomic.Int64
+	expiredKeys         atomic.Int64
+)
+
+// The instantaneous rate of commands is, as in Redis, the average of the
+// rates measured over the last opsSamples intervals of opsSampleInterval.
+const (
+	opsSampleInterval = 100 * time.Millisecond
+	opsSamples        = 16
+)
+
+var (
+	opsMu        = sync.Mutex{}
+	opsRates     [opsSamples]int64
+	opsNext      int
+	opsLastCount int64
+	opsLastTime  time.Time
+)
+
+// sampleOps records the rate of commands since the previous sample.
+func sampleOps() {
+	opsMu.Lock()
+	defer opsMu.Unlock()
+
+	now, count := time.Now(), commandsProcessed.Load()
+	if !opsLastTime.IsZero() {
+		if elapsed := now.Sub(opsLastTime); elapsed > 0 {
+			opsRates[opsNext] = (count - opsLastCount) * int64(time.Second) / int64(elapsed)
+			opsNext = (opsNext + 1) % opsSamples
+		}
+	}
+	opsLastCount, opsLastTime = count, now
+}
+
+// instantaneousOps returns the number of commands processed per second
+// lately.
+func instantaneousOps() int64 {
+	opsMu.Lock()
+	defer opsMu.Unlock()
+
+	var sum int64
+	for _, rate := range opsRates {
+		sum += rate
+	}
+	return sum / opsSamples
+}
+
+// startOpsSampler runs sampleOps in the background forever.
+func startOpsSampler() {
+	ticker := time.NewTicker(opsSampleInterval)
+	go func() {
+		for range ticker.C {
+			sampleOps()
+		}
+	}()
+}
+
+// resetStats zeroes the counters of the stats and commandstats sections, as
+// CONFIG RESETSTAT does.
+func resetStats() {
+	opsMu.Lock()
+	commandsProcessed.Store(0)
+	opsRates, opsNext, opsLastCount = [opsSamples]int64{}, 0, 0
+	opsMu.Unlock()
+
+	connectionsReceived.Store(0)
+	keyspaceHits.Store(0)
+	keyspaceMisses.Store(0)
+	expiredKeys.Store(0)
+	evictedKeys.Store(0)
+
+	for _, spec := range commandTable {
+		spec.stats.latency.reset()
+		spec.stats.rejected.Store(0)
+		spec.stats.failed.Store(0)
+	}
+}
+
+func serverInfo() string {
+	uptime := time.Since(startTime)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "redis_version:%s\r\n", serverVersion)
+	fmt.Fprintf(&b, "redis_mode:standalone\r\n")
+	fmt.Fprintf(&b, "os:%s %s\r\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&b, "arch_bits:%d\r\n", strconv.IntSize)
+	fmt.Fprintf(&b, "go_version:%s\r\n", runtime.Version())
+	fmt.Fprintf(&b, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(&b, "run_id:%s\r\n", runID)
+	fmt.Fprintf(&b, "tcp_port:%d\r\n", serverPort)
+	fmt.Fprintf(&b, "config_file:%s\r\n", configFile)
+	fmt.Fprintf(&b, "uptime_in_seconds:%d\r\n", int64(uptime.Seconds()))
+	fmt.Fprintf(&b, "uptime_in_days:%d\r\n", int64(uptime.Hours()/24))
+
+	return b.String()
+}
+
+func clientsInfo() string {
+	pubsubMu.RLock()
+	subscribers := map[*client]struct{}{}
+	for _, clients := range pubsubChannels {
+		for c := range clients {
+			subscribers[c] = struct{}{}
+		}
+	}
+	for _, clients := range pubsubPatterns {
+		for c := range clients {
+			subscribers[c] = struct{}{}
+		}
+	}
+	pubsubMu.RUnlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "connected_clients:%d\r\n", connectedClients.Load())
+	fmt.Fprintf(&b, "pubsub_clients:%d\r\n", len(subscribers))
+
+	return b.String()
+}
+
+func persistenceInfo() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "loading:%d\r\n", boolToInt(loading.Load()))
+
+	if activeSnapshotter != nil {
+		b.WriteString(activeSnapshotter.info())
+	}
+	if activeAof != nil {
+		b.WriteString(activeAof.info())
+	} else {
+		fmt.Fprintf(&b, "aof_enabled:0\r\n")
+	}
+
+	return b.String()
+}
+
+func statsInfo() string {
+	pubsubMu.RLock()
+	channels, patterns := len(pubsubChannels), len(pubsubPatterns)
+	pubsubMu.RUnlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "total_connections_received:%d\r\n", connectionsReceived.Load())
+	fmt.Fprintf(&b, "total_commands_processed:%d\r\n", commandsProcessed.Load())
+	fmt.Fprintf(&b, "instantaneous_ops_per_sec:%d\r\n", instantaneousOps())
+	fmt.Fprintf(&b, "expired_keys:%d\r\n", expiredKeys.Load())
+	fmt.Fprintf(&b, "evicted_keys:%d\r\n", evictedKeys.Load())
+	fmt.Fprintf(&b, "keyspace_hits:%d\r\n", keyspaceHits.Load())
+	fmt.Fprintf(&b, "keyspace_misses:%d\r\n", keyspaceMisses.Load())
+	fmt.Fprintf(&b, "pubsub_channels:%d\r\n", channels)
+	fmt.Fprintf(&b, "pubsub_patterns:%d\r\n", patterns)
+
+	return b.String()
+}
+
+// keyspaceInfo describes the only database, as Redis does with db0, and
+// adds the number of keys of each type. Keys that expired but were not
+// reclaimed yet are still counted, and nothing is printed for an empty
+// keyspace.
+func keyspaceInfo() string {
+	dbMu.RLock()
+	strs, lists, hashes := len(SETs), len(SETsL), len(HSETs)
+	now := nowMs()
+	var ttls int64
+	for _, when := range expires {
+		ttls += max(when-now, 0)
+	}
+	volatile := len(expires)
+	dbMu.RUnlock()
+
+	keys := strs + lists + hashes
+	if keys == 0 {
+		return ""
+	}
+
+	avgTTL := int64(0)
+	if volatile > 0 {
+		avgTTL = ttls / int64(volatile)
+	}
+
+	return fmt.Sprintf("db0:keys=%d,expires=%d,avg_ttl=%d,strings=%d,lists=%d,hashes=%d\r\n", keys, volatile, avgTTL, strs, lists, hashes)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// infoStatus is how INFO reports the outcome of the last operation that
+// returned err.
+func infoStatus(err error) string {
+	if err != nil {
+		return "err"
+	}
+	return "ok"
+}
+
+// durationSec returns the duration in seconds of an operation that ended at
+// end, or -1 if there was none.
+func durationSec(end time.Time, duration time.Duration) int64 {
+	if end.IsZero() {
+		return -1
+	}
+	return int64(duration.Seconds())
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// infoField returns the value of field in the output of INFO section.
+func infoField(t *testing.T, section, field string) string {
+	t.Helper()
+
+	for _, line := range strings.Split(info(bulks(section)).bulk, "\r\n") {
+		if name, value, ok := strings.Cut(line, ":"); ok && name == field {
+			return value
+		}
+	}
+	t.Fatalf("INFO %s has no %s", section, field)
+	return ""
+}
+
+func TestInfoSections(t *testing.T) {
+	got := info(nil).bulk
+	last := -1
+	for _, title := range []string{"Server", "Clients", "Memory", "Persistence", "Stats", "Replication", "Keyspace"} {
+		i := strings.Index(got, "# "+title+"\r\n")
+		if i < last {
+			t.Errorf("section %s is missing or out of order", title)
+		}
+		last = i
+	}
+
+	if got := info(bulks("SERVER", "clients")).bulk; !strings.HasPrefix(got, "# Server\r\n") || !strings.Contains(got, "\r\n\r\n# Clients\r\n") || strings.Contains(got, "# Stats") {
+		t.Errorf("INFO server clients = %q", got)
+	}
+}
+
+func TestInfoStats(t *testing.T) {
+	resetKeyspace()
+	port := startTestServer(t)
+	c := dialTestServer(t, port)
+	c.do(t, "PING")
+
+	if got := infoField(t, "clients", "connected_clients"); got == "0" {
+		t.Errorf("connected_clients = %s with a client connected", got)
+	}
+
+	commands := commandsProcessed.Load()
+	hits, misses := keyspaceHits.Load(), keyspaceMisses.Load()
+
+	c.do(t, "SET", "s", "v")
+	c.do(t, "GET", "s")
+	c.resp.reader.ReadString('\n')
+	c.do(t, "GET", "missing")
+	c.do(t, "RPUSH", "l", "a")
+	c.do(t, "HSET", "h", "f", "v")
+	c.do(t, "PEXPIRE", "h", "100000")
+
+	if got := commandsProcessed.Load() - commands; got != 6 {
+		t.Errorf("%d commands processed, want 6", got)
+	}
+	if keyspaceHits.Load()-hits != 1 || keyspaceMisses.Load()-misses != 1 {
+		t.Errorf("keyspace hits and misses grew by %d and %d, want 1 and 1", keyspaceHits.Load()-hits, keyspaceMisses.Load()-misses)
+	}
+
+	got := infoField(t, "keyspace", "db0")
+	if !strings.HasPrefix(got, "keys=3,expires=1,avg_ttl=") || !strings.HasSuffix(got, ",strings=1,lists=1,hashes=1") {
+		t.Errorf("db0 = %s", got)
+	}
+
+	expired := expiredKeys.Load()
+	c.do(t, "PEXPIRE", "s", "1")
+	time.Sleep(5 * time.Millisecond)
+	c.do(t, "GET", "s")
+	if got := expiredKeys.Load() - expired; got != 1 {
+		t.Errorf("%d keys expired, want 1", got)
+	}
+}
+
+func TestInfoPersistence(t *testing.T) {
+	if got := infoField(t, "persistence", "aof_enabled"); got != "0" {
+		t.Errorf("aof_enabled = %s without an AOF", got)
+	}
+
+	activeAof = newTestAof(t)
+	defer func() { activeAof = nil }()
+
+	applyAndLog(activeAof, "SET", "k", "v")
+	if got := infoField(t, "persistence", "aof_enabled"); got != "1" {
+		t.Errorf("aof_enabled = %s", got)
+	}
+	if got := infoField(t, "persistence", "aof_current_size"); got == "0" {
+		t.Errorf("aof_current_size = %s after a write", got)
+	}
+	if got := infoField(t, "persistence", "aof_last_bgrewrite_status"); got != "ok" {
+		t.Errorf("aof_last_bgrewrite_status = %s", got)
+	}
+}
+
+func TestInstantaneousOps(t *testing.T) {
+	opsMu.Lock()
+	opsRates, opsNext, opsLastTime = [opsSamples]int64{}, 0, time.Time{}
+	opsMu.Unlock()
+
+	sampleOps()
+	time.Sleep(opsSampleInterval)
+	commandsProcessed.Add(100)
+	sampleOps()
+
+	// 100 commands in a tenth of a second, averaged over opsSamples samples
+	if got := instantaneousOps(); got < 20 || got > 200 {
+		t.Errorf("instantaneous ops = %d", got)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// The keyspace is split into one map per data type (SETs, SETsL and HSETs)
+// plus the expires table, all guarded by dbMu. A key lives in at most one of
+// the type maps, so it always has exactly one type, and has an entry in
+// keyInfos that handlers keep up to date with growKey. Helpers in this file
+// expect the caller to hold dbMu.
+var dbMu = sync.RWMutex{}
+
+const (
+	typeNone   = "none"
+	typeString = "string"
+	typeList   = "list"
+	typeHash   = "hash"
+)
+
+var wrongType = Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+
+// keyType returns the type of the value stored at key, or typeNone.
+func keyType(key string) string {
+	if _, ok := SETs[key]; ok {
+		return typeString
+	}
+	if _, ok := SETsL[key]; ok {
+		return typeList
+	}
+	if _, ok := HSETs[key]; ok {
+		return typeHash
+	}
+	return typeNone
+}
+
+// keyExists reports whether key holds a value of any type.
+func keyExists(key string) bool {
+	return keyType(key) != typeNone
+}
+
+// checkType reports whether key is either missing or holds a value of typ.
+func checkType(key, typ string) bool {
+	t := keyType(key)
+	return t == typeNone || t == typ
+}
+
+// deleteValue drops the value stored at key but keeps its time to live.
+func deleteValue(key string) {
+	delete(SETs, key)
+	delete(SETsL, key)
+	delete(HSETs, key)
+	delete(hashFields, key)
+	forgetKey(key)
+}
+
+// lookupRead reports whether key exists and has not expired, and counts a
+// keyspace hit or miss accordingly. Read commands call it in place of
+// expireIfNeeded and treat an expired key as missing: it is left for call to
+// delete, as readers do not hold callMu.
+func lookupRead(key string) bool {
+	if isExpired(key) {
+		if canExpire() {
+			staleKeys[key] = struct{}{}
+		}
+		keyspaceMisses.Add(1)
+		return false
+	}
+
+	recordAccess(key)
+	if !keyExists(key) {
+		keyspaceMisses.Add(1)
+		return false
+	}
+
+	keyspaceHits.Add(1)
+	return true
+}
+
+// removeKey drops key together with its time to live, once the running
+// captures hold a copy of it.
+func removeKey(key string) {
+	preserveKey(key)
+	deleteValue(key)
+	removeExpire(key)
+}
+
+func del(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'del' command"}
+	}
+
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	deleted := 0
+	for _, arg := range args {
+		key := arg.bulk
+
+		expireIfNeeded(key)
+		if keyExists(key) {
+			removeKey(key)
+			deleted++
+		}
+	}
+
+	return Value{typ: "integer", num: deleted}
+}
+
+func exists(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'exists' command"}
+	}
+
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	count := 0
+	for _, arg := range args {
+		key := arg.bulk
+
+		if lookupRead(key) {
+			count++
+		}
+	}
+
+	return Value{typ: "integer", num: count}
+}
+
+func typeCommand(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'type' command"}
+	}
+
+	key := args[0].bulk
+
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	if !lookupRead(key) {
+		return Value{typ: "string", str: typeNone}
+	}
+
+	return Value{typ: "string", str: keyType(key)}
+}
+
+// keyspaceSnapshot is a deep copy of the keyspace taken at one instant.
+// Expired keys are left out.
+type keyspaceSnapshot struct {
+	strings map[string]string
+	lists   map[string][]string
+	hashes  map[string]map[string]string
+	expires map[string]int64
+}
+
+// A capture builds a keyspaceSnapshot of the keyspace as it was when the
+// capture started, without stopping writers. finish copies the keys a batch
+// at a time, walking keyIndex, and writers first call preserveKeys on the
+// keys they are about to change so that their old value is copied before,
+// copy on write. A key is copied once: seen holds the keys copied and those
+// created since the start, which were missing then.
+type keyspaceCapture struct {
+	now  int64
+	snap *keyspaceSnapshot
+	seen map[string]struct{}
+
+	// complete is set once every key is copied before the keyspace is
+	// replaced, see restore.
+	complete bool
+}
+
+// captures are the running captures, guarded by dbMu. capturing counts them
+// for writers to skip preserveKeys without taking dbMu.
+var (
+	captures  = map[*keyspaceCapture]struct{}{}
+	capturing atomic.Int64
+)
+
+// captureBatch is the number of keys a capture copies each time it takes
+// dbMu.
+const captureBatch = 128
+
+// startCapture starts a capture of the keyspace. The caller must hold callMu,
+// so that every write is either fully part of the capture or not at all.
+func startCapture() *keyspaceCapture {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	c := &keyspaceCapture{
+		now: nowMs(),
+		snap: &keyspaceSnapshot{
+			strings: map[string]string{},
+			lists:   map[string][]string{},
+			hashes:  map[string]map[string]string{},
+			expires: map[string]int64{},
+		},
+		seen: map[string]struct{}{},
+	}
+	captures[c] = struct{}{}
+	capturing.Add(1)
+
+	return c
+}
+
+// finish copies the keys that writers left untouched and returns the
+// snapshot. Keys expired when the capture started are left out.
+func (c *keyspaceCapture) finish() *keyspaceSnapshot {
+	cursor := uint64(0)
+	for {
+		dbMu.Lock()
+		if !c.complete {
+			cursor = keyIndex.scan(cursor, captureBatch, c.copyKey)
+		}
+		done := c.complete || cursor == 0
+		if done {
+			delete(captures, c)
+			capturing.Add(-1)
+		}
+		dbMu.Unlock()
+
+		if done {
+			return c.snap
+		}
+	}
+}
+
+// copyKey copies key to the snapshot unless it was already seen.
+func (c *keyspaceCapture) copyKey(key string) {
+	if _, ok := c.seen[key]; ok || c.complete {
+		return
+	}
+	c.seen[key] = struct{}{}
+
+	when, volatile := expires[key]
+	if volatile && when <= c.now {
+		return
+	}
+
+	switch keyType(key) {
+	case typeString:
+		c.snap.strings[key] = SETs[key]
+	case typeList:
+		c.snap.lists[key] = append([]string(nil), SETsL[key]...)
+	case typeHash:
+		fields := HSETs[key]
+		copied := make(map[string]string, len(fields))
+		for field, value := range fields {
+			copied[field] = value
+		}
+		c.snap.hashes[key] = copied
+	default:
+		return
+	}
+	if volatile {
+		c.snap.expires[key] = when
+	}
+}
+
+// copyAll copies every key left and completes the capture.
+func (c *keyspaceCapture) copyAll() {
+	for key := range keyInfos {
+		c.copyKey(key)
+	}
+	c.complete = true
+}
+
+// preserveKeys copies keys to every running capture before a writer changes
+// them. The caller must hold callMu, and not dbMu.
+func preserveKeys(keys []string) {
+	if capturing.Load() == 0 {
+		return
+	}
+
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	for _, key := range keys {
+		preserveKey(key)
+	}
+}
+
+// preserveKey is preserveKeys for a single key, with dbMu held.
+func preserveKey(key string) {
+	for c := range captures {
+		c.copyKey(key)
+	}
+}
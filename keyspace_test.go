@@ -0,0 +1,141 @@
+package main
+
+import "testing"
+
+func resetKeyspace() {
+	dbMu.Lock()
+	for k := range SETs {
+		delete(SETs, k)
+	}
+	for k := range SETsL {
+		delete(SETsL, k)
+	}
+	for k := range HSETs {
+		delete(HSETs, k)
+	}
+	for k := range expires {
+		delete(expires, k)
+	}
+	keyInfos = map[string]*keyInfo{}
+	keyIndex = newScanTable()
+	volatileIndex = newScanTable()
+	hashFields = map[string]*scanTable{}
+	usedMemory.Store(0)
+	expiredDels = nil
+	clear(staleKeys)
+	dbMu.Unlock()
+}
+
+func TestWrongType(t *testing.T) {
+	resetKeyspace()
+
+	set(bulks("s", "v"))
+	Rpush(bulks("l", "a"))
+	hset(bulks("h", "f", "v"))
+
+	tests := []struct {
+		name string
+		got  Value
+	}{
+		{"GET list", get(bulks("l"))},
+		{"APPEND hash", appendto(bulks("h", "x"))},
+		{"INCR list", incr(bulks("l"))},
+		{"LPUSH string", Lpush(bulks("s", "a"))},
+		{"RPUSH hash", Rpush(bulks("h", "a"))},
+		{"LRANGE string", Lrange(bulks("s", "0", "-1"))},
+		{"LPOP hash", Lpop(bulks("h"))},
+		{"HSET string", hset(bulks("s", "f", "v"))},
+		{"HGET list", hget(bulks("l", "f"))},
+		{"HGETALL string", hgetall(bulks("s"))},
+		{"HDEL list", hdel(bulks("l", "f"))},
+		{"SET GET list", set(bulks("l", "v", "GET"))},
+	}
+
+	for _, tt := range tests {
+		if tt.got.typ != "error" || tt.got.str != wrongType.str {
+			t.Errorf("%s = %+v, want WRONGTYPE", tt.name, tt.got)
+		}
+	}
+}
+
+func TestSetReplacesOtherTypes(t *testing.T) {
+	resetKeyspace()
+
+	Rpush(bulks("k", "a"))
+	set(bulks("k", "v"))
+
+	if got := typeCommand(bulks("k")); got.str != "string" {
+		t.Errorf("TYPE after SET over a list = %q, want string", got.str)
+	}
+	if got := Lrange(bulks("k", "0", "-1")); got.typ != "error" {
+		t.Errorf("LRANGE after SET over a list = %+v, want WRONGTYPE", got)
+	}
+}
+
+func TestDelAcrossTypes(t *testing.T) {
+	resetKeyspace()
+
+	set(bulks("s", "v"))
+	Rpush(bulks("l", "a"))
+	hset(bulks("h", "f", "v"))
+	expire(bulks("l", "100"))
+
+	del(bulks("s", "l", "h", "missing"))
+
+	if got := exists(bulks("s", "l", "h")); got.num != 0 {
+		t.Errorf("EXISTS after DEL = %d, want 0", got.num)
+	}
+
+	dbMu.RLock()
+	_, volatile := expires["l"]
+	dbMu.RUnlock()
+	if volatile {
+		t.Error("DEL left the time to live of a deleted key behind")
+	}
+}
+
+func TestExists(t *testing.T) {
+	resetKeyspace()
+
+	set(bulks("s", "v"))
+	Rpush(bulks("l", "a"))
+
+	got := exists(bulks("s", "l", "missing", "s"))
+	if got.typ != "integer" || got.num != 3 {
+		t.Errorf("EXISTS s l missing s = %+v, want 3", got)
+	}
+
+	if got := exists([]Value{}); got.typ != "error" {
+		t.Errorf("EXISTS with no args = %+v, want error", got)
+	}
+}
+
+func TestType(t *testing.T) {
+	resetKeyspace()
+
+	set(bulks("s", "v"))
+	Rpush(bulks("l", "a"))
+	hset(bulks("h", "f", "v"))
+
+	for key, want := range map[string]string{"s": "string", "l": "list", "h": "hash", "missing": "none"} {
+		got := typeCommand(bulks(key))
+		if got.typ != "string" || got.str != want {
+			t.Errorf("TYPE %s = %+v, want %s", key, got, want)
+		}
+	}
+}
+
+func TestEmptyListIsDeleted(t *testing.T) {
+	resetKeyspace()
+
+	Rpush(bulks("l", "a", "b"))
+	Lpop(bulks("l"))
+	Rpop(bulks("l"))
+
+	if got := typeCommand(bulks("l")); got.str != "none" {
+		t.Errorf("TYPE of an emptied list = %q, want none", got.str)
+	}
+	if got := Lpop(bulks("l")); got.typ != "null" {
+		t.Errorf("LPOP on a missing list = %+v, want null", got)
+	}
+}
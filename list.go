@@ -2,11 +2,9 @@ package main
 
 import (
 	"strconv"
-	"sync"
 )
 
 var SETsL = map[string][]string{}
-var SETLsMu = sync.RWMutex{}
 
 func Lpush(args []Value) Value {
 	if len(args) < 2 {
@@ -22,13 +20,19 @@ func Lpush(args []Value) Value {
 		values[size-i-1] = args[i+1].bulk
 	}
 
-	SETLsMu.Lock()
-	defer SETLsMu.Unlock()
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	expireIfNeeded(key)
+	if !checkType(key, typeList) {
+		return wrongType
+	}
 
 	// Append values to the beginning of SETsL[key]
 	SETsL[key] = append(values, SETsL[key]...)
+	growKey(key, listSize(values))
 
-	return Value{typ: "string", str: "OK"}
+	return Value{typ: "integer", num: len(SETsL[key])}
 }
 
 func Lrange(args []Value) Value {
@@ -51,11 +55,17 @@ func Lrange(args []Value) Value {
 		return Value{typ: "error", str: "ERR: value is not an integer"}
 	}
 
-	SETLsMu.RLock()
+	dbMu.Lock()
+	defer dbMu.Unlock()
 
-	value, ok := SETsL[key]
+	if !lookupRead(key) {
+		return Value{typ: "null"}
+	}
+	if !checkType(key, typeList) {
+		return wrongType
+	}
 
-	SETLsMu.RUnlock()
+	value, ok := SETsL[key]
 
 	if !ok {
 		return Value{typ: "null"}
@@ -93,11 +103,18 @@ func Rpush(args []Value) Value {
 		values = append(values, args[i+1].bulk)
 	}
 
-	SETLsMu.Lock()
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	expireIfNeeded(key)
+	if !checkType(key, typeList) {
+		return wrongType
+	}
+
 	SETsL[key] = append(SETsL[key], values...)
-	SETLsMu.Unlock()
+	growKey(key, listSize(values))
 
-	return Value{typ: "string", str: "OK"}
+	return Value{typ: "integer", num: len(SETsL[key])}
 }
 
 func Lpop(args []Value) Value {
@@ -107,37 +124,59 @@ func Lpop(args []Value) Value {
 	}
 
 	key := args[0].bulk
-	SETLsMu.Lock()
 
-	value, ok := SETsL[key]
-	res := value[0]
-	SETsL[key] = value[1:]
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	expireIfNeeded(key)
+	if !checkType(key, typeList) {
+		return wrongType
+	}
 
-	SETLsMu.Unlock()
+	value, ok := SETsL[key]
 	if !ok {
 		return Value{typ: "null"}
 	}
 
+	res := value[0]
+	growKey(key, -listSize(value[:1]))
+	setList(key, value[1:])
+
 	return Value{typ: "bulk", bulk: res}
 }
 func Rpop(args []Value) Value {
 
 	if len(args) != 1 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'lpop' command"}
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'rpop' command"}
 	}
 
 	key := args[0].bulk
 
-	SETLsMu.Lock()
+	dbMu.Lock()
+	defer dbMu.Unlock()
 
-	value, ok := SETsL[key]
-	res := value[len(value)-1]
-	SETsL[key] = value[:len(value)-1]
-	SETLsMu.Unlock()
+	expireIfNeeded(key)
+	if !checkType(key, typeList) {
+		return wrongType
+	}
 
+	value, ok := SETsL[key]
 	if !ok {
 		return Value{typ: "null"}
 	}
 
+	res := value[len(value)-1]
+	growKey(key, -listSize(value[len(value)-1:]))
+	setList(key, value[:len(value)-1])
+
 	return Value{typ: "bulk", bulk: res}
 }
+
+// setList stores list at key, deleting the key once the list is empty.
+func setList(key string, list []string) {
+	if len(list) == 0 {
+		removeKey(key)
+		return
+	}
+	SETsL[key] = list
+}
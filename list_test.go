@@ -24,13 +24,13 @@ func TestLpush(t *testing.T) {
 		{
 			name:     "Single value push",
 			args:     []Value{{bulk: "mylist"}, {bulk: "value1"}},
-			want:     Value{typ: "string", str: "OK"},
+			want:     Value{typ: "integer", num: 1},
 			wantList: []string{"value1"},
 		},
 		{
 			name:     "Multiple values push",
 			args:     []Value{{bulk: "mylist"}, {bulk: "value2"}, {bulk: "value3"}},
-			want:     Value{typ: "string", str: "OK"},
+			want:     Value{typ: "integer", num: 3},
 			wantList: []string{"value3", "value2", "value1"},
 		},
 		{
@@ -45,12 +45,12 @@ func TestLpush(t *testing.T) {
 			t.Logf("Running test case: %s", tt.name)
 			t.Logf("Initial state: %v", SETsL)
 
-			got := Lpush(tt.args).str
-			if got != tt.want.str {
+			got := Lpush(tt.args)
+			if got.typ != tt.want.typ || got.str != tt.want.str || got.num != tt.want.num {
 				t.Errorf("Lpush() = %v, want %v", got, tt.want)
 			}
-			if tt.want.typ == "string" {
-				SETLsMu.Lock()
+			if tt.want.typ == "integer" {
+				dbMu.Lock()
 				if list, exists := SETsL[tt.args[0].bulk]; exists {
 					if !equal(list, tt.wantList) {
 						t.Errorf("SETsL[%v] = %v, want %v", tt.args[0].bulk, list, tt.wantList)
@@ -58,7 +58,7 @@ func TestLpush(t *testing.T) {
 				} else {
 					t.Errorf("SETsL[%v] does not exist", tt.args[0].bulk)
 				}
-				SETLsMu.Unlock()
+				dbMu.Unlock()
 			}
 		})
 	}
@@ -149,13 +149,13 @@ func TestRpush(t *testing.T) {
 		{
 			name:     "Single value push",
 			args:     []Value{{bulk: "mylist"}, {bulk: "value1"}},
-			want:     Value{typ: "string", str: "OK"},
+			want:     Value{typ: "integer", num: 1},
 			wantList: []string{"value1"},
 		},
 		{
 			name:     "Multiple values push",
 			args:     []Value{{bulk: "mylist"}, {bulk: "value2"}, {bulk: "value3"}},
-			want:     Value{typ: "string", str: "OK"},
+			want:     Value{typ: "integer", num: 2},
 			wantList: []string{"value2", "value3"},
 		},
 		{
@@ -177,12 +177,12 @@ func TestRpush(t *testing.T) {
 
 			got := Rpush(tt.args)
 
-			if got.typ != tt.want.typ || got.str != tt.want.str {
+			if got.typ != tt.want.typ || got.str != tt.want.str || got.num != tt.want.num {
 				t.Errorf("Rpush() = %v, want %v", got, tt.want)
 			}
 
-			if tt.want.typ == "string" {
-				SETLsMu.Lock()
+			if tt.want.typ == "integer" {
+				dbMu.Lock()
 				if list, exists := SETsL[tt.args[0].bulk]; exists {
 					if !equal(list, tt.wantList) {
 						t.Errorf("SETsL[%v] = %v, want %v", tt.args[0].bulk, list, tt.wantList)
@@ -190,7 +190,7 @@ func TestRpush(t *testing.T) {
 				} else {
 					t.Errorf("SETsL[%v] does not exist", tt.args[0].bulk)
 				}
-				SETLsMu.Unlock()
+				dbMu.Unlock()
 			}
 		})
 	}
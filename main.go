@@ -1,47 +1,124 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func main() {
-	aof, err := NewAof("database.aof")
+	// as with redis-server, the config file is the first argument and the
+	// flags after it override its parameters
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		configFile, args = args[0], args[1:]
+	}
+
+	overrides := []string{}
+	configFlags(flag.CommandLine, &overrides)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [config file] [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
+
+	pairs := []string{}
+	if configFile != "" {
+		var err error
+		if pairs, err = readConfigFile(configFile); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	// the files and ports are needed to open the AOF and the snapshot, which
+	// the other parameters may change
+	startup, others := splitConfig(append(pairs, overrides...))
+	if err := applyConfig(startup, true); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	aof, err := NewAof(appendFilename)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 	defer aof.Close()
+	activeAof = aof
 
-	aof.Read(func(value Value) {
-		command := strings.ToUpper(value.array[0].bulk)
-		args := value.array[1:]
+	snapshotter := NewSnapshotter(dbFilename, aof)
+	activeSnapshotter = snapshotter
+
+	if err := applyConfig(others, true); err != nil {
+		fmt.Println(err)
+		return
+	}
+	startTLSReload()
 
-		handler, ok := Handlers[command]
-		if !ok {
-			fmt.Println("Invalid command: ", command)
+	if aclFilePath() != "" {
+		if err := loadStartupACLFile(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Println(err)
 			return
 		}
+	}
 
-		handler(args)
-	})
+	// serving part of the data would let the next writes bury the rest
+	if err := loadData(aof, snapshotter); err != nil {
+		log.Println("Error loading data:", err)
+		return
+	}
+
+	startActiveExpire(aof)
+	startOpsSampler()
 
 	api := NewAPI(aof)
 	go api.Start()
 
-	l, err := net.Listen("tcp", ":6379")
+	if tlsHTTPPort != 0 {
+		go api.StartTLS(tlsHTTPPort)
+	}
+
+	if tlsPort != 0 {
+		tl, err := listenTLS(tlsPort)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		fmt.Printf("Listening for TLS on port :%d\n", tlsPort)
+		go serve(tl, aof)
+	}
+
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(serverPort))
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	defer l.Close()
 
-	fmt.Println("Listening on port :6379")
+	fmt.Printf("Listening on port :%d\n", serverPort)
+	go serve(l, aof)
+
+	// SHUTDOWN exits from the connection it is sent on
+	handleSignals()
+}
+
+// serve handles the connections accepted by l until it is closed on
+// shutdown.
+func serve(l net.Listener, aof *Aof) {
+	trackListener(l)
 
 	for {
 		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Println("Accept error:", err)
 			continue
@@ -52,14 +129,39 @@ func main() {
 }
 
 func handleConnection(conn net.Conn, aof *Aof) {
-	defer conn.Close()
+	c := newClient(conn)
+	c.aof = aof
+	if !trackClient(c) {
+		c.close()
+		return
+	}
+	defer untrackClient(c)
+	connectedClients.Add(1)
+	connectionsReceived.Add(1)
+	defer connectedClients.Add(-1)
+	defer c.finish()
+	defer unsubscribeAll(c)
+	defer stopMonitoring(c)
+	defer c.unwatchAll()
+
+	resp := NewResp(conn)
 
 	for {
-		resp := NewResp(conn)
-		value, err := resp.Read()
+		// replies are sent once every pipelined command has been read
+		if resp.reader.Buffered() == 0 {
+			c.flush()
+		}
+
+		resp.unauthenticated = c.user == nil
+		value, err := resp.ReadCommand()
 		if err != nil {
+			var protoErr *protocolError
+			if errors.As(err, &protoErr) {
+				c.write(Value{typ: "error", str: "ERR " + protoErr.Error()})
+			}
 			return
 		}
+		c.cork()
 
 		if value.typ != "array" {
 			continue
@@ -72,19 +174,87 @@ func handleConnection(conn net.Conn, aof *Aof) {
 		command := strings.ToUpper(value.array[0].bulk)
 		args := value.array[1:]
 
-		writer := NewWriter(conn)
+		// RESP3 connections can run any command while subscribed, as pushed
+		// messages cannot be mistaken for replies
+		if c.protocol() == 2 && c.subscribed() {
+			if command == "PING" {
+				c.write(pubsubPing(args))
+				continue
+			}
+			if !pubsubCommands[command] {
+				c.write(Value{typ: "error", str: "ERR Can't execute '" + strings.ToLower(command) + "': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context"})
+				continue
+			}
+		}
+
+		// the replies to a client in monitor mode would be mixed with the
+		// commands it receives
+		if c.isMonitoring() && command != "QUIT" {
+			c.write(Value{typ: "error", str: "ERR Can't execute '" + strings.ToLower(command) + "': only QUIT is allowed in MONITOR mode"})
+			continue
+		}
+
+		spec := lookupCommand(command)
 
-		handler, ok := Handlers[command]
-		if !ok {
-			writer.Write(Value{typ: "string", str: ""})
+		// the user was deleted
+		if c.user != nil && c.user.isRemoved() {
+			return
+		}
+
+		// an unauthenticated client gets NOAUTH for unknown commands too,
+		// so it cannot probe which commands exist
+		if c.user == nil && (spec == nil || spec.flags&flagNoAuth == 0) {
+			if spec != nil {
+				spec.stats.rejected.Add(1)
+			}
+			c.write(noAuth)
+			continue
+		}
+
+		// the permissions are checked before the command is queued, and
+		// a refusal aborts the transaction
+		if spec != nil && spec.flags&flagNoAuth == 0 {
+			if reply, denied := c.aclDenied(spec, args); denied {
+				spec.stats.rejected.Add(1)
+				if c.multi {
+					c.multiFailed = true
+				}
+				c.write(reply)
+				continue
+			}
+		}
+
+		if c.multi && command != "EXEC" && command != "DISCARD" && command != "MULTI" && command != "WATCH" && command != "QUIT" {
+			c.queue(spec, value)
 			continue
 		}
 
-		switch command {
-		case "SET", "HSET", "HDEL", "DEL", "INCR", "DECR", "INCRBY", "DECRBY", "APPEND", "LPOP", "RPOP", "LPUSH", "RPUSH":
-			aof.Write(value)
+		if spec == nil {
+			c.write(unknownCommand(value))
+			continue
+		}
+		if !spec.checkArity(len(value.array)) {
+			spec.stats.rejected.Add(1)
+			c.write(spec.arityError())
+			continue
+		}
+
+		switch {
+		case command == "QUIT":
+			c.write(Value{typ: "string", str: "OK"})
+			return
+		case command == "PSYNC":
+			repl.serveReplica(c, resp, args)
+			return
+		case spec.clientHandler != nil:
+			from := c.origin()
+			commandsProcessed.Add(1)
+			feedMonitors(from, spec, args)
+			start := time.Now()
+			spec.clientHandler(c, args)
+			recordCall(from, spec, args, time.Since(start), false)
+		default:
+			c.write(call(aof, c.origin(), spec, args))
 		}
-		result := handler(args)
-		writer.Write(result)
 	}
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+// pipeline encodes commands as a single pipelined request.
+func pipeline(commands ...[]string) []byte {
+	var b bytes.Buffer
+	for _, command := range commands {
+		b.Write(Value{typ: "array", array: bulks(command...)}.Marshal())
+	}
+	return b.Bytes()
+}
+
+func TestPipelining(t *testing.T) {
+	resetKeyspace()
+	port := startTestServer(t)
+	c := dialTestServer(t, port)
+
+	commands := [][]string{}
+	for i := 0; i < 1000; i++ {
+		commands = append(commands, []string{"INCR", "counter"})
+	}
+	// inline commands can be pipelined too
+	request := append(pipeline(commands...), "GET counter\r\n"...)
+
+	if _, err := c.conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 1000; i++ {
+		reply, err := c.resp.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.typ != "integer" || reply.num != i {
+			t.Fatalf("reply %d = %+v, want :%d", i, reply, i)
+		}
+	}
+	if reply, err := c.resp.Read(); err != nil || reply.bulk != "1000" {
+		t.Fatalf("GET counter = %+v, %v, want 1000", reply, err)
+	}
+}
+
+func BenchmarkPipeline100(b *testing.B) {
+	resetKeyspace()
+	port := startTestServer(b)
+	c := dialTestServer(b, port)
+
+	const depth = 100
+	commands := [][]string{}
+	for i := 0; i < depth; i++ {
+		commands = append(commands, []string{"SET", "key:" + strconv.Itoa(i), "value"})
+	}
+	request := pipeline(commands...)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.conn.Write(request); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < depth; j++ {
+			if _, err := c.resp.Read(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(b.N*depth)/b.Elapsed().Seconds(), "commands/s")
+}
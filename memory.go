@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// keyInfo holds the bookkeeping of a key used by eviction: an estimate of
+// the memory it takes and how recently and frequently it was accessed. It
+// is guarded by dbMu like the rest of the keyspace.
+type keyInfo struct {
+	size int64
+
+	// access is when the key was last accessed, in unix milliseconds.
+	access int64
+
+	// lfu is a logarithmic access counter as in Redis: it grows more and
+	// more slowly as it gets higher, and is decremented by one for every
+	// minute without an access, the last time being lfuDecayed.
+	lfu        uint8
+	lfuDecayed int64
+}
+
+// keyInfos has an entry for every key of the keyspace, and keyIndex indexes
+// the same keys for SCAN.
+var (
+	keyInfos = map[string]*keyInfo{}
+	keyIndex = newScanTable()
+)
+
+// usedMemory is the sum of the sizes of every key.
+var usedMemory atomic.Int64
+
+// The size of a key is estimated as its name and contents plus a fixed
+// overhead for the key itself and for each element of a list or field of a
+// hash, which stands for the Go map entries, slice headers and strings
+// holding them.
+const (
+	keyOverhead     = 64
+	elementOverhead = 16
+	fieldOverhead   = 48
+)
+
+const (
+	lfuInitValue = 5
+	lfuLogFactor = 10
+	lfuDecayTime = 60 * 1000
+)
+
+// growKey adds delta to the size of key, creating its bookkeeping if it is
+// new. Handlers call it right after changing the value stored at key.
+func growKey(key string, delta int) {
+	info := keyInfos[key]
+	if info == nil {
+		now := nowMs()
+		info = &keyInfo{size: keyOverhead + int64(len(key)), access: now, lfu: lfuInitValue, lfuDecayed: now}
+		keyInfos[key] = info
+		keyIndex.add(key)
+		usedMemory.Add(info.size)
+	}
+
+	info.size += int64(delta)
+	usedMemory.Add(int64(delta))
+}
+
+// forgetKey drops the bookkeeping of key once its value is deleted.
+func forgetKey(key string) {
+	if info := keyInfos[key]; info != nil {
+		usedMemory.Add(-info.size)
+		delete(keyInfos, key)
+		keyIndex.remove(key)
+	}
+}
+
+// recordAccess updates the access time and counter of key.
+func recordAccess(key string) {
+	info := keyInfos[key]
+	if info == nil {
+		return
+	}
+
+	now := nowMs()
+	info.access = now
+	info.lfu = info.decayedLFU(now)
+	info.lfuDecayed = now
+
+	if info.lfu < 255 {
+		base := max(float64(info.lfu)-lfuInitValue, 0)
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			info.lfu++
+		}
+	}
+}
+
+// decayedLFU returns the access counter decremented for the time elapsed
+// since it was last decayed.
+func (info *keyInfo) decayedLFU(now int64) uint8 {
+	periods := (now - info.lfuDecayed) / lfuDecayTime
+	if periods >= int64(info.lfu) {
+		return 0
+	}
+	return info.lfu - uint8(periods)
+}
+
+// stringSize, listSize and hashSize estimate the contents of a value,
+// without the overhead of the key.
+func stringSize(value string) int {
+	return len(value)
+}
+
+func listSize(list []string) int {
+	size := 0
+	for _, element := range list {
+		size += len(element) + elementOverhead
+	}
+	return size
+}
+
+func hashSize(fields map[string]string) int {
+	size := 0
+	for field, value := range fields {
+		size += len(field) + len(value) + fieldOverhead
+	}
+	return size
+}
+
+// rebuildKeyInfos recomputes the bookkeeping of the whole keyspace, after
+// it was replaced. dbMu must be held.
+func rebuildKeyInfos() {
+	keyInfos = make(map[string]*keyInfo, len(SETs)+len(SETsL)+len(HSETs))
+	keyIndex = newScanTable()
+	usedMemory.Store(0)
+
+	for key, value := range SETs {
+		growKey(key, stringSize(value))
+	}
+	for key, list := range SETsL {
+		growKey(key, listSize(list))
+	}
+	for key, fields := range HSETs {
+		growKey(key, hashSize(fields))
+	}
+}
+
+// Eviction policies, as in Redis.
+const (
+	policyNoEviction     = "noeviction"
+	policyAllKeysLRU     = "allkeys-lru"
+	policyAllKeysLFU     = "allkeys-lfu"
+	policyAllKeysRandom  = "allkeys-random"
+	policyVolatileLRU    = "volatile-lru"
+	policyVolatileLFU    = "volatile-lfu"
+	policyVolatileRandom = "volatile-random"
+	policyVolatileTTL    = "volatile-ttl"
+)
+
+var evictionPolicies = []string{
+	policyNoEviction, policyAllKeysLRU, policyAllKeysLFU, policyAllKeysRandom,
+	policyVolatileLRU, policyVolatileLFU, policyVolatileRandom, policyVolatileTTL,
+}
+
+// maxmemoryConfig limits the memory used by the keyspace. maxmemory is in
+// bytes, 0 meaning no limit, and samples is how many keys eviction looks at
+// to pick each victim.
+type maxmemoryConfig struct {
+	maxmemory int64
+	policy    string
+	samples   int
+}
+
+var (
+	maxmemoryMu = sync.RWMutex{}
+	maxmemory   = maxmemoryConfig{policy: policyNoEviction, samples: 5}
+)
+
+// evictedKeys counts the keys evicted since startup.
+var evictedKeys atomic.Int64
+
+var errOOM = Value{typ: "error", str: "OOM command not allowed when used memory > 'maxmemory'."}
+
+func currentMaxmemory() maxmemoryConfig {
+	maxmemoryMu.RLock()
+	defer maxmemoryMu.RUnlock()
+
+	return maxmemory
+}
+
+func setMaxmemory(bytes int64) {
+	maxmemoryMu.Lock()
+	defer maxmemoryMu.Unlock()
+
+	maxmemory.maxmemory = bytes
+}
+
+func setMaxmemoryPolicy(policy string) error {
+	policy = strings.ToLower(policy)
+	if !containsString(evictionPolicies, policy) {
+		return fmt.Errorf("invalid maxmemory-policy %q", policy)
+	}
+
+	maxmemoryMu.Lock()
+	defer maxmemoryMu.Unlock()
+
+	maxmemory.policy = policy
+	return nil
+}
+
+func setMaxmemorySamples(samples int) error {
+	if samples < 1 || samples > 64 {
+		return errors.New("maxmemory-samples must be between 1 and 64")
+	}
+
+	maxmemoryMu.Lock()
+	defer maxmemoryMu.Unlock()
+
+	maxmemory.samples = samples
+	return nil
+}
+
+// performEvictions evicts keys until the used memory is back under
+// maxmemory, appending a DEL for each of them to aof and sending it to the
+// replicas. It reports whether enough memory could be freed, which is never
+// the case under noeviction or once no key is left to evict.
+func performEvictions(aof *Aof) bool {
+	config := currentMaxmemory()
+	if config.maxmemory == 0 {
+		return true
+	}
+
+	for usedMemory.Load() > config.maxmemory {
+		if config.policy == policyNoEviction {
+			return false
+		}
+
+		key, ok := evictKey(config)
+		if !ok {
+			return false
+		}
+
+		evictedKeys.Add(1)
+		commit(aof, Value{typ: "array", array: bulks("DEL", key)})
+	}
+
+	return true
+}
+
+// evictKey samples keys at random, among every key or only those with a
+// time to live depending on the policy, and deletes the best candidate among
+// them: the least recently used, the least frequently used, the one closest
+// to expire or any of them.
+func evictKey(config maxmemoryConfig) (string, bool) {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	now := nowMs()
+	victim, best := "", int64(0)
+
+	index := volatileIndex
+	if strings.HasPrefix(config.policy, "allkeys-") {
+		index = keyIndex
+	}
+
+	for _, key := range index.sample(config.samples) {
+		info := keyInfos[key]
+		if info == nil {
+			continue
+		}
+
+		var score int64
+		switch config.policy {
+		case policyAllKeysLRU, policyVolatileLRU:
+			score = now - info.access
+		case policyAllKeysLFU, policyVolatileLFU:
+			score = 255 - int64(info.decayedLFU(now))
+		case policyVolatileTTL:
+			score = -expires[key]
+		}
+
+		if victim == "" || score > best {
+			victim, best = key, score
+		}
+	}
+
+	if victim == "" {
+		return "", false
+	}
+
+	removeKey(victim)
+	touchKey(victim)
+	return victim, true
+}
+
+// parseMemory parses an amount of memory such as 1048576, 100mb or 2gb.
+// As in Redis k, m and g are powers of 1000 and kb, mb and gb powers of
+// 1024.
+func parseMemory(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+
+	value = strings.ToLower(value)
+	factor := int64(1)
+	for _, unit := range units {
+		if number, ok := strings.CutSuffix(value, unit.suffix); ok {
+			value, factor = number, unit.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("argument must be a memory value")
+	}
+	if n > math.MaxInt64/factor {
+		return 0, errors.New("argument is out of range")
+	}
+	return n * factor, nil
+}
+
+// formatMemory formats bytes for humans, as the *_human fields of INFO.
+func formatMemory(bytes int64) string {
+	switch {
+	case bytes >= 1<<30:
+		return fmt.Sprintf("%.2fG", float64(bytes)/(1<<30))
+	case bytes >= 1<<20:
+		return fmt.Sprintf("%.2fM", float64(bytes)/(1<<20))
+	case bytes >= 1<<10:
+		return fmt.Sprintf("%.2fK", float64(bytes)/(1<<10))
+	}
+	return strconv.FormatInt(bytes, 10) + "B"
+}
+
+// memoryInfo is the memory section of INFO.
+func memoryInfo() string {
+	config := currentMaxmemory()
+	used := usedMemory.Load()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "used_memory:%d\r\n", used)
+	fmt.Fprintf(&b, "used_memory_human:%s\r\n", formatMemory(used))
+	fmt.Fprintf(&b, "maxmemory:%d\r\n", config.maxmemory)
+	fmt.Fprintf(&b, "maxmemory_human:%s\r\n", formatMemory(config.maxmemory))
+	fmt.Fprintf(&b, "maxmemory_policy:%s\r\n", config.policy)
+	fmt.Fprintf(&b, "maxmemory_samples:%d\r\n", config.samples)
+
+	return b.String()
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// limitMemory sets maxmemory and the eviction policy until the end of the
+// test.
+func limitMemory(t *testing.T, bytes int64, policy string) {
+	t.Helper()
+
+	setMaxmemory(bytes)
+	if err := setMaxmemoryPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		setMaxmemory(0)
+		setMaxmemoryPolicy(policyNoEviction)
+	})
+}
+
+func TestMemoryAccounting(t *testing.T) {
+	resetKeyspace()
+
+	// sizes of the keys s, l and h once they hold "x", ["bb"] and {f: vv}
+	str := int64(keyOverhead + 1 + 1)
+	list := int64(keyOverhead + 1 + elementOverhead + 2)
+	hash := int64(keyOverhead + 1 + fieldOverhead + 1 + 2)
+
+	steps := []struct {
+		command []string
+		want    int64
+	}{
+		{[]string{"SET", "s", "abc"}, keyOverhead + 1 + 3},
+		{[]string{"APPEND", "s", "de"}, keyOverhead + 1 + 5},
+		{[]string{"SET", "s", "x"}, str},
+		{[]string{"RPUSH", "l", "a", "bb"}, str + list + elementOverhead + 1},
+		{[]string{"LPOP", "l"}, str + list},
+		{[]string{"HSET", "h", "f", "vv"}, str + list + hash},
+		{[]string{"HDEL", "h", "f"}, str + list},
+		{[]string{"DEL", "s", "l"}, 0},
+	}
+	for _, step := range steps {
+		spec := lookupCommand(step.command[0])
+		call(nil, origin{}, spec, bulks(step.command[1:]...))
+		if got := usedMemory.Load(); got != step.want {
+			t.Fatalf("used memory after %v = %d, want %d", step.command, got, step.want)
+		}
+	}
+}
+
+func TestNoEviction(t *testing.T) {
+	resetKeyspace()
+	port := startTestServer(t)
+	c := dialTestServer(t, port)
+
+	c.do(t, "SET", "k", strings.Repeat("x", 100))
+	limitMemory(t, 100, policyNoEviction)
+
+	if got := c.do(t, "SET", "other", "v"); got != "-"+errOOM.str {
+		t.Fatalf("SET over maxmemory = %q", got)
+	}
+	c.do(t, "MULTI")
+	c.do(t, "SET", "other", "v")
+	if got := c.do(t, "EXEC"); got != "-"+errOOM.str {
+		t.Fatalf("EXEC over maxmemory = %q", got)
+	}
+	if got := c.do(t, "EXISTS", "k"); got != ":1" {
+		t.Fatalf("EXISTS over maxmemory = %q", got)
+	}
+	if got := c.do(t, "DEL", "k"); got != ":1" {
+		t.Fatalf("DEL over maxmemory = %q", got)
+	}
+	if got := c.do(t, "SET", "other", "v"); got != "+OK" {
+		t.Fatalf("SET once memory was freed = %q", got)
+	}
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	tests := []struct {
+		policy  string
+		prepare func()
+		evicted string
+	}{
+		{policyAllKeysLRU, func() { keyInfos["a"].access -= 60 * 1000 }, "a"},
+		{policyAllKeysLFU, func() { keyInfos["b"].lfu = 0 }, "b"},
+		{policyVolatileLRU, func() { keyInfos["a"].access -= 60 * 1000; keyInfos["b"].access -= 1000 }, "b"},
+		{policyVolatileTTL, func() {}, "c"},
+	}
+
+	for _, tt := range tests {
+		resetKeyspace()
+		set(bulks("a", "1"))
+		set(bulks("b", "1"))
+		set(bulks("c", "1"))
+		expire(bulks("b", "1000"))
+		expire(bulks("c", "100"))
+		tt.prepare()
+
+		evicted := evictedKeys.Load()
+		limitMemory(t, usedMemory.Load()-1, tt.policy)
+		if !performEvictions(nil) {
+			t.Fatalf("%s: no key could be evicted", tt.policy)
+		}
+
+		if got := evictedKeys.Load() - evicted; got != 1 {
+			t.Errorf("%s: %d keys evicted, want 1", tt.policy, got)
+		}
+		if got := exists(bulks(tt.evicted)); got.num != 0 {
+			t.Errorf("%s: %s was not evicted", tt.policy, tt.evicted)
+		}
+	}
+}
+
+func TestVolatileEvictionWithoutTTL(t *testing.T) {
+	resetKeyspace()
+	set(bulks("k", "v"))
+	limitMemory(t, 1, policyVolatileRandom)
+
+	if performEvictions(nil) {
+		t.Fatal("evictions succeeded without any key with a time to live")
+	}
+	if got := exists(bulks("k")); got.num != 1 {
+		t.Error("a key without a time to live was evicted")
+	}
+}
+
+func TestVolatileIndexFollowsExpires(t *testing.T) {
+	resetKeyspace()
+	set(bulks("a", "1"))
+	set(bulks("b", "1"))
+	set(bulks("c", "1"))
+	expire(bulks("a", "100"))
+	expire(bulks("b", "100"))
+	expire(bulks("b", "200"))
+	persist(bulks("a"))
+	del(bulks("b"))
+	expire(bulks("c", "100"))
+
+	if volatileIndex.count != 1 || len(expires) != 1 {
+		t.Fatalf("volatile index holds %d keys, expires %d, want 1", volatileIndex.count, len(expires))
+	}
+	if key, _ := volatileIndex.random(); key != "c" {
+		t.Errorf("volatile index holds %q, want c", key)
+	}
+}
+
+func TestMemoryConfig(t *testing.T) {
+	t.Cleanup(func() {
+		setMaxmemory(0)
+		setMaxmemoryPolicy(policyNoEviction)
+		setMaxmemorySamples(5)
+	})
+
+	for _, args := range [][]string{
+		{"SET", "maxmemory", "2mb"},
+		{"SET", "maxmemory-policy", "ALLKEYS-LFU"},
+		{"SET", "maxmemory-samples", "10"},
+	} {
+		if got := configCommand(bulks(args...)); got.str != "OK" {
+			t.Fatalf("CONFIG %v = %+v", args, got)
+		}
+	}
+	if got := currentMaxmemory(); got != (maxmemoryConfig{maxmemory: 2 << 20, policy: policyAllKeysLFU, samples: 10}) {
+		t.Errorf("maxmemory settings = %+v", got)
+	}
+
+	for _, args := range [][]string{
+		{"SET", "maxmemory", "lots"},
+		{"SET", "maxmemory", "9999999999999gb"},
+		{"SET", "maxmemory-policy", "sometimes"},
+		{"SET", "maxmemory-samples", "0"},
+	} {
+		if got := configCommand(bulks(args...)); got.typ != "error" {
+			t.Errorf("CONFIG %v = %+v, want error", args, got)
+		}
+	}
+
+	if got := info(bulks("memory")); !strings.Contains(got.bulk, "maxmemory:2097152\r\nmaxmemory_human:2.00M\r\nmaxmemory_policy:allkeys-lfu\r\n") {
+		t.Errorf("INFO memory = %q", got.bulk)
+	}
+}
+
+func TestParseMemory(t *testing.T) {
+	tests := map[string]int64{
+		"0":     0,
+		"100":   100,
+		"100b":  100,
+		"1k":    1000,
+		"1kb":   1024,
+		"2MB":   2 << 20,
+		"1g":    1000 * 1000 * 1000,
+		"3gb":   3 << 30,
+		"-1":    -1,
+		"":      -1,
+		"12xb":  -1,
+		"1.5mb": -1,
+
+		"9999999999999gb":     -1,
+		"9223372036854775807": math.MaxInt64,
+	}
+	for value, want := range tests {
+		got, err := parseMemory(value)
+		if want < 0 {
+			if err == nil {
+				t.Errorf("parseMemory(%q) = %d, want an error", value, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("parseMemory(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+}
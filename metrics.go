@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of the
+// latency histograms exposed on /metrics.
+var latencyBuckets = [...]float64{0.00001, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// histogram counts durations in latencyBuckets, the last bucket holding
+// those above every bound. Its counters are updated together under mu, so
+// that a snapshot never sees a sample in one and not in another.
+type histogram struct {
+	mu     sync.Mutex
+	counts histogramCounts
+}
+
+// histogramCounts are the counters of a histogram. sum is in microseconds.
+type histogramCounts struct {
+	buckets [len(latencyBuckets) + 1]int64
+	count   int64
+	sum     int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d.Seconds() > latencyBuckets[i] {
+		i++
+	}
+
+	h.mu.Lock()
+	h.counts.buckets[i]++
+	h.counts.count++
+	h.counts.sum += d.Microseconds()
+	h.mu.Unlock()
+}
+
+// snapshot returns a copy of the counters of h.
+func (h *histogram) snapshot() histogramCounts {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.counts
+}
+
+func (h *histogram) reset() {
+	h.mu.Lock()
+	h.counts = histogramCounts{}
+	h.mu.Unlock()
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+// family starts a metric family with its help text and type.
+func (m metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP tinykv_%s %s\n# TYPE tinykv_%s %s\n", name, help, name, typ)
+}
+
+// sample writes one sample of name, labels being pairs of names and
+// values.
+func (m metricsWriter) sample(name string, value float64, labels ...string) {
+	fmt.Fprintf(m.w, "tinykv_%s%s %s\n", name, formatLabels(labels), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// metric writes a family holding a single sample without labels.
+func (m metricsWriter) metric(name, typ, help string, value float64) {
+	m.family(name, typ, help)
+	m.sample(name, value)
+}
+
+// histogram writes the samples of h, whose family must have been started,
+// all from the same snapshot.
+func (m metricsWriter) histogram(name string, h *histogram, labels ...string) {
+	counts := h.snapshot()
+	cumulative := int64(0)
+	for i, bound := range latencyBuckets {
+		cumulative += counts.buckets[i]
+		m.sample(name+"_bucket", float64(cumulative), append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64))...)
+	}
+	m.sample(name+"_bucket", float64(counts.count), append(labels, "le", "+Inf")...)
+	m.sample(name+"_sum", float64(counts.sum)/1e6, labels...)
+	m.sample(name+"_count", float64(counts.count), labels...)
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	parts := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		parts = append(parts, labels[i]+`="`+value+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func boolToFloat(b bool) float64 {
+	return float64(boolToInt(b))
+}
+
+// writeMetrics writes every metric of the server, with those of aof if it
+// is not nil.
+func writeMetrics(w io.Writer, aof *Aof) {
+	m := metricsWriter{w: w}
+
+	m.metric("uptime_seconds", "gauge", "Seconds since the server started.", time.Since(startTime).Seconds())
+	m.metric("connected_clients", "gauge", "Number of RESP client connections.", float64(connectedClients.Load()))
+	m.metric("connections_received_total", "counter", "Number of RESP connections accepted.", float64(connectionsReceived.Load()))
+
+	commands := sortedCommands()
+	m.family("commands_total", "counter", "Number of calls of each command.")
+	for _, spec := range commands {
+		m.sample("commands_total", float64(spec.stats.latency.snapshot().count), "command", spec.name)
+	}
+	m.family("commands_rejected_total", "counter", "Number of calls of each command refused before running.")
+	for _, spec := range commands {
+		m.sample("commands_rejected_total", float64(spec.stats.rejected.Load()), "command", spec.name)
+	}
+	m.family("commands_failed_total", "counter", "Number of calls of each command that replied with an error.")
+	for _, spec := range commands {
+		m.sample("commands_failed_total", float64(spec.stats.failed.Load()), "command", spec.name)
+	}
+	m.family("command_duration_seconds", "histogram", "Time spent running each command.")
+	for _, spec := range commands {
+		if spec.stats.latency.snapshot().count > 0 {
+			m.histogram("command_duration_seconds", &spec.stats.latency, "command", spec.name)
+		}
+	}
+
+	dbMu.RLock()
+	strs, lists, hashes, volatile := len(SETs), len(SETsL), len(HSETs), len(expires)
+	dbMu.RUnlock()
+
+	m.family("keys", "gauge", "Number of keys of each type.")
+	m.sample("keys", float64(strs), "type", typeString)
+	m.sample("keys", float64(lists), "type", typeList)
+	m.sample("keys", float64(hashes), "type", typeHash)
+	m.metric("keys_with_expiry", "gauge", "Number of keys with a time to live.", float64(volatile))
+	m.metric("keyspace_hits_total", "counter", "Number of successful key lookups by read commands.", float64(keyspaceHits.Load()))
+	m.metric("keyspace_misses_total", "counter", "Number of failed key lookups by read commands.", float64(keyspaceMisses.Load()))
+	m.metric("expired_keys_total", "counter", "Number of keys deleted because they expired.", float64(expiredKeys.Load()))
+	m.metric("evicted_keys_total", "counter", "Number of keys evicted because of maxmemory.", float64(evictedKeys.Load()))
+
+	m.metric("memory_used_bytes", "gauge", "Estimated memory used by the keyspace.", float64(usedMemory.Load()))
+	m.metric("memory_max_bytes", "gauge", "The maxmemory limit, 0 when there is none.", float64(currentMaxmemory().maxmemory))
+
+	m.metric("aof_enabled", "gauge", "Whether the append only file is enabled.", boolToFloat(aof != nil))
+	if aof != nil {
+		aof.writeMetrics(m)
+	}
+}
+
+// writeMetrics writes the metrics of the AOF.
+func (aof *Aof) writeMetrics(m metricsWriter) {
+	aof.mu.Lock()
+	size, base, pending := aof.size, aof.baseSize, aof.writeOffset-aof.syncedOffset
+	rewriting, rewritten, rewriteErr, rewriteDuration := aof.rewriting, !aof.lastRewriteTime.IsZero(), aof.lastRewriteErr, aof.lastRewriteDuration
+	aof.mu.Unlock()
+
+	m.metric("aof_size_bytes", "gauge", "Current size of the append only file.", float64(size))
+	m.metric("aof_base_size_bytes", "gauge", "Size of the append only file after startup or the last rewrite.", float64(base))
+	m.metric("aof_pending_fsync_bytes", "gauge", "Bytes written to the append only file but not synced to disk yet.", float64(pending))
+
+	m.family("aof_fsync_duration_seconds", "histogram", "Time spent syncing the append only file to disk.")
+	m.histogram("aof_fsync_duration_seconds", &aof.fsyncLatency)
+
+	m.metric("aof_rewrite_in_progress", "gauge", "Whether a rewrite of the append only file is running.", boolToFloat(rewriting))
+	if rewritten {
+		m.metric("aof_last_rewrite_success", "gauge", "Whether the last rewrite of the append only file succeeded.", boolToFloat(rewriteErr == nil))
+		m.metric("aof_last_rewrite_duration_seconds", "gauge", "Duration of the last rewrite of the append only file.", rewriteDuration.Seconds())
+	}
+}
+
+// handleMetrics serves the metrics to Prometheus. They are the data of
+// INFO, so the user must be allowed to run it.
+func (api *API) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	spec := lookupCommand("INFO")
+	if reason, object := user.permit(spec, nil); reason != "" {
+		http.Error(w, denyACL(user, reason, object, "http", "addr="+r.RemoteAddr).str, http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, api.aof)
+}
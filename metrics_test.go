@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	h.observe(5 * time.Microsecond)
+	h.observe(2 * time.Millisecond)
+	h.observe(10 * time.Second)
+
+	var b strings.Builder
+	metricsWriter{w: &b}.histogram("test_seconds", &h, "command", "get")
+	got := b.String()
+
+	for _, want := range []string{
+		`tinykv_test_seconds_bucket{command="get",le="1e-05"} 1` + "\n",
+		`tinykv_test_seconds_bucket{command="get",le="0.001"} 1` + "\n",
+		`tinykv_test_seconds_bucket{command="get",le="0.0025"} 2` + "\n",
+		`tinykv_test_seconds_bucket{command="get",le="2.5"} 2` + "\n",
+		`tinykv_test_seconds_bucket{command="get",le="+Inf"} 3` + "\n",
+		`tinykv_test_seconds_sum{command="get"} 10.002005` + "\n",
+		`tinykv_test_seconds_count{command="get"} 3` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("histogram is missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestHistogramIsConsistent(t *testing.T) {
+	var h histogram
+	done := make(chan struct{})
+	defer close(done)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for d := time.Duration(0); ; d += time.Millisecond {
+				select {
+				case <-done:
+					return
+				default:
+					h.observe(d % (5 * time.Second))
+				}
+			}
+		}()
+	}
+
+	previous := 0.0
+	for scrape := 0; scrape < 200; scrape++ {
+		var b strings.Builder
+		metricsWriter{w: &b}.histogram("test_seconds", &h)
+
+		last, count := 0.0, 0.0
+		for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+			name, value, _ := strings.Cut(line, " ")
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case strings.HasPrefix(name, "tinykv_test_seconds_bucket"):
+				if n < last {
+					t.Fatalf("bucket %s = %v is below the previous one %v", name, n, last)
+				}
+				last = n
+			case name == "tinykv_test_seconds_count":
+				count = n
+			}
+		}
+		if last != count {
+			t.Fatalf("+Inf bucket = %v, count = %v", last, count)
+		}
+		if count < previous {
+			t.Fatalf("count went from %v down to %v", previous, count)
+		}
+		previous = count
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	resetACL(t)
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	handler := api.Handler()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	do(http.MethodPut, "/kv/k", "v")
+	do(http.MethodPut, "/list/l", `["a"]`)
+	do(http.MethodGet, "/kv/missing", "")
+
+	w := do(http.MethodGet, "/metrics", "")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("GET /metrics: status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	got := w.Body.String()
+
+	for _, want := range []string{
+		"# TYPE tinykv_commands_total counter\n",
+		`tinykv_commands_total{command="set"} `,
+		"# TYPE tinykv_command_duration_seconds histogram\n",
+		`tinykv_command_duration_seconds_bucket{command="lpush",le="+Inf"} `,
+		`tinykv_keys{type="string"} 1` + "\n",
+		`tinykv_keys{type="list"} 1` + "\n",
+		`tinykv_keys{type="hash"} 0` + "\n",
+		"tinykv_memory_used_bytes ",
+		"tinykv_evicted_keys_total ",
+		"tinykv_expired_keys_total ",
+		"tinykv_aof_enabled 1\n",
+		"tinykv_aof_fsync_duration_seconds_count ",
+		"tinykv_aof_rewrite_in_progress 0\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("/metrics is missing %q", want)
+		}
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(got), "\n") {
+		if !strings.HasPrefix(line, "# ") && len(strings.Fields(line)) != 2 {
+			t.Errorf("malformed sample %q", line)
+		}
+	}
+
+	aclSetUser("default", bulks("-info"))
+	if w := do(http.MethodGet, "/metrics", ""); w.Code != http.StatusForbidden {
+		t.Errorf("GET /metrics without the permission to run INFO: status %d", w.Code)
+	}
+}
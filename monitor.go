@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// monitorMu guards monitors, the clients that ran MONITOR. monitorCount is
+// their number, checked without a lock so that commands pay nothing for
+// MONITOR while no client uses it.
+var (
+	monitorMu    = sync.RWMutex{}
+	monitors     = map[*client]struct{}{}
+	monitorCount atomic.Int64
+)
+
+// monitor puts c in monitor mode: from then on it receives every command
+// processed by the server, and can only leave with QUIT.
+func monitor(c *client, args []Value) {
+	monitorMu.Lock()
+	defer monitorMu.Unlock()
+
+	if _, ok := monitors[c]; !ok {
+		monitors[c] = struct{}{}
+		monitorCount.Add(1)
+		c.setOutputLimit(&replicaOutputLimit)
+	}
+
+	c.write(Value{typ: "string", str: "OK"})
+}
+
+// isMonitoring reports whether c ran MONITOR.
+func (c *client) isMonitoring() bool {
+	if monitorCount.Load() == 0 {
+		return false
+	}
+
+	monitorMu.RLock()
+	defer monitorMu.RUnlock()
+
+	_, ok := monitors[c]
+	return ok
+}
+
+// stopMonitoring takes c out of monitor mode once it disconnects.
+func stopMonitoring(c *client) {
+	monitorMu.Lock()
+	defer monitorMu.Unlock()
+
+	if _, ok := monitors[c]; ok {
+		delete(monitors, c)
+		monitorCount.Add(-1)
+	}
+}
+
+// feedMonitors sends a command about to run to the clients in monitor mode,
+// as Redis does: the time, the database and address of the client, and the
+// quoted command. Administrative commands are left out and passwords
+// redacted.
+func feedMonitors(from origin, spec *commandSpec, args []Value) {
+	if monitorCount.Load() == 0 || spec.flags&flagAdmin != 0 {
+		return
+	}
+
+	now := time.Now()
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d.%06d [0 %s] ", now.Unix(), now.Nanosecond()/1000, from.addr)
+	writeRepr(&b, spec.name)
+	for i := range args {
+		b.WriteByte(' ')
+		writeRepr(&b, redacted(spec, args, i))
+	}
+	line := Value{typ: "string", str: b.String()}
+
+	monitorMu.RLock()
+	defer monitorMu.RUnlock()
+
+	for c := range monitors {
+		c.write(line)
+	}
+}
+
+// writeRepr writes s quoted, with special and non printable characters
+// escaped, so that it fits on a line.
+func writeRepr(b *strings.Builder, s string) {
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; ch {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\a':
+			b.WriteString(`\a`)
+		case '\b':
+			b.WriteString(`\b`)
+		default:
+			if ch < ' ' || ch > '~' {
+				fmt.Fprintf(b, `\x%02x`, ch)
+			} else {
+				b.WriteByte(ch)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	resetKeyspace()
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	port := startTestServer(t)
+
+	m := dialTestServer(t, port)
+	if got := m.do(t, "MONITOR"); got != "+OK" {
+		t.Fatalf("MONITOR = %q", got)
+	}
+
+	c := dialTestServer(t, port)
+	c.do(t, "SET", "k", "a \"b\"\n")
+	c.do(t, "AUTH", "secret")
+	c.do(t, "CONFIG", "SET", "appendfsync", "no")
+	c.do(t, "LPUSH", "l", "x")
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/k", nil)
+	api.Handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	m.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	want := []string{
+		`"set" "k" "a \"b\"\n"`,
+		`"auth" "(redacted)"`,
+		`"lpush" "l" "x"`,
+		`"get" "k"`,
+	}
+	addrs := []string{c.conn.LocalAddr().String(), c.conn.LocalAddr().String(), c.conn.LocalAddr().String(), req.RemoteAddr}
+	line := regexp.MustCompile(`^\+\d+\.\d{6} \[0 ([^\]]+)\] (.*)$`)
+	for i, command := range want {
+		got, err := m.resp.reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		match := line.FindStringSubmatch(strings.TrimRight(got, "\r\n"))
+		if match == nil || match[1] != addrs[i] || match[2] != command {
+			t.Errorf("line %d = %q, want %s from %s", i, got, command, addrs[i])
+		}
+	}
+
+	if got := m.do(t, "GET", "k"); !strings.HasPrefix(got, "-ERR Can't execute 'get'") {
+		t.Errorf("GET in monitor mode = %q", got)
+	}
+	if got := m.do(t, "QUIT"); got != "+OK" {
+		t.Errorf("QUIT in monitor mode = %q", got)
+	}
+	waitFor(t, "the monitor to be removed", func() bool { return monitorCount.Load() == 0 })
+}
+
+func TestWriteRepr(t *testing.T) {
+	var b strings.Builder
+	writeRepr(&b, "a\\b\t\x00é")
+	if got := b.String(); got != `"a\\b\t\x00\xc3\xa9"` {
+		t.Errorf("repr = %s", got)
+	}
+}
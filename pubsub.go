@@ -0,0 +1,248 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pubsubMu guards the subscription tables below together with the channels
+// and patterns of every client.
+var pubsubMu = sync.RWMutex{}
+
+var (
+	pubsubChannels = map[string]map[*client]struct{}{}
+	pubsubPatterns = map[string]map[*client]struct{}{}
+)
+
+// pubsubCommands are the only commands a client with subscriptions may run.
+var pubsubCommands = map[string]bool{
+	"SUBSCRIBE": true, "UNSUBSCRIBE": true, "PSUBSCRIBE": true, "PUNSUBSCRIBE": true, "PING": true,
+}
+
+// subscribed reports whether c is in push mode.
+func (c *client) subscribed() bool {
+	pubsubMu.RLock()
+	defer pubsubMu.RUnlock()
+
+	return len(c.channels)+len(c.patterns) > 0
+}
+
+// subscriptionsLocked returns the number of channels and patterns c is
+// subscribed to. Callers must hold pubsubMu.
+func (c *client) subscriptionsLocked() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+// updateOutputLimitLocked puts c under the pub/sub output limit while it has
+// subscriptions. Callers must hold pubsubMu.
+func (c *client) updateOutputLimitLocked() {
+	if c.subscriptionsLocked() > 0 {
+		c.setOutputLimit(&pubsubOutputLimit)
+	} else {
+		c.setOutputLimit(nil)
+	}
+}
+
+// subscriptionReply confirms a change of subscriptions. Like published
+// messages it is a push frame for RESP3 connections.
+func subscriptionReply(kind, name string, count int) Value {
+	return Value{typ: "push", array: []Value{
+		{typ: "bulk", bulk: kind},
+		{typ: "bulk", bulk: name},
+		{typ: "integer", num: count},
+	}}
+}
+
+// subscribeGeneric adds c to table under every name, replying once per name
+// with kind and the number of subscriptions c holds afterwards.
+func subscribeGeneric(c *client, args []Value, table map[string]map[*client]struct{}, own map[string]struct{}, kind string) {
+	if len(args) < 1 {
+		c.write(Value{typ: "error", str: "ERR wrong number of arguments for '" + kind + "' command"})
+		return
+	}
+
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+
+	for _, arg := range args {
+		name := arg.bulk
+		if _, ok := own[name]; !ok {
+			own[name] = struct{}{}
+			if table[name] == nil {
+				table[name] = map[*client]struct{}{}
+			}
+			table[name][c] = struct{}{}
+		}
+		c.write(subscriptionReply(kind, name, c.subscriptionsLocked()))
+	}
+
+	c.updateOutputLimitLocked()
+}
+
+// unsubscribeGeneric removes c from table under every name, or under all the
+// names it is subscribed to when none is given.
+func unsubscribeGeneric(c *client, args []Value, table map[string]map[*client]struct{}, own map[string]struct{}, kind string) {
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+
+	names := []string{}
+	for _, arg := range args {
+		names = append(names, arg.bulk)
+	}
+	if len(args) == 0 {
+		for name := range own {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	if len(names) == 0 {
+		c.write(Value{typ: "push", array: []Value{
+			{typ: "bulk", bulk: kind},
+			{typ: "null"},
+			{typ: "integer", num: c.subscriptionsLocked()},
+		}})
+		return
+	}
+
+	for _, name := range names {
+		if _, ok := own[name]; ok {
+			delete(own, name)
+			delete(table[name], c)
+			if len(table[name]) == 0 {
+				delete(table, name)
+			}
+		}
+		c.write(subscriptionReply(kind, name, c.subscriptionsLocked()))
+	}
+
+	c.updateOutputLimitLocked()
+}
+
+func subscribe(c *client, args []Value) {
+	subscribeGeneric(c, args, pubsubChannels, c.channels, "subscribe")
+}
+
+func unsubscribe(c *client, args []Value) {
+	unsubscribeGeneric(c, args, pubsubChannels, c.channels, "unsubscribe")
+}
+
+func psubscribe(c *client, args []Value) {
+	subscribeGeneric(c, args, pubsubPatterns, c.patterns, "psubscribe")
+}
+
+func punsubscribe(c *client, args []Value) {
+	unsubscribeGeneric(c, args, pubsubPatterns, c.patterns, "punsubscribe")
+}
+
+// unsubscribeAll drops every subscription of a client that goes away.
+func unsubscribeAll(c *client) {
+	pubsubMu.Lock()
+	defer pubsubMu.Unlock()
+
+	for name := range c.channels {
+		delete(pubsubChannels[name], c)
+		if len(pubsubChannels[name]) == 0 {
+			delete(pubsubChannels, name)
+		}
+	}
+	for name := range c.patterns {
+		delete(pubsubPatterns[name], c)
+		if len(pubsubPatterns[name]) == 0 {
+			delete(pubsubPatterns, name)
+		}
+	}
+	c.channels = map[string]struct{}{}
+	c.patterns = map[string]struct{}{}
+}
+
+// pubsubPing is the reply to PING for a client in push mode.
+func pubsubPing(args []Value) Value {
+	message := ""
+	if len(args) > 0 {
+		message = args[0].bulk
+	}
+
+	return Value{typ: "array", array: bulks("pong", message)}
+}
+
+// publish queues message for every subscriber of channel and every client
+// with a matching pattern. Queueing never blocks: a subscriber that falls
+// too far behind is disconnected by its output limit instead.
+func publish(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'publish' command"}
+	}
+
+	channel, message := args[0].bulk, args[1].bulk
+
+	pubsubMu.RLock()
+	defer pubsubMu.RUnlock()
+
+	receivers := 0
+
+	if subscribers := pubsubChannels[channel]; len(subscribers) > 0 {
+		receivers += deliver(subscribers, Value{typ: "push", array: bulks("message", channel, message)})
+	}
+
+	for pattern, subscribers := range pubsubPatterns {
+		if globMatch(pattern, channel) {
+			receivers += deliver(subscribers, Value{typ: "push", array: bulks("pmessage", pattern, channel, message)})
+		}
+	}
+
+	return Value{typ: "integer", num: receivers}
+}
+
+// deliver queues msg for every subscriber, marshalling it once per protocol
+// version, and returns the number of subscribers.
+func deliver(subscribers map[*client]struct{}, msg Value) int {
+	data := map[int][]byte{}
+	for c := range subscribers {
+		proto := c.protocol()
+		if data[proto] == nil {
+			data[proto] = msg.MarshalProto(proto)
+		}
+		c.writeBytes(data[proto])
+	}
+
+	return len(subscribers)
+}
+
+func pubsubCommand(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'pubsub' command"}
+	}
+
+	subcommand := strings.ToUpper(args[0].bulk)
+	args = args[1:]
+
+	pubsubMu.RLock()
+	defer pubsubMu.RUnlock()
+
+	switch {
+	case subcommand == "CHANNELS" && len(args) <= 1:
+		names := []string{}
+		for name := range pubsubChannels {
+			if len(args) == 0 || globMatch(args[0].bulk, name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return Value{typ: "array", array: bulks(names...)}
+	case subcommand == "NUMSUB":
+		result := []Value{}
+		for _, arg := range args {
+			result = append(result,
+				Value{typ: "bulk", bulk: arg.bulk},
+				Value{typ: "integer", num: len(pubsubChannels[arg.bulk])},
+			)
+		}
+		return Value{typ: "array", array: result}
+	case subcommand == "NUMPAT" && len(args) == 0:
+		return Value{typ: "integer", num: len(pubsubPatterns)}
+	}
+
+	return Value{typ: "error", str: "ERR Unknown subcommand or wrong number of arguments for '" + strings.ToLower(subcommand) + "'"}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// readPush reads the next array reply of c as a list of strings, with
+// integers in their decimal form.
+func readPush(t *testing.T, c *testClient) []string {
+	t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header, err := c.resp.reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != '*' {
+		t.Fatalf("expected an array, got %q", header)
+	}
+
+	n := 0
+	for _, b := range header[1 : len(header)-2] {
+		n = n*10 + int(b-'0')
+	}
+
+	items := []string{}
+	for i := 0; i < n; i++ {
+		line, err := c.resp.reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = line[:len(line)-2]
+		switch line[0] {
+		case '$':
+			if line == "$-1" {
+				items = append(items, "(nil)")
+				continue
+			}
+			value, err := c.resp.reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			items = append(items, value[:len(value)-2])
+		default:
+			items = append(items, line[1:])
+		}
+	}
+
+	return items
+}
+
+func send(t *testing.T, c *testClient, args ...string) {
+	t.Helper()
+
+	if _, err := c.conn.Write(Value{typ: "array", array: bulks(args...)}.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkPush(t *testing.T, c *testClient, want ...string) {
+	t.Helper()
+
+	got := readPush(t, c)
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	port := startTestServer(t)
+	subscriber := dialTestServer(t, port)
+	publisher := dialTestServer(t, port)
+
+	send(t, subscriber, "SUBSCRIBE", "news", "sport")
+	checkPush(t, subscriber, "subscribe", "news", "1")
+	checkPush(t, subscriber, "subscribe", "sport", "2")
+
+	send(t, subscriber, "PSUBSCRIBE", "n*")
+	checkPush(t, subscriber, "psubscribe", "n*", "3")
+
+	if got := publisher.do(t, "PUBLISH", "news", "hello"); got != ":2" {
+		t.Fatalf("PUBLISH news = %q, want :2", got)
+	}
+	checkPush(t, subscriber, "message", "news", "hello")
+	checkPush(t, subscriber, "pmessage", "n*", "news", "hello")
+
+	if got := publisher.do(t, "PUBLISH", "weather", "rain"); got != ":0" {
+		t.Fatalf("PUBLISH weather = %q, want :0", got)
+	}
+
+	if got := subscriber.do(t, "GET", "news"); got != "-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context" {
+		t.Fatalf("GET in push mode = %q", got)
+	}
+	send(t, subscriber, "PING")
+	checkPush(t, subscriber, "pong", "")
+
+	send(t, subscriber, "UNSUBSCRIBE")
+	checkPush(t, subscriber, "unsubscribe", "news", "2")
+	checkPush(t, subscriber, "unsubscribe", "sport", "1")
+
+	if got := publisher.do(t, "PUBLISH", "sport", "goal"); got != ":0" {
+		t.Fatalf("PUBLISH after UNSUBSCRIBE = %q, want :0", got)
+	}
+
+	send(t, subscriber, "PUNSUBSCRIBE", "n*")
+	checkPush(t, subscriber, "punsubscribe", "n*", "0")
+
+	if got := subscriber.do(t, "PING"); got != "+PONG" {
+		t.Fatalf("PING after leaving push mode = %q, want +PONG", got)
+	}
+}
+
+func TestPubSubIntrospection(t *testing.T) {
+	port := startTestServer(t)
+	first := dialTestServer(t, port)
+	second := dialTestServer(t, port)
+	other := dialTestServer(t, port)
+
+	send(t, first, "SUBSCRIBE", "a.1", "b.1")
+	readPush(t, first)
+	readPush(t, first)
+	send(t, second, "SUBSCRIBE", "a.1")
+	readPush(t, second)
+	send(t, second, "PSUBSCRIBE", "a.*")
+	readPush(t, second)
+
+	send(t, other, "PUBSUB", "CHANNELS", "a.*")
+	checkPush(t, other, "a.1")
+	send(t, other, "PUBSUB", "CHANNELS")
+	checkPush(t, other, "a.1", "b.1")
+	send(t, other, "PUBSUB", "NUMSUB", "a.1", "b.1", "c.1")
+	checkPush(t, other, "a.1", "2", "b.1", "1", "c.1", "0")
+	if got := other.do(t, "PUBSUB", "NUMPAT"); got != ":1" {
+		t.Fatalf("PUBSUB NUMPAT = %q, want :1", got)
+	}
+
+	// subscriptions go away with the connection
+	first.conn.Close()
+	waitFor(t, "subscriptions to be dropped", func() bool {
+		pubsubMu.RLock()
+		defer pubsubMu.RUnlock()
+		return len(pubsubChannels["b.1"]) == 0
+	})
+	if got := other.do(t, "PUBLISH", "a.1", "x"); got != ":2" {
+		t.Fatalf("PUBLISH = %q, want :2", got)
+	}
+}
+
+func TestPubSubOutputLimit(t *testing.T) {
+	saved := pubsubOutputLimit
+	pubsubOutputLimit = outputLimit{hard: 64 * 1024, soft: 32 * 1024, softFor: time.Minute}
+	t.Cleanup(func() { pubsubOutputLimit = saved })
+
+	// the subscriber never reads, so once the socket buffers are full its
+	// output queue only grows
+	server, conn := net.Pipe()
+	t.Cleanup(func() { conn.Close() })
+	c := newClient(server)
+	t.Cleanup(func() { unsubscribeAll(c) })
+
+	subscribe(c, bulks("slow"))
+
+	message := string(make([]byte, 1024))
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 200; i++ {
+			publish(bulks("slow", message))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("PUBLISH blocked on a slow subscriber")
+	}
+
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if !closed {
+		t.Fatal("slow subscriber was not disconnected")
+	}
+}
@@ -0,0 +1,860 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replication follows the Redis model. Every instance has a replication ID
+// and an offset counting the bytes of write stream it has produced or
+// applied; the stream is made of exactly the values appended to the AOF. The
+// last bytes of the stream are kept in a backlog.
+//
+// A follower connects to its leader, authenticates with masterauth if set,
+// announces its listening port with REPLCONF and sends "PSYNC id offset"
+// with its own ID and offset. If the leader has the same ID and still holds
+// everything after offset in its backlog it replies "+CONTINUE id" and
+// streams from there. Otherwise it replies "+FULLRESYNC id offset" followed
+// by a snapshot sent as a bulk string, and the follower replaces its data
+// with it, adopting the leader's ID and offset. Followers report their offset
+// with "REPLCONF ACK offset" once a second.
+const (
+	defaultBacklogSize = 1024 * 1024
+
+	replicaAckInterval = time.Second
+
+	// replicaReconnectDelay is how long a follower waits before reconnecting
+	// to its leader.
+	replicaReconnectDelay = time.Second
+)
+
+var readOnlyReplica = Value{typ: "error", str: "READONLY You can't write against a read only replica."}
+
+// serverPort is the port the RESP server listens on, announced to leaders.
+var serverPort = 6379
+
+// backlog is a ring buffer holding the last bytes of the write stream.
+type backlog struct {
+	buf     []byte
+	end     int64 // replication offset right after the last byte held
+	histlen int   // number of bytes held
+}
+
+func newBacklog(size int, offset int64) *backlog {
+	return &backlog{buf: make([]byte, size), end: offset}
+}
+
+func (b *backlog) write(p []byte) {
+	for len(p) > 0 {
+		n := copy(b.buf[b.end%int64(len(b.buf)):], p)
+		p = p[n:]
+		b.end += int64(n)
+		b.histlen = min(b.histlen+n, len(b.buf))
+	}
+}
+
+// first returns the replication offset of the oldest byte held.
+func (b *backlog) first() int64 {
+	return b.end - int64(b.histlen)
+}
+
+// since returns a copy of the stream after offset, or false if the backlog
+// no longer holds all of it.
+func (b *backlog) since(offset int64) ([]byte, bool) {
+	if offset < b.first() || offset > b.end {
+		return nil, false
+	}
+
+	out := make([]byte, 0, b.end-offset)
+	for offset < b.end {
+		i := offset % int64(len(b.buf))
+		n := min(int64(len(b.buf))-i, b.end-offset)
+		out = append(out, b.buf[i:i+n]...)
+		offset += n
+	}
+
+	return out, true
+}
+
+// replica is a follower connected to this instance. Until ready is set, the
+// snapshot of a full resync is being prepared and the stream is held back.
+type replica struct {
+	client *client
+	ip     string
+	port   int
+
+	mu        sync.Mutex
+	ready     bool
+	held      []byte
+	ackOffset int64
+	lastAck   time.Time
+}
+
+func (rep *replica) send(data []byte) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+
+	if !rep.ready {
+		rep.held = append(rep.held, data...)
+		return
+	}
+
+	rep.client.writeBytes(data)
+}
+
+// masterLink is the connection of a follower to its leader.
+type masterLink struct {
+	host string
+	port int
+
+	// apply executes commands received from the leader, either a single one
+	// or a whole transaction with its MULTI and EXEC, and load replaces the
+	// data with a snapshot received during a full resync. They are called
+	// with callMu held.
+	apply func(...Value)
+	load  func(*keyspaceSnapshot)
+
+	mu       sync.Mutex
+	conn     net.Conn
+	state    string
+	stopped  bool
+	lastIO   time.Time
+	downFrom time.Time
+}
+
+const (
+	linkConnect    = "connect"
+	linkConnecting = "connecting"
+	linkSync       = "sync"
+	linkConnected  = "connected"
+)
+
+func (link *masterLink) addr() string {
+	return net.JoinHostPort(link.host, strconv.Itoa(link.port))
+}
+
+func (link *masterLink) setState(state string) {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+
+	if state != linkConnected && link.state == linkConnected {
+		link.downFrom = time.Now()
+	}
+	link.state = state
+}
+
+// stop closes the connection and keeps the link from reconnecting.
+func (link *masterLink) stop() {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+
+	link.stopped = true
+	if link.conn != nil {
+		link.conn.Close()
+	}
+}
+
+func (link *masterLink) isStopped() bool {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+
+	return link.stopped
+}
+
+// replState is the replication state of an instance, either a leader or a
+// follower of link.
+type replState struct {
+	mu       sync.Mutex
+	id       string
+	offset   int64
+	backlog  *backlog
+	replicas map[*replica]struct{}
+	link     *masterLink
+
+	// following is set along with link, for the expiry checks made with dbMu
+	// held to read it without taking mu.
+	following atomic.Bool
+}
+
+func newReplState() *replState {
+	return &replState{
+		id:       newReplicationID(),
+		backlog:  newBacklog(defaultBacklogSize, 0),
+		replicas: map[*replica]struct{}{},
+	}
+}
+
+// repl is the replication state of the server.
+var repl = newReplState()
+
+func newReplicationID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// feed appends value to the write stream.
+func (r *replState) feed(value Value) {
+	data := value.Marshal()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.offset += int64(len(data))
+	r.backlog.write(data)
+	for rep := range r.replicas {
+		rep.send(data)
+	}
+}
+
+// readOnly reports whether writes from clients must be refused.
+func (r *replState) readOnly() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.link != nil
+}
+
+// setBacklogSize replaces the backlog with an empty one of size bytes.
+func (r *replState) setBacklogSize(size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.backlog = newBacklog(size, r.offset)
+}
+
+func (r *replState) backlogSize() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.backlog.buf)
+}
+
+// disconnectReplicasLocked drops every replica, which makes them resync.
+func (r *replState) disconnectReplicasLocked() {
+	for rep := range r.replicas {
+		rep.client.close()
+		delete(r.replicas, rep)
+	}
+}
+
+// serveReplica takes over the connection of c, read through reader, after a
+// PSYNC from a follower and streams writes to it until the connection is
+// closed.
+func (r *replState) serveReplica(c *client, reader *Resp, args []Value) {
+	if len(args) != 2 {
+		c.write(Value{typ: "error", str: "ERR wrong number of arguments for 'psync' command"})
+		return
+	}
+	id := args[0].bulk
+	offset, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		c.write(Value{typ: "error", str: "ERR value is not an integer or out of range"})
+		return
+	}
+
+	ip, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	rep := &replica{client: c, ip: ip, port: c.replicaPort, lastAck: time.Now()}
+	c.setOutputLimit(&replicaOutputLimit)
+	// the stream is sent as it comes rather than after the next command
+	c.flush()
+
+	if !r.continueSync(rep, id, offset) {
+		if err := r.fullSync(rep); err != nil {
+			log.Println("Full resync with replica failed:", err)
+			return
+		}
+	}
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.replicas, rep)
+		r.mu.Unlock()
+	}()
+
+	// the replica only ever sends REPLCONF ACK
+	for {
+		value, err := reader.Read()
+		if err != nil {
+			return
+		}
+		if len(value.array) != 3 || !strings.EqualFold(value.array[0].bulk, "REPLCONF") || !strings.EqualFold(value.array[1].bulk, "ACK") {
+			continue
+		}
+		ack, err := strconv.ParseInt(value.array[2].bulk, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		rep.mu.Lock()
+		rep.ackOffset = ack
+		rep.lastAck = time.Now()
+		rep.mu.Unlock()
+	}
+}
+
+// continueSync registers rep for a partial resync from offset if possible.
+func (r *replState) continueSync(rep *replica, id string, offset int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id != r.id {
+		return false
+	}
+	data, ok := r.backlog.since(offset)
+	if !ok {
+		return false
+	}
+
+	log.Printf("Partial resync with replica %s:%d from offset %d", rep.ip, rep.port, offset)
+	rep.client.writeBytes(append([]byte("+CONTINUE "+r.id+"\r\n"), data...))
+	rep.ready = true
+	rep.ackOffset = offset
+	r.replicas[rep] = struct{}{}
+
+	return true
+}
+
+// fullSync registers rep and queues a snapshot of the keyspace for it. A
+// capture of the keyspace starts and the offset is read while callMu is held
+// exclusively, and rep is registered at the same time, so it receives every
+// write after the snapshot. The keyspace is copied after releasing callMu.
+func (r *replState) fullSync(rep *replica) error {
+	callMu.Lock()
+	capture := startCapture()
+	r.mu.Lock()
+	id, offset := r.id, r.offset
+	r.replicas[rep] = struct{}{}
+	r.mu.Unlock()
+	callMu.Unlock()
+
+	snap := capture.finish()
+
+	log.Printf("Full resync with replica %s:%d at offset %d", rep.ip, rep.port, offset)
+
+	var payload bytes.Buffer
+	if err := snap.encode(&payload, snapshotHeader{created: nowMs()}); err != nil {
+		return err
+	}
+
+	header := fmt.Sprintf("+FULLRESYNC %s %d\r\n$%d\r\n", id, offset, payload.Len())
+
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+
+	rep.client.writeBytes(append([]byte(header), payload.Bytes()...))
+	rep.client.writeBytes(rep.held)
+	rep.held = nil
+	rep.ready = true
+	rep.ackOffset = offset
+
+	return nil
+}
+
+// replicaOf makes the instance follow the leader at host:port.
+func (r *replState) replicaOf(host string, port int, apply func(...Value), load func(*keyspaceSnapshot)) {
+	link := &masterLink{host: host, port: port, apply: apply, load: load, state: linkConnect, downFrom: time.Now()}
+
+	r.mu.Lock()
+	old := r.link
+	r.link = link
+	r.following.Store(true)
+	r.mu.Unlock()
+
+	if old != nil {
+		old.stop()
+	}
+
+	go r.followLoop(link)
+}
+
+// stopReplication turns a follower into a leader. It gets a new replication
+// ID, as its history may now diverge from that of its former leader.
+func (r *replState) stopReplication() {
+	r.mu.Lock()
+	link := r.link
+	r.link = nil
+	r.following.Store(false)
+	if link != nil {
+		r.id = newReplicationID()
+	}
+	r.mu.Unlock()
+
+	if link != nil {
+		link.stop()
+	}
+}
+
+// followLoop keeps link synchronised with its leader until it is stopped.
+func (r *replState) followLoop(link *masterLink) {
+	for !link.isStopped() {
+		err := r.syncWithMaster(link)
+		link.setState(linkConnect)
+		if link.isStopped() {
+			return
+		}
+
+		log.Printf("Lost connection to leader %s: %v", link.addr(), err)
+		time.Sleep(replicaReconnectDelay)
+	}
+}
+
+// syncWithMaster runs one connection to the leader: the handshake, a full or
+// partial resync and then the write stream until the connection breaks.
+func (r *replState) syncWithMaster(link *masterLink) error {
+	link.setState(linkConnecting)
+
+	conn, err := dialLeader(link.host, link.addr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	link.mu.Lock()
+	if link.stopped {
+		link.mu.Unlock()
+		return errors.New("replication stopped")
+	}
+	link.conn = conn
+	link.mu.Unlock()
+
+	reader := bufio.NewReader(conn)
+	command := func(args ...string) Value {
+		return Value{typ: "array", array: bulks(args...)}
+	}
+
+	if password := masterauth(); password != "" {
+		if _, err := conn.Write(command("AUTH", password).Marshal()); err != nil {
+			return err
+		}
+		if line, err := readReplyLine(reader); err != nil {
+			return err
+		} else if line != "+OK" {
+			return fmt.Errorf("unexpected AUTH reply %q", line)
+		}
+	}
+
+	if _, err := conn.Write(command("REPLCONF", "listening-port", strconv.Itoa(announcedPort())).Marshal()); err != nil {
+		return err
+	}
+	if line, err := readReplyLine(reader); err != nil {
+		return err
+	} else if line != "+OK" {
+		return fmt.Errorf("unexpected REPLCONF reply %q", line)
+	}
+
+	r.mu.Lock()
+	id, offset := r.id, r.offset
+	r.mu.Unlock()
+
+	link.setState(linkSync)
+	if _, err := conn.Write(command("PSYNC", id, strconv.FormatInt(offset, 10)).Marshal()); err != nil {
+		return err
+	}
+
+	line, err := readReplyLine(reader)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+
+	switch {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid FULLRESYNC reply %q", line)
+		}
+		snap, err := readSyncPayload(reader)
+		if err != nil {
+			return err
+		}
+
+		callMu.Lock()
+		link.load(snap)
+		r.mu.Lock()
+		r.id, r.offset = fields[1], offset
+		r.backlog = newBacklog(len(r.backlog.buf), offset)
+		// their history is not ours anymore
+		r.disconnectReplicasLocked()
+		r.mu.Unlock()
+		callMu.Unlock()
+
+		log.Printf("Full resync with leader %s at offset %d", link.addr(), offset)
+	case len(fields) == 2 && fields[0] == "+CONTINUE":
+		r.mu.Lock()
+		r.id = fields[1]
+		r.mu.Unlock()
+
+		log.Printf("Partial resync with leader %s from offset %d", link.addr(), offset)
+	default:
+		return fmt.Errorf("unexpected PSYNC reply %q", line)
+	}
+
+	link.mu.Lock()
+	link.state = linkConnected
+	link.lastIO = time.Now()
+	link.mu.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+	go r.sendAcks(conn, done)
+
+	// the commands of a transaction are collected until its EXEC and only
+	// then applied, and counted in the offset, as a unit
+	var transaction []Value
+
+	resp := NewResp(reader)
+	for {
+		value, err := resp.Read()
+		if err != nil {
+			return err
+		}
+		if value.typ != "array" || len(value.array) == 0 {
+			continue
+		}
+
+		link.mu.Lock()
+		link.lastIO = time.Now()
+		link.mu.Unlock()
+
+		command := strings.ToUpper(value.array[0].bulk)
+		switch {
+		case command == "MULTI":
+			transaction = []Value{value}
+			continue
+		case transaction != nil && command != "EXEC":
+			transaction = append(transaction, value)
+			continue
+		case transaction != nil:
+			r.applyTransaction(link, append(transaction, value))
+			transaction = nil
+			awaitReplicatedFsync()
+			continue
+		}
+
+		execMu.RLock()
+		callMu.Lock()
+		link.apply(value)
+		r.feed(value)
+		callMu.Unlock()
+		execMu.RUnlock()
+		awaitReplicatedFsync()
+	}
+}
+
+func (r *replState) applyTransaction(link *masterLink, transaction []Value) {
+	execMu.Lock()
+	defer execMu.Unlock()
+	callMu.Lock()
+	defer callMu.Unlock()
+
+	link.apply(transaction...)
+	for _, value := range transaction {
+		r.feed(value)
+	}
+}
+
+// sendAcks reports the replication offset to the leader until done is closed.
+func (r *replState) sendAcks(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(replicaAckInterval)
+	defer ticker.Stop()
+
+	for {
+		r.mu.Lock()
+		offset := r.offset
+		r.mu.Unlock()
+
+		ack := Value{typ: "array", array: bulks("REPLCONF", "ACK", strconv.FormatInt(offset, 10))}
+		if _, err := conn.Write(ack.Marshal()); err != nil {
+			return
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func readReplyLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "-") {
+		return "", errors.New(line[1:])
+	}
+
+	return line, nil
+}
+
+// readSyncPayload reads the snapshot sent as a bulk string after FULLRESYNC.
+func readSyncPayload(r *bufio.Reader) (*keyspaceSnapshot, error) {
+	line, err := readReplyLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "$") {
+		return nil, fmt.Errorf("unexpected snapshot header %q", line)
+	}
+	size, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("unexpected snapshot header %q", line)
+	}
+
+	d, _, err := newSnapshotDecoder(io.LimitReader(r, size), size)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.decode()
+}
+
+// applyReplicated executes commands received from the leader against the
+// keyspace and appends them to the AOF. It is called with callMu held, so it
+// does not wait for them to be on disk: see awaitReplicatedFsync.
+func applyReplicated(values ...Value) {
+	applied := 0
+
+	for _, value := range values {
+		command := strings.ToUpper(value.array[0].bulk)
+		if command == "MULTI" || command == "EXEC" {
+			continue
+		}
+
+		handler, ok := Handlers[command]
+		if !ok {
+			log.Println("Unknown command from leader:", command)
+			continue
+		}
+		args := value.array[1:]
+		preserveKeys(lookupCommand(command).keys(args))
+		handler(args)
+		touchKeys(command, args)
+		applied++
+	}
+
+	dirty.Add(int64(applied))
+	if activeAof != nil {
+		activeAof.append(values...)
+	}
+}
+
+// awaitReplicatedFsync waits for the commands applied from the leader to be
+// on disk with appendfsync always. The follower calls it once it released
+// callMu, as call does for local writes.
+func awaitReplicatedFsync() {
+	if activeAof != nil {
+		activeAof.awaitFsync()
+	}
+}
+
+// loadReplicated replaces the keyspace with a snapshot received from the
+// leader. The AOF is rewritten afterwards, as it describes the old data.
+func loadReplicated(snap *keyspaceSnapshot) {
+	snap.restore()
+	touchAllKeys()
+	dirty.Add(1)
+
+	if activeAof != nil {
+		go func() {
+			// a rewrite that is already running captured the old data
+			err := activeAof.Rewrite()
+			for err == errRewriteInProgress {
+				time.Sleep(100 * time.Millisecond)
+				err = activeAof.Rewrite()
+			}
+			if err != nil {
+				log.Println("AOF rewrite after full resync failed:", err)
+			}
+		}()
+	}
+}
+
+func replicaof(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'replicaof' command"}
+	}
+
+	if strings.EqualFold(args[0].bulk, "NO") && strings.EqualFold(args[1].bulk, "ONE") {
+		repl.stopReplication()
+		return Value{typ: "string", str: "OK"}
+	}
+
+	host := args[0].bulk
+	port, err := strconv.Atoi(args[1].bulk)
+	if err != nil || port < 1 || port > 65535 {
+		return Value{typ: "error", str: "ERR Invalid master port"}
+	}
+
+	repl.mu.Lock()
+	link := repl.link
+	repl.mu.Unlock()
+	if link != nil && link.host == host && link.port == port {
+		return Value{typ: "string", str: "OK Already connected to specified master"}
+	}
+
+	repl.replicaOf(host, port, applyReplicated, loadReplicated)
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// replconf answers the REPLCONF a follower sends before PSYNC and returns
+// the listening port it announced, or port if it did not announce one.
+func replconf(args []Value, port int) (int, Value) {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return port, Value{typ: "error", str: "ERR wrong number of arguments for 'replconf' command"}
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		if strings.EqualFold(args[i].bulk, "listening-port") {
+			p, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return port, Value{typ: "error", str: "ERR value is not an integer or out of range"}
+			}
+			port = p
+		}
+	}
+
+	return port, Value{typ: "string", str: "OK"}
+}
+
+func replconfCommand(c *client, args []Value) {
+	var result Value
+	c.replicaPort, result = replconf(args, c.replicaPort)
+	c.write(result)
+}
+
+func role(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'role' command"}
+	}
+
+	return repl.role()
+}
+
+func (r *replState) role() Value {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if link := r.link; link != nil {
+		link.mu.Lock()
+		defer link.mu.Unlock()
+
+		return Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: "slave"},
+			{typ: "bulk", bulk: link.host},
+			{typ: "integer", num: link.port},
+			{typ: "bulk", bulk: link.state},
+			{typ: "integer", num: int(r.offset)},
+		}}
+	}
+
+	replicas := []Value{}
+	for _, rep := range r.sortedReplicasLocked() {
+		rep.mu.Lock()
+		replicas = append(replicas, Value{typ: "array", array: bulks(
+			rep.ip, strconv.Itoa(rep.port), strconv.FormatInt(rep.ackOffset, 10),
+		)})
+		rep.mu.Unlock()
+	}
+
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: "master"},
+		{typ: "integer", num: int(r.offset)},
+		{typ: "array", array: replicas},
+	}}
+}
+
+// sortedReplicasLocked returns the replicas ordered by address.
+func (r *replState) sortedReplicasLocked() []*replica {
+	replicas := make([]*replica, 0, len(r.replicas))
+	for rep := range r.replicas {
+		replicas = append(replicas, rep)
+	}
+	sort.Slice(replicas, func(i, j int) bool {
+		if replicas[i].ip != replicas[j].ip {
+			return replicas[i].ip < replicas[j].ip
+		}
+		return replicas[i].port < replicas[j].port
+	})
+
+	return replicas
+}
+
+// info returns the replication section of INFO.
+func (r *replState) info() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b strings.Builder
+	now := time.Now()
+
+	if link := r.link; link != nil {
+		link.mu.Lock()
+		status := "down"
+		if link.state == linkConnected {
+			status = "up"
+		}
+		syncing := 0
+		if link.state == linkSync {
+			syncing = 1
+		}
+
+		fmt.Fprintf(&b, "role:slave\r\n")
+		fmt.Fprintf(&b, "master_host:%s\r\n", link.host)
+		fmt.Fprintf(&b, "master_port:%d\r\n", link.port)
+		fmt.Fprintf(&b, "master_link_status:%s\r\n", status)
+		if link.lastIO.IsZero() {
+			fmt.Fprintf(&b, "master_last_io_seconds_ago:-1\r\n")
+		} else {
+			fmt.Fprintf(&b, "master_last_io_seconds_ago:%d\r\n", int(now.Sub(link.lastIO).Seconds()))
+		}
+		fmt.Fprintf(&b, "master_sync_in_progress:%d\r\n", syncing)
+		fmt.Fprintf(&b, "slave_repl_offset:%d\r\n", r.offset)
+		if status == "down" {
+			fmt.Fprintf(&b, "master_link_down_since_seconds:%d\r\n", int(now.Sub(link.downFrom).Seconds()))
+		}
+		fmt.Fprintf(&b, "slave_read_only:1\r\n")
+		link.mu.Unlock()
+	} else {
+		fmt.Fprintf(&b, "role:master\r\n")
+	}
+
+	replicas := r.sortedReplicasLocked()
+	fmt.Fprintf(&b, "connected_slaves:%d\r\n", len(replicas))
+	for i, rep := range replicas {
+		rep.mu.Lock()
+		state := "wait_bgsave"
+		if rep.ready {
+			state = "online"
+		}
+		fmt.Fprintf(&b, "slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\r\n",
+			i, rep.ip, rep.port, state, rep.ackOffset, int(now.Sub(rep.lastAck).Seconds()))
+		rep.mu.Unlock()
+	}
+
+	fmt.Fprintf(&b, "master_replid:%s\r\n", r.id)
+	fmt.Fprintf(&b, "master_repl_offset:%d\r\n", r.offset)
+	fmt.Fprintf(&b, "repl_backlog_active:1\r\n")
+	fmt.Fprintf(&b, "repl_backlog_size:%d\r\n", len(r.backlog.buf))
+	fmt.Fprintf(&b, "repl_backlog_first_byte_offset:%d\r\n", r.backlog.first())
+	fmt.Fprintf(&b, "repl_backlog_histlen:%d\r\n", r.backlog.histlen)
+
+	return b.String()
+}
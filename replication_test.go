@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTestServer serves RESP connections on a loopback port.
+func startTestServer(t testing.TB) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(conn, nil)
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+type testClient struct {
+	conn net.Conn
+	resp *Resp
+}
+
+func dialTestServer(t testing.TB, port int) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &testClient{conn: conn, resp: NewResp(conn)}
+}
+
+// do sends a command and returns the first line of the reply.
+func (c *testClient) do(t *testing.T, args ...string) string {
+	t.Helper()
+
+	if _, err := c.conn.Write(Value{typ: "array", array: bulks(args...)}.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	line, err := c.resp.reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimRight(line, "\r\n")
+}
+
+// recorder collects what a follower receives from its leader.
+type recorder struct {
+	mu       sync.Mutex
+	commands []string
+	loads    []*keyspaceSnapshot
+}
+
+func (rec *recorder) apply(values ...Value) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	for _, value := range values {
+		args := []string{}
+		for _, v := range value.array {
+			args = append(args, v.bulk)
+		}
+		rec.commands = append(rec.commands, strings.Join(args, " "))
+	}
+}
+
+func (rec *recorder) load(snap *keyspaceSnapshot) {
+	rec.mu.Lock()
+	rec.loads = append(rec.loads, snap)
+	rec.mu.Unlock()
+}
+
+func (rec *recorder) snapshot() ([]string, int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	return append([]string(nil), rec.commands...), len(rec.loads)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// resetReplication drops the replicas of the server from earlier tests.
+func resetReplication() {
+	repl.mu.Lock()
+	repl.disconnectReplicasLocked()
+	repl.mu.Unlock()
+}
+
+func (r *replState) position() (string, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.id, r.offset
+}
+
+func linkState(r *replState) string {
+	r.mu.Lock()
+	link := r.link
+	r.mu.Unlock()
+
+	link.mu.Lock()
+	defer link.mu.Unlock()
+
+	return link.state
+}
+
+func waitInSync(t *testing.T, follower *replState) {
+	t.Helper()
+
+	waitFor(t, "follower to catch up", func() bool {
+		leaderID, leaderOffset := repl.position()
+		id, offset := follower.position()
+		return linkState(follower) == linkConnected && id == leaderID && offset == leaderOffset
+	})
+}
+
+func TestBacklog(t *testing.T) {
+	b := newBacklog(8, 100)
+
+	if data, ok := b.since(100); !ok || len(data) != 0 {
+		t.Errorf("since(100) on an empty backlog = %q, %v", data, ok)
+	}
+
+	b.write([]byte("abcde"))
+	if data, ok := b.since(102); !ok || string(data) != "cde" {
+		t.Errorf("since(102) = %q, %v, want cde", data, ok)
+	}
+
+	// wraps around and drops the oldest bytes
+	b.write([]byte("fghijk"))
+	if b.first() != 103 || b.end != 111 {
+		t.Errorf("backlog holds [%d, %d), want [103, 111)", b.first(), b.end)
+	}
+	if data, ok := b.since(103); !ok || string(data) != "defghijk" {
+		t.Errorf("since(103) = %q, %v, want defghijk", data, ok)
+	}
+	if _, ok := b.since(102); ok {
+		t.Error("since(102) succeeded although the byte was dropped")
+	}
+	if _, ok := b.since(112); ok {
+		t.Error("since(112) succeeded for an offset in the future")
+	}
+
+	b.write([]byte("0123456789"))
+	if data, ok := b.since(b.first()); !ok || string(data) != "23456789" {
+		t.Errorf("after a write larger than the backlog, held = %q, want 23456789", data)
+	}
+}
+
+func TestReplicationFullResyncAndStream(t *testing.T) {
+	resetKeyspace()
+	resetReplication()
+	set(bulks("existing", "1"))
+	Rpush(bulks("list", "a", "b"))
+
+	port := startTestServer(t)
+	client := dialTestServer(t, port)
+
+	rec := &recorder{}
+	follower := newReplState()
+	follower.replicaOf("127.0.0.1", port, rec.apply, rec.load)
+	defer follower.stopReplication()
+
+	waitInSync(t, follower)
+
+	commands, loads := rec.snapshot()
+	if loads != 1 || len(commands) != 0 {
+		t.Fatalf("got %d loads and %d commands, want one load", loads, len(commands))
+	}
+	snap := rec.loads[0]
+	if snap.strings["existing"] != "1" || len(snap.lists["list"]) != 2 {
+		t.Errorf("snapshot = %+v, want existing and list", snap)
+	}
+
+	if got := client.do(t, "SET", "a", "1"); got != "+OK" {
+		t.Fatalf("SET = %q", got)
+	}
+	client.do(t, "INCR", "a")
+	client.do(t, "EXPIRE", "a", "100")
+	client.do(t, "GET", "a")
+	client.do(t, "INCR", "list") // WRONGTYPE, not replicated
+
+	waitInSync(t, follower)
+
+	commands, _ = rec.snapshot()
+	if len(commands) != 3 || commands[0] != "SET a 1" || commands[1] != "INCR a" || !strings.HasPrefix(commands[2], "PEXPIREAT a ") {
+		t.Errorf("replicated commands = %q", commands)
+	}
+
+	// the leader learns the follower's offset from its acks
+	_, offset := repl.position()
+	waitFor(t, "ack from follower", func() bool {
+		got := repl.role()
+		replicas := got.array[2].array
+		return len(replicas) == 1 && replicas[0].array[2].bulk == strconv.FormatInt(offset, 10)
+	})
+
+	got := repl.role()
+	if got.array[0].bulk != "master" || got.array[1].num != int(offset) {
+		t.Errorf("ROLE on leader = %+v", got)
+	}
+	if replica := got.array[2].array[0].array; replica[0].bulk != "127.0.0.1" || replica[1].bulk != strconv.Itoa(serverPort) {
+		t.Errorf("ROLE replica = %+v, want 127.0.0.1 %d", replica, serverPort)
+	}
+
+	info := repl.info()
+	for _, want := range []string{"role:master", "connected_slaves:1", "slave0:ip=127.0.0.1,", "state=online,offset=" + strconv.FormatInt(offset, 10)} {
+		if !strings.Contains(info, want) {
+			t.Errorf("INFO replication lacks %q:\n%s", want, info)
+		}
+	}
+
+	got = follower.role()
+	if got.array[0].bulk != "slave" || got.array[2].num != port || got.array[3].bulk != linkConnected || got.array[4].num != int(offset) {
+		t.Errorf("ROLE on follower = %+v", got)
+	}
+	info = follower.info()
+	for _, want := range []string{"role:slave", "master_link_status:up", "slave_repl_offset:" + strconv.FormatInt(offset, 10)} {
+		if !strings.Contains(info, want) {
+			t.Errorf("follower INFO replication lacks %q:\n%s", want, info)
+		}
+	}
+}
+
+func TestReplicationPartialResync(t *testing.T) {
+	resetKeyspace()
+	resetReplication()
+
+	port := startTestServer(t)
+	client := dialTestServer(t, port)
+
+	rec := &recorder{}
+	follower := newReplState()
+	follower.replicaOf("127.0.0.1", port, rec.apply, rec.load)
+	defer follower.stopReplication()
+	waitInSync(t, follower)
+
+	client.do(t, "SET", "k", "0")
+	waitInSync(t, follower)
+
+	// drop the connection; the follower reconnects by itself
+	follower.mu.Lock()
+	link := follower.link
+	follower.mu.Unlock()
+	link.mu.Lock()
+	link.conn.Close()
+	link.mu.Unlock()
+
+	for i := 0; i < 10; i++ {
+		client.do(t, "INCR", "k")
+	}
+
+	waitInSync(t, follower)
+
+	commands, loads := rec.snapshot()
+	if loads != 1 {
+		t.Errorf("got %d full resyncs, want only the initial one", loads)
+	}
+	if len(commands) != 11 {
+		t.Errorf("got %d commands, want 11: %q", len(commands), commands)
+	}
+}
+
+func TestReplicationFullResyncWhenBacklogOverrun(t *testing.T) {
+	resetKeyspace()
+	resetReplication()
+
+	port := startTestServer(t)
+	client := dialTestServer(t, port)
+
+	size := repl.backlogSize()
+	repl.setBacklogSize(16 * 1024)
+	defer repl.setBacklogSize(size)
+
+	rec := &recorder{}
+	follower := newReplState()
+	follower.replicaOf("127.0.0.1", port, rec.apply, rec.load)
+	waitInSync(t, follower)
+	follower.link.stop()
+
+	value := strings.Repeat("x", 1024)
+	for i := 0; i < 20; i++ {
+		client.do(t, "SET", "k"+strconv.Itoa(i), value)
+	}
+
+	follower.replicaOf("127.0.0.1", port, rec.apply, rec.load)
+	defer follower.stopReplication()
+	waitInSync(t, follower)
+
+	_, loads := rec.snapshot()
+	if loads != 2 {
+		t.Fatalf("got %d full resyncs, want 2", loads)
+	}
+	if got := len(rec.loads[1].strings); got != 20 {
+		t.Errorf("second snapshot holds %d keys, want 20", got)
+	}
+}
+
+func TestReplicaIsReadOnly(t *testing.T) {
+	resetKeyspace()
+	resetReplication()
+	set(bulks("k", "v"))
+
+	port := startTestServer(t)
+	client := dialTestServer(t, port)
+
+	// nothing listens there, so the link stays down
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	idBefore, _ := repl.position()
+	if got := client.do(t, "REPLICAOF", "127.0.0.1", strconv.Itoa(deadPort)); got != "+OK" {
+		t.Fatalf("REPLICAOF = %q", got)
+	}
+	defer repl.stopReplication()
+
+	if got := client.do(t, "SET", "k", "other"); !strings.HasPrefix(got, "-READONLY") {
+		t.Errorf("SET on a replica = %q, want READONLY error", got)
+	}
+	if got := client.do(t, "GET", "k"); got != "$1" {
+		t.Errorf("GET on a replica = %q, want a bulk reply", got)
+	}
+	client.resp.reader.ReadString('\n')
+
+	if got := client.do(t, "ROLE"); got != "*5" {
+		t.Errorf("ROLE on a replica = %q, want 5 elements", got)
+	}
+	// two bulk strings, an integer, a bulk string and an integer
+	for i := 0; i < 8; i++ {
+		client.resp.reader.ReadString('\n')
+	}
+	if info := repl.info(); !strings.Contains(info, "role:slave") || !strings.Contains(info, "master_link_status:down") {
+		t.Errorf("INFO replication = %q", info)
+	}
+
+	if got := client.do(t, "REPLICAOF", "NO", "ONE"); got != "+OK" {
+		t.Fatalf("REPLICAOF NO ONE = %q", got)
+	}
+	if got := client.do(t, "SET", "k", "other"); got != "+OK" {
+		t.Errorf("SET after REPLICAOF NO ONE = %q", got)
+	}
+	if id, _ := repl.position(); id == idBefore {
+		t.Error("replication ID did not change after REPLICAOF NO ONE")
+	}
+}
+
+func TestReplicationOfExpiredKeys(t *testing.T) {
+	resetKeyspace()
+	resetReplication()
+
+	port := startTestServer(t)
+	client := dialTestServer(t, port)
+
+	rec := &recorder{}
+	follower := newReplState()
+	follower.replicaOf("127.0.0.1", port, rec.apply, rec.load)
+	defer follower.stopReplication()
+	waitInSync(t, follower)
+
+	client.do(t, "SET", "k", "v", "PX", "1")
+	time.Sleep(5 * time.Millisecond)
+	client.do(t, "GET", "k")
+	waitInSync(t, follower)
+
+	// the leader tells its followers when a key expires
+	commands, _ := rec.snapshot()
+	if len(commands) != 2 || commands[1] != "DEL k" {
+		t.Errorf("replicated commands = %q, want the SET and DEL k", commands)
+	}
+}
+
+func TestReplicaDoesNotExpireKeys(t *testing.T) {
+	resetKeyspace()
+	resetReplication()
+	set(bulks("k", "v", "PX", "1"))
+	time.Sleep(5 * time.Millisecond)
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	repl.replicaOf("127.0.0.1", deadPort, applyReplicated, loadReplicated)
+	defer repl.stopReplication()
+
+	if got := call(nil, origin{}, lookupCommand("GET"), bulks("k")); got.typ != "null" {
+		t.Errorf("GET k on a replica = %+v, want null", got)
+	}
+	if n := activeExpireCycle(nil); n != 0 {
+		t.Errorf("active expiry reclaimed %d keys on a replica", n)
+	}
+
+	// until the leader sends its DEL, its writes apply to the key as it is
+	applyReplicated(Value{typ: "array", array: bulks("APPEND", "k", "x")})
+	dbMu.RLock()
+	value, volatile := SETs["k"], expires["k"] != 0
+	dbMu.RUnlock()
+	if value != "vx" || !volatile {
+		t.Errorf("k = %q with a deadline %v, want \"vx\" with its deadline", value, volatile)
+	}
+
+	applyReplicated(Value{typ: "array", array: bulks("DEL", "k")})
+	dbMu.RLock()
+	_, exists := SETs["k"]
+	dbMu.RUnlock()
+	if exists {
+		t.Error("k still exists after the DEL from the leader")
+	}
+}
+
+func TestReplicaofArguments(t *testing.T) {
+	if got := replicaof(bulks("localhost")); got.typ != "error" {
+		t.Errorf("REPLICAOF localhost = %+v, want error", got)
+	}
+	if got := replicaof(bulks("localhost", "port")); got.typ != "error" {
+		t.Errorf("REPLICAOF localhost port = %+v, want error", got)
+	}
+}
+
+func TestApplyReplicated(t *testing.T) {
+	resetKeyspace()
+	dirty.Store(0)
+
+	applyReplicated(Value{typ: "array", array: bulks("SET", "k", "v")})
+	applyReplicated(Value{typ: "array", array: bulks("RPUSH", "l", "a", "b")})
+
+	if got := get(bulks("k")); got.bulk != "v" {
+		t.Errorf("k = %+v, want v", got)
+	}
+	if got := Lrange(bulks("l", "0", "-1")); len(got.array) != 2 {
+		t.Errorf("l = %+v, want 2 elements", got.array)
+	}
+	if got := dirty.Load(); got != 2 {
+		t.Errorf("dirty = %d, want 2", got)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	for _, args := range [][]string{nil, {"replication"}, {"ALL"}, {"default"}} {
+		got := info(bulks(args...))
+		if got.typ != "bulk" || !strings.Contains(got.bulk, "# Replication\r\nrole:") {
+			t.Errorf("INFO %v = %q", args, got.bulk)
+		}
+	}
+
+	if got := info(bulks("replication")); !strings.HasPrefix(got.bulk, "# Replication\r\n") || strings.Contains(got.bulk, "# Memory") {
+		t.Errorf("INFO replication = %q", got.bulk)
+	}
+
+	if got := info(bulks("nosuchsection")); got.bulk != "" {
+		t.Errorf("INFO nosuchsection = %q, want empty", got.bulk)
+	}
+}
+
+func TestSyncPayloadRoundTrip(t *testing.T) {
+	resetKeyspace()
+	set(bulks("k", "v"))
+
+	var payload bytes.Buffer
+	snapshotKeyspace().encode(&payload, snapshotHeader{})
+	stream := "$" + strconv.Itoa(payload.Len()) + "\r\n" + payload.String() + "*1\r\n$4\r\nPING\r\n"
+
+	reader := NewResp(strings.NewReader(stream))
+	snap, err := readSyncPayload(reader.reader)
+	if err != nil {
+		t.Fatalf("readSyncPayload: %v", err)
+	}
+	if snap.strings["k"] != "v" {
+		t.Errorf("snapshot = %+v", snap)
+	}
+
+	// the stream continues right after the payload
+	if v, err := reader.Read(); err != nil || v.array[0].bulk != "PING" {
+		t.Errorf("next value = %+v, %v, want PING", v, err)
+	}
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"bufio"
-	"fmt"
+	"bytes"
 	"io"
+	"math"
+	"math/big"
+	"slices"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -13,37 +17,113 @@ const (
 	INTEGER = ':'
 	BULK    = '$'
 	ARRAY   = '*'
+
+	// RESP3 types
+	NULL      = '_'
+	DOUBLE    = ','
+	BOOLEAN   = '#'
+	BIGNUMBER = '('
+	VERBATIM  = '='
+	MAP       = '%'
+	SET       = '~'
+	PUSH      = '>'
 )
 
+// Value is a RESP value. Besides the RESP2 types it can hold the RESP3 ones,
+// which are sent as their closest RESP2 equivalent to RESP2 connections:
+//   - "map" keeps keys and values alternating in array, and is flattened
+//   - "set" and "push" keep their elements in array and become arrays
+//   - "double" uses double and becomes a bulk string
+//   - "boolean" uses boolean and becomes the integer 1 or 0
+//   - "bignumber" keeps its digits in str and becomes a bulk string
+//   - "verbatim" keeps its text in bulk and its format, like "txt", in str,
+//     and becomes a bulk string
 type Value struct {
-	typ   string
-	str   string
-	bulk  string
-	array []Value
+	typ     string
+	str     string
+	num     int
+	bulk    string
+	array   []Value
+	double  float64
+	boolean bool
+}
+
+// bulks turns strings into a slice of bulk Values, the shape of command
+// arguments.
+func bulks(args ...string) []Value {
+	values := make([]Value, len(args))
+	for i, arg := range args {
+		values[i] = Value{typ: "bulk", bulk: arg}
+	}
+	return values
+}
+
+const (
+	// maxBulkLength and maxArrayLength bound the lengths announced by a
+	// peer, so a corrupt or hostile header cannot make us allocate without
+	// limit.
+	maxBulkLength  = 512 * 1024 * 1024
+	maxArrayLength = 1024 * 1024 * 1024
+
+	// maxInlineLength bounds an inline command, which has no length header.
+	maxInlineLength = 64 * 1024
+
+	// Until a client authenticates, its commands are bounded much more
+	// tightly, as Redis does, so that it cannot make us hold large buffers.
+	unauthBulkLength  = 16 * 1024
+	unauthArrayLength = 10
+
+	// bulkChunkLength is how much of a bulk string is allocated before any
+	// of it is received: the buffer then doubles as the payload arrives, so
+	// that announcing a large length costs nothing by itself.
+	bulkChunkLength = 64 * 1024
+)
+
+// protocolError reports input that is not valid RESP. The stream cannot be
+// resynchronized after it, so the connection has to be closed.
+type protocolError struct {
+	msg string
+}
+
+func (e *protocolError) Error() string {
+	return "Protocol error: " + e.msg
 }
 
 type Resp struct {
 	reader *bufio.Reader
+
+	// unauthenticated applies the limits of clients that have not
+	// authenticated yet to the lengths read.
+	unauthenticated bool
 }
 
 func NewResp(rd io.Reader) *Resp {
 	return &Resp{reader: bufio.NewReader(rd)}
 }
 
+// readLine reads a line terminated by CRLF and returns it without the
+// terminator, along with the number of bytes consumed.
 func (r *Resp) readLine() (line []byte, n int, err error) {
 	for {
-		b, err := r.reader.ReadByte()
-		if err != nil {
+		chunk, err := r.reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
 			return nil, 0, err
 		}
-		n++
-		line = append(line, b)
-		if len(line) >= 2 && line[len(line)-2] == '\r' {
-			break
+		if len(line) > maxInlineLength {
+			return nil, 0, &protocolError{"too big line"}
 		}
 	}
-	// discard the \r\n->CRLF => \r - Carriage return \n - Line feed
-	return line[:len(line)-2], n, nil
+
+	n = len(line)
+	if n < 2 || line[n-2] != '\r' {
+		return nil, n, &protocolError{"expected CRLF"}
+	}
+
+	return line[:n-2], n, nil
 }
 
 // readInteger reads an integer from the Resp reader and returns the integer value, the number of bytes read, and any error encountered.
@@ -65,11 +145,13 @@ func (r *Resp) readInteger() (x int, n int, err error) {
 	}
 	i64, err := strconv.ParseInt(string(line), 10, 64)
 	if err != nil {
-		return 0, n, err
+		return 0, n, &protocolError{"invalid integer " + strconv.Quote(string(line))}
 	}
 	return int(i64), n, nil
 }
 
+// Read parses the next RESP2 value: a simple string, an error, an integer, a
+// bulk string or an array of any of them, with $-1 and *-1 read as nulls.
 func (r *Resp) Read() (Value, error) {
 	_type, err := r.reader.ReadByte()
 
@@ -79,16 +161,116 @@ func (r *Resp) Read() (Value, error) {
 
 	switch _type {
 	case ARRAY:
-		return r.readArray()
+		return r.readArray(r.Read)
 	case BULK:
 		return r.readBulk()
+	case STRING, ERROR:
+		line, _, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		if _type == ERROR {
+			return Value{typ: "error", str: string(line)}, nil
+		}
+		return Value{typ: "string", str: string(line)}, nil
+	case INTEGER:
+		num, _, err := r.readInteger()
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{typ: "integer", num: num}, nil
+	case MAP, SET, PUSH:
+		v, err := r.readArray(r.Read)
+		if err != nil {
+			return v, err
+		}
+		if _type == MAP {
+			// the length counts pairs
+			for i := len(v.array); i > 0; i-- {
+				val, err := r.Read()
+				if err != nil {
+					return v, err
+				}
+				v.array = append(v.array, val)
+			}
+		}
+		v.typ = map[byte]string{MAP: "map", SET: "set", PUSH: "push"}[_type]
+		return v, nil
+	case NULL, DOUBLE, BOOLEAN, BIGNUMBER:
+		line, _, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		return parseResp3Line(_type, string(line))
+	case VERBATIM:
+		v, err := r.readBulk()
+		if err != nil {
+			return v, err
+		}
+		format, text, ok := strings.Cut(v.bulk, ":")
+		if !ok || len(format) != 3 {
+			return v, &protocolError{"invalid verbatim string"}
+		}
+		return Value{typ: "verbatim", str: format, bulk: text}, nil
 	default:
-		fmt.Printf("Unknown type: %v", string(_type))
-		return Value{}, nil
+		return Value{}, &protocolError{"unexpected type byte " + strconv.QuoteRune(rune(_type))}
+	}
+}
+
+func parseResp3Line(_type byte, line string) (Value, error) {
+	switch {
+	case _type == NULL && line == "":
+		return Value{typ: "null"}, nil
+	case _type == BOOLEAN && (line == "t" || line == "f"):
+		return Value{typ: "boolean", boolean: line == "t"}, nil
+	case _type == DOUBLE:
+		double, err := strconv.ParseFloat(line, 64)
+		if err == nil {
+			return Value{typ: "double", double: double}, nil
+		}
+	case _type == BIGNUMBER:
+		if _, ok := new(big.Int).SetString(line, 10); ok {
+			return Value{typ: "bignumber", str: line}, nil
+		}
+	}
+
+	return Value{}, &protocolError{"invalid " + strconv.QuoteRune(rune(_type)) + " value " + strconv.Quote(line)}
+}
+
+// ReadCommand parses the next command sent by a client: either an array of
+// bulk strings or, like Redis does for telnet sessions, a single line of
+// arguments separated by spaces. Empty inline lines yield an empty array.
+func (r *Resp) ReadCommand() (Value, error) {
+	first, err := r.reader.Peek(1)
+	if err != nil {
+		return Value{}, err
 	}
+
+	if first[0] != ARRAY {
+		return r.readInline()
+	}
+
+	r.reader.ReadByte()
+
+	return r.readArray(func() (Value, error) {
+		_type, err := r.reader.ReadByte()
+		if err != nil {
+			return Value{}, err
+		}
+		if _type != BULK {
+			return Value{}, &protocolError{"expected '$', got " + strconv.QuoteRune(rune(_type))}
+		}
+		v, err := r.readBulk()
+		if err == nil && v.typ == "null" {
+			return v, &protocolError{"invalid bulk length"}
+		}
+		return v, err
+	})
 }
 
-func (r *Resp) readArray() (Value, error) {
+// readArray reads the length of an array and then every element with
+// readElement.
+func (r *Resp) readArray(readElement func() (Value, error)) (Value, error) {
 	v := Value{}
 	v.typ = "array"
 
@@ -97,11 +279,20 @@ func (r *Resp) readArray() (Value, error) {
 	if err != nil {
 		return v, err
 	}
+	if len == -1 {
+		return Value{typ: "nullarray"}, nil
+	}
+	if len < 0 || len > maxArrayLength {
+		return v, &protocolError{"invalid multibulk length"}
+	}
+	if r.unauthenticated && len > unauthArrayLength {
+		return v, &protocolError{"unauthenticated multibulk length"}
+	}
 
 	// foreach line, parse and read the value
 	v.array = make([]Value, 0)
 	for i := 0; i < len; i++ {
-		val, err := r.Read()
+		val, err := readElement()
 		if err != nil {
 			return v, err
 		}
@@ -115,9 +306,10 @@ func (r *Resp) readArray() (Value, error) {
 
 // readBulk reads a bulk value from the Resp reader and returns the parsed Value and any error encountered.
 //
-// It reads the length of the bulk value using the readInteger method, creates a byte slice of the specified length,
-// reads the bulk value into the byte slice, converts the byte slice to a string, and returns the parsed Value.
+// It reads the length of the bulk value using the readInteger method, reads the bulk value into a buffer that starts
+// at bulkChunkLength and doubles as the data arrives, converts it to a string, and returns the parsed Value.
 // If an error is encountered during the read operation, it returns the empty Value and the error.
+// A length of -1 is the null bulk string.
 //
 // Parameters:
 // - r: a pointer to the Resp struct
@@ -130,44 +322,256 @@ func (r *Resp) readBulk() (Value, error) {
 
 	v.typ = "bulk"
 
-	len, _, err := r.readInteger()
+	length, _, err := r.readInteger()
 	if err != nil {
 		return v, err
 	}
+	if length == -1 {
+		return Value{typ: "null"}, nil
+	}
+	if length < 0 || length > maxBulkLength {
+		return v, &protocolError{"invalid bulk length"}
+	}
+	if r.unauthenticated && length > unauthBulkLength {
+		return v, &protocolError{"unauthenticated bulk length"}
+	}
 
-	bulk := make([]byte, len)
-
-	if _, err := r.reader.Read(bulk); err != nil {
-		return v, err
+	bulk := make([]byte, 0, min(length, bulkChunkLength))
+	for {
+		end := min(cap(bulk), length)
+		if _, err := io.ReadFull(r.reader, bulk[len(bulk):end]); err != nil {
+			if err == io.EOF && len(bulk) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return v, err
+		}
+		bulk = bulk[:end]
+		if end == length {
+			break
+		}
+		bulk = slices.Grow(bulk, min(length-end, cap(bulk)))
 	}
 
 	v.bulk = string(bulk)
 
-	if _, _, err := r.readLine(); err != nil {
+	crlf := make([]byte, 2)
+	if _, err := io.ReadFull(r.reader, crlf); err != nil {
 		return v, err
 	}
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		return v, &protocolError{"expected CRLF after bulk string"}
+	}
 
 	return v, nil
 }
 
-// Marshal Value to bytes
+// readInline reads a command sent as a plain line, terminated by LF or CRLF.
+func (r *Resp) readInline() (Value, error) {
+	var line []byte
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxInlineLength {
+			return Value{}, &protocolError{"too big inline request"}
+		}
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return Value{}, err
+		}
+	}
+
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'})
+
+	args, err := splitArgs(string(line))
+	if err != nil {
+		return Value{}, err
+	}
+
+	return Value{typ: "array", array: bulks(args...)}, nil
+}
+
+// splitArgs splits an inline command into its arguments. Like Redis it
+// accepts double-quoted arguments with C-like escapes and single-quoted
+// arguments taken literally except for \'.
+func splitArgs(line string) ([]string, error) {
+	args := []string{}
+	unbalanced := &protocolError{"unbalanced quotes in request"}
+
+	for i := 0; ; {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		switch line[i] {
+		case '"':
+			i++
+			for {
+				if i == len(line) {
+					return nil, unbalanced
+				}
+				c := line[i]
+				if c == '"' {
+					i++
+					break
+				}
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					arg = append(arg, byte(b))
+					i += 4
+					continue
+				}
+				if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					default:
+						c = line[i]
+					}
+				}
+				arg = append(arg, c)
+				i++
+			}
+		case '\'':
+			i++
+			for {
+				if i == len(line) {
+					return nil, unbalanced
+				}
+				c := line[i]
+				if c == '\'' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					c = '\''
+				}
+				arg = append(arg, c)
+				i++
+			}
+		default:
+			for i < len(line) && !isSpace(line[i]) {
+				arg = append(arg, line[i])
+				i++
+			}
+			args = append(args, string(arg))
+			continue
+		}
+
+		// a closing quote must be followed by a space or the end of line
+		if i < len(line) && !isSpace(line[i]) {
+			return nil, unbalanced
+		}
+		args = append(args, string(arg))
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// Marshal Value to bytes, using RESP2.
 func (v Value) Marshal() []byte {
+	return v.MarshalProto(2)
+}
+
+// MarshalProto marshals v for a connection speaking the given protocol
+// version, 2 or 3.
+func (v Value) MarshalProto(proto int) []byte {
 	switch v.typ {
 	case "array":
-		return v.marshalArray()
+		return v.marshalArray(ARRAY, proto)
 	case "bulk":
 		return v.marshalBulk()
 	case "string":
 		return v.marshalString()
+	case "integer":
+		return v.marshalInteger()
 	case "null":
+		if proto == 3 {
+			return []byte("_\r\n")
+		}
 		return v.marshallNull()
+	case "nullarray":
+		if proto == 3 {
+			return []byte("_\r\n")
+		}
+		return []byte("*-1\r\n")
 	case "error":
 		return v.marshallError()
+	case "map", "set", "push":
+		if proto == 3 {
+			return v.marshalArray(map[string]byte{"map": MAP, "set": SET, "push": PUSH}[v.typ], proto)
+		}
+		return v.marshalArray(ARRAY, proto)
+	case "double":
+		text := formatDouble(v.double)
+		if proto == 3 {
+			return []byte(string(DOUBLE) + text + "\r\n")
+		}
+		return Value{typ: "bulk", bulk: text}.marshalBulk()
+	case "boolean":
+		if proto == 3 {
+			if v.boolean {
+				return []byte("#t\r\n")
+			}
+			return []byte("#f\r\n")
+		}
+		if v.boolean {
+			return Value{typ: "integer", num: 1}.marshalInteger()
+		}
+		return Value{typ: "integer", num: 0}.marshalInteger()
+	case "bignumber":
+		if proto == 3 {
+			return []byte(string(BIGNUMBER) + v.str + "\r\n")
+		}
+		return Value{typ: "bulk", bulk: v.str}.marshalBulk()
+	case "verbatim":
+		if proto == 3 {
+			bytes := Value{typ: "bulk", bulk: v.str + ":" + v.bulk}.marshalBulk()
+			bytes[0] = VERBATIM
+			return bytes
+		}
+		return v.marshalBulk()
 	default:
 		return []byte{}
 	}
 }
 
+// formatDouble formats f the way RESP3 expects, with inf, -inf and nan
+// spelled out.
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
 func (v Value) marshalString() []byte {
 	var bytes []byte
 	bytes = append(bytes, STRING)
@@ -177,6 +581,15 @@ func (v Value) marshalString() []byte {
 	return bytes
 }
 
+func (v Value) marshalInteger() []byte {
+	var bytes []byte
+	bytes = append(bytes, INTEGER)
+	bytes = append(bytes, strconv.Itoa(v.num)...)
+	bytes = append(bytes, '\r', '\n')
+
+	return bytes
+}
+
 func (v Value) marshalBulk() []byte {
 	var bytes []byte
 	bytes = append(bytes, BULK)
@@ -188,15 +601,22 @@ func (v Value) marshalBulk() []byte {
 	return bytes
 }
 
-func (v Value) marshalArray() []byte {
+// marshalArray marshals the elements of v after a header made of prefix and
+// their count, or the count of pairs for a RESP3 map.
+func (v Value) marshalArray(prefix byte, proto int) []byte {
 	len := len(v.array)
+	count := len
+	if prefix == MAP {
+		count /= 2
+	}
+
 	var bytes []byte
-	bytes = append(bytes, ARRAY)
-	bytes = append(bytes, strconv.Itoa(len)...)
+	bytes = append(bytes, prefix)
+	bytes = append(bytes, strconv.Itoa(count)...)
 	bytes = append(bytes, '\r', '\n')
 
 	for i := 0; i < len; i++ {
-		bytes = append(bytes, v.array[i].Marshal()...)
+		bytes = append(bytes, v.array[i].MarshalProto(proto)...)
 	}
 
 	return bytes
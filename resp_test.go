@@ -2,7 +2,14 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestMarshalString(t *testing.T) {
@@ -13,6 +20,14 @@ func TestMarshalString(t *testing.T) {
 	}
 }
 
+func TestMarshalInteger(t *testing.T) {
+	v := Value{typ: "integer", num: -42}
+	expected := ":-42\r\n"
+	if string(v.Marshal()) != expected {
+		t.Errorf("Marshal integer = %q, want %q", string(v.Marshal()), expected)
+	}
+}
+
 func TestMarshalBulk(t *testing.T) {
 	v := Value{typ: "bulk", bulk: "hello"}
 	expected := "$5\r\nhello\r\n"
@@ -149,3 +164,298 @@ func TestReadEmptyBulk(t *testing.T) {
 		t.Errorf("Read empty bulk = %+v, want {typ:bulk, bulk:''}", v)
 	}
 }
+
+func TestReadBulkAcrossBufferBoundary(t *testing.T) {
+	// iotest.OneByteReader hands out a single byte per Read, so the bulk can
+	// never be filled by one read of the underlying reader
+	input := "$11\r\nhello world\r\n"
+	resp := NewResp(iotest.OneByteReader(bytes.NewBufferString(input)))
+
+	v, err := resp.Read()
+	if err != nil {
+		t.Fatalf("Read bulk: %v", err)
+	}
+	if v.bulk != "hello world" {
+		t.Errorf("Read bulk = %q, want %q", v.bulk, "hello world")
+	}
+}
+
+func TestReadLargeBulk(t *testing.T) {
+	payload := strings.Repeat("x", 3*bulkChunkLength+1)
+	resp := NewResp(bytes.NewBufferString("$" + strconv.Itoa(len(payload)) + "\r\n" + payload + "\r\n"))
+
+	v, err := resp.Read()
+	if err != nil || v.bulk != payload {
+		t.Fatalf("Read bulk of %d bytes = %d bytes, %v", len(payload), len(v.bulk), err)
+	}
+
+	// the announced length is not allocated before the payload arrives
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	resp = NewResp(bytes.NewBufferString("$" + strconv.Itoa(maxBulkLength) + "\r\nabc"))
+	if _, err := resp.Read(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Read truncated bulk: %v, want unexpected EOF", err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("reading a truncated bulk allocated %d bytes", allocated)
+	}
+}
+
+func TestReadUnauthenticatedLimits(t *testing.T) {
+	tests := []struct {
+		input string
+		ok    bool
+	}{
+		{"*10\r\n" + strings.Repeat("$1\r\na\r\n", 10), true},
+		{"*11\r\n", false},
+		{"*1\r\n$16384\r\n" + strings.Repeat("a", 16384) + "\r\n", true},
+		{"*1\r\n$16385\r\n", false},
+	}
+
+	for _, tt := range tests {
+		resp := NewResp(bytes.NewBufferString(tt.input))
+		resp.unauthenticated = true
+
+		_, err := resp.ReadCommand()
+		var protoErr *protocolError
+		if tt.ok && err != nil {
+			t.Errorf("reading %.20q before authenticating: %v", tt.input, err)
+		}
+		if !tt.ok && !errors.As(err, &protoErr) {
+			t.Errorf("reading %.20q before authenticating: got %v, want a protocol error", tt.input, err)
+		}
+
+		// the same command is fine once authenticated
+		if !tt.ok {
+			resp = NewResp(bytes.NewBufferString(tt.input))
+			if _, err := resp.ReadCommand(); errors.As(err, &protoErr) {
+				t.Errorf("reading %.20q once authenticated: %v", tt.input, err)
+			}
+		}
+	}
+}
+
+func TestReadReplies(t *testing.T) {
+	input := "+OK\r\n-ERR bad\r\n:-42\r\n$-1\r\n*-1\r\n*3\r\n:1\r\n+two\r\n*1\r\n$5\r\nthree\r\n"
+	resp := NewResp(bytes.NewBufferString(input))
+
+	read := func() Value {
+		t.Helper()
+		v, err := resp.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	if v := read(); v.typ != "string" || v.str != "OK" {
+		t.Errorf("simple string = %+v", v)
+	}
+	if v := read(); v.typ != "error" || v.str != "ERR bad" {
+		t.Errorf("error = %+v", v)
+	}
+	if v := read(); v.typ != "integer" || v.num != -42 {
+		t.Errorf("integer = %+v", v)
+	}
+	if v := read(); v.typ != "null" {
+		t.Errorf("null bulk = %+v", v)
+	}
+	if v := read(); v.typ != "nullarray" {
+		t.Errorf("null array = %+v", v)
+	}
+	v := read()
+	if v.typ != "array" || len(v.array) != 3 || v.array[0].num != 1 || v.array[1].str != "two" || v.array[2].array[0].bulk != "three" {
+		t.Errorf("nested array = %+v", v)
+	}
+}
+
+func TestMarshalNullArray(t *testing.T) {
+	v := Value{typ: "nullarray"}
+	if string(v.Marshal()) != "*-1\r\n" {
+		t.Errorf("Marshal null array = %q, want %q", string(v.Marshal()), "*-1\r\n")
+	}
+}
+
+func TestReadCommandInline(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"PING\r\n", []string{"PING"}},
+		{"set  key value\n", []string{"set", "key", "value"}},
+		{"\r\n", []string{}},
+		{`SET k "hello world\n\x41"` + "\r\n", []string{"SET", "k", "hello world\nA"}},
+		{`SET k 'it\'s' ""` + "\r\n", []string{"SET", "k", "it's", ""}},
+	}
+
+	for _, tt := range tests {
+		v, err := NewResp(bytes.NewBufferString(tt.input)).ReadCommand()
+		if err != nil {
+			t.Errorf("ReadCommand(%q): %v", tt.input, err)
+			continue
+		}
+		got := []string{}
+		for _, arg := range v.array {
+			got = append(got, arg.bulk)
+		}
+		if v.typ != "array" || strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("ReadCommand(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestReadProtocolErrors(t *testing.T) {
+	tests := []struct {
+		input   string
+		command bool
+	}{
+		{"*x\r\n", true},
+		{"*-5\r\n", true},
+		{"*1\r\n$-7\r\n", true},
+		{"*1\r\n$-1\r\n", true},
+		{"*1\r\n:1\r\n", true},
+		{"*1\r\n$3\r\nGETX\r\n", true},
+		{"*1\r\n$3\nGET\r\n", true},
+		{`GET "key` + "\r\n", true},
+		{`GET "key"x` + "\r\n", true},
+		{strings.Repeat("A", maxInlineLength+1) + "\r\n", true},
+		{"?what\r\n", false},
+		{":12a\r\n", false},
+		{"+OK\n", false},
+	}
+
+	for _, tt := range tests {
+		resp := NewResp(bytes.NewBufferString(tt.input))
+		var err error
+		if tt.command {
+			_, err = resp.ReadCommand()
+		} else {
+			_, err = resp.Read()
+		}
+		var protoErr *protocolError
+		if !errors.As(err, &protoErr) {
+			t.Errorf("reading %q: got %v, want a protocol error", tt.input, err)
+		}
+	}
+}
+
+func TestProtocolErrorClosesConnection(t *testing.T) {
+	port := startTestServer(t)
+	c := dialTestServer(t, port)
+
+	// commands typed in nc or telnet arrive inline
+	c.conn.Write([]byte("PING\r\n"))
+	if line, _ := c.resp.reader.ReadString('\n'); line != "+PONG\r\n" {
+		t.Fatalf("inline PING = %q", line)
+	}
+
+	c.conn.Write([]byte("ECHO \"hi\r\n"))
+	line, err := c.resp.reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "-ERR Protocol error: unbalanced quotes in request\r\n" {
+		t.Fatalf("reply = %q", line)
+	}
+	if _, err := c.resp.reader.ReadString('\n'); err != io.EOF {
+		t.Fatalf("connection still open after a protocol error: %v", err)
+	}
+}
+
+func TestMarshalResp3(t *testing.T) {
+	tests := []struct {
+		v          Value
+		resp2      string
+		resp3      string
+		roundTrips bool
+	}{
+		{Value{typ: "null"}, "$-1\r\n", "_\r\n", true},
+		{Value{typ: "nullarray"}, "*-1\r\n", "_\r\n", false},
+		{Value{typ: "double", double: 1.5}, "$3\r\n1.5\r\n", ",1.5\r\n", true},
+		{Value{typ: "double", double: math.Inf(-1)}, "$4\r\n-inf\r\n", ",-inf\r\n", true},
+		{Value{typ: "boolean", boolean: true}, ":1\r\n", "#t\r\n", true},
+		{Value{typ: "boolean"}, ":0\r\n", "#f\r\n", true},
+		{Value{typ: "bignumber", str: "12345678901234567890"}, "$20\r\n12345678901234567890\r\n", "(12345678901234567890\r\n", true},
+		{Value{typ: "verbatim", str: "txt", bulk: "hi"}, "$2\r\nhi\r\n", "=6\r\ntxt:hi\r\n", true},
+		{Value{typ: "map", array: bulks("k", "v")}, "*2\r\n$1\r\nk\r\n$1\r\nv\r\n", "%1\r\n$1\r\nk\r\n$1\r\nv\r\n", true},
+		{Value{typ: "set", array: bulks("a")}, "*1\r\n$1\r\na\r\n", "~1\r\n$1\r\na\r\n", true},
+		{Value{typ: "push", array: []Value{{typ: "null"}}}, "*1\r\n$-1\r\n", ">1\r\n_\r\n", true},
+	}
+
+	for _, tt := range tests {
+		if got := string(tt.v.Marshal()); got != tt.resp2 {
+			t.Errorf("Marshal(%+v) = %q, want %q", tt.v, got, tt.resp2)
+		}
+		if got := string(tt.v.MarshalProto(3)); got != tt.resp3 {
+			t.Errorf("MarshalProto(%+v, 3) = %q, want %q", tt.v, got, tt.resp3)
+		}
+		if !tt.roundTrips {
+			continue
+		}
+		got, err := NewResp(bytes.NewBufferString(tt.resp3)).Read()
+		if err != nil {
+			t.Errorf("Read(%q): %v", tt.resp3, err)
+			continue
+		}
+		if again := string(got.MarshalProto(3)); again != tt.resp3 {
+			t.Errorf("Read(%q) = %+v", tt.resp3, got)
+		}
+	}
+}
+
+func TestHello(t *testing.T) {
+	resetKeyspace()
+	port := startTestServer(t)
+	c := dialTestServer(t, port)
+
+	if got := c.do(t, "HELLO", "4"); got != "-NOPROTO unsupported protocol version" {
+		t.Fatalf("HELLO 4 = %q", got)
+	}
+	if got := c.do(t, "HELLO", "3", "AUTH", "someone", "secret"); !strings.HasPrefix(got, "-WRONGPASS") {
+		t.Fatalf("HELLO with a wrong user = %q", got)
+	}
+
+	send(t, c, "HELLO", "3", "AUTH", "default", "anything", "SETNAME", "worker")
+	reply, err := c.resp.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.typ != "map" || len(reply.array) != 14 || reply.array[0].bulk != "server" || reply.array[5].num != 3 {
+		t.Fatalf("HELLO 3 = %+v", reply)
+	}
+
+	c.do(t, "HSET", "h", "f", "v")
+	if got := c.do(t, "HGETALL", "h"); got != "%1" {
+		t.Fatalf("HGETALL under RESP3 = %q, want a map", got)
+	}
+	c.resp.Read()
+	c.resp.Read()
+	if got := c.do(t, "GET", "missing"); got != "_" {
+		t.Fatalf("GET missing under RESP3 = %q, want _", got)
+	}
+
+	// subscribed RESP3 clients receive push frames and can still run
+	// commands
+	send(t, c, "SUBSCRIBE", "ch")
+	if push, _ := c.resp.Read(); push.typ != "push" || push.array[0].bulk != "subscribe" {
+		t.Fatalf("SUBSCRIBE under RESP3 = %+v", push)
+	}
+	if got := c.do(t, "GET", "missing"); got != "_" {
+		t.Fatalf("GET while subscribed = %q", got)
+	}
+	dialTestServer(t, port).do(t, "PUBLISH", "ch", "hi")
+	if push, _ := c.resp.Read(); push.typ != "push" || push.array[2].bulk != "hi" {
+		t.Fatalf("message under RESP3 = %+v", push)
+	}
+	send(t, c, "UNSUBSCRIBE")
+	c.resp.Read()
+
+	send(t, c, "HELLO", "2")
+	if reply, _ := c.resp.Read(); reply.typ != "array" || len(reply.array) != 14 {
+		t.Fatalf("HELLO 2 = %+v", reply)
+	}
+	if got := c.do(t, "HGETALL", "h"); got != "*2" {
+		t.Fatalf("HGETALL under RESP2 = %q, want a flat array", got)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRewritePercentage = 100
+	defaultRewriteMinSize    = 64 * 1024 * 1024
+
+	// rewriteItemsPerCmd caps how many list elements go into one RPUSH.
+	rewriteItemsPerCmd = 64
+
+	// rewriteBufDrainSize is how much buffered data is still copied to the
+	// new file without blocking writers before the final swap.
+	rewriteBufDrainSize = 64 * 1024
+)
+
+var (
+	errRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+	errAofDisabled       = errors.New("ERR append only file is not enabled")
+)
+
+func bgrewriteaof(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'bgrewriteaof' command"}
+	}
+
+	if activeAof == nil {
+		return Value{typ: "error", str: errAofDisabled.Error()}
+	}
+
+	if err := activeAof.BackgroundRewrite(); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	return Value{typ: "string", str: "Background append only file rewriting started"}
+}
+
+// BackgroundRewrite starts a rewrite in its own goroutine.
+func (aof *Aof) BackgroundRewrite() error {
+	if !aof.claimRewrite() {
+		return errRewriteInProgress
+	}
+
+	go aof.rewrite()
+
+	return nil
+}
+
+// Rewrite replaces the AOF with the shortest sequence of commands that
+// rebuilds the current keyspace and waits for it to finish.
+func (aof *Aof) Rewrite() error {
+	if !aof.claimRewrite() {
+		return errRewriteInProgress
+	}
+
+	return aof.rewrite()
+}
+
+func (aof *Aof) claimRewrite() bool {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.rewriting {
+		return false
+	}
+	aof.rewriting = true
+
+	return true
+}
+
+// maybeRewrite starts a background rewrite once the file has grown past the
+// configured percentage of its size after the previous rewrite.
+func (aof *Aof) maybeRewrite() {
+	aof.mu.Lock()
+	percentage, minSize := aof.rewritePercentage, aof.rewriteMinSize
+	size, base := aof.size, aof.baseSize
+	aof.mu.Unlock()
+
+	if percentage <= 0 || size < minSize {
+		return
+	}
+	if base == 0 {
+		base = 1
+	}
+	if (size-base)*100/base < int64(percentage) {
+		return
+	}
+
+	if err := aof.BackgroundRewrite(); err == nil {
+		log.Printf("Starting automatic AOF rewrite (%d%% growth)", (size-base)*100/base)
+	}
+}
+
+// rewrite does the work once the rewriting flag has been claimed.
+//
+// A capture of the keyspace and buffering of new writes start while callMu
+// is held exclusively, so every write is either part of the snapshot or of
+// rewriteBuf, never both. The keyspace is then copied alongside writers and
+// written to a temporary file without holding any lock, the buffered writes
+// are appended and the temporary file atomically replaces the old one.
+func (aof *Aof) rewrite() (err error) {
+	start := time.Now()
+
+	defer func() {
+		aof.mu.Lock()
+		aof.rewriting = false
+		aof.rewriteBuf = nil
+		aof.lastRewriteErr = err
+		aof.lastRewriteTime = time.Now()
+		aof.lastRewriteDuration = time.Since(start)
+		aof.mu.Unlock()
+
+		if err != nil {
+			log.Println("AOF rewrite failed:", err)
+		}
+	}()
+
+	callMu.Lock()
+	capture := startCapture()
+	aof.mu.Lock()
+	aof.rewriteBuf = []byte{}
+	aof.mu.Unlock()
+	callMu.Unlock()
+
+	snap := capture.finish()
+
+	tmp, err := os.CreateTemp(filepath.Dir(aof.path), "temp-rewriteaof-*.aof")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = tmp.Chmod(0644); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	err = snap.rewriteCommands(func(v Value) error {
+		_, err := w.Write(v.Marshal())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	// copy what was buffered so far without stopping writers, then take the
+	// lock for good once only a small tail is left
+	aof.mu.Lock()
+	for len(aof.rewriteBuf) > rewriteBufDrainSize {
+		buf := aof.rewriteBuf
+		aof.rewriteBuf = []byte{}
+		aof.mu.Unlock()
+
+		if _, err = tmp.Write(buf); err != nil {
+			return err
+		}
+
+		aof.mu.Lock()
+	}
+	defer aof.mu.Unlock()
+
+	if _, err = tmp.Write(aof.rewriteBuf); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+
+	size, err := tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), aof.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(aof.path))
+
+	// tmp now is the file at aof.path, positioned at its end
+	aof.file.Close()
+	aof.file = tmp
+	aof.rd = bufio.NewReader(tmp)
+	aof.size = size
+	aof.baseSize = size
+	// the new file was synced with everything written so far
+	aof.syncedOffset = aof.writeOffset
+	aof.syncDone.Broadcast()
+
+	return nil
+}
+
+// syncDir flushes a directory entry so a rename survives a crash.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// rewriteCommands calls fn with the commands that rebuild the snapshot.
+func (snap *keyspaceSnapshot) rewriteCommands(fn func(Value) error) error {
+	command := func(args ...string) Value {
+		return Value{typ: "array", array: bulks(args...)}
+	}
+
+	for key, value := range snap.strings {
+		args := []string{"SET", key, value}
+		if when, ok := snap.expires[key]; ok {
+			args = append(args, "PXAT", strconv.FormatInt(when, 10))
+		}
+		if err := fn(command(args...)); err != nil {
+			return err
+		}
+	}
+
+	for key, list := range snap.lists {
+		for i := 0; i < len(list); i += rewriteItemsPerCmd {
+			end := min(i+rewriteItemsPerCmd, len(list))
+			args := append([]string{"RPUSH", key}, list[i:end]...)
+			if err := fn(command(args...)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for key, fields := range snap.hashes {
+		for field, value := range fields {
+			if err := fn(command("HSET", key, field, value)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for key, when := range snap.expires {
+		if _, ok := snap.strings[key]; ok {
+			continue
+		}
+		if err := fn(command("PEXPIREAT", key, strconv.FormatInt(when, 10))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestAof(t *testing.T) *Aof {
+	t.Helper()
+
+	aof, err := NewAof(filepath.Join(t.TempDir(), "test.aof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { aof.Close() })
+
+	return aof
+}
+
+// applyAndLog runs a write command and logs it like handleConnection does.
+func applyAndLog(aof *Aof, command string, args ...string) Value {
+	values := bulks(args...)
+	result := Handlers[command](values)
+	propagate(aof, command, values, result)
+	return result
+}
+
+func TestRewriteCompactsAndRestores(t *testing.T) {
+	resetKeyspace()
+	aof := newTestAof(t)
+
+	applyAndLog(aof, "SET", "counter", "0")
+	for i := 0; i < 500; i++ {
+		applyAndLog(aof, "INCR", "counter")
+	}
+	applyAndLog(aof, "SET", "session", "abc", "EX", "100")
+	for i := 0; i < 150; i++ {
+		applyAndLog(aof, "RPUSH", "list", strconv.Itoa(i))
+	}
+	applyAndLog(aof, "LPOP", "list")
+	applyAndLog(aof, "HSET", "h", "f1", "v1")
+	applyAndLog(aof, "HSET", "h", "f2", "v2")
+	applyAndLog(aof, "EXPIRE", "h", "100")
+	applyAndLog(aof, "SET", "gone", "x")
+	applyAndLog(aof, "DEL", "gone")
+
+	before := aof.size
+	if err := aof.Rewrite(); err != nil {
+		t.Fatalf("Rewrite: %v", err)
+	}
+	if aof.size >= before {
+		t.Errorf("rewritten AOF is %d bytes, want less than %d", aof.size, before)
+	}
+	if aof.baseSize != aof.size {
+		t.Errorf("baseSize = %d, want %d", aof.baseSize, aof.size)
+	}
+
+	info, err := os.Stat(aof.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != aof.size {
+		t.Errorf("file is %d bytes, size says %d", info.Size(), aof.size)
+	}
+
+	sessionTTL := ttl(bulks("session")).num
+	resetKeyspace()
+	if err := loadAof(aof); err != nil {
+		t.Fatalf("loadAof: %v", err)
+	}
+
+	if got := get(bulks("counter")); got.bulk != "500" {
+		t.Errorf("counter = %q, want 500", got.bulk)
+	}
+	if got := ttl(bulks("session")); got.num != sessionTTL {
+		t.Errorf("TTL session = %d, want %d", got.num, sessionTTL)
+	}
+	if got := Lrange(bulks("list", "0", "-1")); len(got.array) != 149 || got.array[0].bulk != "1" {
+		t.Errorf("list has %d elements starting at %q, want 149 starting at 1", len(got.array), got.array[0].bulk)
+	}
+	if got := hget(bulks("h", "f2")); got.bulk != "v2" {
+		t.Errorf("HGET h f2 = %q, want v2", got.bulk)
+	}
+	if got := ttl(bulks("h")); got.num <= 0 {
+		t.Errorf("TTL h = %d, want a positive ttl", got.num)
+	}
+	if got := exists(bulks("gone")); got.num != 0 {
+		t.Errorf("EXISTS gone = %d, want 0", got.num)
+	}
+}
+
+func TestRewriteKeepsAppendingAfterSwap(t *testing.T) {
+	resetKeyspace()
+	aof := newTestAof(t)
+
+	applyAndLog(aof, "SET", "a", "1")
+	if err := aof.Rewrite(); err != nil {
+		t.Fatalf("Rewrite: %v", err)
+	}
+	applyAndLog(aof, "SET", "b", "2")
+
+	resetKeyspace()
+	loadAof(aof)
+
+	if got := get(bulks("a")); got.bulk != "1" {
+		t.Errorf("a = %q, want 1", got.bulk)
+	}
+	if got := get(bulks("b")); got.bulk != "2" {
+		t.Errorf("b = %q, want 2", got.bulk)
+	}
+}
+
+func TestRewriteBuffersConcurrentWrites(t *testing.T) {
+	resetKeyspace()
+	aof := newTestAof(t)
+
+	applyAndLog(aof, "SET", "counter", "0")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			callMu.Lock()
+			applyAndLog(aof, "INCR", "counter")
+			callMu.Unlock()
+		}
+	}()
+
+	if err := aof.Rewrite(); err != nil {
+		t.Fatalf("Rewrite: %v", err)
+	}
+	<-done
+
+	resetKeyspace()
+	loadAof(aof)
+
+	if got := get(bulks("counter")); got.bulk != "200" {
+		t.Errorf("counter after replay = %q, want 200", got.bulk)
+	}
+}
+
+func TestBgrewriteaof(t *testing.T) {
+	resetKeyspace()
+	aof := newTestAof(t)
+
+	activeAof = nil
+	if got := bgrewriteaof(nil); got.typ != "error" {
+		t.Errorf("BGREWRITEAOF without an AOF = %+v, want error", got)
+	}
+
+	activeAof = aof
+	defer func() { activeAof = nil }()
+
+	aof.claimRewrite()
+	if got := bgrewriteaof(nil); got.typ != "error" {
+		t.Errorf("BGREWRITEAOF during a rewrite = %+v, want error", got)
+	}
+	aof.mu.Lock()
+	aof.rewriting = false
+	aof.mu.Unlock()
+
+	if got := bgrewriteaof(nil); got.typ != "string" {
+		t.Fatalf("BGREWRITEAOF = %+v, want status reply", got)
+	}
+	waitForRewrite(t, aof)
+}
+
+func TestAutomaticRewrite(t *testing.T) {
+	resetKeyspace()
+	aof := newTestAof(t)
+	aof.rewriteMinSize = 1024
+
+	for i := 0; i < 100; i++ {
+		applyAndLog(aof, "SET", "k", strconv.Itoa(i))
+	}
+
+	aof.maybeRewrite()
+	waitForRewrite(t, aof)
+
+	aof.mu.Lock()
+	size := aof.size
+	aof.mu.Unlock()
+	if size >= 1024 {
+		t.Errorf("after automatic rewrite AOF is %d bytes, want less than 1024", size)
+	}
+
+	// right after a rewrite there is no growth to trigger another one
+	aof.maybeRewrite()
+	aof.mu.Lock()
+	rewriting := aof.rewriting
+	aof.mu.Unlock()
+	if rewriting {
+		t.Error("maybeRewrite started a rewrite without any growth")
+	}
+}
+
+func waitForRewrite(t *testing.T, aof *Aof) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		aof.mu.Lock()
+		rewriting, last := aof.rewriting, aof.lastRewriteTime
+		aof.mu.Unlock()
+		if !rewriting && !last.IsZero() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("rewrite did not finish")
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/bits"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+const (
+	scanDefaultCount = 10
+	scanTableMinSize = 4
+
+	// scanMaxEmptyVisits bounds the buckets a call visits per name asked
+	// for, should most of them be empty.
+	scanMaxEmptyVisits = 10
+)
+
+// SCAN and HSCAN walk a scanTable, which indexes names in a power of two
+// number of buckets by their 64-bit FNV-1a hash, as a Redis dict does. A
+// cursor is a bucket, and every call returns the names of the buckets it
+// visits until it has about COUNT of them. Buckets are visited in reverse
+// binary order, incrementing the high bits of the cursor first: when the
+// table doubles or halves in between calls, the buckets left to visit still
+// cover every name that was not returned yet. So anything present for the
+// whole iteration is returned at least once, while a call only touches a
+// few buckets and no server side state is kept.
+type scanTable struct {
+	buckets [][]string
+	count   int
+}
+
+func newScanTable() *scanTable {
+	return &scanTable{buckets: make([][]string, scanTableMinSize)}
+}
+
+func scanHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+func (t *scanTable) bucket(name string) uint64 {
+	return scanHash(name) & uint64(len(t.buckets)-1)
+}
+
+// add indexes name, which must not be indexed already. The table doubles
+// once it holds more names than buckets.
+func (t *scanTable) add(name string) {
+	i := t.bucket(name)
+	t.buckets[i] = append(t.buckets[i], name)
+	t.count++
+
+	if t.count > len(t.buckets) {
+		t.resize(len(t.buckets) * 2)
+	}
+}
+
+// remove drops name from the index. The table halves once less than an
+// eighth of its buckets would be used.
+func (t *scanTable) remove(name string) {
+	i := t.bucket(name)
+	b := t.buckets[i]
+	for j := range b {
+		if b[j] == name {
+			b[j] = b[len(b)-1]
+			t.buckets[i] = b[:len(b)-1]
+			t.count--
+			break
+		}
+	}
+
+	if len(t.buckets) > scanTableMinSize && t.count*8 < len(t.buckets) {
+		t.resize(len(t.buckets) / 2)
+	}
+}
+
+func (t *scanTable) resize(size int) {
+	old := t.buckets
+	t.buckets = make([][]string, size)
+	for _, b := range old {
+		for _, name := range b {
+			i := t.bucket(name)
+			t.buckets[i] = append(t.buckets[i], name)
+		}
+	}
+}
+
+// random returns a name picked at random: a bucket is drawn until one is
+// not empty, then a name in it. It returns false if the table is empty.
+func (t *scanTable) random() (string, bool) {
+	if t.count == 0 {
+		return "", false
+	}
+
+	for {
+		b := t.buckets[rand.Intn(len(t.buckets))]
+		if len(b) > 0 {
+			return b[rand.Intn(len(b))], true
+		}
+	}
+}
+
+// sample returns n names drawn at random, or every name if the table holds
+// no more than n.
+func (t *scanTable) sample(n int) []string {
+	names := make([]string, 0, n)
+	if t.count <= n {
+		for _, b := range t.buckets {
+			names = append(names, b...)
+		}
+		return names
+	}
+
+	for len(names) < n {
+		name, _ := t.random()
+		names = append(names, name)
+	}
+	return names
+}
+
+// scan calls fn for the names of the buckets from cursor on, until about
+// count names were visited, and returns the cursor to continue from, which
+// is 0 once the iteration is complete.
+func (t *scanTable) scan(cursor uint64, count int, fn func(name string)) uint64 {
+	mask := uint64(len(t.buckets) - 1)
+	visits := min(count, len(t.buckets)) * scanMaxEmptyVisits
+
+	for seen := 0; seen < count && visits > 0; visits-- {
+		for _, name := range t.buckets[cursor&mask] {
+			fn(name)
+			seen++
+		}
+
+		cursor = nextScanCursor(cursor, mask)
+		if cursor == 0 {
+			break
+		}
+	}
+
+	return cursor
+}
+
+// nextScanCursor increments the bits of cursor covered by mask in reverse
+// order.
+func nextScanCursor(cursor, mask uint64) uint64 {
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
+
+type scanOptions struct {
+	cursor   uint64
+	match    string
+	count    int
+	typ      string
+	noValues bool
+}
+
+// parseScanOptions parses "cursor [MATCH pattern] [COUNT count]" plus the
+// TYPE option of SCAN or the NOVALUES flag of HSCAN.
+func parseScanOptions(args []Value, command string) (scanOptions, error) {
+	opts := scanOptions{count: scanDefaultCount}
+
+	cursor, err := strconv.ParseUint(args[0].bulk, 10, 64)
+	if err != nil {
+		return opts, errors.New("ERR invalid cursor")
+	}
+	opts.cursor = cursor
+
+	for i := 1; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		hasValue := i+1 < len(args)
+
+		switch {
+		case option == "MATCH" && hasValue:
+			i++
+			opts.match = args[i].bulk
+		case option == "COUNT" && hasValue:
+			i++
+			count, err := strconv.Atoi(args[i].bulk)
+			if err != nil {
+				return opts, errors.New("ERR: value is not an integer")
+			}
+			if count < 1 {
+				return opts, errors.New("ERR syntax error")
+			}
+			opts.count = count
+		case option == "TYPE" && hasValue && command == "scan":
+			i++
+			opts.typ = strings.ToLower(args[i].bulk)
+		case option == "NOVALUES" && command == "hscan":
+			opts.noValues = true
+		default:
+			return opts, errors.New("ERR syntax error")
+		}
+	}
+
+	return opts, nil
+}
+
+func scanReply(cursor uint64, elements []Value) Value {
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: strconv.FormatUint(cursor, 10)},
+		{typ: "array", array: elements},
+	}}
+}
+
+// liveKeys calls fn for every key that has not expired yet. Callers must
+// hold dbMu.
+func liveKeys(fn func(key string)) {
+	now := nowMs()
+	visit := func(key string) {
+		if when, ok := expires[key]; ok && when <= now {
+			return
+		}
+		fn(key)
+	}
+
+	for key := range SETs {
+		visit(key)
+	}
+	for key := range SETsL {
+		visit(key)
+	}
+	for key := range HSETs {
+		visit(key)
+	}
+}
+
+func keys(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'keys' command"}
+	}
+
+	pattern := args[0].bulk
+
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+
+	result := []Value{}
+	liveKeys(func(key string) {
+		if globMatch(pattern, key) {
+			result = append(result, Value{typ: "bulk", bulk: key})
+		}
+	})
+
+	return Value{typ: "array", array: result}
+}
+
+func scan(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'scan' command"}
+	}
+
+	opts, err := parseScanOptions(args, "scan")
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+
+	result := []Value{}
+	next := keyIndex.scan(opts.cursor, opts.count, func(key string) {
+		if isExpired(key) || !keyExists(key) {
+			return
+		}
+		if opts.match != "" && !globMatch(opts.match, key) {
+			return
+		}
+		if opts.typ != "" && keyType(key) != opts.typ {
+			return
+		}
+		result = append(result, Value{typ: "bulk", bulk: key})
+	})
+
+	return scanReply(next, result)
+}
+
+func hscan(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hscan' command"}
+	}
+
+	hash := args[0].bulk
+
+	opts, err := parseScanOptions(args[1:], "hscan")
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	if !lookupRead(hash) {
+		return scanReply(0, []Value{})
+	}
+	if !checkType(hash, typeHash) {
+		return wrongType
+	}
+
+	fields := HSETs[hash]
+
+	result := []Value{}
+	next := hashFields[hash].scan(opts.cursor, opts.count, func(field string) {
+		if opts.match != "" && !globMatch(opts.match, field) {
+			return
+		}
+		result = append(result, Value{typ: "bulk", bulk: field})
+		if !opts.noValues {
+			result = append(result, Value{typ: "bulk", bulk: fields[field]})
+		}
+	})
+
+	return scanReply(next, result)
+}
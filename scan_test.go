@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func sortedBulks(v Value) []string {
+	result := make([]string, len(v.array))
+	for i, item := range v.array {
+		result[i] = item.bulk
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestKeys(t *testing.T) {
+	resetKeyspace()
+
+	set(bulks("cache:1", "v"))
+	set(bulks("cache:2", "v"))
+	Rpush(bulks("cache:list", "a"))
+	set(bulks("session:1", "v"))
+	set(bulks("cache:old", "v", "PXAT", "1"))
+
+	got := sortedBulks(keys(bulks("cache:*")))
+	want := []string{"cache:1", "cache:2", "cache:list"}
+	if !equal(got, want) {
+		t.Errorf("KEYS cache:* = %v, want %v", got, want)
+	}
+
+	if got := keys(bulks("nomatch*")); len(got.array) != 0 {
+		t.Errorf("KEYS nomatch* = %v, want empty", got.array)
+	}
+}
+
+// scanAll runs a full SCAN iteration, calling between after every call.
+func scanAll(t *testing.T, extra []string, between func(call int)) map[string]int {
+	t.Helper()
+
+	seen := map[string]int{}
+	cursor := "0"
+	for call := 0; ; call++ {
+		if call > 10000 {
+			t.Fatal("SCAN did not terminate")
+		}
+
+		reply := scan(append(bulks(cursor), bulks(extra...)...))
+		if reply.typ != "array" || len(reply.array) != 2 {
+			t.Fatalf("SCAN %s = %+v, want [cursor, keys]", cursor, reply)
+		}
+		for _, key := range reply.array[1].array {
+			seen[key.bulk]++
+		}
+
+		cursor = reply.array[0].bulk
+		if cursor == "0" {
+			return seen
+		}
+		if between != nil {
+			between(call)
+		}
+	}
+}
+
+func TestScanReturnsEveryKey(t *testing.T) {
+	resetKeyspace()
+
+	for i := 0; i < 100; i++ {
+		set(bulks(fmt.Sprintf("key:%d", i), "v"))
+	}
+
+	seen := scanAll(t, []string{"COUNT", "7"}, nil)
+	if len(seen) != 100 {
+		t.Errorf("SCAN returned %d distinct keys, want 100", len(seen))
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Errorf("SCAN returned %s %d times on an unchanged keyspace, want 1", key, n)
+		}
+	}
+}
+
+func TestScanWhileMutating(t *testing.T) {
+	resetKeyspace()
+
+	for i := 0; i < 200; i++ {
+		set(bulks(fmt.Sprintf("stable:%d", i), "v"))
+	}
+
+	seen := scanAll(t, []string{"COUNT", "10"}, func(call int) {
+		for i := 0; i < 20; i++ {
+			set(bulks(fmt.Sprintf("churn:%d:%d", call, i), "v"))
+		}
+		del(bulks(fmt.Sprintf("churn:%d:0", call-1)))
+	})
+
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("stable:%d", i)
+		if seen[key] == 0 {
+			t.Errorf("SCAN never returned %s although it existed for the whole iteration", key)
+		}
+	}
+}
+
+func TestScanIsIncremental(t *testing.T) {
+	resetKeyspace()
+
+	for i := 0; i < 10000; i++ {
+		set(bulks(fmt.Sprintf("key:%d", i), "v"))
+	}
+
+	reply := scan(bulks("0", "COUNT", "10"))
+	if n := len(reply.array[1].array); n < 10 || n > 30 {
+		t.Errorf("SCAN 0 COUNT 10 returned %d keys out of 10000, want about 10", n)
+	}
+}
+
+func TestScanTableResizedDuringIteration(t *testing.T) {
+	table := newScanTable()
+	for i := 0; i < 1000; i++ {
+		table.add(fmt.Sprintf("name:%d", i))
+	}
+
+	seen := map[string]bool{}
+	cursor := uint64(0)
+	for call := 0; ; call++ {
+		cursor = table.scan(cursor, 20, func(name string) { seen[name] = true })
+		if cursor == 0 {
+			break
+		}
+
+		// shrink the table a few times, then grow it again
+		switch call {
+		case 5:
+			for i := 100; i < 1000; i++ {
+				table.remove(fmt.Sprintf("name:%d", i))
+			}
+		case 10:
+			for i := 0; i < 5000; i++ {
+				table.add(fmt.Sprintf("other:%d", i))
+			}
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if name := fmt.Sprintf("name:%d", i); !seen[name] {
+			t.Errorf("%s was never returned although it stayed in the table", name)
+		}
+	}
+}
+
+func TestScanTableRandom(t *testing.T) {
+	table := newScanTable()
+	if _, ok := table.random(); ok {
+		t.Fatal("random returned a name from an empty table")
+	}
+
+	for i := 0; i < 20; i++ {
+		table.add(fmt.Sprintf("name:%d", i))
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 2000; i++ {
+		name, ok := table.random()
+		if !ok {
+			t.Fatal("random returned no name from a full table")
+		}
+		seen[name] = true
+	}
+	if len(seen) != 20 {
+		t.Errorf("random returned %d distinct names out of 20", len(seen))
+	}
+
+	if got := table.sample(5); len(got) != 5 {
+		t.Errorf("sample(5) returned %d names", len(got))
+	}
+	if got := table.sample(30); len(got) != 20 {
+		t.Errorf("sample(30) returned %d names, want every one of the 20", len(got))
+	}
+}
+
+func TestScanMatchAndType(t *testing.T) {
+	resetKeyspace()
+
+	set(bulks("user:1", "v"))
+	set(bulks("user:2", "v"))
+	Rpush(bulks("user:list", "a"))
+	hset(bulks("other", "f", "v"))
+
+	seen := scanAll(t, []string{"MATCH", "user:*", "COUNT", "2"}, nil)
+	if len(seen) != 3 || seen["other"] != 0 {
+		t.Errorf("SCAN MATCH user:* = %v, want the three user keys", seen)
+	}
+
+	seen = scanAll(t, []string{"TYPE", "list"}, nil)
+	if len(seen) != 1 || seen["user:list"] != 1 {
+		t.Errorf("SCAN TYPE list = %v, want user:list", seen)
+	}
+}
+
+func TestScanInvalidArgs(t *testing.T) {
+	tests := [][]string{
+		{},
+		{"abc"},
+		{"-1"},
+		{"0", "COUNT", "0"},
+		{"0", "COUNT", "x"},
+		{"0", "MATCH"},
+		{"0", "NOVALUES"},
+		{"0", "BOGUS", "1"},
+	}
+
+	for _, args := range tests {
+		if got := scan(bulks(args...)); got.typ != "error" {
+			t.Errorf("SCAN %v = %+v, want error", args, got)
+		}
+	}
+}
+
+func TestHscan(t *testing.T) {
+	resetKeyspace()
+
+	for i := 0; i < 30; i++ {
+		hset(bulks("h", fmt.Sprintf("f%d", i), fmt.Sprintf("v%d", i)))
+	}
+
+	fields := map[string]string{}
+	cursor := "0"
+	for {
+		reply := hscan(bulks("h", cursor, "COUNT", "4"))
+		if reply.typ != "array" {
+			t.Fatalf("HSCAN = %+v, want array", reply)
+		}
+		items := reply.array[1].array
+		for i := 0; i+1 < len(items); i += 2 {
+			fields[items[i].bulk] = items[i+1].bulk
+		}
+		cursor = reply.array[0].bulk
+		if cursor == "0" {
+			break
+		}
+	}
+
+	if len(fields) != 30 || fields["f7"] != "v7" {
+		t.Errorf("HSCAN returned %d fields (f7=%q), want 30", len(fields), fields["f7"])
+	}
+
+	reply := hscan(bulks("h", "0", "MATCH", "f1*", "COUNT", "100", "NOVALUES"))
+	if got := sortedBulks(reply.array[1]); len(got) != 11 {
+		t.Errorf("HSCAN MATCH f1* NOVALUES = %v, want 11 fields", got)
+	}
+}
+
+func TestHscanMissingAndWrongType(t *testing.T) {
+	resetKeyspace()
+
+	reply := hscan(bulks("nohash", "0"))
+	if reply.typ != "array" || reply.array[0].bulk != "0" || len(reply.array[1].array) != 0 {
+		t.Errorf("HSCAN nohash = %+v, want [0, []]", reply)
+	}
+
+	set(bulks("s", "v"))
+	if got := hscan(bulks("s", "0")); got.str != wrongType.str {
+		t.Errorf("HSCAN on a string = %+v, want WRONGTYPE", got)
+	}
+}
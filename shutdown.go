@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds how long shutting down waits for the HTTP requests
+// being served and for the clients to receive their replies.
+const shutdownTimeout = 10 * time.Second
+
+// The listeners, HTTP servers and clients stopped on shutdown are guarded
+// by serverMu. Once shuttingDown is set, new connections are closed right
+// away.
+var (
+	serverMu      = sync.Mutex{}
+	listeners     = map[net.Listener]struct{}{}
+	httpServers   = map[*http.Server]struct{}{}
+	activeClients = map[*client]struct{}{}
+	shuttingDown  bool
+)
+
+// shutdownMu makes a shutdown wait for another one in progress, which ends
+// the process unless saving the snapshot failed.
+var shutdownMu = sync.Mutex{}
+
+// exit ends the process with status. Tests replace it.
+var exit = os.Exit
+
+func trackListener(l net.Listener) {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+
+	listeners[l] = struct{}{}
+}
+
+func trackHTTPServer(s *http.Server) {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+
+	httpServers[s] = struct{}{}
+}
+
+// trackClient registers c to be drained on shutdown. It returns false if the
+// server is already shutting down.
+func trackClient(c *client) bool {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+
+	if shuttingDown {
+		return false
+	}
+	activeClients[c] = struct{}{}
+	return true
+}
+
+func untrackClient(c *client) {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+
+	delete(activeClients, c)
+}
+
+// saveOnShutdown reports whether shutting down saves a snapshot by default,
+// which is when save rules are set.
+func saveOnShutdown() bool {
+	return activeSnapshotter != nil && activeSnapshotter.SaveRules() != ""
+}
+
+// shutdown saves a snapshot if save is true and stops the server. It returns
+// the status the process should exit with: 0 once everything is on disk, 1
+// if saving the snapshot or flushing the AOF failed. If the snapshot cannot
+// be saved and force is false, the server keeps running and the error is
+// returned instead.
+func shutdown(save, force bool) (int, error) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+
+	status := 0
+	if save {
+		log.Println("Saving the final snapshot before exiting")
+		if err := saveFinalSnapshot(); err != nil {
+			log.Println("Error saving the final snapshot:", err)
+			if !force {
+				return 0, err
+			}
+			status = 1
+		}
+	}
+
+	if err := stopServer(); err != nil {
+		log.Println("Error flushing the AOF:", err)
+		status = 1
+	}
+
+	log.Println("TinyKV is now ready to exit, bye bye...")
+	return status, nil
+}
+
+// saveFinalSnapshot saves a snapshot, waiting for a background save in
+// progress to end first.
+func saveFinalSnapshot() error {
+	if activeSnapshotter == nil {
+		return errSnapshotsDisabled
+	}
+
+	for {
+		err := activeSnapshotter.Save()
+		if !errors.Is(err, errSaveInProgress) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stopServer closes the listeners, waits for the HTTP requests and the
+// commands in flight to complete, closes the connections of the clients
+// once their replies are sent and closes the AOF.
+//
+// execMu is held exclusively from the moment the commands in flight are
+// done and never released, so nothing is written once the AOF is closed,
+// until the process exits.
+func stopServer() error {
+	serverMu.Lock()
+	shuttingDown = true
+	for l := range listeners {
+		l.Close()
+	}
+	servers := []*http.Server{}
+	for s := range httpServers {
+		servers = append(servers, s)
+	}
+	listeners, httpServers = map[net.Listener]struct{}{}, map[*http.Server]struct{}{}
+	serverMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Println("Error stopping the HTTP API:", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	execMu.Lock()
+
+	serverMu.Lock()
+	clients := []*client{}
+	for c := range activeClients {
+		clients = append(clients, c)
+	}
+	serverMu.Unlock()
+
+	for _, c := range clients {
+		c.finish()
+	}
+	for _, c := range clients {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+		}
+	}
+
+	if activeAof == nil {
+		return nil
+	}
+	return activeAof.Close()
+}
+
+// shutdownCommand stops the server: SHUTDOWN [NOSAVE|SAVE]. A snapshot is
+// saved first with SAVE, or by default when save rules are set. The client
+// only gets a reply if the server keeps running because the snapshot could
+// not be saved.
+func shutdownCommand(c *client, args []Value) {
+	save := saveOnShutdown()
+	if len(args) > 0 {
+		switch strings.ToUpper(args[0].bulk) {
+		case "SAVE":
+			save = true
+		case "NOSAVE":
+			save = false
+		default:
+			c.write(Value{typ: "error", str: "ERR syntax error"})
+			return
+		}
+	}
+
+	log.Printf("User requested shutdown from %s", c.conn.RemoteAddr())
+	status, err := shutdown(save, false)
+	if err != nil {
+		c.write(Value{typ: "error", str: "ERR Errors trying to SHUTDOWN. Check logs."})
+		return
+	}
+	exit(status)
+}
+
+// handleSignals shuts the server down on SIGTERM or SIGINT, saving a
+// snapshot if save rules are set, and exits. The server exits even if the
+// snapshot cannot be saved, and right away on a second signal.
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	log.Printf("Received %s, shutting down", <-signals)
+	go func() {
+		log.Printf("Received %s again, exiting now", <-signals)
+		exit(1)
+	}()
+
+	status, _ := shutdown(saveOnShutdown(), true)
+	exit(status)
+}
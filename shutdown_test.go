@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startShutdownTestServer serves RESP and the HTTP API as main does, and
+// replaces exit with a function sending the status on the returned channel.
+// The state left by a shutdown is reset at the end of the test.
+func startShutdownTestServer(t *testing.T) (int, int, chan int) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve(l, activeAof)
+
+	hl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: NewAPI(activeAof).Handler()}
+	trackHTTPServer(server)
+	go server.Serve(hl)
+
+	statuses := make(chan int, 1)
+	exit = func(status int) { statuses <- status }
+	t.Cleanup(func() {
+		exit = os.Exit
+		l.Close()
+		server.Close()
+
+		serverMu.Lock()
+		stopped := shuttingDown
+		shuttingDown = false
+		listeners, httpServers = map[net.Listener]struct{}{}, map[*http.Server]struct{}{}
+		serverMu.Unlock()
+		if stopped {
+			execMu.Unlock()
+		}
+	})
+
+	return l.Addr().(*net.TCPAddr).Port, hl.Addr().(*net.TCPAddr).Port, statuses
+}
+
+func TestShutdown(t *testing.T) {
+	resetKeyspace()
+	activeAof = newTestAof(t)
+	activeSnapshotter = newTestSnapshotter(t, activeAof)
+	defer func() { activeAof, activeSnapshotter = nil, nil }()
+	port, httpPort, statuses := startShutdownTestServer(t)
+
+	c := dialTestServer(t, port)
+	if got := c.do(t, "SHUTDOWN", "BOGUS"); got != "-ERR syntax error" {
+		t.Errorf("SHUTDOWN BOGUS = %q", got)
+	}
+
+	// the reply to the SET pipelined before SHUTDOWN is still sent
+	send(t, c, "SET", "k", "v")
+	send(t, c, "SHUTDOWN")
+	rest, err := io.ReadAll(c.resp.reader)
+	if err != nil || string(rest) != "+OK\r\n" {
+		t.Errorf("replies before the connection closed = %q, %v", rest, err)
+	}
+
+	select {
+	case status := <-statuses:
+		if status != 0 {
+			t.Errorf("exit status = %d, want 0", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SHUTDOWN did not exit")
+	}
+
+	if conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port)); err == nil {
+		conn.Close()
+		t.Error("RESP connections are still accepted")
+	}
+	if _, err := http.Get("http://127.0.0.1:" + strconv.Itoa(httpPort) + "/ping"); err == nil {
+		t.Error("HTTP requests are still served")
+	}
+
+	if !activeAof.closed || activeAof.syncedOffset != activeAof.writeOffset {
+		t.Errorf("AOF closed=%v with %d of %d bytes synced", activeAof.closed, activeAof.syncedOffset, activeAof.writeOffset)
+	}
+	if data, err := os.ReadFile(activeAof.path); err != nil || !strings.Contains(string(data), "SET") {
+		t.Errorf("AOF = %q, %v", data, err)
+	}
+	if _, err := os.Stat(activeSnapshotter.path); err != nil {
+		t.Errorf("no snapshot saved with save rules set: %v", err)
+	}
+	if err := activeAof.Close(); err != nil {
+		t.Errorf("closing the AOF again: %v", err)
+	}
+}
+
+func TestShutdownSaveFails(t *testing.T) {
+	port, _, statuses := startShutdownTestServer(t)
+	c := dialTestServer(t, port)
+
+	// snapshots are not set up
+	if got := c.do(t, "SHUTDOWN", "SAVE"); got != "-ERR Errors trying to SHUTDOWN. Check logs." {
+		t.Errorf("SHUTDOWN SAVE = %q", got)
+	}
+	if got := c.do(t, "PING"); got != "+PONG" {
+		t.Errorf("PING after a failed SHUTDOWN = %q", got)
+	}
+	if got := dialTestServer(t, port).do(t, "PING"); got != "+PONG" {
+		t.Errorf("PING on a new connection after a failed SHUTDOWN = %q", got)
+	}
+
+	select {
+	case status := <-statuses:
+		t.Fatalf("exited with status %d", status)
+	default:
+	}
+
+	// a signal shuts down anyway
+	if status, err := shutdown(true, true); status != 1 || err != nil {
+		t.Errorf("forced shutdown = %d, %v, want 1", status, err)
+	}
+}
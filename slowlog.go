@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// commandStats are the counters INFO commandstats and /metrics report for
+// a command: how long its calls took, how many of them were refused before
+// running, for example by ACL rules or because of a wrong number of
+// arguments, and how many ran but replied with an error.
+type commandStats struct {
+	latency  histogram
+	rejected atomic.Int64
+	failed   atomic.Int64
+}
+
+// origin describes who sent a command, for the slow log and MONITOR.
+type origin struct {
+	addr string
+	name string
+}
+
+func (c *client) origin() origin {
+	return origin{addr: c.conn.RemoteAddr().String(), name: c.name}
+}
+
+// execute runs the handler of spec, after showing it to the clients in
+// monitor mode, and records the call in the statistics of the command and in
+// the slow log.
+func execute(from origin, spec *commandSpec, args []Value) Value {
+	feedMonitors(from, spec, args)
+
+	start := time.Now()
+	result := spec.handler(args)
+	recordCall(from, spec, args, time.Since(start), result.typ == "error")
+
+	return result
+}
+
+// recordCall adds a call of spec that took duration to its statistics, and
+// to the slow log if it was slow enough.
+func recordCall(from origin, spec *commandSpec, args []Value, duration time.Duration, failed bool) {
+	spec.stats.latency.observe(duration)
+	if failed {
+		spec.stats.failed.Add(1)
+	}
+
+	slowlog.add(from, spec, args, duration.Microseconds())
+}
+
+// The slow log keeps at most slowlogMaxArgs arguments of a command, counting
+// its name, and the first slowlogMaxString bytes of each, as Redis does.
+const (
+	slowlogMaxArgs   = 32
+	slowlogMaxString = 128
+)
+
+// redactedArgs gives, for the commands that may carry passwords, the index
+// of the first argument that is replaced by "(redacted)" in the slow log
+// and the output of MONITOR.
+var redactedArgs = map[string]int{
+	"auth":   0,
+	"hello":  1,
+	"acl":    1,
+	"config": 1,
+}
+
+// redacted returns the i-th argument of a command described by spec, or
+// "(redacted)" if it may be a password.
+func redacted(spec *commandSpec, args []Value, i int) string {
+	if from, ok := redactedArgs[spec.name]; ok && i >= from {
+		return "(redacted)"
+	}
+	return args[i].bulk
+}
+
+type slowlogEntry struct {
+	id       int64
+	time     int64
+	duration int64
+	args     []string
+	from     origin
+}
+
+// slowlogBuffer is a ring buffer of the slowest commands. Commands running
+// for at least slowerThan microseconds are logged, none if it is negative,
+// and only the last maxLen of them are kept.
+type slowlogBuffer struct {
+	mu sync.Mutex
+
+	// entries are in the order they were logged, the oldest one being at
+	// next once the buffer is full.
+	entries []slowlogEntry
+	next    int
+	nextID  int64
+
+	slowerThan int64
+	maxLen     int
+}
+
+var slowlog = &slowlogBuffer{slowerThan: 10000, maxLen: 128}
+
+func (l *slowlogBuffer) add(from origin, spec *commandSpec, args []Value, usec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.slowerThan < 0 || usec < l.slowerThan || l.maxLen == 0 {
+		return
+	}
+
+	entry := slowlogEntry{id: l.nextID, time: time.Now().Unix(), duration: usec, args: slowlogArgs(spec, args), from: from}
+	l.nextID++
+
+	if len(l.entries) < l.maxLen {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+}
+
+// newest returns up to count entries, the most recent first, or all of them
+// if count is negative.
+func (l *slowlogBuffer) newest(count int) []slowlogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := len(l.entries)
+	if count < 0 || count > n {
+		count = n
+	}
+
+	entries := make([]slowlogEntry, 0, count)
+	for i := 1; i <= count; i++ {
+		entries = append(entries, l.entries[(l.next-i+n)%n])
+	}
+	return entries
+}
+
+func (l *slowlogBuffer) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.entries)
+}
+
+func (l *slowlogBuffer) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries, l.next = nil, 0
+}
+
+func (l *slowlogBuffer) settings() (int64, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.slowerThan, l.maxLen
+}
+
+func (l *slowlogBuffer) setSlowerThan(usec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.slowerThan = usec
+}
+
+// setMaxLen changes how many entries are kept, dropping the oldest ones if
+// there are too many.
+func (l *slowlogBuffer) setMaxLen(maxLen int) error {
+	if maxLen < 0 {
+		return errors.New("slowlog-max-len must not be negative")
+	}
+
+	kept := l.newest(maxLen)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries, l.next, l.maxLen = make([]slowlogEntry, 0, maxLen), 0, maxLen
+	for i := len(kept) - 1; i >= 0; i-- {
+		l.entries = append(l.entries, kept[i])
+	}
+	return nil
+}
+
+// slowlogArgs returns the name and arguments of a command as the slow log
+// keeps them: redacted, and truncated when there are too many or they are
+// too long.
+func slowlogArgs(spec *commandSpec, args []Value) []string {
+	argv := []string{spec.name}
+
+	for i := range args {
+		if len(argv) == slowlogMaxArgs-1 && len(args)-i > 1 {
+			argv = append(argv, fmt.Sprintf("... (%d more arguments)", len(args)-i))
+			break
+		}
+
+		s := redacted(spec, args, i)
+		if len(s) > slowlogMaxString {
+			s = fmt.Sprintf("%s... (%d more bytes)", s[:slowlogMaxString], len(s)-slowlogMaxString)
+		}
+		argv = append(argv, s)
+	}
+
+	return argv
+}
+
+func slowlogCommand(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'slowlog' command"}
+	}
+
+	subcommand := strings.ToUpper(args[0].bulk)
+	args = args[1:]
+
+	switch {
+	case subcommand == "GET" && len(args) <= 1:
+		count := 10
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0].bulk)
+			if err != nil || n < -1 {
+				return Value{typ: "error", str: "ERR count should be greater than or equal to -1"}
+			}
+			count = n
+		}
+		return slowlogGet(count)
+	case subcommand == "LEN" && len(args) == 0:
+		return Value{typ: "integer", num: slowlog.len()}
+	case subcommand == "RESET" && len(args) == 0:
+		slowlog.reset()
+		return Value{typ: "string", str: "OK"}
+	}
+
+	return Value{typ: "error", str: "ERR Unknown subcommand or wrong number of arguments for '" + strings.ToLower(subcommand) + "'"}
+}
+
+// slowlogGet replies with the count most recent entries, each holding its
+// id, the unix time it was logged, the duration in microseconds, the
+// arguments and the address and name of the client.
+func slowlogGet(count int) Value {
+	entries := []Value{}
+	for _, entry := range slowlog.newest(count) {
+		entries = append(entries, Value{typ: "array", array: []Value{
+			{typ: "integer", num: int(entry.id)},
+			{typ: "integer", num: int(entry.time)},
+			{typ: "integer", num: int(entry.duration)},
+			{typ: "array", array: bulks(entry.args...)},
+			{typ: "bulk", bulk: entry.from.addr},
+			{typ: "bulk", bulk: entry.from.name},
+		}})
+	}
+
+	return Value{typ: "array", array: entries}
+}
+
+// commandstatsInfo is the commandstats section of INFO, with a line for
+// every command called or rejected at least once.
+func commandstatsInfo() string {
+	var b strings.Builder
+	for _, spec := range sortedCommands() {
+		latency := spec.stats.latency.snapshot()
+		calls, usec := latency.count, latency.sum
+		rejected, failed := spec.stats.rejected.Load(), spec.stats.failed.Load()
+		if calls == 0 && rejected == 0 {
+			continue
+		}
+
+		perCall := 0.0
+		if calls > 0 {
+			perCall = float64(usec) / float64(calls)
+		}
+		fmt.Fprintf(&b, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d\r\n", spec.name, calls, usec, perCall, rejected, failed)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// resetSlowlog empties the slow log and sets its threshold and length, both
+// restored at the end of the test.
+func resetSlowlog(t *testing.T, slowerThan int64, maxLen int) {
+	t.Helper()
+
+	slowlog.reset()
+	slowlog.setSlowerThan(slowerThan)
+	slowlog.setMaxLen(maxLen)
+	t.Cleanup(func() {
+		slowlog.reset()
+		slowlog.setSlowerThan(10000)
+		slowlog.setMaxLen(128)
+	})
+}
+
+func TestSlowlog(t *testing.T) {
+	resetKeyspace()
+	resetSlowlog(t, 0, 128)
+	port := startTestServer(t)
+	c := dialTestServer(t, port)
+
+	c.do(t, "SET", "k", "v")
+	c.do(t, "GET", "k")
+	c.resp.reader.ReadString('\n')
+
+	if got := c.do(t, "SLOWLOG", "LEN"); got != ":2" {
+		t.Fatalf("SLOWLOG LEN = %q, want :2", got)
+	}
+
+	// SLOWLOG LEN was logged in the meantime
+	send(t, c, "SLOWLOG", "GET", "2")
+	reply, err := c.resp.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.array) != 2 {
+		t.Fatalf("SLOWLOG GET 2 = %+v", reply)
+	}
+	entry := reply.array[1].array
+	argv := []string{}
+	for _, arg := range entry[3].array {
+		argv = append(argv, arg.bulk)
+	}
+	if entry[0].num != reply.array[0].array[0].num-1 || entry[2].num < 0 || strings.Join(argv, " ") != "get k" || entry[4].bulk != c.conn.LocalAddr().String() {
+		t.Errorf("second entry of SLOWLOG GET 2 = %+v", entry)
+	}
+
+	slowlog.setSlowerThan(-1)
+	if got := c.do(t, "SLOWLOG", "RESET"); got != "+OK" {
+		t.Fatalf("SLOWLOG RESET = %q", got)
+	}
+	c.do(t, "SET", "k", "v")
+	if got := c.do(t, "SLOWLOG", "LEN"); got != ":0" {
+		t.Errorf("SLOWLOG LEN with the slow log disabled = %q", got)
+	}
+
+	for _, args := range [][]string{{"GET", "-2"}, {"GET", "x"}, {"LEN", "1"}, {"NOSUCH"}} {
+		if got := slowlogCommand(bulks(args...)); got.typ != "error" {
+			t.Errorf("SLOWLOG %v = %+v, want error", args, got)
+		}
+	}
+}
+
+func TestSlowlogRing(t *testing.T) {
+	resetSlowlog(t, 0, 3)
+	spec := lookupCommand("GET")
+
+	ids := func(count int) string {
+		parts := []string{}
+		for _, entry := range slowlog.newest(count) {
+			parts = append(parts, strconv.FormatInt(entry.id, 10))
+		}
+		return strings.Join(parts, " ")
+	}
+
+	first := slowlog.nextID
+	for i := 0; i < 5; i++ {
+		slowlog.add(origin{}, spec, bulks("k"), 1)
+	}
+	id := func(n int64) string { return strconv.FormatInt(first+n, 10) }
+
+	if got := ids(-1); got != id(4)+" "+id(3)+" "+id(2) {
+		t.Errorf("entries after 5 commands = %s", got)
+	}
+	if got := ids(2); got != id(4)+" "+id(3) {
+		t.Errorf("newest 2 entries = %s", got)
+	}
+
+	slowlog.setMaxLen(2)
+	slowlog.add(origin{}, spec, bulks("k"), 1)
+	if got := ids(-1); got != id(5)+" "+id(4) {
+		t.Errorf("entries after shrinking = %s", got)
+	}
+
+	slowlog.setMaxLen(4)
+	slowlog.add(origin{}, spec, bulks("k"), 1)
+	if got := ids(-1); got != id(6)+" "+id(5)+" "+id(4) {
+		t.Errorf("entries after growing = %s", got)
+	}
+}
+
+func TestSlowlogArgs(t *testing.T) {
+	args := []string{}
+	for i := 0; i < 40; i++ {
+		args = append(args, strconv.Itoa(i))
+	}
+	args[0] = strings.Repeat("x", 130)
+
+	got := slowlogArgs(lookupCommand("DEL"), bulks(args...))
+	if len(got) != slowlogMaxArgs || got[31] != "... (10 more arguments)" || got[30] != "29" {
+		t.Errorf("slow log arguments of DEL with 40 keys = %v", got)
+	}
+	if got[1] != strings.Repeat("x", 128)+"... (2 more bytes)" {
+		t.Errorf("long argument = %q", got[1])
+	}
+
+	if got := slowlogArgs(lookupCommand("AUTH"), bulks("alice", "secret")); strings.Join(got, " ") != "auth (redacted) (redacted)" {
+		t.Errorf("slow log arguments of AUTH = %v", got)
+	}
+	if got := slowlogArgs(lookupCommand("CONFIG"), bulks("SET", "requirepass", "secret")); strings.Join(got, " ") != "config SET (redacted) (redacted)" {
+		t.Errorf("slow log arguments of CONFIG SET = %v", got)
+	}
+}
+
+func TestCommandstats(t *testing.T) {
+	resetKeyspace()
+	port := startTestServer(t)
+	c := dialTestServer(t, port)
+
+	stats := &lookupCommand("INCR").stats
+	calls, rejected, failed := stats.latency.snapshot().count, stats.rejected.Load(), stats.failed.Load()
+
+	c.do(t, "INCR", "n")
+	c.do(t, "SET", "s", "text")
+	c.do(t, "INCR", "s")
+	c.do(t, "INCR")
+
+	if stats.latency.snapshot().count-calls != 2 || stats.failed.Load()-failed != 1 || stats.rejected.Load()-rejected != 1 {
+		t.Errorf("INCR stats grew by calls=%d failed=%d rejected=%d, want 2, 1 and 1",
+			stats.latency.snapshot().count-calls, stats.failed.Load()-failed, stats.rejected.Load()-rejected)
+	}
+
+	got := info(bulks("commandstats")).bulk
+	if !strings.Contains(got, "\r\ncmdstat_incr:calls=") || !strings.Contains(got, ",rejected_calls=") {
+		t.Errorf("INFO commandstats = %q", got)
+	}
+	if strings.Contains(info(nil).bulk, "# Commandstats") {
+		t.Error("INFO prints commandstats by default")
+	}
+	if !strings.Contains(info(bulks("all")).bulk, "# Commandstats") {
+		t.Error("INFO all does not print commandstats")
+	}
+}
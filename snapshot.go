@@ -0,0 +1,726 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A snapshot file is laid out as follows, integers being unsigned varints
+// unless stated otherwise:
+//
+//	"TINYKV" version(uint16) flags(byte) created-ms aof-offset aof-crc(uint32)
+//	records...
+//	0xFF crc64(uint64)
+//
+// Every record is a type byte followed by the key and the value; a record
+// may be preceded by 0xFC and an absolute expire time in milliseconds.
+// Strings are a length followed by the bytes, lists an element count followed
+// by the elements and hashes a field count followed by the field/value pairs.
+// The trailing CRC-64 (ECMA) covers everything before it. Fixed width
+// integers are big endian.
+//
+// aof-offset and aof-crc describe the AOF the snapshot was taken against, as
+// returned by Aof.position, so that only the AOF tail is replayed on startup.
+const (
+	snapshotMagic   = "TINYKV"
+	snapshotVersion = 1
+
+	snapshotFlagAofPosition = 1 << 0
+
+	snapshotTypeString = 0
+	snapshotTypeList   = 1
+	snapshotTypeHash   = 2
+	snapshotOpExpire   = 0xFC
+	snapshotOpEOF      = 0xFF
+
+	// saveRetryDelay is how long the save rules wait after a failed save.
+	saveRetryDelay = 5 * time.Second
+)
+
+var (
+	errSaveInProgress    = errors.New("ERR Background save already in progress")
+	errSnapshotsDisabled = errors.New("ERR snapshots are not enabled")
+	errSnapshotCorrupt   = errors.New("snapshot is corrupt")
+)
+
+var snapshotCrcTable = crc64.MakeTable(crc64.ECMA)
+
+// dirty counts the writes applied since the last successful save.
+var dirty atomic.Int64
+
+// saveRule triggers a background save once at least changes writes happened
+// and seconds have passed since the last save.
+type saveRule struct {
+	seconds int64
+	changes int64
+}
+
+const defaultSaveRules = "3600 1 300 100 60 10000"
+
+type Snapshotter struct {
+	mu    sync.Mutex
+	path  string
+	aof   *Aof
+	rules []saveRule
+
+	// saving is set while a save runs. lastSave is the time of the last
+	// successful one, lastSaveAttempt that of the last one, successful or not.
+	saving           bool
+	lastSave         time.Time
+	lastSaveAttempt  time.Time
+	lastSaveErr      error
+	lastSaveDuration time.Duration
+}
+
+// activeSnapshotter is the Snapshotter used by SAVE, BGSAVE and LASTSAVE. It
+// is nil when snapshots are not set up, for example in tests.
+var activeSnapshotter *Snapshotter
+
+// dbFilename is the path of the snapshot, set by the dbfilename parameter.
+var dbFilename = "dump.tkv"
+
+// NewSnapshotter returns a Snapshotter writing to path. aof is the AOF
+// snapshots are taken against and may be nil. It spawns a goroutine that
+// checks the save rules once a second.
+func NewSnapshotter(path string, aof *Aof) *Snapshotter {
+	rules, _ := parseSaveRules(defaultSaveRules)
+
+	s := &Snapshotter{
+		path:     path,
+		aof:      aof,
+		rules:    rules,
+		lastSave: time.Now(),
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			s.maybeSave()
+		}
+	}()
+
+	return s
+}
+
+func save(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'save' command"}
+	}
+
+	if activeSnapshotter == nil {
+		return Value{typ: "error", str: errSnapshotsDisabled.Error()}
+	}
+
+	if err := activeSnapshotter.Save(); err != nil {
+		if err == errSaveInProgress {
+			return Value{typ: "error", str: err.Error()}
+		}
+		return Value{typ: "error", str: "ERR " + err.Error()}
+	}
+
+	return Value{typ: "string", str: "OK"}
+}
+
+func bgsave(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'bgsave' command"}
+	}
+
+	if activeSnapshotter == nil {
+		return Value{typ: "error", str: errSnapshotsDisabled.Error()}
+	}
+
+	if err := activeSnapshotter.BackgroundSave(); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	return Value{typ: "string", str: "Background saving started"}
+}
+
+func lastsave(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'lastsave' command"}
+	}
+
+	if activeSnapshotter == nil {
+		return Value{typ: "error", str: errSnapshotsDisabled.Error()}
+	}
+
+	return Value{typ: "integer", num: int(activeSnapshotter.LastSave().Unix())}
+}
+
+// Save writes a snapshot and waits for it to finish.
+func (s *Snapshotter) Save() error {
+	if !s.claimSave() {
+		return errSaveInProgress
+	}
+
+	return s.save()
+}
+
+// BackgroundSave writes a snapshot in its own goroutine.
+func (s *Snapshotter) BackgroundSave() error {
+	if !s.claimSave() {
+		return errSaveInProgress
+	}
+
+	go s.save()
+
+	return nil
+}
+
+// LastSave returns the time of the last successful save, or the startup time
+// if there was none.
+func (s *Snapshotter) LastSave() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastSave
+}
+
+func (s *Snapshotter) claimSave() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.saving {
+		return false
+	}
+	s.saving = true
+
+	return true
+}
+
+// info is the snapshot part of the persistence section of INFO.
+func (s *Snapshotter) info() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "rdb_changes_since_last_save:%d\r\n", dirty.Load())
+	fmt.Fprintf(&b, "rdb_bgsave_in_progress:%d\r\n", boolToInt(s.saving))
+	fmt.Fprintf(&b, "rdb_last_save_time:%d\r\n", s.lastSave.Unix())
+	fmt.Fprintf(&b, "rdb_last_bgsave_status:%s\r\n", infoStatus(s.lastSaveErr))
+	fmt.Fprintf(&b, "rdb_last_bgsave_time_sec:%d\r\n", durationSec(s.lastSaveAttempt, s.lastSaveDuration))
+
+	return b.String()
+}
+
+// SetSaveRules replaces the save rules with the ones described by config, a
+// list of "seconds changes" pairs. An empty config disables them.
+func (s *Snapshotter) SetSaveRules(config string) error {
+	rules, err := parseSaveRules(config)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.rules = rules
+	s.mu.Unlock()
+
+	return nil
+}
+
+// SaveRules returns the save rules in the format SetSaveRules accepts.
+func (s *Snapshotter) SaveRules() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return formatSaveRules(s.rules)
+}
+
+func parseSaveRules(config string) ([]saveRule, error) {
+	fields := strings.Fields(config)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("save rules must be pairs of seconds and changes")
+	}
+
+	rules := []saveRule{}
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("invalid number of seconds %q", fields[i])
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid number of changes %q", fields[i+1])
+		}
+		rules = append(rules, saveRule{seconds: seconds, changes: changes})
+	}
+
+	return rules, nil
+}
+
+func formatSaveRules(rules []saveRule) string {
+	parts := []string{}
+	for _, rule := range rules {
+		parts = append(parts, strconv.FormatInt(rule.seconds, 10), strconv.FormatInt(rule.changes, 10))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// maybeSave starts a background save when one of the save rules is met. After
+// a failed save it waits saveRetryDelay before trying again.
+func (s *Snapshotter) maybeSave() {
+	s.mu.Lock()
+	rules, last := s.rules, s.lastSave
+	failed := s.lastSaveErr != nil && time.Since(s.lastSaveAttempt) < saveRetryDelay
+	s.mu.Unlock()
+
+	if failed {
+		return
+	}
+
+	changes, elapsed := dirty.Load(), time.Since(last)
+	for _, rule := range rules {
+		if changes < rule.changes || elapsed < time.Duration(rule.seconds)*time.Second {
+			continue
+		}
+
+		if err := s.BackgroundSave(); err == nil {
+			log.Printf("%d changes in %d seconds. Saving...", rule.changes, rule.seconds)
+		}
+		return
+	}
+}
+
+// save does the work once the saving flag has been claimed.
+//
+// A capture of the keyspace starts, and the dirty counter and the AOF
+// position are read, while callMu is held exclusively, so the snapshot holds
+// exactly the writes logged before that position. That is all callMu is held
+// for: the keyspace is then copied a batch at a time alongside writers, and
+// encoding and writing the file happen without any lock.
+func (s *Snapshotter) save() (err error) {
+	start := time.Now()
+	var saved int64
+
+	defer func() {
+		s.mu.Lock()
+		s.saving = false
+		s.lastSaveAttempt = time.Now()
+		s.lastSaveErr = err
+		s.lastSaveDuration = time.Since(start)
+		if err == nil {
+			s.lastSave = s.lastSaveAttempt
+			dirty.Add(-saved)
+		}
+		s.mu.Unlock()
+
+		if err != nil {
+			log.Println("Snapshot failed:", err)
+		}
+	}()
+
+	hdr := snapshotHeader{created: nowMs()}
+
+	callMu.Lock()
+	capture := startCapture()
+	saved = dirty.Load()
+	if s.aof != nil {
+		hdr.hasAofPosition = true
+		hdr.aofOffset, hdr.aofCrc, err = s.aof.position()
+	}
+	callMu.Unlock()
+
+	snap := capture.finish()
+	if err != nil {
+		return err
+	}
+
+	return writeSnapshot(s.path, snap, hdr)
+}
+
+type snapshotHeader struct {
+	created        int64
+	hasAofPosition bool
+	aofOffset      int64
+	aofCrc         uint32
+}
+
+// writeSnapshot atomically replaces the file at path with snap.
+func writeSnapshot(path string, snap *keyspaceSnapshot, hdr snapshotHeader) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "temp-snapshot-*.tkv")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tmp.Close()
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = tmp.Chmod(0644); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	if err = snap.encode(w, hdr); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+
+	return nil
+}
+
+// snapshotEncoder writes the snapshot format while checksumming it. The
+// first error is kept and makes every later call a no-op.
+type snapshotEncoder struct {
+	w   io.Writer
+	crc hash.Hash64
+	buf []byte
+	err error
+}
+
+func (e *snapshotEncoder) write(b []byte) {
+	if e.err != nil {
+		return
+	}
+	e.crc.Write(b)
+	_, e.err = e.w.Write(b)
+}
+
+func (e *snapshotEncoder) byte(b byte) {
+	e.write([]byte{b})
+}
+
+func (e *snapshotEncoder) uvarint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf[:0], v)
+	e.write(e.buf)
+}
+
+func (e *snapshotEncoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.write([]byte(s))
+}
+
+// encode writes the snapshot format of snap to w.
+func (snap *keyspaceSnapshot) encode(w io.Writer, hdr snapshotHeader) error {
+	e := &snapshotEncoder{w: w, crc: crc64.New(snapshotCrcTable)}
+
+	var flags byte
+	if hdr.hasAofPosition {
+		flags |= snapshotFlagAofPosition
+	}
+
+	e.write([]byte(snapshotMagic))
+	e.write(binary.BigEndian.AppendUint16(nil, snapshotVersion))
+	e.byte(flags)
+	e.uvarint(uint64(hdr.created))
+	e.uvarint(uint64(hdr.aofOffset))
+	e.write(binary.BigEndian.AppendUint32(nil, hdr.aofCrc))
+
+	record := func(typ byte, key string) {
+		if when, ok := snap.expires[key]; ok {
+			e.byte(snapshotOpExpire)
+			e.uvarint(uint64(when))
+		}
+		e.byte(typ)
+		e.string(key)
+	}
+
+	for key, value := range snap.strings {
+		record(snapshotTypeString, key)
+		e.string(value)
+	}
+	for key, list := range snap.lists {
+		record(snapshotTypeList, key)
+		e.uvarint(uint64(len(list)))
+		for _, item := range list {
+			e.string(item)
+		}
+	}
+	for key, fields := range snap.hashes {
+		record(snapshotTypeHash, key)
+		e.uvarint(uint64(len(fields)))
+		for field, value := range fields {
+			e.string(field)
+			e.string(value)
+		}
+	}
+
+	e.byte(snapshotOpEOF)
+	if e.err != nil {
+		return e.err
+	}
+
+	_, err := w.Write(binary.BigEndian.AppendUint64(nil, e.crc.Sum64()))
+	return err
+}
+
+// snapshotDecoder reads the snapshot format while checksumming it. The
+// first error is kept and makes every later call return zero values.
+type snapshotDecoder struct {
+	r   *bufio.Reader
+	crc hash.Hash64
+	// remaining bounds lengths read from the file, so a corrupt length
+	// cannot trigger a huge allocation.
+	remaining int64
+	err       error
+}
+
+func (d *snapshotDecoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *snapshotDecoder) read(n int64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > d.remaining {
+		d.fail(errSnapshotCorrupt)
+		return nil
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		d.fail(err)
+		return nil
+	}
+	d.remaining -= n
+	d.crc.Write(b)
+
+	return b
+}
+
+func (d *snapshotDecoder) byte() byte {
+	b := d.read(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// ReadByte lets binary.ReadUvarint read through the decoder.
+func (d *snapshotDecoder) ReadByte() (byte, error) {
+	b := d.byte()
+	return b, d.err
+}
+
+func (d *snapshotDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(d)
+	if err != nil {
+		d.fail(errSnapshotCorrupt)
+	}
+	return v
+}
+
+// length reads a count or a string length.
+func (d *snapshotDecoder) length() int64 {
+	n := d.uvarint()
+	if n > uint64(d.remaining) {
+		d.fail(errSnapshotCorrupt)
+		return 0
+	}
+	return int64(n)
+}
+
+func (d *snapshotDecoder) string() string {
+	return string(d.read(d.length()))
+}
+
+// openSnapshot opens the snapshot at path and reads its header.
+func openSnapshot(path string) (*os.File, *snapshotDecoder, snapshotHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, snapshotHeader{}, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, snapshotHeader{}, err
+	}
+
+	d, hdr, err := newSnapshotDecoder(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, nil, hdr, err
+	}
+
+	return f, d, hdr, nil
+}
+
+// newSnapshotDecoder reads the header of a snapshot of size bytes from r.
+func newSnapshotDecoder(r io.Reader, size int64) (*snapshotDecoder, snapshotHeader, error) {
+	var hdr snapshotHeader
+
+	d := &snapshotDecoder{
+		r:         bufio.NewReader(r),
+		crc:       crc64.New(snapshotCrcTable),
+		remaining: size,
+	}
+
+	magic := d.read(int64(len(snapshotMagic)))
+	version := d.read(2)
+	if d.err != nil || string(magic) != snapshotMagic {
+		return nil, hdr, errSnapshotCorrupt
+	}
+	if v := binary.BigEndian.Uint16(version); v != snapshotVersion {
+		return nil, hdr, fmt.Errorf("unsupported snapshot version %d", v)
+	}
+
+	flags := d.byte()
+	hdr.created = int64(d.uvarint())
+	hdr.hasAofPosition = flags&snapshotFlagAofPosition != 0
+	hdr.aofOffset = int64(d.uvarint())
+	if b := d.read(4); b != nil {
+		hdr.aofCrc = binary.BigEndian.Uint32(b)
+	}
+	if d.err != nil {
+		return nil, hdr, errSnapshotCorrupt
+	}
+
+	return d, hdr, nil
+}
+
+// decode reads the records following the header into a snapshot and checks
+// the trailing checksum. Keys that have expired in the meantime are kept,
+// like during an AOF replay, for the commands logged after the snapshot to
+// apply to them as they did.
+func (d *snapshotDecoder) decode() (*keyspaceSnapshot, error) {
+	snap := &keyspaceSnapshot{
+		strings: map[string]string{},
+		lists:   map[string][]string{},
+		hashes:  map[string]map[string]string{},
+		expires: map[string]int64{},
+	}
+
+	for d.err == nil {
+		var when int64
+		op := d.byte()
+		if op == snapshotOpEOF {
+			break
+		}
+		if op == snapshotOpExpire {
+			when = int64(d.uvarint())
+			op = d.byte()
+		}
+
+		key := d.string()
+		switch op {
+		case snapshotTypeString:
+			snap.strings[key] = d.string()
+		case snapshotTypeList:
+			n := d.length()
+			list := make([]string, 0, min(n, 1024))
+			for i := int64(0); i < n && d.err == nil; i++ {
+				list = append(list, d.string())
+			}
+			snap.lists[key] = list
+		case snapshotTypeHash:
+			n := d.length()
+			fields := make(map[string]string, min(n, 1024))
+			for i := int64(0); i < n && d.err == nil; i++ {
+				field := d.string()
+				fields[field] = d.string()
+			}
+			snap.hashes[key] = fields
+		default:
+			d.fail(errSnapshotCorrupt)
+		}
+
+		if when != 0 {
+			snap.expires[key] = when
+		}
+	}
+
+	if d.err != nil {
+		if d.err == io.EOF || d.err == io.ErrUnexpectedEOF {
+			return nil, errSnapshotCorrupt
+		}
+		return nil, d.err
+	}
+
+	want := d.crc.Sum64()
+	sum := make([]byte, 8)
+	if _, err := io.ReadFull(d.r, sum); err != nil || binary.BigEndian.Uint64(sum) != want {
+		return nil, errSnapshotCorrupt
+	}
+
+	return snap, nil
+}
+
+// restore replaces the contents of the keyspace with snap.
+func (snap *keyspaceSnapshot) restore() {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	// running captures keep the keyspace being replaced
+	for c := range captures {
+		c.copyAll()
+	}
+
+	SETs = snap.strings
+	SETsL = snap.lists
+	HSETs = snap.hashes
+	expires = snap.expires
+	rebuildKeyInfos()
+	rebuildHashFields()
+	rebuildVolatileIndex()
+}
+
+// loadData rebuilds the keyspace at startup. When the snapshot was taken
+// against the current AOF it is loaded and only the commands appended to the
+// AOF after it are replayed, otherwise the whole AOF is. If the AOF is empty
+// the snapshot is all there is, so the AOF is rewritten from it to be
+// complete again.
+func loadData(aof *Aof, s *Snapshotter) error {
+	f, d, hdr, err := openSnapshot(s.path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Println("Ignoring snapshot:", err)
+		}
+		return loadAof(aof)
+	}
+	defer f.Close()
+
+	aofEmpty := aof.Size() == 0
+	if !aofEmpty && !(hdr.hasAofPosition && aof.matchesPosition(hdr.aofOffset, hdr.aofCrc)) {
+		log.Println("Snapshot was not taken against the current AOF, replaying the whole AOF")
+		return loadAof(aof)
+	}
+
+	snap, err := d.decode()
+	if err != nil {
+		log.Println("Ignoring snapshot:", err)
+		return loadAof(aof)
+	}
+	snap.restore()
+
+	if aofEmpty {
+		return aof.Rewrite()
+	}
+
+	return loadAofFrom(aof, hdr.aofOffset)
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestSnapshotter(t *testing.T, aof *Aof) *Snapshotter {
+	t.Helper()
+
+	return NewSnapshotter(filepath.Join(t.TempDir(), "dump.tkv"), aof)
+}
+
+// snapshotKeyspace captures the keyspace and copies it at once.
+func snapshotKeyspace() *keyspaceSnapshot {
+	callMu.Lock()
+	capture := startCapture()
+	callMu.Unlock()
+
+	return capture.finish()
+}
+
+func fillKeyspace() {
+	set(bulks("str", "hello"))
+	set(bulks("session", "abc", "EX", "100"))
+	set(bulks("empty", ""))
+	Rpush(bulks("list", "a", "b", "c"))
+	hset(bulks("h", "f1", "v1"))
+	hset(bulks("h", "f2", "v2"))
+	expire(bulks("h", "100"))
+}
+
+func checkKeyspace(t *testing.T) {
+	t.Helper()
+
+	if got := get(bulks("str")); got.bulk != "hello" {
+		t.Errorf("str = %+v, want hello", got)
+	}
+	if got := get(bulks("empty")); got.typ != "bulk" || got.bulk != "" {
+		t.Errorf("empty = %+v, want empty bulk", got)
+	}
+	if got := ttl(bulks("session")); got.num <= 0 || got.num > 100 {
+		t.Errorf("TTL session = %d, want 1..100", got.num)
+	}
+	if got := Lrange(bulks("list", "0", "-1")); len(got.array) != 3 || got.array[2].bulk != "c" {
+		t.Errorf("list = %+v, want [a b c]", got.array)
+	}
+	if got := hget(bulks("h", "f2")); got.bulk != "v2" {
+		t.Errorf("HGET h f2 = %+v, want v2", got)
+	}
+	if got := ttl(bulks("h")); got.num <= 0 {
+		t.Errorf("TTL h = %d, want a positive ttl", got.num)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	resetKeyspace()
+	fillKeyspace()
+
+	var buf bytes.Buffer
+	hdr := snapshotHeader{created: 1700000000000, hasAofPosition: true, aofOffset: 12345, aofCrc: 0xdeadbeef}
+	if err := snapshotKeyspace().encode(&buf, hdr); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "dump.tkv")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, d, got, err := openSnapshot(path)
+	if err != nil {
+		t.Fatalf("openSnapshot: %v", err)
+	}
+	defer f.Close()
+	if got != hdr {
+		t.Errorf("header = %+v, want %+v", got, hdr)
+	}
+
+	snap, err := d.decode()
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	resetKeyspace()
+	snap.restore()
+	checkKeyspace(t)
+}
+
+// Keys that expired since the snapshot was taken are loaded, for the AOF
+// replayed after it to apply as it ran, but read as missing.
+func TestSnapshotKeepsExpiredKeys(t *testing.T) {
+	resetKeyspace()
+	set(bulks("old", "x"))
+
+	snap := snapshotKeyspace()
+	snap.expires["old"] = nowMs() + 10
+
+	var buf bytes.Buffer
+	if err := snap.encode(&buf, snapshotHeader{}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "dump.tkv")
+	os.WriteFile(path, buf.Bytes(), 0644)
+
+	time.Sleep(20 * time.Millisecond)
+
+	f, d, _, err := openSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	loaded, err := d.decode()
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if _, ok := loaded.strings["old"]; !ok {
+		t.Error("expired key was not loaded")
+	}
+	if _, ok := loaded.expires["old"]; !ok {
+		t.Error("expire time of an expired key was not loaded")
+	}
+
+	loaded.restore()
+	if got := get(bulks("old")); got.typ != "null" {
+		t.Errorf("GET old = %+v after loading, want null", got)
+	}
+}
+
+func TestSnapshotDetectsCorruption(t *testing.T) {
+	resetKeyspace()
+	fillKeyspace()
+
+	var buf bytes.Buffer
+	if err := snapshotKeyspace().encode(&buf, snapshotHeader{}); err != nil {
+		t.Fatal(err)
+	}
+	good := buf.Bytes()
+
+	corrupt := func(mutate func([]byte) []byte) error {
+		data := mutate(append([]byte(nil), good...))
+		path := filepath.Join(t.TempDir(), "dump.tkv")
+		os.WriteFile(path, data, 0644)
+
+		f, d, _, err := openSnapshot(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = d.decode()
+		return err
+	}
+
+	tests := []struct {
+		name   string
+		mutate func([]byte) []byte
+	}{
+		{"flipped byte", func(b []byte) []byte { b[len(b)/2] ^= 0xff; return b }},
+		{"truncated", func(b []byte) []byte { return b[:len(b)-3] }},
+		{"bad checksum", func(b []byte) []byte { b[len(b)-1]++; return b }},
+		{"bad magic", func(b []byte) []byte { b[0] = 'X'; return b }},
+		{"future version", func(b []byte) []byte { b[len(snapshotMagic)+1] = 99; return b }},
+		{"empty", func(b []byte) []byte { return nil }},
+	}
+
+	for _, tt := range tests {
+		if err := corrupt(tt.mutate); err == nil {
+			t.Errorf("%s: snapshot was accepted", tt.name)
+		}
+	}
+}
+
+func TestLoadDataReplaysAofTail(t *testing.T) {
+	resetKeyspace()
+	aof := newTestAof(t)
+	s := newTestSnapshotter(t, aof)
+
+	applyAndLog(aof, "SET", "counter", "0")
+	for i := 0; i < 10; i++ {
+		applyAndLog(aof, "INCR", "counter")
+	}
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		applyAndLog(aof, "INCR", "counter")
+	}
+	applyAndLog(aof, "SET", "after", "1")
+
+	resetKeyspace()
+	if err := loadData(aof, s); err != nil {
+		t.Fatalf("loadData: %v", err)
+	}
+
+	if got := get(bulks("counter")); got.bulk != "15" {
+		t.Errorf("counter = %q, want 15", got.bulk)
+	}
+	if got := get(bulks("after")); got.bulk != "1" {
+		t.Errorf("after = %q, want 1", got.bulk)
+	}
+}
+
+func TestLoadDataIgnoresSnapshotOfAnotherAof(t *testing.T) {
+	resetKeyspace()
+	aof := newTestAof(t)
+	s := newTestSnapshotter(t, aof)
+
+	applyAndLog(aof, "SET", "counter", "0")
+	applyAndLog(aof, "INCR", "counter")
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	applyAndLog(aof, "INCR", "counter")
+	if err := aof.Rewrite(); err != nil {
+		t.Fatalf("Rewrite: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		applyAndLog(aof, "INCR", "counter")
+	}
+
+	resetKeyspace()
+	if err := loadData(aof, s); err != nil {
+		t.Fatalf("loadData: %v", err)
+	}
+
+	if got := get(bulks("counter")); got.bulk != "102" {
+		t.Errorf("counter = %q, want 102", got.bulk)
+	}
+}
+
+func TestLoadDataWithEmptyAof(t *testing.T) {
+	resetKeyspace()
+	fillKeyspace()
+
+	s := newTestSnapshotter(t, nil)
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	aof := newTestAof(t)
+	resetKeyspace()
+	if err := loadData(aof, s); err != nil {
+		t.Fatalf("loadData: %v", err)
+	}
+	checkKeyspace(t)
+
+	// the AOF was rebuilt from the snapshot, so it alone is enough now
+	if aof.Size() == 0 {
+		t.Fatal("AOF was not rewritten after loading the snapshot")
+	}
+	resetKeyspace()
+	if err := loadAof(aof); err != nil {
+		t.Fatalf("loadAof: %v", err)
+	}
+	checkKeyspace(t)
+}
+
+func TestSaveDuringWrites(t *testing.T) {
+	resetKeyspace()
+	aof := newTestAof(t)
+	s := newTestSnapshotter(t, aof)
+
+	applyAndLog(aof, "SET", "counter", "0")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 300; i++ {
+			callMu.Lock()
+			applyAndLog(aof, "INCR", "counter")
+			callMu.Unlock()
+		}
+	}()
+
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	<-done
+
+	resetKeyspace()
+	if err := loadData(aof, s); err != nil {
+		t.Fatalf("loadData: %v", err)
+	}
+
+	if got := get(bulks("counter")); got.bulk != "300" {
+		t.Errorf("counter = %q, want 300", got.bulk)
+	}
+}
+
+func TestSaveCommands(t *testing.T) {
+	resetKeyspace()
+
+	activeSnapshotter = nil
+	for _, handler := range []func([]Value) Value{save, bgsave, lastsave} {
+		if got := handler(nil); got.typ != "error" {
+			t.Errorf("without snapshots got %+v, want error", got)
+		}
+	}
+
+	s := newTestSnapshotter(t, nil)
+	activeSnapshotter = s
+	defer func() { activeSnapshotter = nil }()
+
+	before := lastsave(nil).num
+
+	time.Sleep(1100 * time.Millisecond)
+	dirty.Store(3)
+	if got := save(nil); got.typ != "string" || got.str != "OK" {
+		t.Fatalf("SAVE = %+v, want OK", got)
+	}
+	if got := lastsave(nil); got.typ != "integer" || got.num <= before {
+		t.Errorf("LASTSAVE = %+v, want later than %d", got, before)
+	}
+	if got := dirty.Load(); got != 0 {
+		t.Errorf("dirty after SAVE = %d, want 0", got)
+	}
+	if _, err := os.Stat(s.path); err != nil {
+		t.Errorf("snapshot file: %v", err)
+	}
+
+	s.claimSave()
+	if got := bgsave(nil); got.typ != "error" {
+		t.Errorf("BGSAVE during a save = %+v, want error", got)
+	}
+	if got := save(nil); got.typ != "error" {
+		t.Errorf("SAVE during a save = %+v, want error", got)
+	}
+	s.mu.Lock()
+	s.saving = false
+	s.mu.Unlock()
+
+	if got := bgsave(nil); got.typ != "string" {
+		t.Fatalf("BGSAVE = %+v, want status reply", got)
+	}
+	waitForSave(t, s)
+}
+
+func TestSaveRules(t *testing.T) {
+	s := newTestSnapshotter(t, nil)
+
+	if got := s.SaveRules(); got != defaultSaveRules {
+		t.Errorf("default rules = %q, want %q", got, defaultSaveRules)
+	}
+
+	for _, bad := range []string{"900", "0 1", "x 1", "900 -1"} {
+		if err := s.SetSaveRules(bad); err == nil {
+			t.Errorf("SetSaveRules(%q) succeeded", bad)
+		}
+	}
+
+	if err := s.SetSaveRules("1 2"); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.lastSave = time.Now().Add(-2 * time.Second)
+	s.mu.Unlock()
+
+	dirty.Store(1)
+	s.maybeSave()
+	if !s.claimSave() {
+		t.Fatal("a save started with fewer changes than the rule requires")
+	}
+	s.mu.Lock()
+	s.saving = false
+	s.mu.Unlock()
+
+	dirty.Store(2)
+	s.maybeSave()
+	waitForSave(t, s)
+	if got := dirty.Load(); got != 0 {
+		t.Errorf("dirty after automatic save = %d, want 0", got)
+	}
+
+	if err := s.SetSaveRules(""); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.SaveRules(); got != "" {
+		t.Errorf("rules = %q, want none", got)
+	}
+}
+
+func TestPropagateCountsWrites(t *testing.T) {
+	resetKeyspace()
+	dirty.Store(0)
+
+	for i := 0; i < 3; i++ {
+		propagate(nil, "SET", bulks("k", strconv.Itoa(i)), set(bulks("k", strconv.Itoa(i))))
+	}
+	propagate(nil, "INCR", bulks("k"), Value{typ: "error", str: "ERR"})
+
+	if got := dirty.Load(); got != 3 {
+		t.Errorf("dirty = %d, want 3", got)
+	}
+}
+
+func waitForSave(t *testing.T, s *Snapshotter) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		saving, attempt := s.saving, s.lastSaveAttempt
+		s.mu.Unlock()
+		if !saving && !attempt.IsZero() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("save did not finish")
+}
+
+// Writes run while a capture copies the keyspace, and the snapshot still
+// holds the keyspace as it was when the capture started.
+func TestCaptureKeepsTheKeyspaceOfItsStart(t *testing.T) {
+	resetKeyspace()
+	for i := 0; i < 1000; i++ {
+		set(bulks("k"+strconv.Itoa(i), "old"))
+	}
+	Rpush(bulks("list", "a", "b"))
+
+	callMu.Lock()
+	capture := startCapture()
+	callMu.Unlock()
+
+	for _, command := range [][]string{
+		{"SET", "k1", "new"},
+		{"DEL", "k2"},
+		{"SET", "created", "v"},
+		{"LPOP", "list"},
+		{"EXPIRE", "k3", "100"},
+	} {
+		call(nil, origin{}, lookupCommand(command[0]), bulks(command[1:]...))
+	}
+	snap := capture.finish()
+
+	if len(snap.strings) != 1000 || snap.strings["k1"] != "old" || snap.strings["k2"] != "old" {
+		t.Errorf("captured %d strings, k1 = %q, k2 = %q", len(snap.strings), snap.strings["k1"], snap.strings["k2"])
+	}
+	if _, ok := snap.strings["created"]; ok {
+		t.Error("a key created during the capture was captured")
+	}
+	if got := snap.lists["list"]; len(got) != 2 {
+		t.Errorf("captured list = %v, want [a b]", got)
+	}
+	if _, ok := snap.expires["k3"]; ok {
+		t.Error("a time to live set during the capture was captured")
+	}
+	if capturing.Load() != 0 || len(captures) != 0 {
+		t.Error("the capture is still registered once finished")
+	}
+}
@@ -1,27 +1,61 @@
 package main
 
-import "sync"
-
 var HSETs = map[string]map[string]string{}
-var HSETsMu = sync.RWMutex{}
+
+// hashFields indexes the fields of every hash for HSCAN.
+var hashFields = map[string]*scanTable{}
+
+// rebuildHashFields indexes the fields of every hash from scratch.
+func rebuildHashFields() {
+	hashFields = make(map[string]*scanTable, len(HSETs))
+	for hash, fields := range HSETs {
+		index := newScanTable()
+		for field := range fields {
+			index.add(field)
+		}
+		hashFields[hash] = index
+	}
+}
 
 func hset(args []Value) Value {
-	if len(args) != 3 {
+	if len(args) < 3 || len(args)%2 != 1 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'hset' command"}
 	}
 
 	hash := args[0].bulk
-	key := args[1].bulk
-	value := args[2].bulk
 
-	HSETsMu.Lock()
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	expireIfNeeded(hash)
+	if !checkType(hash, typeHash) {
+		return wrongType
+	}
+
 	if _, ok := HSETs[hash]; !ok {
 		HSETs[hash] = map[string]string{}
+		hashFields[hash] = newScanTable()
+	}
+	fields := HSETs[hash]
+
+	added, delta := 0, 0
+	for i := 1; i < len(args); i += 2 {
+		key, value := args[i].bulk, args[i+1].bulk
+
+		old, exists := fields[key]
+		fields[key] = value
+		if exists {
+			delta += stringSize(value) - stringSize(old)
+		} else {
+			hashFields[hash].add(key)
+			delta += hashSize(map[string]string{key: value})
+			added++
+		}
 	}
-	HSETs[hash][key] = value
-	HSETsMu.Unlock()
+	growKey(hash, delta)
 
-	return Value{typ: "string", str: "OK"}
+	// the number of fields added
+	return Value{typ: "integer", num: added}
 }
 
 func hget(args []Value) Value {
@@ -32,9 +66,17 @@ func hget(args []Value) Value {
 	hash := args[0].bulk
 	key := args[1].bulk
 
-	HSETsMu.RLock()
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	if !lookupRead(hash) {
+		return Value{typ: "null"}
+	}
+	if !checkType(hash, typeHash) {
+		return wrongType
+	}
+
 	value, ok := HSETs[hash][key]
-	HSETsMu.RUnlock()
 
 	if !ok {
 		return Value{typ: "null"}
@@ -50,9 +92,17 @@ func hgetall(args []Value) Value {
 
 	hash := args[0].bulk
 
-	HSETsMu.RLock()
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	if !lookupRead(hash) {
+		return Value{typ: "null"}
+	}
+	if !checkType(hash, typeHash) {
+		return wrongType
+	}
+
 	value, ok := HSETs[hash]
-	HSETsMu.RUnlock()
 
 	if !ok {
 		return Value{typ: "null"}
@@ -64,25 +114,47 @@ func hgetall(args []Value) Value {
 		values = append(values, Value{typ: "bulk", bulk: v})
 	}
 
-	return Value{typ: "array", array: values}
+	return Value{typ: "map", array: values}
 }
 
 func hdel(args []Value) Value {
-	if len(args) != 2 {
+	if len(args) < 2 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'hdel' command"}
 	}
 
 	hash := args[0].bulk
-	key := args[1].bulk
 
-	HSETsMu.Lock()
-	if m, ok := HSETs[hash]; ok {
-		delete(m, key)
-		if len(m) == 0 {
-			delete(HSETs, hash)
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	expireIfNeeded(hash)
+	if !checkType(hash, typeHash) {
+		return wrongType
+	}
+
+	m := HSETs[hash]
+	removed, delta := 0, 0
+	for _, arg := range args[1:] {
+		key := arg.bulk
+
+		old, ok := m[key]
+		if !ok {
+			continue
 		}
+		delete(m, key)
+		hashFields[hash].remove(key)
+		delta += hashSize(map[string]string{key: old})
+		removed++
+	}
+	if removed == 0 {
+		return Value{typ: "integer", num: 0}
+	}
+
+	growKey(hash, -delta)
+	if len(m) == 0 {
+		removeKey(hash)
 	}
-	HSETsMu.Unlock()
 
-	return Value{typ: "string", str: "OK"}
+	// the number of fields removed
+	return Value{typ: "integer", num: removed}
 }
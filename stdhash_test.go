@@ -5,19 +5,24 @@ import (
 )
 
 func resetHash() {
-	HSETsMu.Lock()
+	dbMu.Lock()
 	for k := range HSETs {
 		delete(HSETs, k)
 	}
-	HSETsMu.Unlock()
+	dbMu.Unlock()
 }
 
 func TestHsetAndHget(t *testing.T) {
 	resetHash()
 
 	result := hset([]Value{{typ: "bulk", bulk: "myhash"}, {typ: "bulk", bulk: "field1"}, {typ: "bulk", bulk: "value1"}})
-	if result.typ != "string" || result.str != "OK" {
-		t.Fatalf("HSET returned %+v, want OK", result)
+	if result.typ != "integer" || result.num != 1 {
+		t.Fatalf("HSET returned %+v, want 1", result)
+	}
+
+	result = hset([]Value{{typ: "bulk", bulk: "myhash"}, {typ: "bulk", bulk: "field1"}, {typ: "bulk", bulk: "value1"}})
+	if result.typ != "integer" || result.num != 0 {
+		t.Fatalf("HSET of an existing field returned %+v, want 0", result)
 	}
 
 	got := hget([]Value{{typ: "bulk", bulk: "myhash"}, {typ: "bulk", bulk: "field1"}})
@@ -54,8 +59,8 @@ func TestHgetall(t *testing.T) {
 	hset([]Value{{typ: "bulk", bulk: "h"}, {typ: "bulk", bulk: "f2"}, {typ: "bulk", bulk: "v2"}})
 
 	got := hgetall([]Value{{typ: "bulk", bulk: "h"}})
-	if got.typ != "array" {
-		t.Fatalf("HGETALL = %+v, want array", got)
+	if got.typ != "map" {
+		t.Fatalf("HGETALL = %+v, want map", got)
 	}
 	if len(got.array) != 4 {
 		t.Errorf("HGETALL array length = %d, want 4", len(got.array))
@@ -99,8 +104,8 @@ func TestHdel(t *testing.T) {
 	hset([]Value{{typ: "bulk", bulk: "h"}, {typ: "bulk", bulk: "f2"}, {typ: "bulk", bulk: "v2"}})
 
 	result := hdel([]Value{{typ: "bulk", bulk: "h"}, {typ: "bulk", bulk: "f1"}})
-	if result.typ != "string" || result.str != "OK" {
-		t.Fatalf("HDEL returned %+v, want OK", result)
+	if result.typ != "integer" || result.num != 1 {
+		t.Fatalf("HDEL returned %+v, want 1", result)
 	}
 
 	got := hget([]Value{{typ: "bulk", bulk: "h"}, {typ: "bulk", bulk: "f1"}})
@@ -118,8 +123,8 @@ func TestHdelMissingHash(t *testing.T) {
 	resetHash()
 
 	result := hdel([]Value{{typ: "bulk", bulk: "nohash"}, {typ: "bulk", bulk: "nofield"}})
-	if result.typ != "string" || result.str != "OK" {
-		t.Errorf("HDEL on nonexistent hash = %+v, want OK", result)
+	if result.typ != "integer" || result.num != 0 {
+		t.Errorf("HDEL on nonexistent hash = %+v, want 0", result)
 	}
 }
 
@@ -129,3 +134,64 @@ func TestHdelWrongArgs(t *testing.T) {
 		t.Errorf("HDEL with no args = %+v, want error", got)
 	}
 }
+
+func TestHsetAndHdelSeveralFields(t *testing.T) {
+	resetKeyspace()
+	aof := newTestAof(t)
+
+	steps := []struct {
+		command []string
+		want    int
+	}{
+		{[]string{"HSET", "h", "a", "1", "b", "2", "a", "3"}, 2},
+		{[]string{"HSET", "h", "b", "4", "c", "5"}, 1},
+		{[]string{"HDEL", "h", "a", "missing", "c"}, 2},
+	}
+	for _, step := range steps {
+		got := call(aof, origin{}, lookupCommand(step.command[0]), bulks(step.command[1:]...))
+		if got.typ != "integer" || got.num != step.want {
+			t.Errorf("%v = %+v, want %d", step.command, got, step.want)
+		}
+	}
+	if got := call(aof, origin{}, lookupCommand("HSET"), bulks("h", "a", "1", "b")); got.typ != "error" {
+		t.Errorf("HSET with a field without a value = %+v, want error", got)
+	}
+
+	if got := hget(bulks("h", "b")); got.bulk != "4" || len(HSETs["h"]) != 1 {
+		t.Errorf("hash after HSET and HDEL = %v", HSETs["h"])
+	}
+	if got, want := keyInfos["h"].size, int64(keyOverhead+1+hashSize(HSETs["h"])); got != want {
+		t.Errorf("size of the hash = %d, want %d", got, want)
+	}
+
+	entries := 0
+	aof.ReadFrom(0, func(Value, int64) error {
+		entries++
+		return nil
+	})
+	if entries != len(steps) {
+		t.Errorf("%d AOF entries, want one per command", entries)
+	}
+}
+
+func TestChAliases(t *testing.T) {
+	resetHash()
+
+	Handlers["CHSET"]([]Value{{typ: "bulk", bulk: "h"}, {typ: "bulk", bulk: "f"}, {typ: "bulk", bulk: "v"}})
+	if got := hget([]Value{{typ: "bulk", bulk: "h"}, {typ: "bulk", bulk: "f"}}); got.bulk != "v" {
+		t.Errorf("HGET after CHSET = %+v, want v", got)
+	}
+
+	hset([]Value{{typ: "bulk", bulk: "h"}, {typ: "bulk", bulk: "g"}, {typ: "bulk", bulk: "w"}})
+	if got := Handlers["CHGET"]([]Value{{typ: "bulk", bulk: "h"}, {typ: "bulk", bulk: "g"}}); got.bulk != "w" {
+		t.Errorf("CHGET after HSET = %+v, want w", got)
+	}
+	if got := Handlers["CHGETALL"]([]Value{{typ: "bulk", bulk: "h"}}); len(got.array) != 4 {
+		t.Errorf("CHGETALL = %+v, want both fields", got)
+	}
+
+	Handlers["CHDEL"]([]Value{{typ: "bulk", bulk: "h"}, {typ: "bulk", bulk: "f"}})
+	if got := hget([]Value{{typ: "bulk", bulk: "h"}, {typ: "bulk", bulk: "f"}}); got.typ != "null" {
+		t.Errorf("HGET after CHDEL = %+v, want null", got)
+	}
+}
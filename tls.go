@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsSettings configure the TLS listeners and replication links. The
+// certificate and key are presented by both sides of a connection, and the
+// CA certificates verify the peer: clients when authClients is yes or
+// optional, and the leader when replication runs over TLS.
+type tlsSettings struct {
+	certFile    string
+	keyFile     string
+	caCertFile  string
+	authClients string
+	replication bool
+}
+
+const (
+	tlsAuthClientsYes      = "yes"
+	tlsAuthClientsNo       = "no"
+	tlsAuthClientsOptional = "optional"
+)
+
+// tlsReloadInterval is how often the certificate files are checked for
+// changes.
+const tlsReloadInterval = time.Second
+
+// tlsMu guards tlsConf and the material loaded from its files.
+var tlsMu = sync.RWMutex{}
+
+var (
+	tlsConf = tlsSettings{authClients: tlsAuthClientsNo}
+
+	// tlsCert and tlsCAs are loaded from the files of tlsConf, whose
+	// modification times at that point are in tlsLoaded.
+	tlsCert   *tls.Certificate
+	tlsCAs    *x509.CertPool
+	tlsLoaded map[string]time.Time
+)
+
+// tlsPort and tlsHTTPPort are the ports of the TLS listeners, 0 when they
+// are disabled.
+var (
+	tlsPort     = 0
+	tlsHTTPPort = 0
+)
+
+var errNoCertificate = errors.New("tls-cert-file and tls-key-file are not set")
+
+// setTLSSettings loads the files of settings and makes them current. Nothing
+// changes if they cannot be loaded.
+func setTLSSettings(settings tlsSettings) error {
+	switch settings.authClients {
+	case tlsAuthClientsYes, tlsAuthClientsOptional:
+		if settings.caCertFile == "" {
+			return errors.New("verifying client certificates requires tls-ca-cert-file")
+		}
+	case tlsAuthClientsNo:
+	default:
+		return fmt.Errorf("invalid tls-auth-clients %q, must be yes, no or optional", settings.authClients)
+	}
+
+	cert, cas, loaded, err := loadTLSFiles(settings)
+	if err != nil {
+		return err
+	}
+
+	tlsMu.Lock()
+	defer tlsMu.Unlock()
+
+	tlsConf, tlsCert, tlsCAs, tlsLoaded = settings, cert, cas, loaded
+	return nil
+}
+
+func currentTLSSettings() tlsSettings {
+	tlsMu.RLock()
+	defer tlsMu.RUnlock()
+
+	return tlsConf
+}
+
+// updateTLSSettings applies change to a copy of the current settings and
+// installs the result with setTLSSettings.
+func updateTLSSettings(change func(settings *tlsSettings)) error {
+	settings := currentTLSSettings()
+	change(&settings)
+	return setTLSSettings(settings)
+}
+
+// loadTLSFiles reads the certificate, key and CA certificates of settings,
+// along with the modification times of their files.
+func loadTLSFiles(settings tlsSettings) (*tls.Certificate, *x509.CertPool, map[string]time.Time, error) {
+	loaded := map[string]time.Time{}
+	for _, path := range []string{settings.certFile, settings.keyFile, settings.caCertFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		loaded[path] = info.ModTime()
+	}
+
+	var cert *tls.Certificate
+	if settings.certFile != "" || settings.keyFile != "" {
+		c, err := tls.LoadX509KeyPair(settings.certFile, settings.keyFile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		cert = &c
+	}
+
+	var cas *x509.CertPool
+	if settings.caCertFile != "" {
+		pem, err := os.ReadFile(settings.caCertFile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		cas = x509.NewCertPool()
+		if !cas.AppendCertsFromPEM(pem) {
+			return nil, nil, nil, fmt.Errorf("no certificate found in %s", settings.caCertFile)
+		}
+	}
+
+	return cert, cas, loaded, nil
+}
+
+// reloadTLSIfChanged reloads the certificate files if one of them was
+// modified since they were loaded. Connections that are already open keep
+// the certificate they were established with.
+func reloadTLSIfChanged() {
+	tlsMu.RLock()
+	settings, loaded := tlsConf, tlsLoaded
+	tlsMu.RUnlock()
+
+	changed := false
+	for path, modTime := range loaded {
+		if info, err := os.Stat(path); err == nil && !info.ModTime().Equal(modTime) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	if err := setTLSSettings(settings); err != nil {
+		log.Println("Error reloading the TLS certificates:", err)
+		return
+	}
+	log.Println("Reloaded the TLS certificates")
+}
+
+// startTLSReload spawns a goroutine that reloads the certificate files
+// whenever they change, so that certificates can be renewed without a
+// restart.
+func startTLSReload() {
+	go func() {
+		for {
+			time.Sleep(tlsReloadInterval)
+			reloadTLSIfChanged()
+		}
+	}()
+}
+
+// serverTLSConfig returns the configuration of the TLS listeners. It picks
+// the current certificate and client verification for every handshake.
+func serverTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			tlsMu.RLock()
+			defer tlsMu.RUnlock()
+
+			if tlsCert == nil {
+				return nil, errNoCertificate
+			}
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*tlsCert},
+				ClientCAs:    tlsCAs,
+			}
+			switch tlsConf.authClients {
+			case tlsAuthClientsYes:
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			case tlsAuthClientsOptional:
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return config, nil
+		},
+	}
+}
+
+// clientTLSConfig returns the configuration a follower connects to its
+// leader at host with. The leader is verified against the CA certificates,
+// or the system ones if there are none, and the certificate is presented if
+// the leader asks for one.
+func clientTLSConfig(host string) *tls.Config {
+	tlsMu.RLock()
+	defer tlsMu.RUnlock()
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: host,
+		RootCAs:    tlsCAs,
+	}
+	if tlsCert != nil {
+		config.Certificates = []tls.Certificate{*tlsCert}
+	}
+	return config
+}
+
+// tlsReplication reports whether followers connect to their leader over
+// TLS.
+func tlsReplication() bool {
+	return currentTLSSettings().replication
+}
+
+// listenTLS listens for TLS connections on port.
+func listenTLS(port int) (net.Listener, error) {
+	tlsMu.RLock()
+	loaded := tlsCert != nil
+	tlsMu.RUnlock()
+
+	if !loaded {
+		return nil, errNoCertificate
+	}
+
+	return tls.Listen("tcp", fmt.Sprintf(":%d", port), serverTLSConfig())
+}
+
+// dialLeader connects a follower to the leader at addr, over TLS when
+// tls-replication is set. host is the name the leader's certificate must
+// hold.
+func dialLeader(host, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+
+	if !tlsReplication() {
+		return dialer.Dial("tcp", addr)
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, clientTLSConfig(host))
+}
+
+// announcedPort is the port a follower announces to its leader: the TLS
+// one when replicating over TLS.
+func announcedPort() int {
+	if tlsReplication() && tlsPort != 0 {
+		return tlsPort
+	}
+	return serverPort
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tinykv test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate for 127.0.0.1, usable by servers and clients,
+// and its key, both PEM encoded.
+func (ca *testCA) issue(t *testing.T, serial int64) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setupTLS writes a CA and a certificate it issued to a temporary directory
+// and makes them the TLS settings until the end of the test.
+func setupTLS(t *testing.T, authClients string) (*testCA, tlsSettings) {
+	t.Helper()
+
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, 2)
+
+	settings := tlsSettings{
+		certFile:    filepath.Join(dir, "server.crt"),
+		keyFile:     filepath.Join(dir, "server.key"),
+		caCertFile:  filepath.Join(dir, "ca.crt"),
+		authClients: authClients,
+	}
+	writeFile(t, settings.certFile, cert)
+	writeFile(t, settings.keyFile, key)
+	writeFile(t, settings.caCertFile, ca.pem)
+
+	if err := setTLSSettings(settings); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { setTLSSettings(tlsSettings{authClients: tlsAuthClientsNo}) })
+
+	return ca, settings
+}
+
+func startTLSTestServer(t *testing.T) int {
+	t.Helper()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverTLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(conn, nil)
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// dialTLS connects to port, trusting ca and presenting cert if it is set.
+func dialTLS(t *testing.T, port int, ca *testCA, cert *tls.Certificate) (*testClient, error) {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+
+	conn, err := tls.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port), config)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// with TLS 1.3 a refused client certificate only shows on the first read
+	c := &testClient{conn: conn, resp: NewResp(conn)}
+	if _, err := conn.Write(Value{typ: "array", array: bulks("PING")}.Marshal()); err != nil {
+		return nil, err
+	}
+	if _, err := c.resp.reader.ReadString('\n'); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func TestTLS(t *testing.T) {
+	resetKeyspace()
+	ca, _ := setupTLS(t, tlsAuthClientsNo)
+	port := startTLSTestServer(t)
+
+	c, err := dialTLS(t, port, ca, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.do(t, "SET", "k", "v"); got != "+OK" {
+		t.Fatalf("SET over TLS = %q", got)
+	}
+
+	// a client that does not trust the CA refuses the server
+	if _, err := dialTLS(t, port, newTestCA(t), nil); err == nil {
+		t.Fatal("the handshake succeeded with an unknown CA")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	resetKeyspace()
+	ca, _ := setupTLS(t, tlsAuthClientsYes)
+	port := startTLSTestServer(t)
+
+	if _, err := dialTLS(t, port, ca, nil); err == nil {
+		t.Fatal("a client without a certificate was accepted")
+	}
+
+	certPEM, keyPEM := ca.issue(t, 3)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialTLS(t, port, ca, &cert); err != nil {
+		t.Fatalf("a client with a certificate of the CA was refused: %v", err)
+	}
+
+	otherPEM, otherKey := newTestCA(t).issue(t, 4)
+	other, err := tls.X509KeyPair(otherPEM, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialTLS(t, port, ca, &other); err == nil {
+		t.Fatal("a client with a certificate of another CA was accepted")
+	}
+
+	if err := updateTLSSettings(func(s *tlsSettings) { s.authClients = tlsAuthClientsOptional }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialTLS(t, port, ca, nil); err != nil {
+		t.Fatalf("with optional verification a client without a certificate was refused: %v", err)
+	}
+
+	if err := updateTLSSettings(func(s *tlsSettings) { s.caCertFile = "" }); err == nil {
+		t.Fatal("client verification without a CA was accepted")
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	ca, settings := setupTLS(t, tlsAuthClientsNo)
+	port := startTLSTestServer(t)
+
+	serial := func() int64 {
+		t.Helper()
+		c, err := dialTLS(t, port, ca, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.conn.(*tls.Conn).ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	if got := serial(); got != 2 {
+		t.Fatalf("serial = %d, want 2", got)
+	}
+
+	cert, key := ca.issue(t, 5)
+	writeFile(t, settings.certFile, cert)
+	writeFile(t, settings.keyFile, key)
+	// make the change visible even where modification times are coarse
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(settings.certFile, later, later)
+
+	reloadTLSIfChanged()
+	if got := serial(); got != 5 {
+		t.Fatalf("serial after reload = %d, want 5", got)
+	}
+
+	// a broken file keeps the current certificate
+	writeFile(t, settings.keyFile, []byte("garbage"))
+	os.Chtimes(settings.keyFile, later, later)
+	reloadTLSIfChanged()
+	if got := serial(); got != 5 {
+		t.Fatalf("serial after a failed reload = %d, want 5", got)
+	}
+}
+
+func TestTLSReplication(t *testing.T) {
+	resetKeyspace()
+	resetReplication()
+	setupTLS(t, tlsAuthClientsYes)
+	if err := updateTLSSettings(func(s *tlsSettings) { s.replication = true }); err != nil {
+		t.Fatal(err)
+	}
+	set(bulks("existing", "1"))
+
+	port := startTLSTestServer(t)
+
+	rec := &recorder{}
+	follower := newReplState()
+	follower.replicaOf("127.0.0.1", port, rec.apply, rec.load)
+	defer follower.stopReplication()
+
+	waitInSync(t, follower)
+
+	if _, loads := rec.snapshot(); loads != 1 || rec.loads[0].strings["existing"] != "1" {
+		t.Fatalf("the follower did not receive the snapshot over TLS")
+	}
+}
+
+func TestHTTPSAPI(t *testing.T) {
+	ca, _ := setupTLS(t, tlsAuthClientsNo)
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverTLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, api.Handler())
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	resp, err := client.Get("https://" + l.Addr().String() + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /ping over TLS: status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// watchMu guards watchedKeys together with the watched keys and the
+// watchDirty flag of every client.
+var watchMu = sync.Mutex{}
+
+// watchedKeys maps a key to the clients that WATCH it.
+var watchedKeys = map[string]map[*client]struct{}{}
+
+func multi(c *client, args []Value) {
+	if len(args) != 0 {
+		c.write(Value{typ: "error", str: "ERR wrong number of arguments for 'multi' command"})
+		return
+	}
+	if c.multi {
+		c.write(Value{typ: "error", str: "ERR MULTI calls can not be nested"})
+		return
+	}
+
+	c.multi = true
+	c.write(Value{typ: "string", str: "OK"})
+}
+
+func discard(c *client, args []Value) {
+	if len(args) != 0 {
+		c.write(Value{typ: "error", str: "ERR wrong number of arguments for 'discard' command"})
+		return
+	}
+	if !c.multi {
+		c.write(Value{typ: "error", str: "ERR DISCARD without MULTI"})
+		return
+	}
+
+	c.resetMulti()
+	c.unwatchAll()
+	c.write(Value{typ: "string", str: "OK"})
+}
+
+// queue adds a command sent between MULTI and EXEC to the transaction. A
+// command that cannot be queued makes EXEC discard the whole transaction.
+// SAVE, REPLICAOF and the like cannot be queued as they take callMu, which
+// EXEC already holds.
+func (c *client) queue(spec *commandSpec, value Value) {
+	switch {
+	case spec == nil:
+		c.multiFailed = true
+		c.write(unknownCommand(value))
+		return
+	case !spec.checkArity(len(value.array)):
+		c.multiFailed = true
+		c.write(spec.arityError())
+		return
+	case spec.name == "unwatch":
+		// EXEC unwatches every key anyway
+	case spec.flags&flagNoMulti != 0 || spec.handler == nil:
+		c.multiFailed = true
+		c.write(Value{typ: "error", str: "ERR Command not allowed inside a transaction"})
+		return
+	case spec.flags&flagWrite != 0 && repl.readOnly():
+		c.multiFailed = true
+		c.write(readOnlyReplica)
+		return
+	default:
+		c.queued = append(c.queued, value)
+	}
+
+	c.write(Value{typ: "string", str: "QUEUED"})
+}
+
+func (c *client) resetMulti() {
+	c.multi = false
+	c.multiFailed = false
+	c.queued = nil
+}
+
+func exec(c *client, args []Value) {
+	result := execTransaction(c, c.aof)
+	if c.aof != nil {
+		c.aof.awaitFsync()
+	}
+	c.write(result)
+}
+
+// execTransaction runs the commands queued since MULTI. No other command
+// executes in the meantime and the writes are committed as a single unit.
+// Nothing is run if a key watched by c was modified since WATCH.
+func execTransaction(c *client, aof *Aof) Value {
+	if !c.multi {
+		return Value{typ: "error", str: "ERR EXEC without MULTI"}
+	}
+
+	queued, failed := c.queued, c.multiFailed
+	c.resetMulti()
+	defer c.unwatchAll()
+
+	if failed {
+		return Value{typ: "error", str: "EXECABORT Transaction discarded because of previous errors."}
+	}
+
+	execMu.Lock()
+	defer execMu.Unlock()
+	callMu.Lock()
+	defer callMu.Unlock()
+
+	if c.watchTouched() {
+		return Value{typ: "nullarray"}
+	}
+
+	if !performEvictions(aof) {
+		for _, value := range queued {
+			if spec := lookupCommand(strings.ToUpper(value.array[0].bulk)); spec.flags&flagDenyOOM != 0 {
+				spec.stats.rejected.Add(1)
+				return errOOM
+			}
+		}
+	}
+
+	results := make([]Value, 0, len(queued))
+	entries := []Value{}
+	from := c.origin()
+
+	for _, value := range queued {
+		command := strings.ToUpper(value.array[0].bulk)
+		args := value.array[1:]
+		spec := lookupCommand(command)
+
+		commandsProcessed.Add(1)
+		write := spec.flags&flagWrite != 0
+
+		if write && repl.readOnly() {
+			spec.stats.rejected.Add(1)
+			results = append(results, readOnlyReplica)
+			continue
+		}
+
+		if write {
+			preserveKeys(spec.keys(args))
+		}
+		result := execute(from, spec, args)
+		results = append(results, result)
+		entries = append(entries, takeExpiredDels()...)
+
+		if !write {
+			continue
+		}
+		if entry, ok := aofEntry(command, args, result); ok {
+			touchKeys(command, args)
+			entries = append(entries, entry)
+		}
+	}
+
+	commit(aof, entries...)
+
+	return Value{typ: "array", array: results}
+}
+
+func watch(c *client, args []Value) {
+	if len(args) < 1 {
+		c.write(Value{typ: "error", str: "ERR wrong number of arguments for 'watch' command"})
+		return
+	}
+	if c.multi {
+		c.write(Value{typ: "error", str: "ERR WATCH inside MULTI is not allowed"})
+		return
+	}
+
+	watchMu.Lock()
+	for _, arg := range args {
+		key := arg.bulk
+		if _, ok := c.watched[key]; ok {
+			continue
+		}
+		c.watched[key] = struct{}{}
+		if watchedKeys[key] == nil {
+			watchedKeys[key] = map[*client]struct{}{}
+		}
+		watchedKeys[key][c] = struct{}{}
+	}
+	watchMu.Unlock()
+
+	c.write(Value{typ: "string", str: "OK"})
+}
+
+func unwatch(c *client, args []Value) {
+	if len(args) != 0 {
+		c.write(Value{typ: "error", str: "ERR wrong number of arguments for 'unwatch' command"})
+		return
+	}
+
+	c.unwatchAll()
+	c.write(Value{typ: "string", str: "OK"})
+}
+
+// unwatchAll forgets every key watched by c.
+func (c *client) unwatchAll() {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	for key := range c.watched {
+		delete(watchedKeys[key], c)
+		if len(watchedKeys[key]) == 0 {
+			delete(watchedKeys, key)
+		}
+	}
+	c.watched = map[string]struct{}{}
+	c.watchDirty = false
+}
+
+// watchTouched reports whether a key watched by c was modified.
+func (c *client) watchTouched() bool {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	return c.watchDirty
+}
+
+// touchKey makes the EXEC of every client watching key fail. It is called
+// whenever key is modified, including when it expires.
+func touchKey(key string) {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	for c := range watchedKeys[key] {
+		c.watchDirty = true
+	}
+}
+
+// touchKeys calls touchKey for the keys modified by a write command.
+func touchKeys(command string, args []Value) {
+	spec := lookupCommand(command)
+	if spec == nil {
+		return
+	}
+
+	for _, key := range spec.keys(args) {
+		touchKey(key)
+	}
+}
+
+// touchAllKeys makes every pending EXEC with watched keys fail, for when the
+// whole keyspace is replaced.
+func touchAllKeys() {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	for _, watchers := range watchedKeys {
+		for c := range watchers {
+			c.watchDirty = true
+		}
+	}
+}
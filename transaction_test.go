@@ -0,0 +1,197 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// get returns the value of key as seen by c, or "(nil)".
+func (c *testClient) get(t *testing.T, key string) string {
+	t.Helper()
+
+	if c.do(t, "GET", key) == "$-1" {
+		return "(nil)"
+	}
+	line, err := c.resp.reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimRight(line, "\r\n")
+}
+
+func TestMultiExec(t *testing.T) {
+	resetKeyspace()
+	port := startTestServer(t)
+	c := dialTestServer(t, port)
+
+	if got := c.do(t, "MULTI"); got != "+OK" {
+		t.Fatalf("MULTI = %q", got)
+	}
+	for _, args := range [][]string{{"SET", "counter", "1"}, {"APPEND", "counter", "0"}, {"GET", "counter"}} {
+		if got := c.do(t, args...); got != "+QUEUED" {
+			t.Fatalf("%v = %q, want +QUEUED", args, got)
+		}
+	}
+	if got := c.do(t, "MULTI"); got != "-ERR MULTI calls can not be nested" {
+		t.Fatalf("nested MULTI = %q", got)
+	}
+
+	send(t, c, "EXEC")
+	checkPush(t, c, "OK", "2", "10")
+
+	if got := c.do(t, "EXEC"); got != "-ERR EXEC without MULTI" {
+		t.Fatalf("EXEC without MULTI = %q", got)
+	}
+
+	c.do(t, "MULTI")
+	c.do(t, "SET", "counter", "10")
+	if got := c.do(t, "DISCARD"); got != "+OK" {
+		t.Fatalf("DISCARD = %q", got)
+	}
+	if got := c.get(t, "counter"); got != "10" {
+		t.Fatalf("GET after DISCARD = %q, want 10", got)
+	}
+}
+
+func TestExecAbortsAfterQueueingError(t *testing.T) {
+	resetKeyspace()
+	port := startTestServer(t)
+	c := dialTestServer(t, port)
+
+	c.do(t, "MULTI")
+	c.do(t, "SET", "k", "v")
+	if got := c.do(t, "NOSUCHCOMMAND"); got != "-ERR unknown command 'NOSUCHCOMMAND', with args beginning with: " {
+		t.Fatalf("unknown command = %q", got)
+	}
+	if got := c.do(t, "SUBSCRIBE", "ch"); got != "-ERR Command not allowed inside a transaction" {
+		t.Fatalf("SUBSCRIBE = %q", got)
+	}
+	if got := c.do(t, "EXEC"); got != "-EXECABORT Transaction discarded because of previous errors." {
+		t.Fatalf("EXEC = %q", got)
+	}
+	if got := c.do(t, "EXISTS", "k"); got != ":0" {
+		t.Fatalf("EXISTS k = %q, want :0", got)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	resetKeyspace()
+	port := startTestServer(t)
+	c := dialTestServer(t, port)
+	other := dialTestServer(t, port)
+
+	c.do(t, "SET", "balance", "10")
+
+	// a watched key modified by another client aborts EXEC
+	c.do(t, "WATCH", "balance")
+	other.do(t, "INCRBY", "balance", "5")
+	c.do(t, "MULTI")
+	c.do(t, "DECRBY", "balance", "10")
+	if got := c.do(t, "EXEC"); got != "*-1" {
+		t.Fatalf("EXEC after the watched key changed = %q, want *-1", got)
+	}
+	if got := other.do(t, "INCRBY", "balance", "0"); got != ":15" {
+		t.Fatalf("balance = %q, want :15", got)
+	}
+
+	// EXEC unwatched the key, so this transaction goes through
+	other.do(t, "SET", "balance", "20")
+	c.do(t, "WATCH", "balance", "other")
+	c.do(t, "MULTI")
+	c.do(t, "DECRBY", "balance", "10")
+	send(t, c, "EXEC")
+	checkPush(t, c, "10")
+
+	if got := c.do(t, "MULTI"); got != "+OK" {
+		t.Fatalf("MULTI = %q", got)
+	}
+	if got := c.do(t, "WATCH", "balance"); got != "-ERR WATCH inside MULTI is not allowed" {
+		t.Fatalf("WATCH inside MULTI = %q", got)
+	}
+	c.do(t, "DISCARD")
+
+	// an expired key counts as modified
+	c.do(t, "SET", "lease", "x", "PX", "1")
+	c.do(t, "WATCH", "lease")
+	waitFor(t, "lease to expire", func() bool { return other.do(t, "EXISTS", "lease") == ":0" })
+	c.do(t, "MULTI")
+	c.do(t, "SET", "lease", "y")
+	if got := c.do(t, "EXEC"); got != "*-1" {
+		t.Fatalf("EXEC after the watched key expired = %q, want *-1", got)
+	}
+
+	c.do(t, "WATCH", "balance")
+	if got := c.do(t, "UNWATCH"); got != "+OK" {
+		t.Fatalf("UNWATCH = %q", got)
+	}
+	other.do(t, "SET", "balance", "0")
+	c.do(t, "MULTI")
+	c.do(t, "GET", "balance")
+	send(t, c, "EXEC")
+	checkPush(t, c, "0")
+}
+
+func TestTransactionIsLoggedAtomically(t *testing.T) {
+	resetKeyspace()
+	aof := newTestAof(t)
+
+	entries := []Value{}
+	for _, args := range [][]string{{"SET", "a", "1"}, {"RPUSH", "l", "x", "y"}} {
+		values := bulks(args[1:]...)
+		result := Handlers[args[0]](values)
+		entry, _ := aofEntry(args[0], values, result)
+		entries = append(entries, entry)
+	}
+	commit(aof, entries...)
+
+	// a transaction cut short by a crash
+	aof.Write(
+		Value{typ: "array", array: bulks("MULTI")},
+		Value{typ: "array", array: bulks("SET", "b", "2")},
+	)
+
+	resetKeyspace()
+	if err := loadAof(aof); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := get(bulks("a")); got.bulk != "1" {
+		t.Fatalf("GET a = %+v, want 1", got)
+	}
+	if got := Handlers["LRANGE"](bulks("l", "0", "-1")); len(got.array) != 2 {
+		t.Fatalf("LRANGE l = %+v, want 2 elements", got)
+	}
+	if got := get(bulks("b")); got.typ != "null" {
+		t.Fatalf("GET b = %+v, want null", got)
+	}
+}
+
+func TestTransactionIsReplicatedAtomically(t *testing.T) {
+	resetKeyspace()
+	resetReplication()
+
+	port := startTestServer(t)
+	c := dialTestServer(t, port)
+
+	rec := &recorder{}
+	follower := newReplState()
+	follower.replicaOf("127.0.0.1", port, rec.apply, rec.load)
+	defer follower.stopReplication()
+
+	waitInSync(t, follower)
+
+	c.do(t, "MULTI")
+	c.do(t, "SET", "a", "1")
+	c.do(t, "GET", "a")
+	c.do(t, "DEL", "a")
+	send(t, c, "EXEC")
+	readPush(t, c)
+
+	waitInSync(t, follower)
+
+	commands, _ := rec.snapshot()
+	if strings.Join(commands, ", ") != "MULTI, SET a 1, DEL a, EXEC" {
+		t.Fatalf("replicated commands = %q", commands)
+	}
+}